@@ -48,11 +48,12 @@ func patchOpts(cfg *config.Config, cmd *cobra.Command, c root.Opts) {
 	patchOpt(cmd.Flags(), "os", runtime.GOOS)
 	patchOpt(cmd.Flags(), "provider", "backend")
 	patchOpt(cmd.Flags(), "provider-config", "backend.json")
-	patchOpt(cmd.Flags(), "metrics-addr", cfg.MetricsAddress)
+	if cfg.MetricsAddress != "" {
+		patchOpt(cmd.Flags(), "metrics-addr", cfg.MetricsAddress)
+	}
 	patchOpt(cmd.Flags(), "disable-taint", strconv.FormatBool(cfg.DisableTaint))
 	patchOpt(cmd.Flags(), "pod-sync-workers", strconv.FormatInt(int64(cfg.PodSyncWorkers), 10))
 	patchOpt(cmd.Flags(), "enable-node-lease", strconv.FormatBool(true))
-	patchOpt(cmd.Flags(), "metrics-addr", cfg.NodeInternalIP.String())
 
 	// Set kubernetes version
 	k8sVersion, _ := util.ReadDepVersion("k8s.io/api")
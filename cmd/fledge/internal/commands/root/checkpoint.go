@@ -0,0 +1,60 @@
+package root
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"gitlab.ilabt.imec.be/fledge/service/cmd/fledge/internal/provider"
+)
+
+const checkpointPathPrefix = "/checkpoint/"
+
+// checkpointResponse lists the locations of the created checkpoints, like the kubelet
+type checkpointResponse struct {
+	Items []string `json:"items"`
+}
+
+// handleCheckpoint serves POST /checkpoint/{namespace}/{pod}/{container} like the kubelet
+// The container keeps running, the location of the checkpoint can be used to restore it in another pod.
+func handleCheckpoint(p provider.Checkpointer) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, checkpointPathPrefix), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace, pod, container := parts[0], parts[1], parts[2]
+
+		ctx := log.WithLogger(req.Context(), log.G(req.Context()).WithFields(log.Fields{
+			"namespace": namespace,
+			"pod":       pod,
+			"container": container,
+		}))
+		location, err := p.CheckpointContainer(ctx, namespace, pod, container)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to checkpoint container")
+			switch {
+			case errdefs.IsNotFound(err):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errdefs.IsInvalidInput(err):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(checkpointResponse{Items: []string{location}}); err != nil {
+			log.G(ctx).WithError(err).Error("failed to write checkpoint response")
+		}
+	}
+}
@@ -15,9 +15,16 @@
 package root
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
 )
 
 type apiServerConfig struct {
@@ -44,3 +51,25 @@ func getAPIConfig(c Opts) (*apiServerConfig, error) {
 
 	return &config, nil
 }
+
+// setupMetrics serves the Prometheus metrics of fledge itself on the metrics address
+// The default mux is used, so the profiles of net/http/pprof are served there as well.
+func setupMetrics(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on metrics address %q", addr)
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: http.DefaultServeMux, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.G(ctx).WithError(err).Error("Metrics server exited")
+		}
+	}()
+	log.G(ctx).Infof("Serving metrics on %s", listener.Addr())
+	return nil
+}
@@ -0,0 +1,220 @@
+package root
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"gitlab.ilabt.imec.be/fledge/service/cmd/fledge/internal/provider"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+)
+
+const (
+	portForwardPathPrefix = "/portForward/"
+	// portForwardProtocolV1Name is the subprotocol used by kubectl port-forward
+	portForwardProtocolV1Name = "portforward.k8s.io"
+)
+
+// handlePortForward serves /portForward/{namespace}/{pod}[/{uid}] like the kubelet
+// Every forwarded connection is a pair of SPDY streams with the same request ID, one for data and one for errors
+func handlePortForward(p provider.PortForwarder, idleTimeout, creationTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, portForwardPathPrefix), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			http.NotFound(w, req)
+			return
+		}
+		namespace, pod := parts[0], parts[1]
+
+		// Handshake writes the response itself if the protocol can not be negotiated
+		if _, err := httpstream.Handshake(req, w, []string{portForwardProtocolV1Name}); err != nil {
+			return
+		}
+
+		streams := make(chan httpstream.Stream, 1)
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(w, req, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+			streams <- stream
+			return nil
+		})
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetIdleTimeout(idleTimeout)
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+			"namespace": namespace,
+			"pod":       pod,
+		}))
+		h := &portForwardHandler{
+			provider:        p,
+			namespace:       namespace,
+			pod:             pod,
+			creationTimeout: creationTimeout,
+			pairs:           map[string]*portForwardStreamPair{},
+		}
+		h.run(ctx, conn, streams)
+	}
+}
+
+type portForwardHandler struct {
+	provider        provider.PortForwarder
+	namespace       string
+	pod             string
+	creationTimeout time.Duration
+
+	mu    sync.Mutex
+	pairs map[string]*portForwardStreamPair
+}
+
+type portForwardStreamPair struct {
+	requestID string
+	complete  chan struct{}
+
+	mu          sync.Mutex
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+}
+
+// run pairs up the incoming streams until the connection is closed
+func (h *portForwardHandler) run(ctx context.Context, conn httpstream.Connection, streams <-chan httpstream.Stream) {
+	for {
+		select {
+		case <-conn.CloseChan():
+			return
+		case stream := <-streams:
+			requestID := streamRequestID(stream)
+			pair, created := h.getStreamPair(requestID)
+			if created {
+				go h.monitorStreamPair(ctx, pair)
+			}
+			complete, err := pair.add(stream)
+			if err != nil {
+				log.G(ctx).Errorf("port-forward request %s: %s", requestID, err)
+				stream.Reset()
+				continue
+			}
+			if complete {
+				close(pair.complete)
+				go h.portForward(ctx, pair)
+			}
+		}
+	}
+}
+
+func (h *portForwardHandler) getStreamPair(requestID string) (*portForwardStreamPair, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pair, ok := h.pairs[requestID]; ok {
+		return pair, false
+	}
+	pair := &portForwardStreamPair{
+		requestID: requestID,
+		complete:  make(chan struct{}),
+	}
+	h.pairs[requestID] = pair
+	return pair, true
+}
+
+func (h *portForwardHandler) removeStreamPair(requestID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pairs, requestID)
+}
+
+// monitorStreamPair drops a pair whose second stream does not arrive in time
+func (h *portForwardHandler) monitorStreamPair(ctx context.Context, pair *portForwardStreamPair) {
+	timer := time.NewTimer(h.creationTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		err := fmt.Errorf("timed out waiting for streams of request %s", pair.requestID)
+		log.G(ctx).Error(err)
+		pair.fail(err)
+	case <-ctx.Done():
+	case <-pair.complete:
+		return
+	}
+	h.removeStreamPair(pair.requestID)
+}
+
+// portForward forwards the data stream of a complete pair to the port in its headers
+func (h *portForwardHandler) portForward(ctx context.Context, pair *portForwardStreamPair) {
+	defer h.removeStreamPair(pair.requestID)
+	defer pair.dataStream.Close()
+	defer pair.errorStream.Close()
+
+	portString := pair.dataStream.Headers().Get(corev1.PortHeader)
+	port, err := strconv.ParseInt(portString, 10, 32)
+	if err == nil && port <= 0 {
+		err = fmt.Errorf("port %d must be positive", port)
+	}
+	if err != nil {
+		fmt.Fprintf(pair.errorStream, "invalid port %q: %s", portString, err)
+		return
+	}
+
+	log.G(ctx).Debugf("forwarding port %d of pod %s/%s (request %s)", port, h.namespace, h.pod, pair.requestID)
+	if err = h.provider.PortForward(ctx, h.namespace, h.pod, int32(port), pair.dataStream); err != nil {
+		err = fmt.Errorf("error forwarding port %d to pod %s/%s: %v", port, h.namespace, h.pod, err)
+		log.G(ctx).Error(err)
+		fmt.Fprint(pair.errorStream, err.Error())
+	}
+}
+
+// streamRequestID returns the request ID of a stream, older clients only send the ID of the stream
+func streamRequestID(stream httpstream.Stream) string {
+	requestID := stream.Headers().Get(corev1.PortForwardRequestIDHeader)
+	if requestID != "" {
+		return requestID
+	}
+	// The data stream is created right after the error stream
+	id := stream.Identifier()
+	if stream.Headers().Get(corev1.StreamType) == corev1.StreamTypeData {
+		id -= 2
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// add assigns a stream to the pair and returns whether the pair is complete
+func (p *portForwardStreamPair) add(stream httpstream.Stream) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch t := stream.Headers().Get(corev1.StreamType); t {
+	case corev1.StreamTypeData:
+		if p.dataStream != nil {
+			return false, fmt.Errorf("data stream already assigned")
+		}
+		p.dataStream = stream
+	case corev1.StreamTypeError:
+		if p.errorStream != nil {
+			return false, fmt.Errorf("error stream already assigned")
+		}
+		p.errorStream = stream
+	default:
+		return false, fmt.Errorf("invalid stream type %q", t)
+	}
+	return p.dataStream != nil && p.errorStream != nil, nil
+}
+
+// fail reports an error on the error stream (if any) and resets the streams of the pair
+func (p *portForwardStreamPair) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.errorStream != nil {
+		fmt.Fprint(p.errorStream, err.Error())
+		p.errorStream.Close()
+	}
+	if p.dataStream != nil {
+		p.dataStream.Reset()
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"gitlab.ilabt.imec.be/fledge/service/pkg/manager"
 	"net/http"
 	"os"
+	"path"
 	"runtime"
 
 	"github.com/pkg/errors"
@@ -32,6 +33,9 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // NewCommand creates a new top-level command.
@@ -73,6 +77,16 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		}
 	}
 
+	apiConfig, err := getAPIConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// The pod controller and the provider share an event recorder, so that the provider can report image pulls
+	eb := record.NewBroadcaster()
+	defer eb.Shutdown()
+	eventRecorder := eb.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(c.NodeName, "pod-controller")})
+
 	mux := http.NewServeMux()
 	newProvider := func(cfg nodeutil.ProviderConfig) (nodeutil.Provider, node.NodeProvider, error) {
 		rm, err := manager.NewResourceManager(ctx, cfg.Pods, cfg.Secrets, cfg.ConfigMaps, cfg.Services)
@@ -84,6 +98,7 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 			NodeName:          c.NodeName,
 			OperatingSystem:   c.OperatingSystem,
 			ResourceManager:   rm,
+			EventRecorder:     eventRecorder,
 			DaemonPort:        c.ListenPort,
 			InternalIP:        os.Getenv("VKUBELET_POD_IP"),
 			KubeClusterDomain: c.KubeClusterDomain,
@@ -97,16 +112,21 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		if err != nil {
 			return nil, nil, errors.Wrapf(err, "error initializing provider %s", c.Provider)
 		}
-		p.ConfigureNode(ctx, cfg.Node)
 		cfg.Node.Status.NodeInfo.KubeletVersion = c.Version
+		p.ConfigureNode(ctx, cfg.Node)
+		if pf, ok := p.(provider.PortForwarder); ok {
+			mux.Handle(portForwardPathPrefix, handlePortForward(pf, apiConfig.StreamIdleTimeout, apiConfig.StreamCreationTimeout))
+		}
+		if cp, ok := p.(provider.Checkpointer); ok {
+			mux.Handle(checkpointPathPrefix, handleCheckpoint(cp))
+		}
+		// Providers that update the status of the node (e.g. when devices are plugged in) notify the node controller
+		if np, ok := p.(node.NodeProvider); ok {
+			return p, np, nil
+		}
 		return p, nil, nil
 	}
 
-	apiConfig, err := getAPIConfig(c)
-	if err != nil {
-		return err
-	}
-
 	cm, err := nodeutil.NewNode(c.NodeName, newProvider, func(cfg *nodeutil.NodeConfig) error {
 		cfg.KubeconfigPath = c.KubeConfigPath
 		cfg.Handler = mux
@@ -125,6 +145,10 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 
 		cfg.NumWorkers = c.PodSyncWorkers
 
+		cfg.EventRecorder = eventRecorder
+		eb.StartLogging(log.G(ctx).Infof)
+		eb.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: cfg.Client.CoreV1().Events(corev1.NamespaceAll)})
+
 		return nil
 	},
 		setAuth(c.NodeName, apiConfig),
@@ -142,6 +166,10 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		return err
 	}
 
+	if err := setupMetrics(ctx, apiConfig.MetricsAddr); err != nil {
+		return err
+	}
+
 	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
 		"provider":         c.Provider,
 		"operatingSystem":  c.OperatingSystem,
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"context"
+	"io"
 
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	v1 "k8s.io/api/core/v1"
@@ -14,3 +15,14 @@ type Provider interface {
 	// will be used for Kubernetes.
 	ConfigureNode(context.Context, *v1.Node)
 }
+
+// PortForwarder is implemented by providers that can forward ports of pods
+type PortForwarder interface {
+	PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error
+}
+
+// Checkpointer is implemented by providers that can checkpoint containers of pods
+type Checkpointer interface {
+	// CheckpointContainer checkpoints a running container and returns the location of the checkpoint
+	CheckpointContainer(ctx context.Context, namespace, pod, container string) (string, error)
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"k8s.io/client-go/tools/record"
 )
 
 // Store is used for registering/fetching providers
@@ -69,6 +70,7 @@ type InitConfig struct {
 	DaemonPort        int32
 	KubeClusterDomain string
 	ResourceManager   *manager.ResourceManager
+	EventRecorder     record.EventRecorder
 }
 
 type InitFunc func(InitConfig) (Provider, error) //nolint:golint
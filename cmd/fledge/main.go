@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -79,11 +77,6 @@ func main() {
 	}
 
 	patchCmd(ctx, rootCmd, s, opts) // FLEDGE
-	// Prometheus
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		http.ListenAndServe(":2112", nil)
-	}()
 
 	if err := rootCmd.Execute(); err != nil && errors.Cause(err) != context.Canceled {
 		log.G(ctx).Fatal(err)
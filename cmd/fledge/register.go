@@ -29,6 +29,7 @@ func registerBackend(ctx context.Context, s *provider.Store) {
 			cfg.NodeName,
 			cfg.OperatingSystem,
 			cfg.ResourceManager,
+			cfg.EventRecorder,
 			cfg.InternalIP,
 			cfg.DaemonPort,
 		)
@@ -45,7 +45,7 @@ type Config struct {
 	// DisableTaint disables fledge default taint.
 	DisableTaint bool `json:"disableTaint" env:"DISABLE_TAINT"`
 
-	// MetricsAddress is the address to bind for serving metrics.
+	// MetricsAddress is the address to bind for serving the Prometheus metrics of fledge (":2112" by default).
 	MetricsAddress string `json:"metricsAddress" env:"METRICS_ADDRESS"`
 
 	// PodSyncWorkers is the number of workers that handle Pod events.
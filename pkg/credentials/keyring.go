@@ -0,0 +1,183 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// dockerHubHosts are the names under which Docker Hub appears in docker configs, they are all matched as "docker.io"
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// A Credential is a username and password for a registry
+type Credential struct {
+	Username string
+	Password string
+}
+
+// A Keyring holds the registry credentials of image pull secrets
+// Credentials are matched against images like the kubelet does, see
+// https://kubernetes.io/docs/concepts/containers/images/#config-json
+type Keyring struct {
+	entries []keyringEntry
+}
+
+type keyringEntry struct {
+	key        string
+	host       string
+	port       string
+	path       string
+	credential Credential
+}
+
+// dockerConfigEntry is an entry of the "auths" in a docker config
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// NewKeyring reads the credentials of kubernetes.io/dockerconfigjson and kubernetes.io/dockercfg secrets
+// Like the kubelet, malformed secrets and entries are skipped with a warning, the pull may still succeed without
+// them.
+func NewKeyring(ctx context.Context, secrets []*corev1.Secret) *Keyring {
+	k := &Keyring{}
+	for _, secret := range secrets {
+		var auths map[string]dockerConfigEntry
+		switch secret.Type {
+		case corev1.SecretTypeDockerConfigJson:
+			var config struct {
+				Auths map[string]dockerConfigEntry `json:"auths"`
+			}
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+				log.G(ctx).Warnf("skipping pull secret %q with an invalid docker config: %s", secret.Name, err)
+				continue
+			}
+			auths = config.Auths
+		case corev1.SecretTypeDockercfg:
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+				log.G(ctx).Warnf("skipping pull secret %q with an invalid docker config: %s", secret.Name, err)
+				continue
+			}
+		default:
+			continue
+		}
+		for key, auth := range auths {
+			credential, err := auth.credential()
+			if err != nil {
+				log.G(ctx).Warnf("skipping invalid credentials for %q in pull secret %q: %s", key, secret.Name, err)
+				continue
+			}
+			entry, err := newKeyringEntry(key, credential)
+			if err != nil {
+				log.G(ctx).Warnf("skipping invalid registry %q in pull secret %q: %s", key, secret.Name, err)
+				continue
+			}
+			k.entries = append(k.entries, entry)
+		}
+	}
+	// The most specific keys come first, secrets that are listed first win for equal keys
+	sort.SliceStable(k.entries, func(i, j int) bool {
+		return k.entries[i].key > k.entries[j].key
+	})
+	return k
+}
+
+func (e dockerConfigEntry) credential() (Credential, error) {
+	if e.Auth == "" {
+		return Credential{Username: e.Username, Password: e.Password}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+	if err != nil {
+		return Credential{}, err
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return Credential{}, errors.New("auth is not of the form username:password")
+	}
+	return Credential{Username: username, Password: password}, nil
+}
+
+func newKeyringEntry(key string, credential Credential) (keyringEntry, error) {
+	// Keys are URLs, with or without scheme
+	value := key
+	if !strings.Contains(value, "://") {
+		value = "https://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return keyringEntry{}, err
+	}
+	host := u.Hostname()
+	if dockerHubHosts[host] {
+		host = "docker.io"
+	}
+	// The path of the docker hub key ("https://index.docker.io/v1/") is the API version and not a repository
+	p := strings.Trim(u.Path, "/")
+	if host == "docker.io" && p == "v1" {
+		p = ""
+	}
+	return keyringEntry{
+		key:        host + "/" + p,
+		host:       host,
+		port:       u.Port(),
+		path:       p,
+		credential: credential,
+	}, nil
+}
+
+// Lookup returns the credentials that match an image, from most to least specific
+func (k *Keyring) Lookup(image string) []Credential {
+	if k == nil {
+		return nil
+	}
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(docker.Domain(named))
+	if err != nil {
+		host = docker.Domain(named)
+	}
+	repository := docker.Path(named)
+
+	var credentials []Credential
+	for _, e := range k.entries {
+		if e.port != port || !matchHost(e.host, host) {
+			continue
+		}
+		if e.path != "" && repository != e.path && !strings.HasPrefix(repository, e.path+"/") {
+			continue
+		}
+		credentials = append(credentials, e.credential)
+	}
+	return credentials
+}
+
+// matchHost matches a host against a pattern in which every label can contain globs (e.g. "*.example.com")
+func matchHost(pattern, host string) bool {
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, err := path.Match(patternLabels[i], hostLabels[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
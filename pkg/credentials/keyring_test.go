@@ -0,0 +1,86 @@
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func dockerConfigJSONSecret(name, config string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func TestKeyringLookup(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("hub:secret"))
+	secrets := []*corev1.Secret{
+		dockerConfigJSONSecret("first", `{"auths": {
+			"registry.example.com": {"username": "registry", "password": "secret"},
+			"registry.example.com/team": {"username": "team", "password": "secret"},
+			"*.example.org": {"username": "wildcard", "password": "secret"},
+			"https://index.docker.io/v1/": {"auth": "`+auth+`"},
+			"localhost:5000": {"username": "local", "password": "secret"},
+			"invalid.example.com": {"auth": "not base64"}
+		}}`),
+		// Malformed secrets are skipped, the others still apply
+		dockerConfigJSONSecret("malformed", `{"auths": `),
+		{
+			Type: corev1.SecretTypeDockercfg,
+			Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{
+				"https://registry.example.com": {"username": "second", "password": "secret"}
+			}`)},
+		},
+		{Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"token": []byte("secret")}},
+	}
+	k := NewKeyring(context.Background(), secrets)
+
+	tests := []struct {
+		image    string
+		expected []string
+	}{
+		// The most specific path comes first, the secret that is listed first wins for the same registry
+		{"registry.example.com/team/app:1.0", []string{"team", "registry", "second"}},
+		{"registry.example.com/team", []string{"team", "registry", "second"}},
+		// Paths only match whole components
+		{"registry.example.com/teams/app", []string{"registry", "second"}},
+		{"registry.example.com/other/app", []string{"registry", "second"}},
+		// Globs match a single label
+		{"mirror.example.org/app", []string{"wildcard"}},
+		{"a.mirror.example.org/app", nil},
+		// Images without a registry come from Docker Hub
+		{"nginx", []string{"hub"}},
+		{"docker.io/library/nginx:latest", []string{"hub"}},
+		{"index.docker.io/library/nginx", []string{"hub"}},
+		// Ports have to match
+		{"localhost:5000/app", []string{"local"}},
+		{"localhost/app", nil},
+		{"registry.example.com:5000/team/app", nil},
+		// Entries with invalid credentials are skipped
+		{"invalid.example.com/app", nil},
+		{"other.example.com/app", nil},
+	}
+	for _, test := range tests {
+		var usernames []string
+		for _, c := range k.Lookup(test.image) {
+			usernames = append(usernames, c.Username)
+		}
+		if !reflect.DeepEqual(usernames, test.expected) {
+			t.Errorf("expected the credentials %v for %q, got %v", test.expected, test.image, usernames)
+		}
+	}
+
+	if c := k.Lookup("nginx"); len(c) != 1 || c[0].Password != "secret" {
+		t.Errorf("expected the decoded password of the auth, got %+v", c)
+	}
+	var nilKeyring *Keyring
+	if c := nilKeyring.Lookup("nginx"); c != nil {
+		t.Errorf("expected no credentials without a keyring, got %+v", c)
+	}
+}
@@ -0,0 +1,304 @@
+package devices
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDiscoveryPeriod is the interval between two scans for devices when the configuration sets none
+const defaultDiscoveryPeriod = 5 * time.Second
+
+// A Rule advertises the device nodes of the host that match it as devices of an extended resource
+// A device matches when it passes all criteria that are set.
+type Rule struct {
+	// Resource is the extended resource of the devices (e.g. fledge.io/serial).
+	Resource string `json:"resource"`
+	// Paths are glob patterns of the device nodes (e.g. /dev/ttyUSB* or /dev/i2c-*).
+	Paths []string `json:"paths,omitempty"`
+	// Subsystem is the subsystem of the devices (e.g. tty, i2c-dev, gpio or video4linux).
+	Subsystem string `json:"subsystem,omitempty"`
+	// Properties are udev properties (e.g. ID_MODEL or ID_SERIAL), the values are glob patterns.
+	Properties map[string]string `json:"properties,omitempty"`
+	// VendorID and ProductID are the USB or PCI IDs of the hardware of the devices, in hexadecimal (e.g. 0403 and
+	// 6001).
+	VendorID  string `json:"vendorID,omitempty"`
+	ProductID string `json:"productID,omitempty"`
+	// Permissions are the cgroup permissions of the devices, rw by default.
+	Permissions string `json:"permissions,omitempty"`
+	// Env is an environment variable that lists the paths of the allocated devices, separated by commas.
+	Env string `json:"env,omitempty"`
+}
+
+// DiscoveryConfig contains the parameters of the discovery of devices
+type DiscoveryConfig struct {
+	// Root is where the /dev, /sys and /run/udev of the host are
+	Root string
+	// Period is the interval between two scans for devices that were plugged in or removed (5s if it is zero)
+	Period time.Duration
+	// Rules match the devices of the host to extended resources
+	Rules []Rule
+}
+
+// A hostDevice is a character device of the host as found in sysfs
+type hostDevice struct {
+	// name is the path of the node in /dev
+	name       string
+	subsystem  string
+	properties map[string]string
+	vendorID   string
+	productID  string
+}
+
+// StartDiscovery advertises the devices of the host that match the rules, it scans for devices that are plugged in
+// or removed until the context is done
+func (m *Manager) StartDiscovery(ctx context.Context, config DiscoveryConfig) error {
+	if len(config.Rules) == 0 {
+		return nil
+	}
+	sources := map[string]*discoverySource{}
+	for _, rule := range config.Rules {
+		if !isExtendedResourceName(corev1.ResourceName(rule.Resource)) {
+			return errors.Errorf("devices: resource %q is not an extended resource", rule.Resource)
+		}
+		for _, pattern := range append(rule.Paths, values(rule.Properties)...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "devices: invalid pattern %q of resource %q", pattern, rule.Resource)
+			}
+		}
+		if sources[rule.Resource] == nil {
+			sources[rule.Resource] = &discoverySource{}
+		}
+		sources[rule.Resource].rules = append(sources[rule.Resource].rules, rule)
+	}
+	for name, src := range sources {
+		m.setSource(name, src)
+	}
+	period := config.Period
+	if period <= 0 {
+		period = defaultDiscoveryPeriod
+	}
+	m.discover(ctx, config.Root, sources)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.discover(ctx, config.Root, sources)
+			}
+		}
+	}()
+	return nil
+}
+
+// discover scans the devices of the host and updates the resources whose devices changed
+func (m *Manager) discover(ctx context.Context, root string, sources map[string]*discoverySource) {
+	hostDevices, err := scanHostDevices(root)
+	if err != nil {
+		log.G(ctx).Errorf("failed to discover devices: %s", err)
+		return
+	}
+	for name, src := range sources {
+		found := map[string]Device{}
+		for _, hd := range hostDevices {
+			for _, rule := range src.rules {
+				if rule.matches(hd) {
+					found[hd.name] = Device{
+						ContainerPath: path.Join("/dev", hd.name),
+						HostPath:      filepath.Join(root, "dev", hd.name),
+						Permissions:   rule.Permissions,
+					}
+					break
+				}
+			}
+		}
+		if !src.update(found) {
+			continue
+		}
+		log.G(ctx).Infof("discovered %d devices of %q", len(found), name)
+		healthy := map[string]bool{}
+		for id := range found {
+			healthy[id] = true
+		}
+		m.setDevices(name, src, healthy)
+	}
+}
+
+// scanHostDevices lists the character devices of the host, which sysfs links by their numbers in /sys/dev/char
+func scanHostDevices(root string) ([]hostDevice, error) {
+	charDir := filepath.Join(root, "sys/dev/char")
+	entries, err := os.ReadDir(charDir)
+	if err != nil {
+		return nil, err
+	}
+	var hostDevices []hostDevice
+	for _, entry := range entries {
+		dir, err := filepath.EvalSymlinks(filepath.Join(charDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		uevent := readProperties(filepath.Join(dir, "uevent"), "")
+		if uevent["DEVNAME"] == "" {
+			continue
+		}
+		hd := hostDevice{
+			name:       uevent["DEVNAME"],
+			properties: uevent,
+		}
+		if subsystem, err := os.Readlink(filepath.Join(dir, "subsystem")); err == nil {
+			hd.subsystem = filepath.Base(subsystem)
+		}
+		// udev keeps the properties it added (e.g. ID_SERIAL) in its database
+		for k, v := range readProperties(filepath.Join(root, "run/udev/data", "c"+entry.Name()), "E:") {
+			hd.properties[k] = v
+		}
+		hd.vendorID, hd.productID = hardwareIDs(filepath.Join(root, "sys"), dir)
+		hostDevices = append(hostDevices, hd)
+	}
+	return hostDevices, nil
+}
+
+// hardwareIDs returns the vendor and product ID of the closest USB (idVendor and idProduct) or PCI (vendor and
+// device) parent of a device in sysfs
+func hardwareIDs(sysDir, dir string) (string, string) {
+	for ; strings.HasPrefix(dir, sysDir) && dir != sysDir; dir = filepath.Dir(dir) {
+		for _, files := range [][2]string{{"idVendor", "idProduct"}, {"vendor", "device"}} {
+			vendor, err := os.ReadFile(filepath.Join(dir, files[0]))
+			if err != nil {
+				continue
+			}
+			product, _ := os.ReadFile(filepath.Join(dir, files[1]))
+			return normalizeID(string(vendor)), normalizeID(string(product))
+		}
+	}
+	return "", ""
+}
+
+// normalizeID strips the 0x prefix of PCI IDs, so that they compare equal to USB IDs
+func normalizeID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+}
+
+// readProperties reads the KEY=VALUE lines that start with a prefix from a file
+func readProperties(file, prefix string) map[string]string {
+	properties := map[string]string{}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return properties
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, ok := strings.CutPrefix(line, prefix)
+		if !ok {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			properties[k] = v
+		}
+	}
+	return properties
+}
+
+// matches reports whether a device of the host passes all criteria of the rule
+func (r Rule) matches(hd hostDevice) bool {
+	if len(r.Paths) > 0 {
+		matched := false
+		for _, pattern := range r.Paths {
+			if ok, _ := path.Match(pattern, path.Join("/dev", hd.name)); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.Subsystem != "" && r.Subsystem != hd.subsystem {
+		return false
+	}
+	for k, pattern := range r.Properties {
+		if ok, _ := path.Match(pattern, hd.properties[k]); !ok {
+			return false
+		}
+	}
+	if r.VendorID != "" && normalizeID(r.VendorID) != hd.vendorID {
+		return false
+	}
+	if r.ProductID != "" && normalizeID(r.ProductID) != hd.productID {
+		return false
+	}
+	return true
+}
+
+// A discoverySource is the source of the devices of the host that match the rules of a resource
+type discoverySource struct {
+	rules []Rule
+
+	mu sync.Mutex
+	// devices are the devices that were discovered last, by their names in /dev
+	devices map[string]Device
+}
+
+// update replaces the discovered devices, it reports whether they changed
+func (s *discoverySource) update(devices map[string]Device) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.devices != nil && reflect.DeepEqual(s.devices, devices) {
+		return false
+	}
+	s.devices = devices
+	return true
+}
+
+// allocate returns the nodes of the devices and the environment variable with their paths
+func (s *discoverySource) allocate(_ context.Context, ids []string) (*Allocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allocation := &Allocation{Envs: map[string]string{}}
+	var paths []string
+	for _, id := range ids {
+		d, ok := s.devices[id]
+		if !ok {
+			return nil, errors.Errorf("device %q was removed", id)
+		}
+		if d.Permissions == "" {
+			d.Permissions = "rw"
+		}
+		allocation.Devices = append(allocation.Devices, d)
+		paths = append(paths, d.ContainerPath)
+	}
+	for _, rule := range s.rules {
+		if rule.Env != "" {
+			allocation.Envs[rule.Env] = strings.Join(paths, ",")
+		}
+	}
+	return allocation, nil
+}
+
+// preStart does nothing, the device nodes need no preparation
+func (s *discoverySource) preStart(context.Context, []string) error {
+	return nil
+}
+
+func (s *discoverySource) stop() {}
+
+// values returns the values of a map in order
+func values(m map[string]string) []string {
+	var vs []string
+	for _, v := range m {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	return vs
+}
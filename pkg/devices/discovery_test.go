@@ -0,0 +1,115 @@
+package devices
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeHostDevice creates a character device in a fake sysfs and /dev, sysDir is the directory of the device below
+// /sys/devices
+func fakeHostDevice(t *testing.T, root, number, sysDir, subsystem, name string) {
+	t.Helper()
+	dir := filepath.Join(root, "sys/devices", sysDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "uevent"), "DEVNAME="+name+"\n")
+	if err := os.MkdirAll(filepath.Join(root, "sys/class", subsystem), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sys/class", subsystem), filepath.Join(dir, "subsystem")); err != nil {
+		t.Fatal(err)
+	}
+	charDir := filepath.Join(root, "sys/dev/char")
+	if err := os.MkdirAll(charDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := filepath.Rel(charDir, dir)
+	if err := os.Symlink(target, filepath.Join(charDir, number)); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "dev", name), "")
+}
+
+func writeFile(t *testing.T, file, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	root := t.TempDir()
+	// A USB serial adapter, with its IDs on the USB device and a property of udev
+	fakeHostDevice(t, root, "188:0", "pci0000:00/usb1/1-1/1-1:1.0/ttyUSB0/tty/ttyUSB0", "tty", "ttyUSB0")
+	writeFile(t, filepath.Join(root, "sys/devices/pci0000:00/usb1/1-1/idVendor"), "0403\n")
+	writeFile(t, filepath.Join(root, "sys/devices/pci0000:00/usb1/1-1/idProduct"), "6001\n")
+	writeFile(t, filepath.Join(root, "run/udev/data/c188:0"), "S:serial/by-id/usb-FTDI\nE:ID_SERIAL=FTDI_FT232R_A1\n")
+	// Two I2C buses and a serial port that is not USB
+	fakeHostDevice(t, root, "89:0", "platform/i2c-0/i2c-dev/i2c-0", "i2c-dev", "i2c-0")
+	fakeHostDevice(t, root, "89:1", "platform/i2c-1/i2c-dev/i2c-1", "i2c-dev", "i2c-1")
+	fakeHostDevice(t, root, "4:64", "platform/serial8250/tty/ttyS0", "tty", "ttyS0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := New(Config{SocketDir: t.TempDir()})
+	err := m.StartDiscovery(ctx, DiscoveryConfig{
+		Root:   root,
+		Period: 10 * time.Millisecond,
+		Rules: []Rule{
+			{Resource: "fledge.io/serial", VendorID: "0403", ProductID: "6001", Subsystem: "tty", Env: "SERIAL_DEVICES"},
+			{Resource: "fledge.io/ftdi", Properties: map[string]string{"ID_SERIAL": "FTDI_*"}},
+			{Resource: "fledge.io/i2c", Paths: []string{"/dev/i2c-*"}, Permissions: "r"},
+			{Resource: "fledge.io/camera", Subsystem: "video4linux"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity, _ := m.Capacity()
+	for name, n := range map[corev1.ResourceName]int64{"fledge.io/serial": 1, "fledge.io/ftdi": 1, "fledge.io/i2c": 2, "fledge.io/camera": 0} {
+		if quantity := capacity[name]; quantity.Value() != n {
+			t.Errorf("expected a capacity of %d %q, got %d", n, name, quantity.Value())
+		}
+	}
+
+	allocation, err := m.Allocate(ctx, "pod", containerWithDevices("c", "fledge.io/serial", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocation.Devices) != 1 || allocation.Devices[0].HostPath != filepath.Join(root, "dev/ttyUSB0") ||
+		allocation.Devices[0].ContainerPath != "/dev/ttyUSB0" || allocation.Devices[0].Permissions != "rw" {
+		t.Fatalf("unexpected devices %+v", allocation.Devices)
+	}
+	if env := allocation.Envs["SERIAL_DEVICES"]; env != "/dev/ttyUSB0" {
+		t.Fatalf("unexpected environment variable %q", env)
+	}
+
+	// Devices that are plugged in or removed change the capacity
+	if err = os.Remove(filepath.Join(root, "sys/dev/char/89:1")); err != nil {
+		t.Fatal(err)
+	}
+	waitForAllocatable(t, m, "fledge.io/i2c", 1)
+	fakeHostDevice(t, root, "81:0", "pci0000:00/usb1/1-2/1-2:1.0/video4linux/video0", "video4linux", "video0")
+	waitForAllocatable(t, m, "fledge.io/camera", 1)
+}
+
+func TestDiscoveryRejectsInvalidRules(t *testing.T) {
+	m := New(Config{SocketDir: t.TempDir()})
+	for _, rule := range []Rule{
+		{Resource: "serial", Paths: []string{"/dev/ttyS*"}},
+		{Resource: "fledge.io/serial", Paths: []string{"/dev/tty["}},
+	} {
+		if err := m.StartDiscovery(context.Background(), DiscoveryConfig{Root: t.TempDir(), Rules: []Rule{rule}}); err == nil {
+			t.Errorf("expected rule %+v to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package devices
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config contains the parameters of a Manager
+type Config struct {
+	// SocketDir is the directory of the registration socket (kubelet.sock), in which device plugins also put their
+	// sockets
+	SocketDir string
+}
+
+// A Device is a device node that is created in a container
+type Device struct {
+	ContainerPath string
+	HostPath      string
+	// Permissions are the cgroup permissions of the device: r (read), w (write) and m (mknod)
+	Permissions string
+}
+
+// A Mount is a path of the host that is bind mounted in a container
+type Mount struct {
+	ContainerPath string
+	HostPath      string
+	ReadOnly      bool
+}
+
+// An Allocation holds what a container needs to use the devices that were allocated to it
+type Allocation struct {
+	// IDs are the IDs of the allocated devices by resource
+	IDs         map[string][]string
+	Devices     []Device
+	Mounts      []Mount
+	Envs        map[string]string
+	Annotations map[string]string
+	// init is whether the devices are allocated to an init container, which the other containers of the pod can
+	// reuse
+	init bool
+}
+
+// A source advertises the devices of a resource and prepares them for the containers to which they are allocated
+type source interface {
+	// allocate returns what a container needs to use devices
+	allocate(ctx context.Context, ids []string) (*Allocation, error)
+	// preStart prepares allocated devices right before a container that uses them starts
+	preStart(ctx context.Context, ids []string) error
+	// stop stops advertising the devices
+	stop()
+}
+
+// An extendedResource is an extended resource of which the devices come from a source
+type extendedResource struct {
+	source source
+	// devices maps the IDs of the devices to whether they are healthy
+	devices map[string]bool
+}
+
+// A Manager tracks the devices of extended resources and allocates them to containers, like the device manager of
+// the kubelet. Device plugins register themselves with the registration service of the Manager and advertise their
+// devices with ListAndWatch.
+type Manager struct {
+	config Config
+	server *grpc.Server
+
+	// allocating serializes allocations, which call out to the sources
+	allocating sync.Mutex
+
+	mu          sync.RWMutex
+	resources   map[string]*extendedResource
+	allocations map[string]map[string]*Allocation
+	notify      func()
+}
+
+// New creates a Manager, it only accepts device plugins once it is started
+func New(config Config) *Manager {
+	return &Manager{
+		config:      config,
+		resources:   map[string]*extendedResource{},
+		allocations: map[string]map[string]*Allocation{},
+	}
+}
+
+// Start serves the registration service on the socket until the context is done
+func (m *Manager) Start(ctx context.Context) error {
+	if err := os.MkdirAll(m.config.SocketDir, 0750); err != nil {
+		return errors.Wrap(err, "devices")
+	}
+	// Plugins register again when the socket is recreated
+	socketPath := filepath.Join(m.config.SocketDir, filepath.Base(pluginapi.KubeletSocket))
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "devices")
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrap(err, "devices")
+	}
+	m.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(m.server, &registrationServer{manager: m, context: ctx})
+	go func() {
+		if err := m.server.Serve(listener); err != nil {
+			log.G(ctx).Errorf("device plugin registration stopped: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		m.server.Stop()
+		m.mu.Lock()
+		for _, r := range m.resources {
+			r.source.stop()
+		}
+		m.mu.Unlock()
+	}()
+	log.G(ctx).Infof("accepting device plugins at %q", socketPath)
+	return nil
+}
+
+// Notify sets a function that is called whenever the capacity changes
+func (m *Manager) Notify(fn func()) {
+	m.mu.Lock()
+	m.notify = fn
+	m.mu.Unlock()
+}
+
+// Capacity returns the number of devices of each resource, allocatable only counts the healthy ones
+func (m *Manager) Capacity() (capacity, allocatable corev1.ResourceList) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	capacity, allocatable = corev1.ResourceList{}, corev1.ResourceList{}
+	for name, r := range m.resources {
+		healthy := 0
+		for _, h := range r.devices {
+			if h {
+				healthy++
+			}
+		}
+		capacity[corev1.ResourceName(name)] = *resource.NewQuantity(int64(len(r.devices)), resource.DecimalSI)
+		allocatable[corev1.ResourceName(name)] = *resource.NewQuantity(int64(healthy), resource.DecimalSI)
+	}
+	return capacity, allocatable
+}
+
+// Allocate allocates the devices of the extended resources that a container of a pod (identified by podID) asks
+// for. It returns the allocation of an earlier call for the same container, nil if it asks for no devices.
+// Like the kubelet, the devices of init containers are given to the containers that come after them in the same pod
+// before free devices, since init containers do not run next to the other containers.
+func (m *Manager) Allocate(ctx context.Context, podID string, container *corev1.Container, init bool) (*Allocation, error) {
+	requests := deviceRequests(container)
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	m.allocating.Lock()
+	defer m.allocating.Unlock()
+
+	m.mu.RLock()
+	allocation, ok := m.allocations[podID][container.Name]
+	m.mu.RUnlock()
+	if ok {
+		return allocation, nil
+	}
+
+	allocation = &Allocation{IDs: map[string][]string{}, Envs: map[string]string{}, Annotations: map[string]string{}, init: init}
+	names := make([]string, 0, len(requests))
+	for name := range requests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src, ids, err := m.freeDevices(podID, name, requests[name])
+		if err != nil {
+			return nil, err
+		}
+		// Other extended resources are not backed by devices of the node
+		if src == nil {
+			continue
+		}
+		a, err := src.allocate(ctx, ids)
+		if err != nil {
+			return nil, errors.Wrapf(err, "devices: failed to allocate %v of %q", ids, name)
+		}
+		allocation.IDs[name] = ids
+		allocation.merge(a)
+	}
+
+	m.mu.Lock()
+	if m.allocations[podID] == nil {
+		m.allocations[podID] = map[string]*Allocation{}
+	}
+	m.allocations[podID][container.Name] = allocation
+	m.mu.Unlock()
+	return allocation, nil
+}
+
+// freeDevices picks n healthy devices of a resource that are not allocated to a container, or only to init
+// containers of the same pod, which are picked first. It returns no source if the resource has no devices on the
+// node.
+func (m *Manager) freeDevices(podID, name string, n int) (source, []string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.resources[name]
+	if !ok {
+		return nil, nil, nil
+	}
+	used, reusable := map[string]bool{}, map[string]bool{}
+	for id, containers := range m.allocations {
+		for _, a := range containers {
+			for _, device := range a.IDs[name] {
+				if id == podID && a.init {
+					reusable[device] = true
+				} else {
+					used[device] = true
+				}
+			}
+		}
+	}
+	var reused, free []string
+	for id, healthy := range r.devices {
+		switch {
+		case !healthy || used[id]:
+		case reusable[id]:
+			reused = append(reused, id)
+		default:
+			free = append(free, id)
+		}
+	}
+	if len(reused)+len(free) < n {
+		return nil, nil, errors.Errorf("devices: %d of %q requested, %d available", n, name, len(reused)+len(free))
+	}
+	sort.Strings(reused)
+	sort.Strings(free)
+	return r.source, append(reused, free...)[:n], nil
+}
+
+// PreStart prepares the devices that are allocated to a container of a pod right before it starts, for the device
+// plugins that ask for it
+func (m *Manager) PreStart(ctx context.Context, podID, containerName string) error {
+	m.mu.RLock()
+	allocation, ok := m.allocations[podID][containerName]
+	sources := map[string]source{}
+	if ok {
+		for name := range allocation.IDs {
+			if r, ok := m.resources[name]; ok {
+				sources[name] = r.source
+			}
+		}
+	}
+	m.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ids := allocation.IDs[name]
+		if err := sources[name].preStart(ctx, ids); err != nil {
+			return errors.Wrapf(err, "devices: failed to prepare %v of %q", ids, name)
+		}
+	}
+	return nil
+}
+
+// Release frees the devices of all containers of a pod
+func (m *Manager) Release(podID string) {
+	m.mu.Lock()
+	delete(m.allocations, podID)
+	m.mu.Unlock()
+}
+
+// setSource replaces the source of a resource, the devices of the old source are forgotten
+func (m *Manager) setSource(name string, src source) {
+	m.mu.Lock()
+	old, ok := m.resources[name]
+	m.resources[name] = &extendedResource{source: src, devices: map[string]bool{}}
+	m.mu.Unlock()
+	if ok {
+		old.source.stop()
+	}
+	m.changed()
+}
+
+// setDevices updates the devices of a resource, as long as they come from the current source
+func (m *Manager) setDevices(name string, src source, devices map[string]bool) {
+	m.mu.Lock()
+	r, ok := m.resources[name]
+	if !ok || r.source != src {
+		m.mu.Unlock()
+		return
+	}
+	r.devices = devices
+	m.mu.Unlock()
+	m.changed()
+}
+
+// changed calls the notify function after the capacity changed
+func (m *Manager) changed() {
+	m.mu.RLock()
+	notify := m.notify
+	m.mu.RUnlock()
+	if notify != nil {
+		notify()
+	}
+}
+
+// merge adds what the devices of another resource need to an allocation
+func (a *Allocation) merge(other *Allocation) {
+	if other == nil {
+		return
+	}
+	a.Devices = append(a.Devices, other.Devices...)
+	a.Mounts = append(a.Mounts, other.Mounts...)
+	for k, v := range other.Envs {
+		a.Envs[k] = v
+	}
+	for k, v := range other.Annotations {
+		a.Annotations[k] = v
+	}
+}
+
+// deviceRequests returns the number of devices of each extended resource that a container asks for
+// Extended resources can not be overcommitted, so the limit is used if it is set.
+func deviceRequests(container *corev1.Container) map[string]int {
+	requests := map[string]int{}
+	for _, list := range []corev1.ResourceList{container.Resources.Requests, container.Resources.Limits} {
+		for name, quantity := range list {
+			if isExtendedResourceName(name) && quantity.Value() > 0 {
+				requests[string(name)] = int(quantity.Value())
+			}
+		}
+	}
+	return requests
+}
+
+// isExtendedResourceName reports whether a resource is an extended resource, which is qualified by a domain other
+// than kubernetes.io
+func isExtendedResourceName(name corev1.ResourceName) bool {
+	return strings.Contains(string(name), "/") &&
+		!strings.Contains(string(name), corev1.ResourceDefaultNamespacePrefix) &&
+		!strings.HasPrefix(string(name), corev1.DefaultResourceRequestsPrefix)
+}
@@ -0,0 +1,221 @@
+package devices
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const fakeResource = "example.com/fake"
+
+// fakePlugin is a device plugin that advertises a fixed list of devices
+type fakePlugin struct {
+	pluginapi.UnimplementedDevicePluginServer
+	devices []*pluginapi.Device
+	stop    chan struct{}
+	// preStarted receives the devices of every PreStartContainer
+	preStarted chan []string
+}
+
+func (p *fakePlugin) ListAndWatch(_ *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
+	if err := stream.Send(&pluginapi.ListAndWatchResponse{Devices: p.devices}); err != nil {
+		return err
+	}
+	<-p.stop
+	return nil
+}
+
+func (p *fakePlugin) Allocate(_ context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	resp := &pluginapi.AllocateResponse{}
+	for _, r := range req.ContainerRequests {
+		c := &pluginapi.ContainerAllocateResponse{Envs: map[string]string{"FAKE_DEVICES": r.DevicesIDs[0]}}
+		for _, id := range r.DevicesIDs {
+			c.Devices = append(c.Devices, &pluginapi.DeviceSpec{ContainerPath: "/dev/" + id, HostPath: "/dev/" + id, Permissions: "rw"})
+		}
+		resp.ContainerResponses = append(resp.ContainerResponses, c)
+	}
+	return resp, nil
+}
+
+func (p *fakePlugin) PreStartContainer(_ context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	p.preStarted <- req.DevicesIDs
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// startFakePlugin serves a fake device plugin and registers it with the manager
+func startFakePlugin(t *testing.T, dir string, devices []*pluginapi.Device) *fakePlugin {
+	t.Helper()
+	p := &fakePlugin{devices: devices, stop: make(chan struct{}), preStarted: make(chan []string, 10)}
+	listener, err := net.Listen("unix", filepath.Join(dir, "fake.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(server, p)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("unix://"+filepath.Join(dir, "kubelet.sock"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = pluginapi.NewRegistrationClient(conn).Register(context.Background(), &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     "fake.sock",
+		ResourceName: fakeResource,
+		Options:      &pluginapi.DevicePluginOptions{PreStartRequired: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// waitForAllocatable waits until the manager has n allocatable devices of a resource
+func waitForAllocatable(t *testing.T, m *Manager, name corev1.ResourceName, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, allocatable := m.Capacity()
+		quantity := allocatable[name]
+		if quantity.Value() == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d allocatable devices of %q, got %d", n, name, quantity.Value())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func fakeContainer(name string, n int64) *corev1.Container {
+	return containerWithDevices(name, fakeResource, n)
+}
+
+func containerWithDevices(name string, resourceName corev1.ResourceName, n int64) *corev1.Container {
+	return &corev1.Container{
+		Name: name,
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{resourceName: *resource.NewQuantity(n, resource.DecimalSI)},
+		},
+	}
+}
+
+func TestManagerAllocatesPluginDevices(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := New(Config{SocketDir: dir})
+	if err := m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	plugin := startFakePlugin(t, dir, []*pluginapi.Device{
+		{ID: "fake0", Health: pluginapi.Healthy},
+		{ID: "fake1", Health: pluginapi.Unhealthy},
+	})
+	waitForAllocatable(t, m, fakeResource, 1)
+	capacity, _ := m.Capacity()
+	if quantity := capacity[fakeResource]; quantity.Value() != 2 {
+		t.Fatalf("expected a capacity of 2, got %d", quantity.Value())
+	}
+
+	allocation, err := m.Allocate(ctx, "pod-a", fakeContainer("c", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocation.Envs["FAKE_DEVICES"] != "fake0" || len(allocation.Devices) != 1 || allocation.Devices[0].HostPath != "/dev/fake0" {
+		t.Fatalf("unexpected allocation %+v", allocation)
+	}
+	// Allocating the same container again returns the same devices
+	if again, err := m.Allocate(ctx, "pod-a", fakeContainer("c", 1), false); err != nil || again != allocation {
+		t.Fatalf("expected the earlier allocation, got %+v (%v)", again, err)
+	}
+	// Unhealthy and allocated devices are not given to other pods
+	if _, err = m.Allocate(ctx, "pod-b", fakeContainer("c", 1), false); err == nil {
+		t.Fatal("expected the allocation to fail")
+	}
+	m.Release("pod-a")
+	if _, err = m.Allocate(ctx, "pod-b", fakeContainer("c", 1), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The devices of a plugin that stops are unhealthy
+	close(plugin.stop)
+	waitForAllocatable(t, m, fakeResource, 0)
+}
+
+func TestManagerReusesInitContainerDevices(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := New(Config{SocketDir: dir})
+	if err := m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	plugin := startFakePlugin(t, dir, []*pluginapi.Device{{ID: "fake0", Health: pluginapi.Healthy}})
+	waitForAllocatable(t, m, fakeResource, 1)
+
+	// The init container and the container that runs after it both get the only device
+	if _, err := m.Allocate(ctx, "pod-a", fakeContainer("init", 1), true); err != nil {
+		t.Fatal(err)
+	}
+	allocation, err := m.Allocate(ctx, "pod-a", fakeContainer("c", 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := allocation.IDs[fakeResource]; len(ids) != 1 || ids[0] != "fake0" {
+		t.Fatalf("expected the device of the init container, got %v", ids)
+	}
+	// The containers of a pod run next to each other, they do not share devices
+	if _, err = m.Allocate(ctx, "pod-a", fakeContainer("other", 1), false); err == nil {
+		t.Fatal("expected the allocation of a second container to fail")
+	}
+	// Other pods do not get the devices of init containers
+	if _, err = m.Allocate(ctx, "pod-b", fakeContainer("init", 1), true); err == nil {
+		t.Fatal("expected the allocation of another pod to fail")
+	}
+
+	// The plugin only prepares the devices when the container starts
+	select {
+	case ids := <-plugin.preStarted:
+		t.Fatalf("expected no PreStartContainer before the container starts, got %v", ids)
+	default:
+	}
+	if err = m.PreStart(ctx, "pod-a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ids := <-plugin.preStarted:
+		if len(ids) != 1 || ids[0] != "fake0" {
+			t.Fatalf("expected PreStartContainer for fake0, got %v", ids)
+		}
+	default:
+		t.Fatal("expected PreStartContainer to be called")
+	}
+	// Containers without devices need no preparation
+	if err = m.PreStart(ctx, "pod-b", "c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerIgnoresOtherResources(t *testing.T) {
+	m := New(Config{SocketDir: t.TempDir()})
+	container := fakeContainer("c", 1)
+	container.Resources.Limits[corev1.ResourceCPU] = resource.MustParse("1")
+	allocation, err := m.Allocate(context.Background(), "pod", container, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocation.IDs) != 0 {
+		t.Fatalf("expected no devices, got %v", allocation.IDs)
+	}
+}
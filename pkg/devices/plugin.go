@@ -0,0 +1,161 @@
+package devices
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// dialTimeout is how long the socket of a device plugin that registers is waited for
+	dialTimeout = 10 * time.Second
+	// preStartTimeout is how long PreStartContainer may take
+	preStartTimeout = pluginapi.KubeletPreStartContainerRPCTimeoutInSecs * time.Second
+)
+
+// registrationServer accepts the device plugins that register themselves
+type registrationServer struct {
+	manager *Manager
+	// context lives as long as the manager, the context of a registration ends with it
+	context context.Context
+}
+
+// Register connects to the socket of a device plugin and starts watching its devices
+func (s *registrationServer) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	ctx = log.WithLogger(s.context, log.G(ctx).WithField("resource", req.ResourceName))
+	if req.Version != pluginapi.Version {
+		return nil, errors.Errorf("device plugin API version %q is not supported, only %q", req.Version, pluginapi.Version)
+	}
+	if !isExtendedResourceName(corev1.ResourceName(req.ResourceName)) {
+		return nil, errors.Errorf("resource %q is not an extended resource", req.ResourceName)
+	}
+	plugin, err := dialPlugin(ctx, filepath.Join(s.manager.config.SocketDir, req.Endpoint), req.Options)
+	if err != nil {
+		log.G(ctx).Errorf("failed to register device plugin: %s", err)
+		return nil, err
+	}
+	log.G(ctx).Infof("registered device plugin at %q", req.Endpoint)
+	ctx, plugin.cancel = context.WithCancel(ctx)
+	s.manager.setSource(req.ResourceName, plugin)
+	go plugin.watch(ctx, s.manager, req.ResourceName)
+	return &pluginapi.Empty{}, nil
+}
+
+// A plugin is a device plugin that registered itself
+type plugin struct {
+	conn    *grpc.ClientConn
+	client  pluginapi.DevicePluginClient
+	options *pluginapi.DevicePluginOptions
+	cancel  context.CancelFunc
+}
+
+func dialPlugin(ctx context.Context, socketPath string, options *pluginapi.DevicePluginOptions) (*plugin, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to device plugin %q", socketPath)
+	}
+	if options == nil {
+		options = &pluginapi.DevicePluginOptions{}
+	}
+	return &plugin{
+		conn:    conn,
+		client:  pluginapi.NewDevicePluginClient(conn),
+		options: options,
+	}, nil
+}
+
+// watch updates the devices of a resource with every list the plugin sends until the plugin stops, after which its
+// devices are unhealthy until it registers again
+func (p *plugin) watch(ctx context.Context, m *Manager, resourceName string) {
+	defer p.conn.Close()
+
+	stream, err := p.client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		log.G(ctx).Errorf("failed to watch devices: %s", err)
+		return
+	}
+	devices := map[string]bool{}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.G(ctx).Warnf("device plugin stopped: %s", err)
+			}
+			break
+		}
+		devices = map[string]bool{}
+		for _, d := range resp.Devices {
+			devices[d.ID] = d.Health == pluginapi.Healthy
+		}
+		log.G(ctx).Debugf("device plugin advertises %d devices", len(devices))
+		m.setDevices(resourceName, p, devices)
+	}
+	unhealthy := map[string]bool{}
+	for id := range devices {
+		unhealthy[id] = false
+	}
+	m.setDevices(resourceName, p, unhealthy)
+}
+
+// allocate asks the plugin to prepare devices for a container
+func (p *plugin) allocate(ctx context.Context, ids []string) (*Allocation, error) {
+	resp, err := p.client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.ContainerResponses) != 1 {
+		return nil, errors.Errorf("device plugin returned %d allocations instead of 1", len(resp.ContainerResponses))
+	}
+	container := resp.ContainerResponses[0]
+	allocation := &Allocation{Envs: container.Envs, Annotations: container.Annotations}
+	for _, d := range container.Devices {
+		allocation.Devices = append(allocation.Devices, Device{
+			ContainerPath: d.ContainerPath,
+			HostPath:      d.HostPath,
+			Permissions:   d.Permissions,
+		})
+	}
+	for _, m := range container.Mounts {
+		allocation.Mounts = append(allocation.Mounts, Mount{
+			ContainerPath: m.ContainerPath,
+			HostPath:      m.HostPath,
+			ReadOnly:      m.ReadOnly,
+		})
+	}
+	return allocation, nil
+}
+
+// preStart runs PreStartContainer of the plugin, when it needs it
+func (p *plugin) preStart(ctx context.Context, ids []string) error {
+	if !p.options.PreStartRequired {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, preStartTimeout)
+	defer cancel()
+	if _, err := p.client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: ids}); err != nil {
+		return errors.Wrap(err, "PreStartContainer")
+	}
+	return nil
+}
+
+func (p *plugin) stop() {
+	p.cancel()
+}
@@ -2,58 +2,112 @@ package fledge
 
 import (
 	"fmt"
-	"gitlab.ilabt.imec.be/fledge/service/pkg/util"
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
 )
 
+// unifiedMountpoint is where the unified hierarchy (cgroup v2) is mounted
+const unifiedMountpoint = "/sys/fs/cgroup"
+
 func GetCgroup(namespace string, podname string, container string) string {
-	cgName := fmt.Sprintf("vkubelet/%s-%s-%s", namespace, podname, container)
+	cgName := fmt.Sprintf("/vkubelet/%s-%s-%s", namespace, podname, container)
 	return cgName
 }
 
-func CreateCgroupIfNotExists(namespace string, podname string, container string) string {
+func CreateCgroupIfNotExists(namespace string, podname string, container string) (string, error) {
 	cgName := GetCgroup(namespace, podname, container)
 	if !CgroupExists(cgName) {
-		CreateCgroup(cgName)
+		if err := CreateCgroup(cgName); err != nil {
+			return "", err
+		}
 	}
-	return cgName
+	return cgName, nil
 }
 
-func CreateCgroup(cgName string) {
-	//cmd := fmt.Sprintf("cgcreate -g memory,cpu:vkubelet/%s", cgName)
-	cmd := fmt.Sprintf("mkdir -p /sys/fs/cgroup/memory/%s", cgName)
-	util.ExecShellCommand(cmd)
-	cmd = fmt.Sprintf("mkdir -p /sys/fs/cgroup/cpu/%s", cgName)
-	util.ExecShellCommand(cmd)
+func CreateCgroup(cgName string) error {
+	return errors.Wrapf(updateCgroup(cgName, &specs.LinuxResources{}), "failed to create cgroup %q", cgName)
 }
 
 func CgroupExists(cgName string) bool {
-	//cmd := fmt.Sprintf("cgget -g memory:vkubelet/%s", cgName)
-	cmd := fmt.Sprintf("cat /sys/fs/cgroup/memory/%s/memory.limit_in_bytes", cgName)
-	_, err := util.ExecShellCommand(cmd)
+	if cgroups.Mode() == cgroups.Unified {
+		_, err := os.Stat(filepath.Join(unifiedMountpoint, cgName))
+		return err == nil
+	}
+	_, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(cgName))
 	return err == nil
 }
 
-func DeleteCgroup(cgName string) {
-	//cmd := fmt.Sprintf("cgdelete memory,cpu:vkubelet/%s", cgName)
-	cmd := fmt.Sprintf("rmdir /sys/fs/cgroup/memory/%s", cgName)
-	util.ExecShellCommand(cmd)
-	cmd = fmt.Sprintf("rmdir /sys/fs/cgroup/cpu/%s", cgName)
-	util.ExecShellCommand(cmd)
+func DeleteCgroup(cgName string) error {
+	var err error
+	if cgroups.Mode() == cgroups.Unified {
+		var cg *cgroupsv2.Manager
+		if cg, err = cgroupsv2.LoadManager(unifiedMountpoint, cgName); err == nil {
+			err = cg.Delete()
+		}
+	} else {
+		var cg cgroups.Cgroup
+		if cg, err = cgroups.Load(cgroups.V1, cgroups.StaticPath(cgName)); err == nil {
+			err = cg.Delete()
+		}
+	}
+	return errors.Wrapf(err, "failed to delete cgroup %q", cgName)
 }
 
-func SetMemoryLimit(cgName string, limit int64) {
-	cmd := fmt.Sprintf("echo %d > /sys/fs/cgroup/memory/%s/memory.limit_in_bytes", limit, cgName)
-	//cmd := fmt.Sprintf("cgset -r memory.limit_in_bytes=%d %s", limit, cgName)
-	util.ExecShellCommand(cmd)
+// CpuLimitSupported checks whether the CFS quota of the CPU controller is available
+func CpuLimitSupported() bool {
+	if cgroups.Mode() == cgroups.Unified {
+		cg, err := cgroupsv2.LoadManager(unifiedMountpoint, "/")
+		if err != nil {
+			return false
+		}
+		controllers, err := cg.RootControllers()
+		if err != nil {
+			return false
+		}
+		for _, c := range controllers {
+			if c == "cpu" {
+				return true
+			}
+		}
+		return false
+	}
+	_, err := os.Stat(filepath.Join(unifiedMountpoint, string(cgroups.Cpu), "cpu.cfs_quota_us"))
+	return err == nil
 }
 
-func SetCpuLimit(cgName string, cpus float64) {
-	//cpu.cfs_period_us=100000
-	//cpu.cfs_quota=100000 * cpus?
-	cmd := fmt.Sprintf("echo %d > /sys/fs/cgroup/cpu/%s/cpu.cfs_period_us", 100000, cgName)
-	//cmd := fmt.Sprintf("cgset -r cpu.cfs_period_us=%d %s", 100000, cgName)
-	util.ExecShellCommand(cmd)
-	cmd = fmt.Sprintf("echo %d > /sys/fs/cgroup/cpu/%s/cpu.cfs_quota_us", int64(100000*cpus), cgName)
-	//cmd = fmt.Sprintf("cgset -r cpu.cfs_quota_us=%d %s", int64(100000*cpus), cgName)
-	util.ExecShellCommand(cmd)
+func SetMemoryLimit(cgName string, limit int64) error {
+	resources := &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+	}
+	return errors.Wrapf(updateCgroup(cgName, resources), "failed to set memory limit of cgroup %q", cgName)
+}
+
+func SetCpuLimit(cgName string, cpus float64) error {
+	period := uint64(100000)
+	quota := int64(100000 * cpus)
+	resources := &specs.LinuxResources{
+		CPU: &specs.LinuxCPU{Period: &period, Quota: &quota},
+	}
+	return errors.Wrapf(updateCgroup(cgName, resources), "failed to set cpu limit of cgroup %q", cgName)
+}
+
+// updateCgroup creates the cgroup if it does not exist yet and sets its resources
+func updateCgroup(cgName string, resources *specs.LinuxResources) error {
+	if cgroups.Mode() == cgroups.Unified {
+		_, err := cgroupsv2.NewManager(unifiedMountpoint, cgName, cgroupsv2.ToResources(resources))
+		return err
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(cgName))
+	if err == cgroups.ErrCgroupDeleted {
+		_, err = cgroups.New(cgroups.V1, cgroups.StaticPath(cgName), resources)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return cg.Update(resources)
 }
@@ -8,11 +8,11 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
-	"gitlab.ilabt.imec.be/fledge/service/pkg/util"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 
 	"github.com/containerd/containerd/namespaces"
@@ -148,7 +148,6 @@ func ValidPrefix(tagPrefix string) bool {
 	default:
 		return false
 	}
-	return false
 }
 
 func (cr *ContainerdRuntime) SetupPorts(pod *corev1.Pod, dc *corev1.Container) {
@@ -196,7 +195,10 @@ func (cr *ContainerdRuntime) CreateContainer(namespace string, pod *corev1.Pod,
 	vmounts := cr.BuildMounts(pod, dc)
 
 	//handle resource limits
-	cgroup := cr.SetContainerResources(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, dc)
+	cgroup, err := cr.SetContainerResources(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, dc)
+	if err != nil {
+		return "", err
+	}
 
 	//pull image + policy
 	image, err := cr.client.GetImage(cr.ctx, imageString)
@@ -295,7 +297,7 @@ func (cr *ContainerdRuntime) CreateContainer(namespace string, pod *corev1.Pod,
 		fmt.Println(err)
 		return "", err
 	}
-	fmt.Println("Task awaited with status %d", exitStatusC)
+	fmt.Printf("Task awaited with status %v\n", exitStatusC)
 
 	// call start on the task to execute the redis server
 	if err := task.Start(cr.ctx); err != nil {
@@ -418,14 +420,12 @@ func (cr *ContainerdRuntime) CreateMount(pod *corev1.Pod, volMount corev1.Volume
 
 }
 
-func (cr *ContainerdRuntime) SetContainerResources(namespace string, podname string, dc *corev1.Container) string {
+func (cr *ContainerdRuntime) SetContainerResources(namespace string, podname string, dc *corev1.Container) (string, error) {
 	//some default values
 	oneCpu, _ := resource.ParseQuantity("1")
 	defaultMem, _ := resource.ParseQuantity("150Mi")
 
-	// fmt.Printf("Checking cpu limiting support\n")
-	supportCheck, _ := util.ExecShellCommand("ls /sys/fs/cgroup/cpu/ | grep -E 'cpu.cfs_[a-z]*_us'")
-	cpuSupported := supportCheck != ""
+	cpuSupported := CpuLimitSupported()
 	// fmt.Printf("Cpu limit support %s\n", cpuSupported)
 
 	var cpuLimit float64
@@ -468,10 +468,17 @@ func (cr *ContainerdRuntime) SetContainerResources(namespace string, podname str
 		}
 	}
 
-	cgroup := CreateCgroupIfNotExists(namespace, podname, dc.Name)
-	SetMemoryLimit(cgroup, memLimit)
-	SetCpuLimit(cgroup, cpuLimit)
-	return cgroup
+	cgroup, err := CreateCgroupIfNotExists(namespace, podname, dc.Name)
+	if err != nil {
+		return "", err
+	}
+	if err = SetMemoryLimit(cgroup, memLimit); err != nil {
+		return "", err
+	}
+	if err = SetCpuLimit(cgroup, cpuLimit); err != nil {
+		return "", err
+	}
+	return cgroup, nil
 }
 
 func (cr *ContainerdRuntime) UpdatePod(pod *corev1.Pod) error {
@@ -522,14 +529,16 @@ func (cr *ContainerdRuntime) StopContainer(namespace string, pod *corev1.Pod, dc
 		//time, _ := time.ParseDuration("10s")
 		//err := cr.cli.ContainerStop(cr.ctx, contID, nil)
 		exitStatus, err := tuple.task.Delete(cr.ctx)
-		fmt.Printf("Task stopped status %d \n", exitStatus)
 
 		if err == nil {
+			fmt.Printf("Task stopped status %d \n", exitStatus.ExitCode())
 			delete(cr.containerNameTaskMapping, fullName)
 			fmt.Printf("Removing container %s\n", fullName)
 
 			err = tuple.container.Delete(cr.ctx, containerd.WithSnapshotCleanup)
-			DeleteCgroup(GetCgroup(namespace, pod.ObjectMeta.Name, dc.Name))
+			if cgErr := DeleteCgroup(GetCgroup(namespace, pod.ObjectMeta.Name, dc.Name)); cgErr != nil {
+				log.G(cr.ctx).Warn(cgErr)
+			}
 			if err != nil {
 				fmt.Println(err.Error())
 			}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"io"
 	corev1 "k8s.io/api/core/v1"
@@ -29,11 +30,16 @@ type BackendOld interface {
 
 type Backend interface {
 	GetInstanceStatus(instance *Instance) (corev1.ContainerStatus, error)
+	PullInstanceImage(ctx context.Context, instance *Instance) (ImagePull, error)
 	CreateInstance(instance *Instance) error
 	StartInstance(instance *Instance) error
 	UpdateInstance(instance *Instance) error
 	KillInstance(instance *Instance, signal syscall.Signal) error
 	DeleteInstance(instance *Instance) error
 	GetInstanceLogs(instance *Instance, opts api.ContainerLogOpts) (io.ReadCloser, error)
-	RunInInstance(instance *Instance, cmd []string, attach api.AttachIO) error
+	RunInInstance(ctx context.Context, instance *Instance, cmd []string, attach api.AttachIO) error
+	AttachToInstance(ctx context.Context, instance *Instance, attach api.AttachIO) error
+	PortForwardInstance(ctx context.Context, instance *Instance, port int32, stream io.ReadWriteCloser) error
+	GetInstanceStorageUsage(instance *Instance) (InstanceStorageUsage, error)
+	GetInstanceStats(instance *Instance) (InstanceStats, error)
 }
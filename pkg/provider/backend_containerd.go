@@ -1,32 +1,57 @@
 package provider
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/containerd/cgroups"
+	v1stats "github.com/containerd/cgroups/stats/v1"
+	v2stats "github.com/containerd/cgroups/v2/stats"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/contrib/seccomp"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
+	seccompsupport "github.com/containerd/containerd/pkg/seccomp"
 	"github.com/containerd/containerd/platforms"
 	refdocker "github.com/containerd/containerd/reference/docker"
+	runcoptions "github.com/containerd/containerd/runtime/v2/runc/options"
 	gocni "github.com/containerd/go-cni"
-	"github.com/containerd/nerdctl/pkg/imgutil/dockerconfigresolver"
 	"github.com/containerd/nerdctl/pkg/labels"
+	"github.com/containerd/typeurl/v2"
+	cnins "github.com/containernetworking/plugins/pkg/ns"
 	"github.com/google/uuid"
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/credentials"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/devices"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/puller"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
 	"io"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilexec "k8s.io/utils/exec"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type ContainerdBackend struct {
@@ -34,22 +59,63 @@ type ContainerdBackend struct {
 
 	context context.Context
 	client  *containerd.Client
+	puller  *puller.Puller
+
+	// cgroupV2 is set on hosts with only the unified hierarchy, hybrid hosts use the controllers of cgroup v1
+	cgroupV2 bool
+	// cpus gives exclusive CPUs to instances, nil unless the static CPU manager policy is used
+	cpus *cpuAllocator
+	// rootless is the RootlessKit of a rootless containerd, nil if containerd runs as root
+	rootless *rootlessKit
+
+	mu          sync.Mutex
+	instanceIOs map[string]*InstanceIO
 }
 
-func NewContainerdBackend(ctx context.Context, cfg Config) (*ContainerdBackend, error) {
+func NewContainerdBackend(ctx context.Context, cfg Config, imagePuller *puller.Puller) (*ContainerdBackend, error) {
 	client, err := containerd.New(
-		"/run/containerd/containerd.sock",
-		containerd.WithDefaultNamespace("fledge"),
+		cfg.Containerd.Address,
+		containerd.WithDefaultNamespace(cfg.Containerd.Namespace),
 		containerd.WithDefaultPlatform(platforms.Default()),
+		containerd.WithDefaultRuntime(cfg.Containerd.DefaultRuntime),
 	)
-	if client == nil {
-		return nil, errors.Wrap(err, "containerd")
+	if err != nil {
+		return nil, errors.Wrapf(err, "containerd: failed to connect to %q", cfg.Containerd.Address)
+	}
+	log.G(ctx).Infof("using containerd at %q in namespace %q with snapshotter %q", cfg.Containerd.Address, cfg.Containerd.Namespace, cfg.Containerd.Snapshotter)
+
+	// Detect the cgroup version of the host, the cgroup driver is configured
+	cgroupV2 := cgroups.Mode() == cgroups.Unified
+	if cgroupV2 {
+		log.G(ctx).Info("using cgroup v2 (unified hierarchy)")
+	} else {
+		log.G(ctx).Info("using cgroup v1")
+		if cfg.Resources.SwapBehavior == SwapBehaviorLimited {
+			log.G(ctx).Warnf("swap behavior %s requires cgroup v2, using %s", SwapBehaviorLimited, SwapBehaviorNo)
+			cfg.Resources.SwapBehavior = SwapBehaviorNo
+		}
+	}
+	var cpus *cpuAllocator
+	if cfg.Resources.CPUManagerPolicy == CPUManagerPolicyStatic {
+		if cpus, err = newCPUAllocator(cfg.Resources.ReservedCPUs); err != nil {
+			return nil, errors.Wrap(err, "containerd")
+		}
+	}
+
+	var rootless *rootlessKit
+	if cfg.Rootless.Enabled {
+		rootless = newRootlessKit(cfg.Rootless.StateDir)
 	}
 
 	b := &ContainerdBackend{
-		config:  cfg,
-		context: namespaces.WithNamespace(ctx, "fledge"),
-		client:  client,
+		config:      cfg,
+		context:     namespaces.WithNamespace(ctx, cfg.Containerd.Namespace),
+		client:      client,
+		puller:      imagePuller,
+		cgroupV2:    cgroupV2,
+		cpus:        cpus,
+		rootless:    rootless,
+		instanceIOs: map[string]*InstanceIO{},
 	}
 
 	// Scrub old containerd instances
@@ -64,6 +130,9 @@ func NewContainerdBackend(ctx context.Context, cfg Config) (*ContainerdBackend,
 			log.G(b.context).Error(errors.Wrap(err, "containerd"))
 		}
 	}
+	if b.cpus != nil {
+		go b.reconcileCPUs()
+	}
 
 	return b, nil
 }
@@ -125,44 +194,75 @@ func (b *ContainerdBackend) GetInstanceStatus(instance *Instance) (corev1.Contai
 	}, nil
 }
 
-func (b *ContainerdBackend) CreateInstance(instance *Instance) error {
-	// Clean up pre-existing instance (TODO can we do this in SIGKILL or on startup?)
-	err := b.DeleteInstance(instance)
+func (b *ContainerdBackend) PullInstanceImage(ctx context.Context, instance *Instance) (ImagePull, error) {
+	ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+	image, pulled, err := b.getImage(ctx, instance.Image, instance.ImagePullPolicy, instance.Keyring)
+	if err != nil {
+		return ImagePull{}, errors.Wrap(err, "containerd")
+	}
+	size, err := image.Size(ctx)
 	if err != nil {
+		return ImagePull{}, errors.Wrap(err, "containerd")
+	}
+	// Pod.Annotations (restore.fledge.io/<container>)
+	if instance.Checkpoint != "" {
+		if err = b.getCheckpoint(ctx, instance.Checkpoint, instance.Keyring); err != nil {
+			return ImagePull{}, errors.Wrap(err, "containerd")
+		}
+	}
+	return ImagePull{Pulled: pulled, Size: uint64(size)}, nil
+}
+
+func (b *ContainerdBackend) CreateInstance(instance *Instance) (err error) {
+	// Clean up pre-existing instance (TODO can we do this in SIGKILL or on startup?)
+	if err = b.DeleteInstance(instance); err != nil {
 		log.G(b.context).Error(err)
 	}
+	// The exclusive CPUs are allocated with the resources, an instance that is not created gives them back
+	defer func() {
+		if err != nil && b.cpus != nil {
+			b.cpus.release(instance.ID)
+		}
+	}()
 
-	// Container.Image
+	// Container.Image (pulled by PullInstanceImage)
 	image, err := b.client.GetImage(b.context, instance.Image)
-	if (err != nil && instance.ImagePullPolicy == corev1.PullIfNotPresent) || instance.ImagePullPolicy == corev1.PullAlways {
-		if instance.ImagePullPolicy == corev1.PullAlways {
-			b.client.ImageService().Delete(b.context, instance.Image)
-		}
-		named, err := refdocker.ParseDockerRef(instance.Image)
-		if err != nil {
-			return errors.Wrap(err, "containerd")
-		}
-		ref := named.String()
-		refDomain := refdocker.Domain(named)
-		resolver, err := dockerconfigresolver.New(b.context, refDomain)
-		if err != nil {
-			return errors.Wrap(err, "containerd")
-		}
-		pullOpts := []containerd.RemoteOpt{containerd.WithResolver(resolver), containerd.WithPullUnpack, containerd.WithSchema1Conversion}
-		image, err = b.client.Pull(b.context, ref, pullOpts...)
-		if err != nil {
-			return errors.Wrap(err, "containerd")
-		}
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+
+	// Pod.RuntimeClassName
+	runtimeOpts, err := b.getRuntimeOpts(instance.RuntimeClassName)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
 	}
 
 	// Get container and specification options
 	containerOpts := []containerd.NewContainerOpts{
 		containerd.WithImage(image),
 		containerd.WithImageConfigLabels(image),
-		containerd.WithSnapshotter(containerd.DefaultSnapshotter),
+		containerd.WithSnapshotter(b.config.Containerd.Snapshotter),
 		containerd.WithNewSnapshot(instance.ID, image),
 		containerd.WithImageStopSignal(image, "SIGTERM"),
 	}
+	containerOpts = append(containerOpts, runtimeOpts...)
+	// Pod.Annotations (restore.fledge.io/<container>, pulled by PullInstanceImage)
+	var taskOpts []containerd.NewTaskOpts
+	if instance.Checkpoint != "" {
+		// The checkpoint is only referenced until the task is created
+		ctx, done, err := b.client.WithLease(b.context)
+		if err != nil {
+			return errors.Wrap(err, "containerd")
+		}
+		defer done(ctx)
+		checkpoint, index, err := b.loadCheckpoint(ctx, instance.Checkpoint)
+		if err != nil {
+			return errors.Wrap(err, "containerd")
+		}
+		// Restores the root filesystem of the checkpoint on top of the new snapshot
+		containerOpts = append(containerOpts, containerd.WithRestoreRW(ctx, instance.ID, b.client, checkpoint, index))
+		taskOpts = append(taskOpts, containerd.WithTaskCheckpoint(checkpoint))
+	}
 	var specOpts []oci.SpecOpts
 	// Container.Command
 	imageArgs := append(instance.Command, instance.Args...)
@@ -195,52 +295,43 @@ func (b *ContainerdBackend) CreateInstance(instance *Instance) error {
 		env = append(env, fmt.Sprintf("%s=%q", envVar.Name, envVar.Value))
 	}
 	specOpts = append(specOpts, oci.WithEnv(env))
-	// Container.Resources (TODO)
-	if cpuLimitMillis := instance.Resources.Limits.Cpu().MilliValue(); cpuLimitMillis > 0 {
-		var (
-			period = uint64(100000)
-			quota  = 100 * cpuLimitMillis
-		)
-		specOpts = append(specOpts, oci.WithCPUCFS(quota, period))
-	}
-	if memoryLimit := instance.Resources.Limits.Memory().Value(); memoryLimit > 0 {
-		specOpts = append(specOpts, oci.WithMemoryLimit(uint64(memoryLimit)))
+	// Container.Resources
+	resourcesSpecOpts, err := b.getResourcesOpts(instance)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
 	}
+	specOpts = append(specOpts, resourcesSpecOpts...)
 	// Container.VolumeMounts
-	volumeMountsContainerOpts, volumeMountsSpecOpts, err := b.getVolumeMountsOpts(instance.VolumeMounts)
+	volumeMountsContainerOpts, volumeMountsSpecOpts, err := b.getVolumeMountsOpts(instance)
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
 	containerOpts = append(containerOpts, volumeMountsContainerOpts...)
 	specOpts = append(specOpts, volumeMountsSpecOpts...)
+	// Pod.SecurityContext.FSGroup
+	if err = b.applyVolumeMountsFSGroup(b.context, instance); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	// Container.Resources (devices of extended resources)
+	specOpts = append(specOpts, b.getDevicesOpts(instance)...)
 	// Container.VolumeDevices (TODO)
-	// Container.LivenessProbe (TODO)
+	// Container.LivenessProbe (TODO, also the metrics of the probe results)
 	// Container.ReadinessProbe (TODO)
 	// Container.StartupProbe (TODO)
 	// Container.Lifecycle (TODO)
 	// Container.TerminationMessagePath (TODO)
-	// Container.SecurityContext(TODO)
-	// Container.Stdin (TODO)
-	// Container.StdinOnce (TODO)
-	// Container.TTY (TODO)
-
-	// Pod.HostNetwork
-	if !instance.HostNetwork {
-		// TODO: Network access inside the container fails without this, but we do not always want host networking
-		hostNetworkSpecOpts := []oci.SpecOpts{
-			oci.WithHostNamespace(specs.NetworkNamespace),
-			oci.WithHostHostsFile,
-			oci.WithHostResolvconf,
-		}
-		specOpts = append(specOpts, hostNetworkSpecOpts...)
-	} else {
-		hostNetworkSpecOpts := []oci.SpecOpts{
-			oci.WithHostNamespace(specs.NetworkNamespace),
-			oci.WithHostHostsFile,
-			oci.WithHostResolvconf,
-		}
-		specOpts = append(specOpts, hostNetworkSpecOpts...)
+	// Container.Stdin and Container.StdinOnce (see container IO)
+	// Container.TTY
+	if instance.TTY {
+		specOpts = append(specOpts, oci.WithTTY)
+	}
+
+	// Pod.HostNetwork, Pod.HostIPC, Pod.HostPID and Pod.ShareProcessNamespace
+	sandboxSpecOpts, err := b.getSandboxOpts(instance)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
 	}
+	specOpts = append(specOpts, sandboxSpecOpts...)
 
 	// Add ImageConfig
 	if len(imageArgs) == 0 {
@@ -249,6 +340,13 @@ func (b *ContainerdBackend) CreateInstance(instance *Instance) error {
 		specOpts = append(specOpts, oci.WithImageConfigArgs(image, imageArgs))
 	}
 
+	// Container.SecurityContext (after the image config, which sets the user of the image)
+	securitySpecOpts, err := b.getSecurityContextOpts(instance, image)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	specOpts = append(specOpts, securitySpecOpts...)
+
 	// Create container
 	containerOpts = append(containerOpts, containerd.WithNewSpec(specOpts...))
 	container, err := b.client.NewContainer(
@@ -259,43 +357,130 @@ func (b *ContainerdBackend) CreateInstance(instance *Instance) error {
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
+	// A container without a task can not be started, it is deleted again so that the next attempt can create it
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := container.Delete(b.context, containerd.WithSnapshotCleanup); err != nil {
+			log.G(b.context).Warnf("containerd: failed to delete container of instance %q: %s", instance.ID, err)
+		}
+	}()
 
-	// Create logsFile
-	r, w, _ := os.Pipe()
+	// Create logs
 	if err = os.MkdirAll(b.instanceDir(instance), 0775); err != nil {
 		return errors.Wrap(err, "containerd")
 	}
-	logsFile, err := os.Create(b.instanceLogsPath(instance))
+	logs, err := NewContainerLogWriter(b.instanceLogsPath(instance), b.config.Logs.MaxSize.Value(), b.config.Logs.MaxFiles)
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
-	// Write everything to a log file continuously
-	go func() { _, _ = io.Copy(logsFile, r) }()
+	// Write everything to the logs and attached clients continuously
+	instanceIO, stdin, err := NewInstanceIO(instance, logs)
+	if err != nil {
+		logs.Close()
+		return errors.Wrap(err, "containerd")
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		instanceIO.Close()
+		if stdin != nil {
+			stdin.Close()
+		}
+		logs.Close()
+	}()
 
-	// Create container IO
-	cioOpts := []cio.Opt{cio.WithStreams(os.Stdin, w, w)}
+	// Create container IO (Container.Stdin, Container.StdinOnce and Container.TTY)
+	var stdinReader io.Reader // A nil *os.File is not a nil io.Reader
+	if stdin != nil {
+		stdinReader = stdin
+	}
+	cioOpts := []cio.Opt{cio.WithStreams(stdinReader, instanceIO.Stdout(), instanceIO.Stderr())}
 	if instance.TTY {
 		cioOpts = append(cioOpts, cio.WithTerminal)
 	}
+	cioOpts = append(cioOpts, cio.WithFIFODir(b.instanceDir(instance)))
 	ioCreator := cio.NewCreator(cioOpts...)
 	// Create new task
 	containerTask, err := container.NewTask(
 		b.context,
 		ioCreator,
+		taskOpts...,
 	)
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
+	// Deleting the task also closes its FIFOs
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, err := containerTask.Delete(b.context, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			log.G(b.context).Warnf("containerd: failed to delete task of instance %q: %s", instance.ID, err)
+		}
+	}()
+	instanceIO.SetResize(func(size api.TermSize) error {
+		return containerTask.Resize(b.context, uint32(size.Width), uint32(size.Height))
+	})
 
 	// Wait for task to be created
-	_, err = containerTask.Wait(b.context)
+	exitStatusC, err := containerTask.Wait(b.context)
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
+	b.mu.Lock()
+	b.instanceIOs[instance.ID] = instanceIO
+	b.mu.Unlock()
+	// Detach clients once the task has exited and its output is flushed
+	go func() {
+		<-exitStatusC
+		containerTask.IO().Wait()
+		instanceIO.Close()
+		if stdin != nil {
+			stdin.Close()
+		}
+		logs.Close()
+	}()
 
 	return nil
 }
 
+// reconcileCPUs updates the cpusets of the running instances when exclusive CPUs are allocated or released, and
+// periodically, like the reconcile loop of the CPU manager of the kubelet
+// Instances that share CPUs would otherwise keep running on the CPUs that were given away, or never get the CPUs that
+// were released.
+func (b *ContainerdBackend) reconcileCPUs() {
+	ticker := time.NewTicker(b.config.Resources.CPUReconcilePeriod.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.context.Done():
+			return
+		case <-ticker.C:
+		case <-b.cpus.changed:
+		}
+		containers, err := b.client.Containers(b.context)
+		if err != nil {
+			log.G(b.context).Warnf("containerd: failed to list containers to update their cpusets: %s", err)
+			continue
+		}
+		for _, container := range containers {
+			task, err := container.Task(b.context, nil)
+			if err != nil {
+				// The instance has exited, it gets the current cpuset when it is created again
+				continue
+			}
+			cpus := formatCPUSet(b.cpus.cpus(container.ID()))
+			err = task.Update(b.context, containerd.WithResources(&specs.LinuxResources{CPU: &specs.LinuxCPU{Cpus: cpus}}))
+			if err != nil && !errdefs.IsNotFound(err) {
+				log.G(b.context).Warnf("containerd: failed to update the cpuset of instance %q to %q: %s", container.ID(), cpus, err)
+			}
+		}
+	}
+}
+
 func (b *ContainerdBackend) StartInstance(instance *Instance) error {
 	// Load existing container
 	container, err := b.client.LoadContainer(b.context, instance.ID)
@@ -347,10 +532,48 @@ func (b *ContainerdBackend) KillInstance(instance *Instance, signal syscall.Sign
 	return nil
 }
 
+// PauseInstance freezes the cgroup of the task of an instance
+func (b *ContainerdBackend) PauseInstance(ctx context.Context, instance *Instance) error {
+	ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+	task, err := b.loadTask(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if err = task.Pause(ctx); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	return nil
+}
+
+// ResumeInstance thaws the cgroup of the task of an instance
+func (b *ContainerdBackend) ResumeInstance(ctx context.Context, instance *Instance) error {
+	ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+	task, err := b.loadTask(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if err = task.Resume(ctx); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	return nil
+}
+
+func (b *ContainerdBackend) loadTask(ctx context.Context, instance *Instance) (containerd.Task, error) {
+	container, err := b.client.LoadContainer(ctx, instance.ID)
+	if err != nil {
+		return nil, err
+	}
+	return container.Task(ctx, nil)
+}
+
 func (b *ContainerdBackend) DeleteInstance(instance *Instance) error {
 	// Load existing container
 	container, err := b.client.LoadContainer(b.context, instance.ID)
 	if errdefs.IsNotFound(err) {
+		// The instance may have failed before its container was created, but after it got exclusive CPUs
+		if b.cpus != nil {
+			b.cpus.release(instance.ID)
+		}
 		return nil
 	}
 	if err != nil {
@@ -367,6 +590,13 @@ func (b *ContainerdBackend) DeleteInstance(instance *Instance) error {
 			return err
 		}
 
+		// Frozen processes can not be killed
+		if status, err := task.Status(b.context); err == nil && (status.Status == containerd.Paused || status.Status == containerd.Pausing) {
+			if err = task.Resume(b.context); err != nil {
+				log.G(b.context).Warnf("failed to resume instance %q: %s", instance.ID, err)
+			}
+		}
+
 		// Delete task
 		tDeleteOpts := []containerd.ProcessDeleteOpts{containerd.WithProcessKill}
 		if _, err = task.Delete(b.context, tDeleteOpts...); err != nil {
@@ -378,24 +608,41 @@ func (b *ContainerdBackend) DeleteInstance(instance *Instance) error {
 		return errors.Wrap(err, "containerd")
 	}
 
+	// Detach clients
+	b.mu.Lock()
+	if instanceIO, ok := b.instanceIOs[instance.ID]; ok {
+		instanceIO.Close()
+		delete(b.instanceIOs, instance.ID)
+	}
+	b.mu.Unlock()
+
 	// Delete container
 	cDeleteOpts := []containerd.DeleteOpts{containerd.WithSnapshotCleanup}
 	if err = container.Delete(b.context, cDeleteOpts...); err != nil {
 		return errors.Wrap(err, "containerd")
 	}
+	if b.cpus != nil {
+		b.cpus.release(instance.ID)
+	}
 
 	return nil
 }
 
 func (b *ContainerdBackend) GetInstanceLogs(instance *Instance, opts api.ContainerLogOpts) (io.ReadCloser, error) {
-	containerLogger, err := NewContainerLogger(b.instanceLogsPath(instance), opts)
+	var exited <-chan struct{}
+	b.mu.Lock()
+	if instanceIO, ok := b.instanceIOs[instance.ID]; ok {
+		exited = instanceIO.Done()
+	}
+	b.mu.Unlock()
+	containerLogger, err := NewContainerLogger(b.instanceLogsPath(instance), opts, exited)
 	if err != nil {
 		return nil, errors.Wrap(err, "containerd")
 	}
 	return containerLogger, nil
 }
 
-func (b *ContainerdBackend) RunInInstance(instance *Instance, cmd []string, attach api.AttachIO) error {
+func (b *ContainerdBackend) RunInInstance(ctx context.Context, instance *Instance, cmd []string, attach api.AttachIO) error {
 	// Load existing container
 	container, err := b.client.LoadContainer(b.context, instance.ID)
 	if err != nil {
@@ -411,11 +658,14 @@ func (b *ContainerdBackend) RunInInstance(instance *Instance, cmd []string, atta
 	// Generate process ID
 	execID := fmt.Sprintf("exec-%s", uuid.New().String())
 
-	// Create process
-	pSpec := specs.Process{
-		Terminal: attach.TTY(),
-		Args:     cmd,
+	// Create process (with the environment, user and working directory of the container)
+	spec, err := container.Spec(b.context)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
 	}
+	pSpec := *spec.Process
+	pSpec.Terminal = attach.TTY()
+	pSpec.Args = cmd
 
 	// Create container IO
 	cioOpts := []cio.Opt{cio.WithStreams(attach.Stdin(), attach.Stdout(), attach.Stderr())}
@@ -440,63 +690,921 @@ func (b *ContainerdBackend) RunInInstance(instance *Instance, cmd []string, atta
 		return errors.Wrap(err, "containerd")
 	}
 
-	// Get status code
-	status := <-statusC
+	// Forward terminal size changes
+	done := make(chan struct{})
+	defer close(done)
+	if attach.Resize() != nil {
+		go func() {
+			for {
+				select {
+				case size := <-attach.Resize():
+					if err := process.Resize(b.context, uint32(size.Width), uint32(size.Height)); err != nil {
+						log.G(b.context).Warnf("failed to resize terminal of %q: %s", execID, err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// Wait for the process to exit, or kill it when the client is gone
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-ctx.Done():
+		if err = process.Kill(b.context, syscall.SIGKILL); err != nil {
+			log.G(b.context).Warnf("failed to kill %q: %s", execID, err)
+		}
+		<-statusC
+		return ctx.Err()
+	}
+	// Make sure all output is copied
+	process.IO().Wait()
+
+	// Get status code, which is reported to the client as is
 	code, _, err := status.Result()
 	if err != nil {
 		return errors.Wrap(err, "containerd")
 	}
 	if code != 0 {
-		err = fmt.Errorf("exec failed with exit code %d", code)
-		return errors.Wrap(err, "containerd")
+		return utilexec.CodeExitError{Err: errors.Errorf("command %q exited with %d", cmd, code), Code: int(code)}
 	}
 
 	return nil
 }
 
-func (b *ContainerdBackend) getPortsOpts(containerPorts []corev1.ContainerPort) ([]containerd.NewContainerOpts, error) {
-	// TODO:  ad-hoc; check nerdctl/cmd/nerdctl/container_run_network.go
-	var ports []gocni.PortMapping
-	for _, cp := range containerPorts {
-		// TODO: Just expose a port for now, do nothing special
-		port := gocni.PortMapping{
-			HostPort:      cp.HostPort,
-			ContainerPort: cp.ContainerPort,
-			Protocol:      string(cp.Protocol),
-			HostIP:        cp.HostIP,
+func (b *ContainerdBackend) AttachToInstance(ctx context.Context, instance *Instance, attach api.AttachIO) error {
+	b.mu.Lock()
+	instanceIO, ok := b.instanceIOs[instance.ID]
+	b.mu.Unlock()
+	if !ok {
+		err := errors.Errorf("instance %q is not running", instance.ID)
+		return errors.Wrap(err, "containerd")
+	}
+	if err := instanceIO.Attach(ctx, attach); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	return nil
+}
+
+func (b *ContainerdBackend) PortForwardInstance(ctx context.Context, instance *Instance, port int32, stream io.ReadWriteCloser) error {
+	// Dial in the network namespace of the pod, the socket stays in it once the thread leaves
+	// Only IPv4 loopback is dialed so that the dialer does not race addresses in other goroutines
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	dial := func() (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp4", address)
+	}
+	var conn net.Conn
+	var err error
+	if b.rootless != nil {
+		// Rootless pods share the network namespace of RootlessKit
+		var remove func()
+		if conn, remove, err = b.rootless.dialPort(ctx, port); err == nil {
+			defer remove()
 		}
-		ports = append(ports, port)
+	} else if instance.Sandbox != nil && instance.Sandbox.Network != nil {
+		err = instance.Sandbox.Network.netns.Do(func(cnins.NetNS) error {
+			conn, err = dial()
+			return err
+		})
+	} else {
+		// Host network
+		conn, err = dial()
+	}
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if err = forwardStream(ctx, conn, stream); err != nil {
+		return errors.Wrap(err, "containerd")
 	}
+	return nil
+}
 
-	portsJson, err := json.Marshal(ports)
+func (b *ContainerdBackend) GetInstanceStorageUsage(instance *Instance) (InstanceStorageUsage, error) {
+	// The writable layer of the container is its active snapshot
+	snapshotUsage, err := b.client.SnapshotService(b.config.Containerd.Snapshotter).Usage(b.context, instance.ID)
 	if err != nil {
-		return nil, errors.Wrap(err, "containerd")
+		return InstanceStorageUsage{}, errors.Wrap(err, "containerd")
 	}
-	portsLabels := map[string]string{labels.Ports: string(portsJson)}
-	return []containerd.NewContainerOpts{containerd.WithAdditionalContainerLabels(portsLabels)}, nil
+	logsUsage, err := storage.PathUsage(b.instanceDir(instance))
+	if err != nil {
+		return InstanceStorageUsage{}, errors.Wrap(err, "containerd")
+	}
+	return InstanceStorageUsage{
+		Rootfs: storage.Usage{Bytes: uint64(snapshotUsage.Size), Inodes: uint64(snapshotUsage.Inodes)},
+		Logs:   logsUsage,
+	}, nil
 }
 
-func (b *ContainerdBackend) getVolumeMountsOpts(volumeMounts []InstanceVolumeMount) ([]containerd.NewContainerOpts, []oci.SpecOpts, error) {
-	var mounts []specs.Mount
-	for _, vm := range volumeMounts {
-		v := vm.Volume
-		switch {
-		case v.HostPath != nil:
-			switch *v.HostPath.Type {
-			case corev1.HostPathDirectoryOrCreate:
-				if err := os.MkdirAll(v.HostPath.Path, 0755); err != nil {
-					return nil, nil, err
-				}
-				fallthrough
-			case "":
-				fallthrough
-			case corev1.HostPathDirectory:
-			default:
-				return nil, nil, errors.Errorf("volumeMount %q has unsupported hostPath.type %q", v.ID, *v.HostPath.Type)
+func (b *ContainerdBackend) GetInstanceStats(instance *Instance) (InstanceStats, error) {
+	container, err := b.client.LoadContainer(b.context, instance.ID)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	info, err := container.Info(b.context)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	task, err := container.Task(b.context, nil)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	// The metrics of the cgroup of the task, in the format of the cgroup version of the host
+	metric, err := task.Metrics(b.context)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	data, err := typeurl.UnmarshalAny(metric.Data)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	var stats InstanceStats
+	switch metrics := data.(type) {
+	case *v1stats.Metrics:
+		stats = instanceStatsFromCgroupV1(metrics)
+	case *v2stats.Metrics:
+		stats = instanceStatsFromCgroupV2(metrics)
+	default:
+		err = errors.Errorf("unknown metrics type %q", metric.Data.GetTypeUrl())
+		return InstanceStats{}, errors.Wrap(err, "containerd")
+	}
+	stats.StartTime = info.CreatedAt
+	return stats, nil
+}
+
+func (b *ContainerdBackend) CreateSandbox(sandbox *Sandbox) error {
+	// Clean up pre-existing sandbox
+	if err := b.DeleteSandbox(sandbox); err != nil {
+		log.G(b.context).Error(err)
+	}
+
+	// The infra task only has to keep the namespaces alive
+	image, _, err := b.getImage(b.context, b.config.Sandbox.PauseImage, corev1.PullIfNotPresent, nil)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(image)}
+	if sandbox.HostNetwork {
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostNamespace(specs.UTSNamespace))
+	} else {
+		specOpts = append(specOpts, oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: sandbox.Network.Path()}), oci.WithHostname(sandbox.Hostname))
+	}
+	if sandbox.HostIPC {
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.IPCNamespace))
+	}
+	if sandbox.HostPID {
+		specOpts = append(specOpts, oci.WithHostNamespace(specs.PIDNamespace))
+	}
+	if len(sandbox.Sysctls) > 0 {
+		specOpts = append(specOpts, withSysctls(sandbox.Sysctls))
+	}
+	if sandbox.CgroupParent != "" {
+		specOpts = append(specOpts, oci.WithCgroup(b.cgroupsPath(sandbox.CgroupParent, sandbox.ID)))
+	}
+	specOpts = append(specOpts, withOOMScoreAdj(sandboxOOMScoreAdj))
+
+	// Create container (in the runtime of the pod)
+	runtimeOpts, err := b.getRuntimeOpts(sandbox.RuntimeClassName)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	containerOpts := []containerd.NewContainerOpts{
+		containerd.WithImage(image),
+		containerd.WithSnapshotter(b.config.Containerd.Snapshotter),
+		containerd.WithNewSnapshot(sandbox.ID, image),
+		containerd.WithNewSpec(specOpts...),
+	}
+	containerOpts = append(containerOpts, runtimeOpts...)
+	container, err := b.client.NewContainer(b.context, sandbox.ID, containerOpts...)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+
+	// Create and start task
+	task, err := container.NewTask(b.context, cio.NullIO)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if err = task.Start(b.context); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+
+	// Instances join the namespaces through the infra task
+	nsPath := func(ns string) string {
+		return fmt.Sprintf("/proc/%d/ns/%s", task.Pid(), ns)
+	}
+	sandbox.Namespaces = map[specs.LinuxNamespaceType]string{}
+	if !sandbox.HostNetwork {
+		sandbox.Namespaces[specs.NetworkNamespace] = sandbox.Network.Path()
+		sandbox.Namespaces[specs.UTSNamespace] = nsPath("uts")
+	}
+	if !sandbox.HostIPC {
+		sandbox.Namespaces[specs.IPCNamespace] = nsPath("ipc")
+	}
+	if !sandbox.HostPID && sandbox.ShareProcessNamespace {
+		sandbox.Namespaces[specs.PIDNamespace] = nsPath("pid")
+	}
+
+	return nil
+}
+
+func (b *ContainerdBackend) DeleteSandbox(sandbox *Sandbox) error {
+	b.unmountMemoryVolumes(sandbox)
+	// The infra task is an ordinary container
+	return b.DeleteInstance(&Instance{ID: sandbox.ID})
+}
+
+// getRuntimeOpts selects the runtime of the runtime class of a pod, pods without a runtime class use the default one
+// With the systemd cgroup driver runc creates the cgroups of instances as scopes.
+func (b *ContainerdBackend) getRuntimeOpts(runtimeClassName string) ([]containerd.NewContainerOpts, error) {
+	runtime := b.config.Containerd.DefaultRuntime
+	if runtimeClassName != "" {
+		var ok bool
+		if runtime, ok = b.config.Containerd.RuntimeHandlers[runtimeClassName]; !ok {
+			return nil, errors.Errorf("no runtime handler is configured for runtime class %q", runtimeClassName)
+		}
+	}
+	var options interface{}
+	if b.config.Resources.CgroupDriver == CgroupDriverSystemd && strings.HasPrefix(runtime, "io.containerd.runc.") {
+		options = &runcoptions.Options{SystemdCgroup: true}
+	}
+	if runtimeClassName == "" && options == nil {
+		return nil, nil
+	}
+	return []containerd.NewContainerOpts{containerd.WithRuntime(runtime, options)}, nil
+}
+
+// cgroupsPath returns the cgroup of an instance in the cgroup of its pod, with the systemd cgroup driver in the
+// slice:prefix:name format of runc
+func (b *ContainerdBackend) cgroupsPath(parent, id string) string {
+	if b.config.Resources.CgroupDriver == CgroupDriverSystemd {
+		return filepath.Base(parent) + ":" + systemdScopePrefix + ":" + id
+	}
+	return filepath.Join(parent, id)
+}
+
+// getImage returns the image of a reference, pulling it if the pull policy requires so, and reports whether it was pulled
+func (b *ContainerdBackend) getImage(ctx context.Context, ref string, pullPolicy corev1.PullPolicy, keyring *credentials.Keyring) (containerd.Image, bool, error) {
+	image, err := b.client.GetImage(ctx, ref)
+	if (err != nil && pullPolicy == corev1.PullIfNotPresent) || pullPolicy == corev1.PullAlways {
+		named, err := refdocker.ParseDockerRef(ref)
+		if err != nil {
+			return nil, false, err
+		}
+		// Pulls of the same image are shared, interrupted downloads are resumed from the content store
+		err = b.puller.Pull(ctx, BackendContainerd, joinIdentifierFromParts(BackendContainerd, named.String()), func(ctx context.Context, progress *puller.Progress) error {
+			ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+			// Try the matching credentials of the pull secrets one by one, and finally the docker config of the host
+			resolvers, err := newResolvers(ctx, named, keyring)
+			if err != nil {
+				return err
 			}
-			options := []string{"bind"}
-			if vm.ReadOnly {
-				options = append(options, "ro")
+			var pullErr error
+			for _, resolver := range resolvers {
+				pullOpts := []containerd.RemoteOpt{containerd.WithResolver(b.puller.Resolver(resolver, progress)), containerd.WithPullUnpack, containerd.WithPullSnapshotter(b.config.Containerd.Snapshotter), containerd.WithSchema1Conversion}
+				if _, pullErr = b.client.Pull(ctx, named.String(), pullOpts...); pullErr == nil {
+					return nil
+				}
+			}
+			return pullErr
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		image, err = b.client.GetImage(ctx, named.String())
+		return image, err == nil, err
+	}
+	return image, false, err
+}
+
+// CheckpointInstance checkpoints the task and the root filesystem of a running instance and exports the checkpoint as
+// an image with a checkpoint config, which is pushed to a registry or written to an archive
+func (b *ContainerdBackend) CheckpointInstance(ctx context.Context, instance *Instance, location string) error {
+	ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+	ctx, done, err := b.client.WithLease(ctx)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	defer done(ctx)
+
+	container, err := b.client.LoadContainer(ctx, instance.ID)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	// The task keeps running, the local checkpoint image is only needed until it is exported
+	ref := "checkpoint-" + uuid.NewString()
+	checkpoint, err := container.Checkpoint(ctx, ref, containerd.WithCheckpointTask, containerd.WithCheckpointRuntime, containerd.WithCheckpointRW)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	defer func() {
+		if err := b.client.ImageService().Delete(ctx, ref); err != nil {
+			log.G(ctx).Warnf("failed to delete checkpoint image %q: %s", ref, err)
+		}
+	}()
+
+	config := checkpointConfig{
+		Image:    instance.Image,
+		Instance: instance.ID,
+		Created:  time.Now().UTC(),
+	}
+	manifestDesc, err := writeCheckpointManifest(ctx, b.client.ContentStore(), checkpoint.Target(), config)
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if filepath.IsAbs(location) {
+		err = exportCheckpoint(ctx, b.client.ContentStore(), manifestDesc, location)
+	} else {
+		err = b.pushCheckpoint(ctx, manifestDesc, location)
+	}
+	return errors.Wrap(err, "containerd")
+}
+
+// writeCheckpointManifest converts the index of a checkpoint of containerd into an image manifest, which registries
+// accept, with the blobs of the checkpoint as layers
+func writeCheckpointManifest(ctx context.Context, store content.Store, indexDesc ocispec.Descriptor, config checkpointConfig) (ocispec.Descriptor, error) {
+	data, err := content.ReadBlob(ctx, store, indexDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var index ocispec.Index
+	if err = json.Unmarshal(data, &index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	configDesc, err := writeJSONBlob(ctx, store, mediaTypeCheckpointConfig, config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	manifest := ocispec.Manifest{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      configDesc,
+		Layers:      index.Manifests,
+		Annotations: index.Annotations,
+	}
+	manifest.SchemaVersion = 2
+	return writeJSONBlob(ctx, store, manifest.MediaType, manifest)
+}
+
+// exportCheckpoint writes the image of a checkpoint to an archive, which is replaced atomically
+// The image is not named, paths are no image references and the archive is restored under the path it is read from.
+func exportCheckpoint(ctx context.Context, store content.Provider, manifestDesc ocispec.Descriptor, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	err = archive.Export(ctx, store, f, archive.WithManifest(manifestDesc))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// pushCheckpoint pushes the image of a checkpoint to a registry with the docker config of the host
+func (b *ContainerdBackend) pushCheckpoint(ctx context.Context, manifestDesc ocispec.Descriptor, ref string) error {
+	named, err := refdocker.ParseDockerRef(ref)
+	if err != nil {
+		return err
+	}
+	resolvers, err := newResolvers(ctx, named, nil)
+	if err != nil {
+		return err
+	}
+	var pushErr error
+	for _, resolver := range resolvers {
+		if pushErr = b.client.Push(ctx, named.String(), manifestDesc, containerd.WithResolver(resolver)); pushErr == nil {
+			return nil
+		}
+	}
+	return pushErr
+}
+
+// getCheckpoint imports the checkpoint at a location (the absolute path of an archive) or pulls it from a registry,
+// unless it is present already
+func (b *ContainerdBackend) getCheckpoint(ctx context.Context, location string, keyring *credentials.Keyring) error {
+	if _, err := b.client.ImageService().Get(ctx, location); err == nil {
+		// Checkpoints are never overwritten, their locations contain the time of the checkpoint
+		return nil
+	}
+	if filepath.IsAbs(location) {
+		// The provider only restores archives in the checkpoint directory, but the archive is read as root
+		dir, err := b.config.Checkpoint.directory()
+		if err != nil {
+			return err
+		}
+		if !inDirectory(dir, location) {
+			return errors.Errorf("checkpoint %q is not in the checkpoint directory %q", location, dir)
+		}
+		ctx, done, err := b.client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+		manifestDesc, err := importCheckpoint(ctx, b.client.ContentStore(), location)
+		if err != nil {
+			return err
+		}
+		// The image is named after the location, not after the names in the archive, which could replace other images
+		_, err = b.client.ImageService().Create(ctx, images.Image{Name: location, Target: manifestDesc})
+		if err != nil && !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		return nil
+	}
+	named, err := refdocker.ParseDockerRef(location)
+	if err != nil {
+		return err
+	}
+	return b.puller.Pull(ctx, BackendContainerd, joinIdentifierFromParts(BackendContainerd, named.String()), func(ctx context.Context, progress *puller.Progress) error {
+		ctx = namespaces.WithNamespace(ctx, b.config.Containerd.Namespace)
+		resolvers, err := newResolvers(ctx, named, keyring)
+		if err != nil {
+			return err
+		}
+		var fetchErr error
+		for _, resolver := range resolvers {
+			// Fetch without unpacking, the layers of a checkpoint are no filesystem layers
+			if _, fetchErr = b.client.Fetch(ctx, named.String(), containerd.WithResolver(b.puller.Resolver(resolver, progress))); fetchErr == nil {
+				return nil
+			}
+		}
+		return fetchErr
+	})
+}
+
+// loadCheckpoint converts the image of a checkpoint back into the index of a checkpoint of containerd
+// The index is only referenced by the lease of the context.
+func (b *ContainerdBackend) loadCheckpoint(ctx context.Context, location string) (containerd.Image, *ocispec.Index, error) {
+	img, err := b.client.ImageService().Get(ctx, location)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexDesc, index, err := writeCheckpointIndex(ctx, b.client.ContentStore(), img.Target)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "image %q", location)
+	}
+	return containerd.NewImage(b.client, images.Image{Name: location, Target: indexDesc}), index, nil
+}
+
+// writeCheckpointIndex converts the manifest of a checkpoint image into the index of a checkpoint of containerd
+func writeCheckpointIndex(ctx context.Context, store content.Store, manifestDesc ocispec.Descriptor) (ocispec.Descriptor, *ocispec.Index, error) {
+	data, err := content.ReadBlob(ctx, store, manifestDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	var manifest ocispec.Manifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	if manifest.Config.MediaType != mediaTypeCheckpointConfig {
+		return ocispec.Descriptor{}, nil, errors.New("not a checkpoint")
+	}
+
+	index := &ocispec.Index{
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   manifest.Layers,
+		Annotations: manifest.Annotations,
+	}
+	index.SchemaVersion = 2
+	indexDesc, err := writeJSONBlob(ctx, store, index.MediaType, index)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	return indexDesc, index, nil
+}
+
+// importCheckpoint writes the content of the checkpoint in an archive to the content store and returns the descriptor
+// of its manifest
+// Unlike Client.Import it creates no images, the archive only names the location it was exported to and could name
+// any other image.
+func importCheckpoint(ctx context.Context, store content.Store, path string) (ocispec.Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer f.Close()
+	indexDesc, err := archive.ImportIndex(ctx, store, f)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	data, err := content.ReadBlob(ctx, store, indexDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var index ocispec.Index
+	if err = json.Unmarshal(data, &index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].MediaType != ocispec.MediaTypeImageManifest {
+		return ocispec.Descriptor{}, errors.Errorf("archive %q does not contain one checkpoint", path)
+	}
+	manifestDesc := index.Manifests[0]
+	manifestDesc.Annotations = nil
+	// The blobs of the checkpoint are referenced by its manifest once the lease of the import is done
+	if err = images.Walk(ctx, images.SetChildrenLabels(store, images.ChildrenHandler(store)), manifestDesc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return manifestDesc, nil
+}
+
+// writeJSONBlob writes a JSON document to the content store and returns its descriptor
+func writeJSONBlob(ctx context.Context, store content.Store, mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err = content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (b *ContainerdBackend) getSandboxOpts(instance *Instance) ([]oci.SpecOpts, error) {
+	sandbox := instance.Sandbox
+	if sandbox == nil {
+		return nil, errors.Errorf("instance %q has no sandbox", instance.ID)
+	}
+	var specOpts []oci.SpecOpts
+	// Namespaces of the host or the sandbox, the others are private to the instance
+	hostNamespaces := map[specs.LinuxNamespaceType]bool{
+		specs.NetworkNamespace: sandbox.HostNetwork,
+		specs.UTSNamespace:     sandbox.HostNetwork,
+		specs.IPCNamespace:     sandbox.HostIPC,
+		specs.PIDNamespace:     sandbox.HostPID,
+	}
+	for ns, host := range hostNamespaces {
+		if host {
+			specOpts = append(specOpts, oci.WithHostNamespace(ns))
+		} else if path, ok := sandbox.Namespaces[ns]; ok {
+			specOpts = append(specOpts, oci.WithLinuxNamespace(specs.LinuxNamespace{Type: ns, Path: path}))
+		}
+	}
+	// Files that describe the network (TODO: cluster DNS)
+	if sandbox.HostNetwork {
+		specOpts = append(specOpts, oci.WithHostHostsFile, oci.WithHostResolvconf)
+	} else {
+		hostsPath, err := sandbox.HostsPath()
+		if err != nil {
+			return nil, err
+		}
+		hostsMount := specs.Mount{
+			Type:        "bind",
+			Source:      hostsPath,
+			Destination: "/etc/hosts",
+			Options:     []string{"rbind", "rw"},
+		}
+		specOpts = append(specOpts, oci.WithMounts([]specs.Mount{hostsMount}), oci.WithHostResolvconf)
+	}
+	return specOpts, nil
+}
+
+func (b *ContainerdBackend) getResourcesOpts(instance *Instance) ([]oci.SpecOpts, error) {
+	resources := instance.Resources
+	var specOpts []oci.SpecOpts
+	// Requests.CPU is the share of CPU time under contention, instances without a request get the minimum
+	shares := milliCPUToShares(resources.Requests.Cpu().MilliValue())
+	if b.cgroupV2 {
+		specOpts = append(specOpts, withUnified("cpu.weight", strconv.FormatUint(sharesToWeight(shares), 10)))
+	} else {
+		specOpts = append(specOpts, oci.WithCPUShares(shares))
+	}
+	// Limits.CPU
+	if cpuLimitMillis := resources.Limits.Cpu().MilliValue(); cpuLimitMillis > 0 {
+		var (
+			period = uint64(100000)
+			quota  = 100 * cpuLimitMillis
+		)
+		specOpts = append(specOpts, oci.WithCPUCFS(quota, period))
+	}
+	// Exclusive CPUs for Guaranteed pods with integer CPU requests (static CPU manager policy)
+	if b.cpus != nil {
+		cpus := b.cpus.shared()
+		if cpuMillis := resources.Requests.Cpu().MilliValue(); instance.QOSClass == corev1.PodQOSGuaranteed && cpuMillis > 0 && cpuMillis%1000 == 0 {
+			var err error
+			if cpus, err = b.cpus.allocate(instance.ID, int(cpuMillis/1000)); err != nil {
+				return nil, err
+			}
+		}
+		specOpts = append(specOpts, oci.WithCPUs(formatCPUSet(cpus)))
+	}
+	// Limits.Memory
+	memoryLimit := resources.Limits.Memory().Value()
+	if memoryLimit > 0 {
+		specOpts = append(specOpts, oci.WithMemoryLimit(uint64(memoryLimit)))
+	}
+	// Requests.Memory is protected from reclaim, fully for Guaranteed pods (memory.min) and on a best effort basis
+	// for Burstable pods (memory.low). cgroup v1 has no protection, the soft limit is the closest.
+	memoryRequest := resources.Requests.Memory().Value()
+	if memoryRequest > 0 && instance.QOSClass != corev1.PodQOSBestEffort {
+		if !b.cgroupV2 {
+			specOpts = append(specOpts, withMemoryReservation(memoryRequest))
+		} else if instance.QOSClass == corev1.PodQOSGuaranteed {
+			specOpts = append(specOpts, withUnified("memory.min", strconv.FormatInt(memoryRequest, 10)))
+		} else {
+			specOpts = append(specOpts, withUnified("memory.low", strconv.FormatInt(memoryRequest, 10)))
+		}
+	}
+	// Swap (cgroup v1 limits memory and swap together, cgroup v2 only swap)
+	switch b.config.Resources.SwapBehavior {
+	case SwapBehaviorUnlimited:
+		if b.cgroupV2 {
+			specOpts = append(specOpts, withUnified("memory.swap.max", "max"))
+		} else {
+			specOpts = append(specOpts, oci.WithMemorySwap(-1))
+		}
+	case SwapBehaviorLimited:
+		swap, err := limitedSwap(instance.QOSClass, memoryRequest, memoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		specOpts = append(specOpts, withUnified("memory.swap.max", strconv.FormatInt(swap, 10)))
+	default:
+		if b.cgroupV2 {
+			specOpts = append(specOpts, withUnified("memory.swap.max", "0"))
+		} else if memoryLimit > 0 {
+			specOpts = append(specOpts, oci.WithMemorySwap(memoryLimit))
+		}
+	}
+	// Limits.hugepages-<size>
+	hugePages, err := hugePageLimits(resources.Limits)
+	if err != nil {
+		return nil, err
+	}
+	if len(hugePages) > 0 {
+		specOpts = append(specOpts, withHugePageLimits(hugePages))
+	}
+	// The cgroup of the pod limits the processes of all its instances, without one every instance gets the limit
+	if instance.CgroupParent != "" {
+		specOpts = append(specOpts, oci.WithCgroup(b.cgroupsPath(instance.CgroupParent, instance.ID)))
+	} else if limit := b.config.Resources.PodPidsLimit; limit > 0 {
+		specOpts = append(specOpts, oci.WithPidsLimit(limit))
+	}
+	// The OOM killer prefers the processes of BestEffort pods, then the ones of Burstable pods
+	specOpts = append(specOpts, withOOMScoreAdj(oomScoreAdj(instance.QOSClass, memoryRequest)))
+	return specOpts, nil
+}
+
+func (b *ContainerdBackend) getSecurityContextOpts(instance *Instance, image containerd.Image) ([]oci.SpecOpts, error) {
+	sc := effectiveSecurityContext(instance.PodSecurityContext, instance.SecurityContext)
+	var specOpts []oci.SpecOpts
+	// RunAsUser and RunAsGroup
+	switch {
+	case sc.RunAsUser != nil && sc.RunAsGroup != nil:
+		specOpts = append(specOpts, oci.WithUIDGID(uint32(*sc.RunAsUser), uint32(*sc.RunAsGroup)))
+	case sc.RunAsUser != nil:
+		specOpts = append(specOpts, oci.WithUserID(uint32(*sc.RunAsUser)))
+	case sc.RunAsGroup != nil:
+		specOpts = append(specOpts, withGID(uint32(*sc.RunAsGroup)))
+	}
+	// RunAsNonRoot
+	imageSpec, err := image.Spec(b.context)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyRunAsNonRoot(sc, imageSpec.Config.User); err != nil {
+		return nil, err
+	}
+	// Pod.SecurityContext.SupplementalGroups and Pod.SecurityContext.FSGroup
+	if gids := supplementalGroups(instance.PodSecurityContext); len(gids) > 0 {
+		specOpts = append(specOpts, withAdditionalGIDs(gids))
+	}
+	// Privileged
+	privileged := sc.Privileged != nil && *sc.Privileged
+	if privileged {
+		privilegedSpecOpts := []oci.SpecOpts{
+			oci.WithPrivileged,
+			oci.WithAllDevicesAllowed,
+			oci.WithHostDevices,
+			oci.WithMaskedPaths(nil),
+			oci.WithReadonlyPaths(nil),
+			oci.WithWriteableSysfs,
+			oci.WithWriteableCgroupfs,
+		}
+		specOpts = append(specOpts, privilegedSpecOpts...)
+	} else {
+		// Capabilities ("ALL" is handled before the individual capabilities)
+		if sc.Capabilities != nil {
+			add, addAll := capabilitiesToOCI(sc.Capabilities.Add)
+			drop, dropAll := capabilitiesToOCI(sc.Capabilities.Drop)
+			if addAll {
+				specOpts = append(specOpts, oci.WithAllCurrentCapabilities)
+			}
+			if dropAll {
+				specOpts = append(specOpts, oci.WithCapabilities(nil))
+			}
+			specOpts = append(specOpts, oci.WithAddedCapabilities(add), oci.WithDroppedCapabilities(drop))
+		}
+		// ProcMount
+		if sc.ProcMount != nil && *sc.ProcMount == corev1.UnmaskedProcMount {
+			specOpts = append(specOpts, oci.WithMaskedPaths(nil), oci.WithReadonlyPaths(nil))
+		}
+	}
+	// ReadOnlyRootFilesystem
+	if sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem {
+		specOpts = append(specOpts, oci.WithRootFSReadonly())
+	}
+	// AllowPrivilegeEscalation
+	if sc.AllowPrivilegeEscalation != nil && !*sc.AllowPrivilegeEscalation {
+		specOpts = append(specOpts, oci.WithNoNewPrivileges)
+	} else {
+		specOpts = append(specOpts, oci.WithNewPrivileges)
+	}
+	// SeccompProfile (after the capabilities, the default profile depends on them)
+	if !privileged {
+		seccompSpecOpts, err := b.getSeccompOpts(sc.SeccompProfile)
+		if err != nil {
+			return nil, err
+		}
+		specOpts = append(specOpts, seccompSpecOpts...)
+	}
+	return specOpts, nil
+}
+
+func (b *ContainerdBackend) getSeccompOpts(profile *corev1.SeccompProfile) ([]oci.SpecOpts, error) {
+	if profile == nil || profile.Type == corev1.SeccompProfileTypeUnconfined {
+		return nil, nil
+	}
+	if !seccompsupport.IsEnabled() {
+		return nil, errors.Errorf("seccomp profile %q is not supported by the kernel of the node", profile.Type)
+	}
+	switch profile.Type {
+	case corev1.SeccompProfileTypeRuntimeDefault:
+		return []oci.SpecOpts{seccomp.WithDefaultProfile()}, nil
+	case corev1.SeccompProfileTypeLocalhost:
+		if profile.LocalhostProfile == nil || *profile.LocalhostProfile == "" {
+			return nil, errors.New("localhost seccomp profile has no path")
+		}
+		root := b.config.Security.SeccompProfileRoot
+		path := filepath.Join(root, *profile.LocalhostProfile)
+		if !strings.HasPrefix(path, filepath.Clean(root)+string(filepath.Separator)) {
+			return nil, errors.Errorf("localhost seccomp profile %q is outside of %q", *profile.LocalhostProfile, root)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, errors.Wrapf(err, "localhost seccomp profile %q cannot be used", *profile.LocalhostProfile)
+		}
+		return []oci.SpecOpts{seccomp.WithProfile(path)}, nil
+	default:
+		return nil, errors.Errorf("seccomp profile %q is not supported", profile.Type)
+	}
+}
+
+func (b *ContainerdBackend) applyVolumeMountsFSGroup(ctx context.Context, instance *Instance) error {
+	if instance.PodSecurityContext == nil || instance.PodSecurityContext.FSGroup == nil {
+		return nil
+	}
+	for _, vm := range instance.VolumeMounts {
+		v := vm.Volume
+		// Only volumes that are managed by the backend
+		if v.EmptyDir == nil && v.Projected == nil {
+			continue
+		}
+		path := b.volumeDir(&v)
+		if v.EmptyDir != nil && v.EmptyDir.Medium == corev1.StorageMediumMemory && instance.Sandbox != nil {
+			path = b.memoryVolumeDir(instance.Sandbox, &v)
+		}
+		// Rootless containers see the groups of the user namespace of RootlessKit
+		var err error
+		if b.rootless != nil {
+			err = b.rootless.applyFSGroup(ctx, path, *instance.PodSecurityContext.FSGroup, instance.PodSecurityContext.FSGroupChangePolicy)
+		} else {
+			err = applyFSGroup(path, *instance.PodSecurityContext.FSGroup, instance.PodSecurityContext.FSGroupChangePolicy)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDevicesOpts creates the devices, mounts, environment variables and annotations that the devices allocated to an
+// instance need
+func (b *ContainerdBackend) getDevicesOpts(instance *Instance) []oci.SpecOpts {
+	allocation := instance.Devices
+	if allocation == nil {
+		return nil
+	}
+	var specOpts []oci.SpecOpts
+	for _, d := range allocation.Devices {
+		specOpts = append(specOpts, withDevice(d))
+	}
+	var mounts []specs.Mount
+	for _, m := range allocation.Mounts {
+		options := []string{"rbind", "rw"}
+		if m.ReadOnly {
+			options[1] = "ro"
+		}
+		mounts = append(mounts, specs.Mount{
+			Type:        "bind",
+			Source:      m.HostPath,
+			Destination: m.ContainerPath,
+			Options:     options,
+		})
+	}
+	if len(mounts) > 0 {
+		specOpts = append(specOpts, oci.WithMounts(mounts))
+	}
+	if len(allocation.Envs) > 0 {
+		var env []string
+		for k, v := range allocation.Envs {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		specOpts = append(specOpts, oci.WithEnv(env))
+	}
+	if len(allocation.Annotations) > 0 {
+		specOpts = append(specOpts, oci.WithAnnotations(allocation.Annotations))
+	}
+	return specOpts
+}
+
+// withDevice creates a device of the host at its path in the container and allows it in the device cgroup
+func withDevice(device devices.Device) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *specs.Spec) error {
+		d, err := oci.DeviceFromPath(device.HostPath)
+		if err != nil {
+			return errors.Wrapf(err, "device %q", device.HostPath)
+		}
+		d.Path = device.ContainerPath
+		permissions := device.Permissions
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		s.Linux.Devices = append(s.Linux.Devices, *d)
+		s.Linux.Resources.Devices = append(s.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   d.Type,
+			Major:  &d.Major,
+			Minor:  &d.Minor,
+			Access: permissions,
+		})
+		return nil
+	}
+}
+
+func (b *ContainerdBackend) getPortsOpts(containerPorts []corev1.ContainerPort) ([]containerd.NewContainerOpts, error) {
+	// TODO:  ad-hoc; check nerdctl/cmd/nerdctl/container_run_network.go
+	var ports []gocni.PortMapping
+	for _, cp := range containerPorts {
+		// TODO: Just expose a port for now, do nothing special
+		port := gocni.PortMapping{
+			HostPort:      cp.HostPort,
+			ContainerPort: cp.ContainerPort,
+			Protocol:      string(cp.Protocol),
+			HostIP:        cp.HostIP,
+		}
+		ports = append(ports, port)
+	}
+
+	portsJson, err := json.Marshal(ports)
+	if err != nil {
+		return nil, errors.Wrap(err, "containerd")
+	}
+	portsLabels := map[string]string{labels.Ports: string(portsJson)}
+	return []containerd.NewContainerOpts{containerd.WithAdditionalContainerLabels(portsLabels)}, nil
+}
+
+func (b *ContainerdBackend) getVolumeMountsOpts(instance *Instance) ([]containerd.NewContainerOpts, []oci.SpecOpts, error) {
+	var mounts []specs.Mount
+	for _, vm := range instance.VolumeMounts {
+		v := vm.Volume
+		switch {
+		case v.HostPath != nil:
+			switch *v.HostPath.Type {
+			case corev1.HostPathDirectoryOrCreate:
+				if err := os.MkdirAll(v.HostPath.Path, 0755); err != nil {
+					return nil, nil, err
+				}
+				fallthrough
+			case "":
+				fallthrough
+			case corev1.HostPathDirectory:
+			default:
+				return nil, nil, errors.Errorf("volumeMount %q has unsupported hostPath.type %q", v.ID, *v.HostPath.Type)
+			}
+			options := []string{"bind"}
+			if vm.ReadOnly {
+				options = append(options, "ro")
 			}
 			mount := specs.Mount{
 				Type:        "bind",
@@ -505,7 +1613,37 @@ func (b *ContainerdBackend) getVolumeMountsOpts(volumeMounts []InstanceVolumeMou
 				Options:     options,
 			}
 			mounts = append(mounts, mount)
-		case v.EmptyDir != nil: // TODO (ignored)
+		case v.EmptyDir != nil:
+			var path string
+			if v.EmptyDir.Medium == corev1.StorageMediumMemory {
+				// The tmpfs is shared by all containers of the pod, so it is mounted in its sandbox
+				if instance.Sandbox == nil {
+					return nil, nil, errors.Errorf("volumeMount %q needs the sandbox of the pod", v.ID)
+				}
+				path = b.memoryVolumeDir(instance.Sandbox, &v)
+				if err := b.mountMemoryVolume(b.context, path, &v); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				// Directory lives as long as the pod and is accounted as its ephemeral storage
+				path = b.volumeDir(&v)
+				if err := os.MkdirAll(path, 0777); err != nil {
+					return nil, nil, err
+				}
+			}
+			options := []string{"rbind"}
+			if vm.ReadOnly {
+				options = append(options, "ro")
+			} else {
+				options = append(options, "rw")
+			}
+			mount := specs.Mount{
+				Type:        "bind",
+				Source:      path,
+				Destination: vm.MountPath,
+				Options:     options,
+			}
+			mounts = append(mounts, mount)
 		// TODO: GCEPersistentDisk *corev1.GCEPersistentDiskVolumeSource
 		// TODO: AWSElasticBlockStore *corev1.AWSElasticBlockStoreVolumeSource
 		// TODO: GitRepo *corev1.GitRepoVolumeSource
@@ -637,6 +1775,8 @@ func (b *ContainerdBackend) getVolumeMountsOpts(volumeMounts []InstanceVolumeMou
 
 // Ensure interface is implemented
 var _ Backend = (*ContainerdBackend)(nil)
+var _ PauseBackend = (*ContainerdBackend)(nil)
+var _ CheckpointBackend = (*ContainerdBackend)(nil)
 
 func (b *ContainerdBackend) instanceDir(instance *Instance) string {
 	return storage.InstancePath(instance.ID)
@@ -649,3 +1789,212 @@ func (b *ContainerdBackend) instanceLogsPath(instance *Instance) string {
 func (b *ContainerdBackend) volumeDir(volume *InstanceVolume) string {
 	return storage.VolumePath(volume.ID)
 }
+
+// memoryVolumeDir is where the tmpfs of a memory-backed emptyDir is mounted for all instances of a pod
+func (b *ContainerdBackend) memoryVolumeDir(sandbox *Sandbox, volume *InstanceVolume) string {
+	return filepath.Join(sandbox.Dir(), "volumes", volume.Name)
+}
+
+// mountMemoryVolume mounts the tmpfs of a memory-backed emptyDir, unless an earlier instance of the pod did
+// Rootless instances see the mounts in the mount namespace of RootlessKit.
+func (b *ContainerdBackend) mountMemoryVolume(ctx context.Context, path string, volume *InstanceVolume) error {
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return err
+	}
+	if mounted, err := b.mounted(path); err != nil || mounted {
+		return err
+	}
+	options := "mode=1777"
+	if volume.EmptyDir.SizeLimit != nil && !volume.EmptyDir.SizeLimit.IsZero() {
+		options += fmt.Sprintf(",size=%d", volume.EmptyDir.SizeLimit.Value())
+	}
+	if b.rootless != nil {
+		cmd, err := b.rootless.command(ctx, "mount", "-t", "tmpfs", "-o", "nosuid,nodev,"+options, "tmpfs", path)
+		if err != nil {
+			return err
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Errorf("failed to mount tmpfs at %q: %s\n%s", path, err, out)
+		}
+		return nil
+	}
+	if err := syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, options); err != nil {
+		return errors.Wrapf(err, "failed to mount tmpfs at %q", path)
+	}
+	return nil
+}
+
+// unmountMemoryVolumes unmounts the memory-backed emptyDirs of a pod, so that the directory of the sandbox can be
+// removed
+func (b *ContainerdBackend) unmountMemoryVolumes(sandbox *Sandbox) {
+	dir := filepath.Join(sandbox.Dir(), "volumes")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if mounted, err := b.mounted(path); err != nil || !mounted {
+			continue
+		}
+		if b.rootless != nil {
+			var cmd *exec.Cmd
+			if cmd, err = b.rootless.command(b.context, "umount", path); err == nil {
+				if out, cmdErr := cmd.CombinedOutput(); cmdErr != nil {
+					err = errors.Errorf("%s\n%s", cmdErr, out)
+				}
+			}
+		} else {
+			err = syscall.Unmount(path, 0)
+		}
+		if err != nil {
+			log.G(b.context).Warnf("containerd: failed to unmount volume %q of sandbox %q: %s", path, sandbox.ID, err)
+		}
+	}
+}
+
+// mounted reports whether a path is a mount point, in the mount namespace of the instances
+func (b *ContainerdBackend) mounted(path string) (bool, error) {
+	if b.rootless == nil {
+		return mountinfo.Mounted(path)
+	}
+	pid, err := b.rootless.childPID()
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/mountinfo", pid))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	mounts, err := mountinfo.GetMountsFromReader(f, mountinfo.SingleEntryFilter(path))
+	return len(mounts) > 0, err
+}
+
+// capabilitiesToOCI converts Kubernetes capabilities to the names in the runtime spec and reports if "ALL" is one of them
+func capabilitiesToOCI(capabilities []corev1.Capability) ([]string, bool) {
+	var names []string
+	all := false
+	for _, c := range capabilities {
+		name := strings.ToUpper(string(c))
+		if name == "ALL" {
+			all = true
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		names = append(names, name)
+	}
+	return names, all
+}
+
+func withGID(gid uint32) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		s.Process.User.GID = gid
+		return nil
+	}
+}
+
+func withUnified(key string, value string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux.Resources.Unified == nil {
+			s.Linux.Resources.Unified = map[string]string{}
+		}
+		s.Linux.Resources.Unified[key] = value
+		return nil
+	}
+}
+
+func withOOMScoreAdj(score int) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		s.Process.OOMScoreAdj = &score
+		return nil
+	}
+}
+
+func withMemoryReservation(reservation int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux.Resources.Memory == nil {
+			s.Linux.Resources.Memory = &specs.LinuxMemory{}
+		}
+		s.Linux.Resources.Memory.Reservation = &reservation
+		return nil
+	}
+}
+
+func withHugePageLimits(hugePages map[string]uint64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		s.Linux.Resources.HugepageLimits = nil
+		for pageSize, limit := range hugePages {
+			s.Linux.Resources.HugepageLimits = append(s.Linux.Resources.HugepageLimits, specs.LinuxHugepageLimit{
+				Pagesize: pageSize,
+				Limit:    limit,
+			})
+		}
+		return nil
+	}
+}
+
+func withAdditionalGIDs(gids []uint32) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		s.Process.User.AdditionalGids = append(s.Process.User.AdditionalGids, gids...)
+		return nil
+	}
+}
+
+func withSysctls(sysctls map[string]string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux.Sysctl == nil {
+			s.Linux.Sysctl = map[string]string{}
+		}
+		for name, value := range sysctls {
+			s.Linux.Sysctl[name] = value
+		}
+		return nil
+	}
+}
+
+func (b *ContainerdBackend) ImageID(ref string) string {
+	// Images are stored under their normalized reference
+	named, err := refdocker.ParseDockerRef(ref)
+	if err != nil {
+		return ref
+	}
+	return named.String()
+}
+
+func (b *ContainerdBackend) ListImages() ([]ImageInfo, error) {
+	imgs, err := b.client.ListImages(b.context)
+	if err != nil {
+		return nil, errors.Wrap(err, "containerd")
+	}
+	var infos []ImageInfo
+	for _, img := range imgs {
+		// The unpacked snapshots take up space as well
+		size, err := img.Usage(b.context, containerd.WithSnapshotUsage())
+		if err != nil {
+			return nil, errors.Wrap(err, "containerd")
+		}
+		infos = append(infos, ImageInfo{ID: img.Name(), Size: uint64(size)})
+	}
+	return infos, nil
+}
+
+func (b *ContainerdBackend) RemoveImage(id string) error {
+	containers, err := b.client.Containers(b.context, "image=="+strconv.Quote(id))
+	if err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	if len(containers) > 0 {
+		return errors.Errorf("image %q is in use by container %q", id, containers[0].ID())
+	}
+	if err = b.client.ImageService().Delete(b.context, id, images.SynchronousDelete()); err != nil {
+		return errors.Wrap(err, "containerd")
+	}
+	return nil
+}
+
+func (b *ContainerdBackend) ImageFsPath() string {
+	return b.config.Containerd.Root
+}
@@ -1,9 +1,11 @@
 package provider
 
 import (
+	"context"
 	"io"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	corev1 "k8s.io/api/core/v1"
@@ -32,6 +34,10 @@ func (b *DummyBackend) GetInstanceStatus(instance *Instance) (corev1.ContainerSt
 	return dummyStatus, nil
 }
 
+func (b *DummyBackend) PullInstanceImage(ctx context.Context, instance *Instance) (ImagePull, error) {
+	return ImagePull{}, nil
+}
+
 func (b *DummyBackend) CreateInstance(instance *Instance) error {
 	return nil
 }
@@ -56,10 +62,26 @@ func (b *DummyBackend) GetInstanceLogs(instance *Instance, opts api.ContainerLog
 	return io.NopCloser(strings.NewReader("")), nil
 }
 
-func (b *DummyBackend) RunInInstance(instance *Instance, cmd []string, attach api.AttachIO) error {
+func (b *DummyBackend) RunInInstance(ctx context.Context, instance *Instance, cmd []string, attach api.AttachIO) error {
+	return nil
+}
+
+func (b *DummyBackend) AttachToInstance(ctx context.Context, instance *Instance, attach api.AttachIO) error {
+	return nil
+}
+
+func (b *DummyBackend) PortForwardInstance(ctx context.Context, instance *Instance, port int32, stream io.ReadWriteCloser) error {
 	return nil
 }
 
+func (b *DummyBackend) GetInstanceStorageUsage(instance *Instance) (InstanceStorageUsage, error) {
+	return InstanceStorageUsage{}, nil
+}
+
+func (b *DummyBackend) GetInstanceStats(instance *Instance) (InstanceStats, error) {
+	return InstanceStats{Time: time.Now()}, nil
+}
+
 func (b *DummyBackend) CreateVolume(volumeID string, volume corev1.Volume) error {
 	return nil
 }
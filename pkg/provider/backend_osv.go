@@ -1,27 +1,36 @@
 package provider
 
 import (
+	"archive/tar"
 	"encoding/json"
 	"fmt"
 	"github.com/cloudius-systems/capstan/core"
 	"github.com/cloudius-systems/capstan/hypervisor/qemu"
 	"github.com/cloudius-systems/capstan/nat"
+	"github.com/containerd/containerd/archive/compression"
 	"github.com/containerd/containerd/log"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/types"
 	"github.com/regclient/regclient/types/ref"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/credentials"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/puller"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/system"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/util"
 	"golang.org/x/net/context"
 	"io"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -35,28 +44,50 @@ type OSvBackend struct {
 
 	context context.Context
 	repo    *capstan.Repo
+	puller  *puller.Puller
 
-	instanceStatuses map[string]*corev1.ContainerStatus
-	instanceExtras   map[string]*OSvExtras
-	volumeExtras     map[string]*OSvExtras
+	volumeExtras map[string]*OSvExtras
+
+	// mu guards the statuses, extras and IO of the instances, the pids of the hypervisors, which are removed once they
+	// exit, and the addresses to which instances were migrated. The goroutines that wait for a hypervisor update the
+	// status of its instance.
+	mu                 sync.Mutex
+	instanceStatuses   map[string]*corev1.ContainerStatus
+	instanceExtras     map[string]*OSvExtras
+	instanceIOs        map[string]*InstanceIO
+	instancePids       map[string]int
+	instanceMigrations map[string]string
+
+	// rootless is the RootlessKit of a rootless containerd, in whose user namespace virtiofsd runs, nil when fledge
+	// runs as root
+	rootless *rootlessKit
 }
 
-func NewOSvBackend(ctx context.Context, cfg Config) (*OSvBackend, error) {
+func NewOSvBackend(ctx context.Context, cfg Config, imagePuller *puller.Puller) (*OSvBackend, error) {
 	repo := capstan.NewRepo("")
 
 	b := &OSvBackend{
-		config:           cfg,
-		context:          ctx,
-		repo:             repo,
-		instanceStatuses: map[string]*corev1.ContainerStatus{},
-		instanceExtras:   map[string]*OSvExtras{},
-		volumeExtras:     map[string]*OSvExtras{},
+		config:             cfg,
+		context:            ctx,
+		repo:               repo,
+		puller:             imagePuller,
+		instanceStatuses:   map[string]*corev1.ContainerStatus{},
+		instanceExtras:     map[string]*OSvExtras{},
+		instanceIOs:        map[string]*InstanceIO{},
+		instancePids:       map[string]int{},
+		instanceMigrations: map[string]string{},
+		volumeExtras:       map[string]*OSvExtras{},
+	}
+	if cfg.Rootless.Enabled {
+		b.rootless = newRootlessKit(cfg.Rootless.StateDir)
 	}
 
 	return b, nil
 }
 
 func (b *OSvBackend) GetInstanceStatus(instance *Instance) (corev1.ContainerStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if instanceStatus, ok := b.instanceStatuses[instance.ID]; ok {
 		return *instanceStatus, nil
 	}
@@ -64,31 +95,38 @@ func (b *OSvBackend) GetInstanceStatus(instance *Instance) (corev1.ContainerStat
 	return corev1.ContainerStatus{}, errors.Wrap(err, "osv")
 }
 
+func (b *OSvBackend) PullInstanceImage(ctx context.Context, instance *Instance) (ImagePull, error) {
+	// Check if the image exists (its directory may only hold a partial download)
+	imageDir := b.imageDir(instance.Image)
+	_, err := os.Stat(b.imageDiskPath(instance.Image, instance.ImageConfig.Hypervisor))
+	imageExists := !os.IsNotExist(err)
+	// Pull image if required
+	pulled := false
+	if (!imageExists && instance.ImagePullPolicy == corev1.PullIfNotPresent) || instance.ImagePullPolicy == corev1.PullAlways {
+		if err = b.pullInstanceImage(ctx, instance.Image, instance.ImageConfig.Hypervisor, instance.Keyring); err != nil {
+			return ImagePull{}, errors.Wrap(err, "osv")
+		}
+		pulled = true
+	} else if !imageExists {
+		return ImagePull{}, errors.Errorf("osv: image %q is not present and the pull policy is %s", instance.Image, instance.ImagePullPolicy)
+	}
+	usage, err := storage.PathUsage(imageDir)
+	if err != nil {
+		return ImagePull{}, errors.Wrap(err, "osv")
+	}
+	return ImagePull{Pulled: pulled, Size: usage.Bytes}, nil
+}
+
 func (b *OSvBackend) CreateInstance(instance *Instance) error {
 	// Clean up pre-existing instance (TODO can we do this in SIGKILL or on startup?)
 	// Otherwise capstan will start a pre-existing instance that was stopped
 	b.DeleteInstance(instance)
 
 	// Get image config
-	imageConf, err := storage.ImageGetConfig(b.context, instance.Image)
-	if err != nil {
-		return errors.Wrap(err, "osv")
-	}
-
-	// Container.Image
-	imagePath := filepath.Join(b.repo.RepoPath(), "fledge", storage.CleanName(instance.Image))
-	// Check if the image exists
-	_, err = os.Stat(imagePath)
-	imageExists := !os.IsNotExist(err)
-	// Pull image if required
-	if (!imageExists && instance.ImagePullPolicy == corev1.PullIfNotPresent) || instance.ImagePullPolicy == corev1.PullAlways {
-		if err = b.pullInstanceImage(instance.Image, imageConf.Hypervisor); err != nil {
-			return errors.Wrap(err, "osv")
-		}
-	}
+	imageConf := instance.ImageConfig
 
 	// Get hypervisor options
-	// Container.Image
+	// Container.Image (pulled by PullInstanceImage)
 	image := b.imageDiskPath(instance.Image, imageConf.Hypervisor)
 	// Container.Command
 	cmd := append(instance.Command, instance.Args...)
@@ -102,6 +140,7 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 		networking = "nat"
 	}
 	natRules := make([]nat.Rule, 0)
+	var err error
 	for _, p := range instance.Ports {
 		// TODO: Support for HostIP?
 		// TODO: Do we need NAT or can we do Bridge? Use p.HostPort?
@@ -118,6 +157,22 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 			GuestPort: strconv.FormatInt(int64(p.ContainerPort), 10),
 		})
 	}
+	// The REST API of the guest is used for exec
+	if networking == "nat" {
+		if apiPort, err := system.AvailablePort(); err == nil {
+			natRules = append(natRules, nat.Rule{
+				HostPort:  strconv.FormatInt(int64(apiPort), 10),
+				GuestPort: strconv.FormatInt(osvAPIPort, 10),
+			})
+		} else {
+			log.G(b.context).Error(errors.Wrap(err, "osv backend"))
+		}
+	}
+	// The MAC address is fixed to find the address of the guest on the bridge
+	mac, err := capstan.GenerateMAC()
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
 	// Container.EnvFrom (TODO)
 	// Container.Env (TODO)
 	// Container.Resources
@@ -138,6 +193,11 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 		},
 		vmOpts: []string{"--rootfs=zfs", "--verbose"},
 	}
+	// Pod.Annotations (incoming.fledge.io/<container>, the guest is received once the instance is started and only
+	// runs once its disk is complete)
+	if instance.IncomingMigrationPort != 0 {
+		instanceExtras.vmArgs = append(instanceExtras.vmArgs, "-incoming", "defer", "-S")
+	}
 	for i, vm := range instance.VolumeMounts {
 		volumeMountExtras, err := b.getVolumeMountExtras(instance, i, vm)
 		if err != nil {
@@ -145,8 +205,16 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 		}
 		instanceExtras.extendWith(volumeMountExtras)
 	}
+	// Container.Resources (devices of extended resources)
+	devicesExtras, err := b.getDevicesExtras(instance)
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	instanceExtras.extendWith(devicesExtras)
 	cmd = append(instanceExtras.vmOpts, cmd...)
+	b.mu.Lock()
 	b.instanceExtras[instance.ID] = instanceExtras
+	b.mu.Unlock()
 	// Container.VolumeDevices (TODO)
 	// Container.LivenessProbe (TODO)
 	// Container.ReadinessProbe (TODO)
@@ -154,9 +222,8 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 	// Container.Lifecycle (TODO)
 	// Container.TerminationMessagePath (TODO)
 	// Container.SecurityContext(TODO)
-	// Container.Stdin (TODO)
-	// Container.StdinOnce (TODO)
-	// Container.TTY (TODO)
+	// Container.Stdin and Container.StdinOnce (forwarded to the serial console)
+	// Container.TTY (TODO: the serial console can not be resized)
 
 	// Show command in logs
 	log.G(b.context).Infof("Setting cmdline: %s\n", strings.Join(cmd, " "))
@@ -183,7 +250,7 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 			Networking:  networking,
 			Bridge:      "virbr0", // TODO
 			NatRules:    natRules,
-			MAC:         "", // TODO
+			MAC:         mac.String(),
 			VNCFile:     b.instanceSockPath(instance),
 		}
 		if err = os.MkdirAll(dir, 0755); err != nil {
@@ -192,6 +259,12 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 		if err = qemu.StoreConfig(conf); err != nil {
 			return errors.Wrap(err, "osv")
 		}
+		// Size the disk of the instance from its ephemeral storage limit
+		if storageLimit := instance.Resources.Limits.StorageEphemeral().Value(); storageLimit > 0 {
+			if err = b.createInstanceDisk(instance, image, storageLimit); err != nil {
+				return errors.Wrap(err, "osv")
+			}
+		}
 	default:
 		err = errors.Errorf("platform %q is not supported", imageConf.Hypervisor)
 		return errors.Wrap(err, "osv")
@@ -209,13 +282,17 @@ func (b *OSvBackend) CreateInstance(instance *Instance) error {
 	}
 	// ContainerStatus.LastTerminationState
 	lastTerminationState := corev1.ContainerState{}
+	b.mu.Lock()
 	if instanceStatus, ok := b.instanceStatuses[instance.ID]; ok {
 		lastTerminationState = instanceStatus.State
 	}
+	b.mu.Unlock()
 	// ContainerStatus.Started
 	started := false
 	// Instance is created, populate its status
 	// https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.23/#containerstatus-v1-core
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.instanceStatuses[instance.ID] = &corev1.ContainerStatus{
 		Name:                 name,
 		State:                state,
@@ -239,7 +316,9 @@ func (b *OSvBackend) StartInstance(instance *Instance) error {
 	}
 
 	// Get extras for instance
+	b.mu.Lock()
 	extras, ok := b.instanceExtras[instance.ID]
+	b.mu.Unlock()
 	if !ok {
 		err := errors.Errorf("instance %q does not have extras", instance.ID)
 		return errors.Wrap(err, "osv")
@@ -264,15 +343,30 @@ func (b *OSvBackend) StartInstance(instance *Instance) error {
 		pErr = errors.Errorf("platform %q is not supported", instancePlatform)
 		return errors.Wrap(pErr, "osv")
 	}
-	r, w, _ := os.Pipe()
+	// Create logs
+	logs, pErr := NewContainerLogWriter(b.instanceLogsPath(instance), b.config.Logs.MaxSize.Value(), b.config.Logs.MaxFiles)
+	if pErr != nil {
+		return errors.Wrap(pErr, "osv")
+	}
 	// Start side processes
 	ctx, cancel := context.WithCancel(b.context)
 	procs := make([]*exec.Cmd, 0)
 	for _, p := range extras.vmProc {
+		// virtiofsd needs root, which the user is in the user namespace of RootlessKit
+		if b.rootless != nil {
+			nsenterArgs, err := b.rootless.nsenterArgs()
+			if err != nil {
+				cancel()
+				logs.Close()
+				return errors.Wrap(err, "osv")
+			}
+			p = append(nsenterArgs, p...)
+		}
 		proc := exec.CommandContext(ctx, p[0], p[1:]...)
-		proc.Stdout, proc.Stderr = w, w
+		proc.Stdout, proc.Stderr = logs.Stdout(), logs.Stderr()
 		if err := proc.Start(); err != nil {
 			cancel()
+			logs.Close()
 			return errors.Wrap(err, "osv")
 		}
 		go func() {
@@ -282,49 +376,106 @@ func (b *OSvBackend) StartInstance(instance *Instance) error {
 		}()
 		procs = append(procs, proc)
 	}
-	// Create logfile
 	log.G(b.context).Infof("Started instance %q (backend=osv)", instance.ID)
-	logsFile, pErr := os.Create(b.instanceLogsPath(instance))
+	// Write everything to the logs continuously, the serial console is also streamed to attached clients
+	instanceIO, stdin, pErr := NewInstanceIO(instance, logs)
 	if pErr != nil {
+		cancel()
+		logs.Close()
 		return errors.Wrap(pErr, "osv")
 	}
-	cmd.Stdout, cmd.Stderr = w, w
-	// Write everything to a log file continuously
-	go func() { _, _ = io.Copy(logsFile, r) }()
+	cmd.Stdout, cmd.Stderr = instanceIO.Stdout(), instanceIO.Stderr()
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
 	if err := cmd.Start(); err != nil {
+		cancel()
+		logs.Close()
 		return errors.Wrap(err, "osv")
 	}
-
+	if stdin != nil {
+		// The hypervisor holds its own copy
+		stdin.Close()
+	}
 	// Instance is started, update its status
 	// https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.23/#containerstaterunning-v1-core
+	b.mu.Lock()
+	b.instanceIOs[instance.ID] = instanceIO
+	b.instancePids[instance.ID] = cmd.Process.Pid
 	instanceStatus := b.instanceStatuses[instance.ID]
 	instanceStatus.State = corev1.ContainerState{
 		Running: &corev1.ContainerStateRunning{
 			StartedAt: metav1.NewTime(time.Now()),
 		},
 	}
+	// The guest of an incoming migration only runs once it is received
+	if port := instance.IncomingMigrationPort; port != 0 {
+		instanceStatus.State = corev1.ContainerState{
+			Waiting: &corev1.ContainerStateWaiting{
+				Reason:  reasonMigrating,
+				Message: fmt.Sprintf("Waiting for the migration on port %d", port),
+			},
+		}
+		go func() {
+			if err := b.acceptMigration(ctx, instance, port); err != nil {
+				// The paused hypervisor would wait forever, its exit terminates the instance
+				log.G(ctx).Errorf("failed to receive migration of instance %q: %s", instance.ID, err)
+				_ = cmd.Process.Kill()
+				return
+			}
+			log.G(ctx).Infof("received migration of instance %q", instance.ID)
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if instanceStatus.State.Waiting != nil {
+				instanceStatus.State = corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{
+						StartedAt: metav1.NewTime(time.Now()),
+					},
+				}
+			}
+		}()
+	}
+	b.mu.Unlock()
 
 	// Run goroutine that waits for the instance to exit
 	go func() {
 		exitCode, exitMsg := util.ExecParseError(cmd.Wait())
 		log.G(ctx).Debugf("instance %s\n", exitMsg)
+		b.mu.Lock()
+		delete(b.instancePids, instance.ID)
+		b.mu.Unlock()
+		// Detach clients
+		instanceIO.Close()
 		// Cancel subprocesses
 		cancel()
-		// Close logfile stream
-		logsFile.Close()
+		// Flush and close the logs
+		logs.Close()
 		// Instance has terminated, update its status
 		// https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.23/#containerstateterminated-v1-core
-		instanceStatus.State = corev1.ContainerState{
-			Terminated: &corev1.ContainerStateTerminated{
-				ExitCode:    int32(exitCode),
-				Signal:      int32(syscall.SIGTERM), // Default
-				Reason:      "Terminated",
-				Message:     exitMsg,
-				StartedAt:   instanceStatus.State.Running.StartedAt,
-				FinishedAt:  metav1.NewTime(time.Now()),
-				ContainerID: instance.ID,
-			},
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		migratedTo, migrated := b.instanceMigrations[instance.ID]
+		var startedAt metav1.Time
+		if running := instanceStatus.State.Running; running != nil {
+			startedAt = running.StartedAt
 		}
+		terminated := &corev1.ContainerStateTerminated{
+			ExitCode:    int32(exitCode),
+			Signal:      int32(syscall.SIGTERM), // Default
+			Reason:      "Terminated",
+			Message:     exitMsg,
+			StartedAt:   startedAt,
+			FinishedAt:  metav1.NewTime(time.Now()),
+			ContainerID: instance.ID,
+		}
+		// The guest continues on another node
+		if migrated {
+			terminated.ExitCode = 0
+			terminated.Signal = 0
+			terminated.Reason = reasonMigrated
+			terminated.Message = fmt.Sprintf("Instance migrated to %s", migratedTo)
+		}
+		instanceStatus.State = corev1.ContainerState{Terminated: terminated}
 	}()
 
 	return nil
@@ -360,6 +511,16 @@ func (b *OSvBackend) KillInstance(instance *Instance, signal syscall.Signal) err
 	return nil
 }
 
+// PauseInstance stops the virtual CPUs of the hypervisor of an instance
+func (b *OSvBackend) PauseInstance(ctx context.Context, instance *Instance) error {
+	return errors.Wrap(b.executeQMP(ctx, instance, "stop"), "osv")
+}
+
+// ResumeInstance lets the virtual CPUs of the hypervisor of an instance continue
+func (b *OSvBackend) ResumeInstance(ctx context.Context, instance *Instance) error {
+	return errors.Wrap(b.executeQMP(ctx, instance, "cont"), "osv")
+}
+
 func (b *OSvBackend) DeleteInstance(instance *Instance) error {
 	instanceName, instancePlatform := capstan.SearchInstance(instance.ID)
 	if instanceName == "" {
@@ -382,20 +543,167 @@ func (b *OSvBackend) DeleteInstance(instance *Instance) error {
 	}
 
 	// Instance is deleted, remove its status (TODO: last termination state)
+	b.mu.Lock()
 	delete(b.instanceStatuses, instance.ID)
+	delete(b.instanceMigrations, instance.ID)
+	// Detach clients
+	if instanceIO, ok := b.instanceIOs[instance.ID]; ok {
+		instanceIO.Close()
+		delete(b.instanceIOs, instance.ID)
+	}
+	b.mu.Unlock()
 
 	return nil
 }
 
 func (b *OSvBackend) GetInstanceLogs(instance *Instance, opts api.ContainerLogOpts) (io.ReadCloser, error) {
-	containerLogger, err := NewContainerLogger(b.instanceLogsPath(instance), opts)
+	var exited <-chan struct{}
+	b.mu.Lock()
+	if instanceIO, ok := b.instanceIOs[instance.ID]; ok {
+		exited = instanceIO.Done()
+	}
+	b.mu.Unlock()
+	containerLogger, err := NewContainerLogger(b.instanceLogsPath(instance), opts, exited)
 	if err != nil {
 		return nil, errors.Wrap(err, "osv")
 	}
 	return containerLogger, nil
 }
 
-func (b *OSvBackend) RunInInstance(instance *Instance, cmd []string, attach api.AttachIO) error {
+func (b *OSvBackend) RunInInstance(ctx context.Context, instance *Instance, cmd []string, attach api.AttachIO) error {
+	b.mu.Lock()
+	instanceIO, ok := b.instanceIOs[instance.ID]
+	b.mu.Unlock()
+	if !ok {
+		err := errors.Errorf("instance %q is not running", instance.ID)
+		return errors.Wrap(err, "osv")
+	}
+	address, err := b.instanceAddress(instance, osvAPIPort)
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+
+	// Applications write to the serial console, stream it to the client while the command runs (TODO: stdin)
+	attachCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { _ = instanceIO.Attach(attachCtx, outputAttachIO{attach}) }()
+
+	if err = runApp(ctx, address, cmd); err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	return nil
+}
+
+func (b *OSvBackend) AttachToInstance(ctx context.Context, instance *Instance, attach api.AttachIO) error {
+	b.mu.Lock()
+	instanceIO, ok := b.instanceIOs[instance.ID]
+	b.mu.Unlock()
+	if !ok {
+		err := errors.Errorf("instance %q is not running", instance.ID)
+		return errors.Wrap(err, "osv")
+	}
+	if err := instanceIO.Attach(ctx, attach); err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	return nil
+}
+
+func (b *OSvBackend) PortForwardInstance(ctx context.Context, instance *Instance, port int32, stream io.ReadWriteCloser) error {
+	// The guest is reached through the forwarded port (nat) or its address on the bridge
+	address, err := b.instanceAddress(instance, int(port))
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	if err = forwardStream(ctx, conn, stream); err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	return nil
+}
+
+func (b *OSvBackend) GetInstanceStats(instance *Instance) (InstanceStats, error) {
+	b.mu.Lock()
+	pid, ok := b.instancePids[instance.ID]
+	b.mu.Unlock()
+	if !ok {
+		err := errors.Errorf("instance %q is not running", instance.ID)
+		return InstanceStats{}, errors.Wrap(err, "osv")
+	}
+	// The usage of the hypervisor process, the memory of the guest counts once it is touched
+	cpuUsage, err := system.ProcessCPUUsage(pid)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "osv")
+	}
+	memoryInfo, err := system.ProcessMemoryInfo(pid)
+	if err != nil {
+		return InstanceStats{}, errors.Wrap(err, "osv")
+	}
+	var startTime time.Time
+	b.mu.Lock()
+	if status, ok := b.instanceStatuses[instance.ID]; ok && status.State.Running != nil {
+		startTime = status.State.Running.StartedAt.Time
+	}
+	b.mu.Unlock()
+	return InstanceStats{
+		Time:             time.Now(),
+		StartTime:        startTime,
+		CPUUsage:         cpuUsage,
+		MemoryUsage:      memoryInfo["VmRSS"],
+		MemoryWorkingSet: memoryInfo["VmRSS"],
+		MemoryRSS:        memoryInfo["RssAnon"],
+		Processes:        1,
+	}, nil
+}
+
+func (b *OSvBackend) GetInstanceStorageUsage(instance *Instance) (InstanceStorageUsage, error) {
+	// Writes of the instance end up in the copy-on-write overlay of the image
+	diskUsage, err := storage.PathUsage(b.instanceDiskPath(instance))
+	if err != nil {
+		return InstanceStorageUsage{}, errors.Wrap(err, "osv")
+	}
+	// Rotated and previous logs count as well
+	logsUsage := storage.Usage{}
+	logsPath := b.instanceLogsPath(instance)
+	for _, path := range append(containerLogFiles(logsPath), containerLogFiles(logsPath+previousLogSuffix)...) {
+		usage, err := storage.PathUsage(path)
+		if err != nil {
+			return InstanceStorageUsage{}, errors.Wrap(err, "osv")
+		}
+		logsUsage = logsUsage.Add(usage)
+	}
+	return InstanceStorageUsage{Rootfs: diskUsage, Logs: logsUsage}, nil
+}
+
+// createInstanceDisk creates the copy-on-write disk of an instance with the given virtual size
+// Capstan only creates this disk when it does not exist yet, in which case it inherits the size of the image
+func (b *OSvBackend) createInstanceDisk(instance *Instance, image string, size int64) error {
+	backingFile, err := filepath.Abs(image)
+	if err != nil {
+		return err
+	}
+	// The disk can not be smaller than the image it is based on
+	out, err := exec.Command("qemu-img", "info", "--output=json", backingFile).Output()
+	if err != nil {
+		return errors.Wrapf(err, "qemu-img failed to inspect %q", backingFile)
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err = json.Unmarshal(out, &info); err != nil {
+		return err
+	}
+	if size < info.VirtualSize {
+		log.G(b.context).Warnf("ephemeral-storage limit of instance %q is smaller than its image (%d < %d), using the size of the image", instance.ID, size, info.VirtualSize)
+		size = info.VirtualSize
+	}
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-o", "backing_file="+backingFile, b.instanceDiskPath(instance), strconv.FormatInt(size, 10))
+	if out, err = cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("qemu-img failed: %s\n%s", out, err)
+	}
 	return nil
 }
 
@@ -414,6 +722,37 @@ func (e *OSvExtras) extendWith(other *OSvExtras) {
 	e.vmOpts = append(e.vmOpts, other.vmOpts...)
 }
 
+// getDevicesExtras passes the PCI devices of the VFIO groups that were allocated to an instance through to the guest
+// and sets the environment variables of the allocation. The guest can not use other devices.
+func (b *OSvBackend) getDevicesExtras(instance *Instance) (*OSvExtras, error) {
+	extras := &OSvExtras{}
+	if instance.Devices == nil {
+		return extras, nil
+	}
+	for _, d := range instance.Devices.Devices {
+		// /dev/vfio/<group>, next to the /dev/vfio/vfio container
+		group, ok := strings.CutPrefix(d.HostPath, "/dev/vfio/")
+		if !ok || group == "vfio" {
+			log.G(b.context).Warnf("device %q of instance %q is not a VFIO group, ignoring it", d.HostPath, instance.ID)
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join("/sys/kernel/iommu_groups", group, "devices"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find the devices of VFIO group %q", group)
+		}
+		for _, entry := range entries {
+			extras.vmArgs = append(extras.vmArgs, "-device", "vfio-pci,host="+entry.Name())
+		}
+	}
+	var env []string
+	for k, v := range instance.Devices.Envs {
+		env = append(env, fmt.Sprintf("--env=%s=%s", k, v))
+	}
+	sort.Strings(env)
+	extras.vmOpts = append(extras.vmOpts, env...)
+	return extras, nil
+}
+
 func (b *OSvBackend) getVolumeMountExtras(instance *Instance, volumeMountIndex int, volumeMount InstanceVolumeMount) (*OSvExtras, error) {
 	volume := volumeMount.Volume
 
@@ -437,7 +776,7 @@ func (b *OSvBackend) getVolumeMountExtras(instance *Instance, volumeMountIndex i
 			fallthrough
 		case corev1.HostPathDirectory:
 		default:
-			return nil, errors.Errorf("volumeMount %q has unsupported hostPath.type %q", volume.ID, volume.HostPath.Type)
+			return nil, errors.Errorf("volumeMount %q has unsupported hostPath.type %q", volume.ID, *volume.HostPath.Type)
 		}
 		/*
 			Create options for virtio-fs socket according to scripts/run.py
@@ -460,7 +799,28 @@ func (b *OSvBackend) getVolumeMountExtras(instance *Instance, volumeMountIndex i
 		extras.vmOpts = []string{
 			fmt.Sprintf("--mount-fs=virtiofs,/dev/virtiofs%d,%s", volumeMountIndex, volumeMount.MountPath),
 		}
-	// TODO: EmptyDir *corev1.EmptyDirVolumeSource
+	case volume.EmptyDir != nil:
+		// Directory lives as long as the pod and is accounted as its ephemeral storage
+		emptyDirPath := storage.VolumePath(volume.ID)
+		if err := os.MkdirAll(emptyDirPath, 0777); err != nil {
+			return nil, err
+		}
+		// Create temporary file for virtio-fs socket
+		socketPath := filepath.Join(volumesDir, fmt.Sprintf("%s.sock", volume.ID))
+		// Determine arguments for virtio-fs
+		extras.vmProc = [][]string{{
+			"virtiofsd",
+			"--socket-path", socketPath,
+			"--shared-dir", emptyDirPath,
+			"--no-announce-submounts",
+		}}
+		extras.vmArgs = []string{
+			"-chardev", fmt.Sprintf("socket,id=char%d,path=%s", volumeMountIndex, socketPath),
+			"-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=char%d,tag=%s", volumeMountIndex, volume.Name),
+		}
+		extras.vmOpts = []string{
+			fmt.Sprintf("--mount-fs=virtiofs,/dev/virtiofs%d,%s", volumeMountIndex, volumeMount.MountPath),
+		}
 	// TODO: GCEPersistentDisk *corev1.GCEPersistentDiskVolumeSource
 	// TODO: AWSElasticBlockStore *corev1.AWSElasticBlockStoreVolumeSource
 	// TODO: GitRepo *corev1.GitRepoVolumeSource
@@ -546,6 +906,7 @@ func (b *OSvBackend) getVolumeMountExtras(instance *Instance, volumeMountIndex i
 
 // Ensure interface is implemented
 var _ Backend = (*OSvBackend)(nil)
+var _ PauseBackend = (*OSvBackend)(nil)
 
 func (b *OSvBackend) imageDir(imageRef string) string {
 	cleaned := storage.CleanName(imageRef)
@@ -575,6 +936,10 @@ func (b *OSvBackend) instanceConfPath(instance *Instance) string {
 	return filepath.Join(b.instanceDir(instance), "osv.config")
 }
 
+func (b *OSvBackend) instanceDiskPath(instance *Instance) string {
+	return filepath.Join(b.instanceDir(instance), "disk.qcow2")
+}
+
 func (b *OSvBackend) instanceMoniPath(instance *Instance) string {
 	return filepath.Join(b.instanceDir(instance), "osv.monitor")
 }
@@ -597,16 +962,16 @@ func (b *OSvBackend) volumePath(volumeID string) string {
 }
 
 // pullInstanceImage pulls the image into a local capstan repository
-func (b *OSvBackend) pullInstanceImage(imageRef string, hypervisor string) error {
-	imageDir := b.imageDir(imageRef)
-	// Remove image if it exists
-	if _, err := os.Stat(imageDir); !os.IsNotExist(err) {
-		if err = os.RemoveAll(imageDir); err != nil {
-			return err
-		}
-	}
+// The disk of the image is replaced atomically, so instances that use the previous disk as backing file keep it
+func (b *OSvBackend) pullInstanceImage(ctx context.Context, imageRef string, hypervisor string, keyring *credentials.Keyring) error {
+	return b.puller.Pull(ctx, BackendOsv, joinIdentifierFromParts(BackendOsv, imageRef), func(ctx context.Context, progress *puller.Progress) error {
+		return b.downloadInstanceImage(ctx, progress, imageRef, hypervisor, keyring)
+	})
+}
+
+func (b *OSvBackend) downloadInstanceImage(ctx context.Context, progress *puller.Progress, imageRef string, hypervisor string, keyring *credentials.Keyring) error {
 	// Create repository directory
-	if err := os.MkdirAll(imageDir, 0755); err != nil {
+	if err := os.MkdirAll(b.imageDir(imageRef), 0755); err != nil {
 		return err
 	}
 	// Parse image reference
@@ -625,19 +990,15 @@ func (b *OSvBackend) pullInstanceImage(imageRef string, hypervisor string) error
 		Description:   "OSv image imported by FLEDGE",
 		Build:         "",
 	}
-	imageInfoFile, err := os.Create(b.imageInfoPath(imageRef))
-	if err != nil {
-		return err
-	}
 	imageInfoBytes, err := json.Marshal(imageInfo)
 	if err != nil {
 		return err
 	}
-	if _, err = imageInfoFile.Write(imageInfoBytes); err != nil {
+	if err = writeFileAtomic(b.imageInfoPath(imageRef), imageInfoBytes); err != nil {
 		return err
 	}
 	//// Retrieve the image config
-	rc := regclient.New(regclient.WithDockerCreds())
+	rc := storage.NewRegClient(r, keyring)
 	//imageConf, err := storage.ImageGetConfigWithClient(rc, b.context, r)
 	//if err != nil {
 	//	return err
@@ -655,7 +1016,7 @@ func (b *OSvBackend) pullInstanceImage(imageRef string, hypervisor string) error
 	//	return err
 	//}
 	// Retrieve the image layers (should be one)
-	layerDescs, err := storage.ImageGetLayersWithClient(rc, b.context, r)
+	layerDescs, err := storage.ImageGetLayersWithClient(rc, ctx, r)
 	if err != nil {
 		return err
 	}
@@ -667,19 +1028,52 @@ func (b *OSvBackend) pullInstanceImage(imageRef string, hypervisor string) error
 	if layerDesc.MediaType != types.MediaTypeOCI1Layer && layerDesc.MediaType != types.MediaTypeOCI1LayerGzip {
 		return fmt.Errorf("layer media type %s is not supported", layerDesc.MediaType)
 	}
-	// Pull the stream
-	layerBlob, err := rc.BlobGet(b.context, r, layerDesc)
+	// The disk is only replaced when the layer changed
+	imageDiskPath := b.imageDiskPath(imageRef, hypervisor)
+	imageDigestPath := imageDiskPath + ".digest"
+	if current, err := os.ReadFile(imageDigestPath); err == nil && string(current) == layerDesc.Digest.String() {
+		if _, err = os.Stat(imageDiskPath); err == nil {
+			return nil
+		}
+	}
+	// Download the layer, an interrupted download of an earlier pull is resumed
+	named, err := refdocker.ParseDockerRef(imageRef)
+	if err != nil {
+		return err
+	}
+	resolvers, err := newResolvers(ctx, named, keyring)
 	if err != nil {
 		return err
 	}
-	layerTarReader, err := layerBlob.ToTarReader()
+	layerPath := filepath.Join(b.imageDir(imageRef), layerDesc.Digest.Encoded()+".layer")
+	defer os.Remove(layerPath)
+	layerOCIDesc := ocispec.Descriptor{MediaType: layerDesc.MediaType, Digest: layerDesc.Digest, Size: layerDesc.Size}
+	// Try the matching credentials of the pull secrets one by one, and finally the docker config of the host
+	var fetchErr error
+	for _, resolver := range resolvers {
+		var fetcher remotes.Fetcher
+		if fetcher, fetchErr = resolver.Fetcher(ctx, named.String()); fetchErr != nil {
+			continue
+		}
+		if fetchErr = b.puller.FetchBlob(ctx, progress, fetcher, layerOCIDesc, layerPath); fetchErr == nil {
+			break
+		}
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+	// Extract the disk from the layer
+	layerFile, err := os.Open(layerPath)
 	if err != nil {
 		return err
 	}
-	tr, err := layerTarReader.GetTarReader()
+	defer layerFile.Close()
+	layerReader, err := compression.DecompressStream(layerFile)
 	if err != nil {
 		return err
 	}
+	defer layerReader.Close()
+	tr := tar.NewReader(layerReader)
 	hdr, err := tr.Next()
 	if err != nil {
 		return err
@@ -688,12 +1082,70 @@ func (b *OSvBackend) pullInstanceImage(imageRef string, hypervisor string) error
 		return fmt.Errorf("unexpected file %s in layer of image %s", hdr.Name, r.CommonName())
 	}
 	// Write image layer to <base>.<hypervisor>
-	imageDiskFile, err := os.Create(b.imageDiskPath(imageRef, hypervisor))
+	imageDiskTempPath := imageDiskPath + ".tmp"
+	imageDiskFile, err := os.Create(imageDiskTempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(imageDiskTempPath)
+	_, err = io.Copy(imageDiskFile, tr)
+	if err == nil {
+		err = imageDiskFile.Sync()
+	}
+	if closeErr := imageDiskFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
-	if _, err = io.Copy(imageDiskFile, tr); err != nil {
+	if err = os.Rename(imageDiskTempPath, imageDiskPath); err != nil {
+		return err
+	}
+	return writeFileAtomic(imageDigestPath, []byte(layerDesc.Digest.String()))
+}
+
+// writeFileAtomic writes a file through a temporary file, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
 		return err
 	}
+	return os.Rename(tempPath, path)
+}
+
+func (b *OSvBackend) ImageID(ref string) string {
+	return filepath.Base(b.imageDir(ref))
+}
+
+func (b *OSvBackend) ListImages() ([]ImageInfo, error) {
+	entries, err := os.ReadDir(b.ImageFsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "osv")
+	}
+	var infos []ImageInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		usage, err := storage.PathUsage(filepath.Join(b.ImageFsPath(), entry.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "osv")
+		}
+		infos = append(infos, ImageInfo{ID: entry.Name(), Size: usage.Bytes})
+	}
+	return infos, nil
+}
+
+func (b *OSvBackend) RemoveImage(id string) error {
+	// The disks of instances are overlays with the image as backing file, the provider never removes these
+	if err := os.RemoveAll(filepath.Join(b.ImageFsPath(), id)); err != nil {
+		return errors.Wrap(err, "osv")
+	}
 	return nil
 }
+
+func (b *OSvBackend) ImageFsPath() string {
+	return filepath.Join(b.repo.RepoPath(), "fledge")
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudius-systems/capstan/hypervisor/qemu"
+	capstan "github.com/cloudius-systems/capstan/util"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// osvAPIPort is the port of the REST API of OSv (httpserver-api module) in the guest
+	osvAPIPort = 8000
+	// osvAppPollInterval is the interval at which the API is asked whether an application is still running
+	osvAppPollInterval = 500 * time.Millisecond
+	// libvirtLeasesDir contains the DHCP leases of the bridges that are managed by libvirt
+	libvirtLeasesDir = "/var/lib/libvirt/dnsmasq"
+)
+
+// instanceAddress returns the address on which a port of the guest can be reached from the host
+func (b *OSvBackend) instanceAddress(instance *Instance, guestPort int) (string, error) {
+	instanceName, instancePlatform := capstan.SearchInstance(instance.ID)
+	if instanceName == "" {
+		return "", errors.Errorf("instance %q does not exist", instance.ID)
+	}
+	if instancePlatform != "qemu" {
+		return "", errors.Errorf("platform %q is not supported", instancePlatform)
+	}
+	conf, err := qemu.LoadConfig(instanceName)
+	if err != nil {
+		return "", err
+	}
+	switch conf.Networking {
+	case "nat":
+		// Only forwarded ports are reachable
+		for _, rule := range conf.NatRules {
+			if rule.GuestPort == strconv.Itoa(guestPort) {
+				return net.JoinHostPort("127.0.0.1", rule.HostPort), nil
+			}
+		}
+		return "", errors.Errorf("port %d of instance %q is not forwarded", guestPort, instance.ID)
+	case "bridge":
+		// The guest got its address from the DHCP server of the bridge
+		ip, err := bridgeLeaseIP(conf.Bridge, conf.MAC)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(ip, strconv.Itoa(guestPort)), nil
+	default:
+		return "", errors.Errorf("networking %q is not supported", conf.Networking)
+	}
+}
+
+// bridgeLeaseIP looks up the IP that was leased to a MAC address on a bridge that is managed by libvirt
+func bridgeLeaseIP(bridge string, mac string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(libvirtLeasesDir, bridge+".status"))
+	if err != nil {
+		return "", err
+	}
+	var leases []struct {
+		IPAddress  string `json:"ip-address"`
+		MACAddress string `json:"mac-address"`
+	}
+	if err = json.Unmarshal(data, &leases); err != nil {
+		return "", err
+	}
+	for _, lease := range leases {
+		if strings.EqualFold(lease.MACAddress, mac) {
+			return lease.IPAddress, nil
+		}
+	}
+	return "", errors.Errorf("no address was leased to %q on bridge %q", mac, bridge)
+}
+
+// runApp starts a program in the guest through the REST API and waits for it to exit
+// OSv does not keep the exit codes of applications, so these can not be reported
+func runApp(ctx context.Context, address string, cmd []string) error {
+	query := url.Values{
+		"command":     {osvCommandLine(cmd)},
+		"new_program": {"true"},
+	}
+	body, err := osvAPIRequest(ctx, http.MethodPut, address, "/app/?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	// The API returns the ids of the main threads of the started applications
+	var threadIDs string
+	if err = json.Unmarshal(body, &threadIDs); err != nil {
+		threadIDs = string(body)
+	}
+	tids := strings.Fields(strings.Trim(threadIDs, "\""))
+	if len(tids) == 0 {
+		return errors.Errorf("no application was started for %q", cmd)
+	}
+
+	ticker := time.NewTicker(osvAppPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		running, err := osvThreadsRunning(ctx, address, tids)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+	}
+}
+
+// osvThreadsRunning checks if any of the threads still exists
+func osvThreadsRunning(ctx context.Context, address string, tids []string) (bool, error) {
+	body, err := osvAPIRequest(ctx, http.MethodGet, address, "/os/threads")
+	if err != nil {
+		return false, err
+	}
+	var threads struct {
+		List []struct {
+			ID int64 `json:"id"`
+		} `json:"list"`
+	}
+	if err = json.Unmarshal(body, &threads); err != nil {
+		return false, err
+	}
+	for _, t := range threads.List {
+		for _, tid := range tids {
+			if strconv.FormatInt(t.ID, 10) == tid {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func osvAPIRequest(ctx context.Context, method, address, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+address+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "REST API of the guest is not reachable")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s %s failed with %q: %s", method, path, resp.Status, body)
+	}
+	return body, nil
+}
+
+// osvCommandLine joins the arguments of a command so that OSv splits them the same way
+func osvCommandLine(cmd []string) string {
+	args := make([]string, len(cmd))
+	for i, arg := range cmd {
+		if arg == "" || strings.ContainsAny(arg, " \t\"';&") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
+
+// outputAttachIO only passes the output streams of an AttachIO
+type outputAttachIO struct {
+	api.AttachIO
+}
+
+func (outputAttachIO) Stdin() io.Reader {
+	return nil
+}
+
+func (outputAttachIO) Resize() <-chan api.TermSize {
+	return nil
+}
@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOSvCommandLine(t *testing.T) {
+	tests := []struct {
+		cmd      []string
+		expected string
+	}{
+		{[]string{"/hello"}, "/hello"},
+		{[]string{"/bin/echo", "a", "b"}, "/bin/echo a b"},
+		{[]string{"/bin/echo", "a b", ""}, `/bin/echo "a b" ""`},
+		// Characters that OSv treats as separators or quotes are quoted
+		{[]string{"/bin/echo", "a;b", `say "hi"`, "it's"}, `/bin/echo "a;b" "say \"hi\"" "it's"`},
+	}
+	for _, test := range tests {
+		if line := osvCommandLine(test.cmd); line != test.expected {
+			t.Errorf("expected the command line %q for %q, got %q", test.expected, test.cmd, line)
+		}
+	}
+}
+
+// fakeOSvAPI is the REST API of a guest of which the started application runs until it was polled a number of times
+type fakeOSvAPI struct {
+	mu       sync.Mutex
+	command  string
+	response string
+	polls    int
+}
+
+func (a *fakeOSvAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/app/":
+		a.command = r.URL.Query().Get("command")
+		fmt.Fprint(w, a.response)
+	case r.Method == http.MethodGet && r.URL.Path == "/os/threads":
+		threads := `{"list": [{"id": 1}, {"id": 12}]}`
+		if a.polls--; a.polls < 0 {
+			threads = `{"list": [{"id": 1}]}`
+		}
+		fmt.Fprint(w, threads)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func TestRunApp(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		polls    int
+		err      string
+	}{
+		{name: "exits", response: `"12"`, polls: 1},
+		{name: "multiple threads", response: `"12 13"`},
+		{name: "not started", response: `""`, err: "no application was started"},
+	}
+	for _, test := range tests {
+		api := &fakeOSvAPI{response: test.response, polls: test.polls}
+		server := httptest.NewServer(api)
+		address := strings.TrimPrefix(server.URL, "http://")
+
+		err := runApp(context.Background(), address, []string{"/bin/echo", "a b"})
+		server.Close()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected the error %q, got %v", test.name, test.err, err)
+		}
+		if api.command != `/bin/echo "a b"` {
+			t.Errorf("%s: expected the command line of the command, got %q", test.name, api.command)
+		}
+		if test.err == "" && api.polls >= 0 {
+			t.Errorf("%s: expected to wait until the application exited, %d polls left", test.name, api.polls)
+		}
+	}
+
+	// Errors of the API are reported
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	if err := runApp(context.Background(), strings.TrimPrefix(server.URL, "http://"), []string{"/hello"}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the status of the API, got %v", err)
+	}
+}
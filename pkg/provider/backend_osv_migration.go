@@ -0,0 +1,308 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+)
+
+const (
+	// osvDiskDevice is the drive of the disk of an instance, as named by capstan
+	osvDiskDevice = "hd0"
+	// osvMirrorJob is the block job that mirrors the disk of a migrating instance
+	osvMirrorJob = "mirror-" + osvDiskDevice
+	// osvMirrorTarget is the node of the export of the disk on the target, to which the disk is mirrored
+	osvMirrorTarget = "migration-" + osvDiskDevice
+	// osvMigrationCredentials is the object with the TLS credentials of migrations
+	osvMigrationCredentials = "tls-migration"
+)
+
+// MigrateInstance mirrors the disk of a running instance to the instance that waits for it at an address, after
+// which the guest is migrated. Only the overlay of the instance is mirrored, both nodes have the base image.
+func (b *OSvBackend) MigrateInstance(ctx context.Context, instance *Instance, address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return errors.Wrapf(err, "osv: invalid migration port %q", port)
+	}
+	if b.config.Migration.CredentialsDir == "" {
+		return errors.New("osv: migrations need the pre-shared key of the nodes in migration.credentialsDir")
+	}
+	b.mu.Lock()
+	_, running := b.instancePids[instance.ID]
+	b.mu.Unlock()
+	if !running {
+		err = errors.Errorf("instance %q is not running", instance.ID)
+		return errors.Wrap(err, "osv")
+	}
+
+	qmp, err := dialQMP(ctx, b.instanceMoniPath(instance))
+	if err != nil {
+		return errors.Wrap(err, "osv")
+	}
+	defer qmp.Close()
+	if err = migrateGuest(ctx, qmp, host, portNumber, b.config.Migration.CredentialsDir); err != nil {
+		return errors.Wrap(err, "osv")
+	}
+
+	// The guest is paused here and runs on the target, the exit of the hypervisor terminates the instance as migrated
+	b.mu.Lock()
+	b.instanceMigrations[instance.ID] = address
+	b.mu.Unlock()
+	// The monitor may close before it replies
+	_ = qmp.execute("quit", nil, nil)
+	return nil
+}
+
+// migrateGuest migrates the guest of a hypervisor to the hypervisor that waits for it on a port of a host, the disk
+// is mirrored to the export on the next port. The migration only switches over to the target once the mirror is
+// complete, so the target never runs the guest on a partial disk.
+func migrateGuest(ctx context.Context, qmp *qmpClient, host string, port int, credentialsDir string) error {
+	if err := addMigrationCredentials(qmp, credentialsDir, "client"); err != nil {
+		return err
+	}
+	target := map[string]interface{}{
+		"driver":    "nbd",
+		"node-name": osvMirrorTarget,
+		"server": map[string]interface{}{
+			"type": "inet",
+			"host": host,
+			"port": strconv.Itoa(port + 1),
+		},
+		"export":    osvDiskDevice,
+		"tls-creds": osvMigrationCredentials,
+	}
+	if err := qmp.execute("blockdev-add", target, nil); err != nil {
+		return err
+	}
+	err := mirrorAndMigrate(ctx, qmp, host, port)
+	if err != nil {
+		_ = qmp.execute("migrate_cancel", nil, nil)
+		_ = qmp.execute("block-job-cancel", map[string]interface{}{"device": osvMirrorJob, "force": true}, nil)
+		_ = finishMirror(ctx, qmp)
+	}
+	if err := qmp.execute("blockdev-del", map[string]interface{}{"node-name": osvMirrorTarget}, nil); err != nil {
+		log.G(ctx).Warnf("failed to disconnect from the disk export of the target: %s", err)
+	}
+	return err
+}
+
+func mirrorAndMigrate(ctx context.Context, qmp *qmpClient, host string, port int) error {
+	// Mirror the disk to the export of the target, writes of the guest are mirrored until the job is canceled
+	mirror := map[string]interface{}{
+		"job-id":       osvMirrorJob,
+		"device":       osvDiskDevice,
+		"target":       osvMirrorTarget,
+		"sync":         "top",
+		"auto-dismiss": false,
+	}
+	if err := qmp.execute("blockdev-mirror", mirror, nil); err != nil {
+		return err
+	}
+	err := qmp.poll(ctx, func() (bool, error) {
+		var jobs []struct {
+			Device string `json:"device"`
+			Ready  bool   `json:"ready"`
+		}
+		if err := qmp.execute("query-block-jobs", nil, &jobs); err != nil {
+			return false, err
+		}
+		for _, job := range jobs {
+			if job.Device == osvMirrorJob {
+				return job.Ready, nil
+			}
+		}
+		return false, errors.New("disk mirror stopped before it was in sync")
+	})
+	if err != nil {
+		return err
+	}
+
+	// Migrate the guest, which pauses before the switch over to the target until the mirror is complete
+	capabilities := map[string]interface{}{
+		"capabilities": []map[string]interface{}{{"capability": "pause-before-switchover", "state": true}},
+	}
+	if err = qmp.execute("migrate-set-capabilities", capabilities, nil); err != nil {
+		return err
+	}
+	if err = qmp.execute("migrate-set-parameters", map[string]interface{}{"tls-creds": osvMigrationCredentials}, nil); err != nil {
+		return err
+	}
+	uri := "tcp:" + net.JoinHostPort(host, strconv.Itoa(port))
+	if err = qmp.execute("migrate", map[string]interface{}{"uri": uri}, nil); err != nil {
+		return err
+	}
+	switchedOver := false
+	return qmp.poll(ctx, func() (bool, error) {
+		var info struct {
+			Status           string `json:"status"`
+			ErrorDescription string `json:"error-desc"`
+		}
+		if err := qmp.execute("query-migrate", nil, &info); err != nil {
+			return false, err
+		}
+		switch info.Status {
+		case "pre-switchover":
+			if switchedOver {
+				return false, nil
+			}
+			// The guest no longer writes, a mirror that is in sync completes without switching to the target when
+			// it is canceled
+			if err := qmp.execute("block-job-cancel", map[string]interface{}{"device": osvMirrorJob}, nil); err != nil {
+				return false, err
+			}
+			if err := finishMirror(ctx, qmp); err != nil {
+				return false, err
+			}
+			switchedOver = true
+			return false, qmp.execute("migrate-continue", map[string]interface{}{"state": "pre-switchover"}, nil)
+		case "completed":
+			return true, nil
+		case "failed", "cancelled":
+			return false, errors.Errorf("migration %s: %s", info.Status, info.ErrorDescription)
+		}
+		return false, nil
+	})
+}
+
+// finishMirror waits until the disk mirror concluded and dismisses it, it returns the error of the mirror if it failed
+func finishMirror(ctx context.Context, qmp *qmpClient) error {
+	var mirrorErr error
+	err := qmp.poll(ctx, func() (bool, error) {
+		var jobs []struct {
+			Device string `json:"device"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := qmp.execute("query-block-jobs", nil, &jobs); err != nil {
+			return false, err
+		}
+		for _, job := range jobs {
+			if job.Device != osvMirrorJob {
+				continue
+			}
+			if job.Status != "concluded" {
+				return false, nil
+			}
+			if job.Error != "" {
+				mirrorErr = errors.Errorf("disk mirror failed: %s", job.Error)
+			}
+			return true, qmp.execute("block-job-dismiss", map[string]interface{}{"id": osvMirrorJob}, nil)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return mirrorErr
+}
+
+// acceptMigration lets an instance whose hypervisor was started paused with -incoming defer receive the guest on a
+// port and the disk on the next port. It returns once the guest runs.
+func (b *OSvBackend) acceptMigration(ctx context.Context, instance *Instance, port int) error {
+	if b.config.Migration.CredentialsDir == "" {
+		return errors.New("migrations need the pre-shared key of the nodes in migration.credentialsDir")
+	}
+	qmp, err := dialQMP(ctx, b.instanceMoniPath(instance))
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+	return receiveGuest(ctx, qmp, b.config.Migration.Address, port, b.config.Migration.CredentialsDir)
+}
+
+// receiveGuest exports the disk of a paused hypervisor that waits for a migration on the next port of an address,
+// and receives the guest on the port. The guest runs once it is received, by then the source completed the mirror of
+// the disk.
+func receiveGuest(ctx context.Context, qmp *qmpClient, address string, port int, credentialsDir string) error {
+	if err := addMigrationCredentials(qmp, credentialsDir, "server"); err != nil {
+		return err
+	}
+	// The export needs the node of the drive
+	var blocks []struct {
+		Device   string `json:"device"`
+		Inserted *struct {
+			NodeName string `json:"node-name"`
+		} `json:"inserted"`
+	}
+	if err := qmp.execute("query-block", nil, &blocks); err != nil {
+		return err
+	}
+	var nodeName string
+	for _, block := range blocks {
+		if block.Device == osvDiskDevice && block.Inserted != nil {
+			nodeName = block.Inserted.NodeName
+		}
+	}
+	if nodeName == "" {
+		return errors.Errorf("hypervisor has no disk %q", osvDiskDevice)
+	}
+	server := map[string]interface{}{
+		"addr": map[string]interface{}{
+			"type": "inet",
+			"data": map[string]interface{}{"host": address, "port": strconv.Itoa(port + 1)},
+		},
+		"tls-creds": osvMigrationCredentials,
+	}
+	if err := qmp.execute("nbd-server-start", server, nil); err != nil {
+		return err
+	}
+	err := func() error {
+		export := map[string]interface{}{
+			"type":      "nbd",
+			"id":        osvDiskDevice,
+			"node-name": nodeName,
+			"name":      osvDiskDevice,
+			"writable":  true,
+		}
+		if err := qmp.execute("block-export-add", export, nil); err != nil {
+			return err
+		}
+		if err := qmp.execute("migrate-set-parameters", map[string]interface{}{"tls-creds": osvMigrationCredentials}, nil); err != nil {
+			return err
+		}
+		uri := "tcp:" + net.JoinHostPort(address, strconv.Itoa(port))
+		if err := qmp.execute("migrate-incoming", map[string]interface{}{"uri": uri}, nil); err != nil {
+			return err
+		}
+		// The hypervisor exits if the migration fails, the guest stays paused (-S) once it is received
+		return qmp.poll(ctx, func() (bool, error) {
+			var status struct {
+				Status string `json:"status"`
+			}
+			if err := qmp.execute("query-status", nil, &status); err != nil {
+				return false, err
+			}
+			return status.Status == "paused", nil
+		})
+	}()
+	// Nothing writes to the disk of the guest but the guest itself
+	if stopErr := qmp.execute("nbd-server-stop", nil, nil); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		return err
+	}
+	return qmp.execute("cont", nil, nil)
+}
+
+// addMigrationCredentials adds the TLS credentials of an endpoint (client or server) of a migration, with the
+// pre-shared key of the nodes, in place of those of an earlier migration
+func addMigrationCredentials(qmp *qmpClient, credentialsDir, endpoint string) error {
+	_ = qmp.execute("object-del", map[string]interface{}{"id": osvMigrationCredentials}, nil)
+	credentials := map[string]interface{}{
+		"qom-type": "tls-creds-psk",
+		"id":       osvMigrationCredentials,
+		"endpoint": endpoint,
+		"dir":      credentialsDir,
+	}
+	return qmp.execute("object-add", credentials, nil)
+}
+
+// Ensure interface is implemented
+var _ MigrationBackend = (*OSvBackend)(nil)
@@ -0,0 +1,144 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.ilabt.imec.be/fledge/service/pkg/system"
+)
+
+// startHypervisor starts QEMU with TCG and a disk that is named like capstan names it, and connects to its monitor
+func startHypervisor(ctx context.Context, t *testing.T, dir, name string, args ...string) *qmpClient {
+	t.Helper()
+	monitor := filepath.Join(dir, name+".monitor")
+	args = append([]string{
+		"-machine", "accel=tcg",
+		"-m", "64",
+		"-nodefaults",
+		"-display", "none",
+		"-qmp", "unix:" + monitor + ",server=on,wait=off",
+		"-drive", "file=" + filepath.Join(dir, name+".qcow2") + ",format=qcow2,if=none,id=" + osvDiskDevice,
+		"-device", "virtio-blk-pci,drive=" + osvDiskDevice,
+	}, args...)
+	cmd := exec.Command("qemu-system-x86_64", args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	qmp, err := dialQMP(ctx, monitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { qmp.Close() })
+	return qmp
+}
+
+func qemuImg(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img failed: %s\n%s", err, out)
+	}
+}
+
+// qemuIO runs a qemu-io command on the disk of a hypervisor
+func qemuIO(t *testing.T, qmp *qmpClient, command string) string {
+	t.Helper()
+	var out string
+	err := qmp.execute("human-monitor-command", map[string]interface{}{
+		"command-line": "qemu-io " + osvDiskDevice + " \"" + command + "\"",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func hypervisorStatus(t *testing.T, qmp *qmpClient) string {
+	t.Helper()
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := qmp.execute("query-status", nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	return status.Status
+}
+
+func TestMigrateGuest(t *testing.T) {
+	for _, name := range []string{"qemu-system-x86_64", "qemu-img"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// Both nodes have the base image, each instance has its own overlay
+	base := filepath.Join(dir, "base.qcow2")
+	qemuImg(t, "create", "-f", "qcow2", base, "64M")
+	for _, name := range []string{"source", "target"} {
+		qemuImg(t, "create", "-f", "qcow2", "-F", "qcow2", "-b", base, filepath.Join(dir, name+".qcow2"))
+	}
+	credentialsDir := filepath.Join(dir, "credentials")
+	if err := os.Mkdir(credentialsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	key := "qemu:" + strings.Repeat("5a", 32) + "\n"
+	if err := os.WriteFile(filepath.Join(credentialsDir, "keys.psk"), []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	port, err := system.AvailablePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := startHypervisor(ctx, t, dir, "source")
+	target := startHypervisor(ctx, t, dir, "target", "-incoming", "defer", "-S")
+	// The guest wrote to its disk before it is migrated
+	qemuIO(t, source, "write -P 0x5a 0 1M")
+
+	received := make(chan error, 1)
+	go func() {
+		received <- receiveGuest(ctx, target, "127.0.0.1", port, credentialsDir)
+	}()
+	// The disk is exported before the guest is received
+	for {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err = migrateGuest(ctx, source, "127.0.0.1", port, credentialsDir); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-received; err != nil {
+		t.Fatal(err)
+	}
+
+	if status := hypervisorStatus(t, source); status != "postmigrate" {
+		t.Fatalf("expected the source to be stopped after the migration, got %q", status)
+	}
+	if status := hypervisorStatus(t, target); status != "running" {
+		t.Fatalf("expected the target to run the guest, got %q", status)
+	}
+	// The target has the writes of the source
+	if out := qemuIO(t, target, "read -P 0x5a 0 1M"); strings.Contains(out, "verification failed") || !strings.Contains(out, "read 1048576/1048576") {
+		t.Fatalf("the disk of the target differs from the source:\n%s", out)
+	}
+}
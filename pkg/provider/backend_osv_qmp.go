@@ -0,0 +1,146 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+const (
+	// qmpDialTimeout is how long the monitor socket of a hypervisor that is starting is waited for
+	qmpDialTimeout = 10 * time.Second
+	// qmpPollInterval is the interval at which the hypervisor is asked about the progress of a migration
+	qmpPollInterval = 250 * time.Millisecond
+)
+
+// A qmpClient executes commands on the QMP monitor of a QEMU hypervisor
+// The monitor accepts one client at a time, so clients should be closed as soon as possible.
+type qmpClient struct {
+	conn    net.Conn
+	decoder *json.Decoder
+	encoder *json.Encoder
+	done    chan struct{}
+}
+
+// qmpResponse is a reply to a command or an asynchronous event, which is ignored
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class       string `json:"class"`
+		Description string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// dialQMP connects to the monitor socket of a hypervisor and negotiates the capabilities
+// The connection is closed when the context is done.
+func dialQMP(ctx context.Context, path string) (*qmpClient, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	deadline := time.Now().Add(qmpDialTimeout)
+	for {
+		var dialer net.Dialer
+		if conn, err = dialer.DialContext(ctx, "unix", path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			return nil, errors.Wrapf(err, "failed to connect to monitor %q", path)
+		}
+		time.Sleep(qmpPollInterval)
+	}
+	c := &qmpClient{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(conn),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-c.done:
+		}
+	}()
+
+	// The greeting announces the version, after which commands are only accepted once the capabilities are negotiated
+	var greeting map[string]json.RawMessage
+	if err = c.decoder.Decode(&greeting); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "failed to read greeting of monitor")
+	}
+	if err = c.execute("qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// executeQMP runs a command without arguments on the monitor of a running instance
+func (b *OSvBackend) executeQMP(ctx context.Context, instance *Instance, command string) error {
+	b.mu.Lock()
+	_, running := b.instancePids[instance.ID]
+	b.mu.Unlock()
+	if !running {
+		return errors.Errorf("instance %q is not running", instance.ID)
+	}
+	qmp, err := dialQMP(ctx, b.instanceMoniPath(instance))
+	if err != nil {
+		return err
+	}
+	defer qmp.Close()
+	return qmp.execute(command, nil, nil)
+}
+
+// execute runs a command with its arguments (nil if it has none) and decodes what it returns into result (nil to
+// ignore it)
+func (c *qmpClient) execute(command string, arguments interface{}, result interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	if err := c.encoder.Encode(request); err != nil {
+		return errors.Wrapf(err, "failed to send %s", command)
+	}
+	for {
+		var response qmpResponse
+		if err := c.decoder.Decode(&response); err != nil {
+			return errors.Wrapf(err, "failed to receive reply to %s", command)
+		}
+		if response.Event != "" {
+			continue
+		}
+		if response.Error != nil {
+			return errors.Errorf("%s failed: %s (%s)", command, response.Error.Description, response.Error.Class)
+		}
+		if result == nil || len(response.Return) == 0 {
+			return nil
+		}
+		return json.Unmarshal(response.Return, result)
+	}
+}
+
+// poll executes fn at the poll interval until it reports that it is done or fails
+func (c *qmpClient) poll(ctx context.Context, fn func() (bool, error)) error {
+	ticker := time.NewTicker(qmpPollInterval)
+	defer ticker.Stop()
+	for {
+		done, err := fn()
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *qmpClient) Close() error {
+	close(c.done)
+	return c.conn.Close()
+}
@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	ociv1ext "gitlab.ilabt.imec.be/fledge/service/pkg/oci/v1/ext"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The backend of an instance is selected in this order of precedence:
+//  1. the runtime class of the pod, mapped to a backend by Config.RuntimeClasses (runtime classes that only have a
+//     runtime handler in Config.Containerd select containerd)
+//  2. the fledge.io/backend annotation of the pod
+//  3. the fledge.backend field of the config of the image of the container in the registry
+//  4. the default backend of the node, Config.Default
+//
+// Pods that select a backend that is not enabled, or a runtime class that is not configured, are rejected.
+
+// annotationBackend selects the backend of all instances of a pod
+const annotationBackend = "fledge.io/backend"
+
+// Reasons in the status of rejected pods
+const (
+	reasonBackendNotEnabled         = "BackendNotEnabled"
+	reasonRuntimeClassNotConfigured = "RuntimeClassNotConfigured"
+)
+
+// A rejectionError explains why a pod can not run on the node
+type rejectionError struct {
+	Reason  string
+	Message string
+}
+
+func (e *rejectionError) Error() string {
+	return e.Message
+}
+
+// podBackendName returns the backend that a pod selects with its runtime class or annotation, empty if the images of
+// its containers decide
+func (p *Provider) podBackendName(pod *corev1.Pod) (string, error) {
+	if rc := runtimeClassName(pod); rc != "" {
+		name, ok := p.config.RuntimeClasses[rc]
+		if !ok {
+			if _, ok = p.config.Containerd.RuntimeHandlers[rc]; !ok {
+				return "", &rejectionError{
+					Reason:  reasonRuntimeClassNotConfigured,
+					Message: fmt.Sprintf("Runtime class %q is not configured on node %q", rc, p.nodeName),
+				}
+			}
+			name = BackendContainerd
+		}
+		return name, p.checkBackendEnabled(name)
+	}
+	if name := pod.Annotations[annotationBackend]; name != "" {
+		return name, p.checkBackendEnabled(name)
+	}
+	return "", nil
+}
+
+// instanceBackendName returns the backend of a container of a pod, given the config of its image
+func (p *Provider) instanceBackendName(pod *corev1.Pod, im ociv1ext.Image) (string, error) {
+	name, err := p.podBackendName(pod)
+	if err != nil || name != "" {
+		return name, err
+	}
+	if im.Backend != "" {
+		return im.Backend, p.checkBackendEnabled(im.Backend)
+	}
+	return p.config.Default, nil
+}
+
+func (p *Provider) checkBackendEnabled(name string) error {
+	if _, ok := p.backends[name]; !ok {
+		return &rejectionError{
+			Reason:  reasonBackendNotEnabled,
+			Message: fmt.Sprintf("Backend %q is not enabled on node %q", name, p.nodeName),
+		}
+	}
+	return nil
+}
+
+// rejectPod reports a pod as failed until it is deleted, none of its instances are created
+func (p *Provider) rejectPod(ctx context.Context, pod *corev1.Pod, rejection *rejectionError) {
+	podID := podToIdentifier(pod)
+	log.G(ctx).Warnf("rejecting pod %q: %s", podID, rejection.Message)
+
+	p.mu.Lock()
+	p.rejections[podID] = rejection
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		delete(p.waiting, podAndContainerToIdentifier(pod, &c))
+	}
+	p.mu.Unlock()
+
+	if p.eventRecorder != nil {
+		p.eventRecorder.Event(pod, corev1.EventTypeWarning, rejection.Reason, rejection.Message)
+	}
+}
+
+func (p *Provider) getRejection(pod *corev1.Pod) (*rejectionError, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rejection, ok := p.rejections[podToIdentifier(pod)]
+	return rejection, ok
+}
+
+// rejectedPodStatus returns the terminal status of a rejected pod
+func rejectedPodStatus(rejection *rejectionError) *corev1.PodStatus {
+	return &corev1.PodStatus{
+		Phase:   corev1.PodFailed,
+		Reason:  rejection.Reason,
+		Message: rejection.Message,
+	}
+}
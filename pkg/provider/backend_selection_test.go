@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	ociv1ext "gitlab.ilabt.imec.be/fledge/service/pkg/oci/v1/ext"
+)
+
+func TestInstanceBackendName(t *testing.T) {
+	p := newTestProvider(newTestBackend(nil))
+	p.backends[BackendOsv] = newTestBackend(nil)
+	p.config.RuntimeClasses = map[string]string{"vm": BackendOsv, "wasm": "wasm"}
+	p.config.Containerd.RuntimeHandlers = map[string]string{"gvisor": "io.containerd.runsc.v1"}
+
+	tests := []struct {
+		name         string
+		runtimeClass string
+		annotation   string
+		image        string
+		expected     string
+		rejection    string
+	}{
+		{name: "default", expected: BackendContainerd},
+		{name: "image", image: BackendOsv, expected: BackendOsv},
+		{name: "annotation over image", annotation: BackendContainerd, image: BackendOsv, expected: BackendContainerd},
+		{name: "runtime class over annotation", runtimeClass: "vm", annotation: BackendContainerd, image: BackendContainerd, expected: BackendOsv},
+		{name: "runtime handler of containerd", runtimeClass: "gvisor", annotation: BackendOsv, expected: BackendContainerd},
+		{name: "unknown runtime class", runtimeClass: "kata", rejection: reasonRuntimeClassNotConfigured},
+		{name: "runtime class of a backend that is not enabled", runtimeClass: "wasm", rejection: reasonBackendNotEnabled},
+		{name: "annotation of a backend that is not enabled", annotation: "wasm", image: BackendOsv, rejection: reasonBackendNotEnabled},
+		{name: "image of a backend that is not enabled", image: "wasm", rejection: reasonBackendNotEnabled},
+	}
+	for _, test := range tests {
+		pod := newTestPod("a")
+		delete(pod.Annotations, annotationBackend)
+		if test.annotation != "" {
+			pod.Annotations[annotationBackend] = test.annotation
+		}
+		if test.runtimeClass != "" {
+			runtimeClass := test.runtimeClass
+			pod.Spec.RuntimeClassName = &runtimeClass
+		}
+		var im ociv1ext.Image
+		im.Backend = test.image
+
+		name, err := p.instanceBackendName(pod, im)
+		var rejection *rejectionError
+		switch {
+		case test.rejection != "":
+			if !errors.As(err, &rejection) || rejection.Reason != test.rejection {
+				t.Errorf("%s: expected the rejection %s, got %v", test.name, test.rejection, err)
+			}
+		case err != nil:
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		case name != test.expected:
+			t.Errorf("%s: expected the backend %q, got %q", test.name, test.expected, name)
+		}
+	}
+}
+
+func TestCreatePodRejection(t *testing.T) {
+	p := newTestProvider(newTestBackend(nil))
+	pod := newTestPod("a")
+	pod.Annotations[annotationBackend] = BackendOsv
+	if err := p.CreatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	rejection, ok := p.getRejection(pod)
+	if !ok || rejection.Reason != reasonBackendNotEnabled {
+		t.Fatalf("expected the pod to be rejected with %s, got %+v", reasonBackendNotEnabled, rejection)
+	}
+	// Rejected pods are not deployed
+	if len(p.deployments) != 0 {
+		t.Errorf("expected no deployment of the pod, got %d", len(p.deployments))
+	}
+	status, err := p.GetPodStatus(context.Background(), pod.Namespace, pod.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Reason != reasonBackendNotEnabled {
+		t.Errorf("expected the reason %s in the status of the pod, got %q", reasonBackendNotEnabled, status.Reason)
+	}
+}
@@ -0,0 +1,438 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	"github.com/containerd/containerd/log"
+	systemddbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Drivers of the cgroups of pods, the same as the ones of the kubelet
+// With the systemd driver the cgroups of pods are slices of systemd and runc creates the instances in scopes, so
+// systemd is the only one that manages the hierarchy.
+const (
+	CgroupDriverCgroupfs = "cgroupfs"
+	CgroupDriverSystemd  = "systemd"
+)
+
+// systemdScopePrefix is the prefix of the scopes of instances with the systemd cgroup driver
+const systemdScopePrefix = "fledge"
+
+// unifiedMountpoint is where the unified hierarchy (cgroup v2) is mounted
+const unifiedMountpoint = "/sys/fs/cgroup"
+
+// Names in the cgroup hierarchy of the pods, the same as the ones of the kubelet
+// Guaranteed pods live directly in kubepods, the pods of the other classes in the cgroup of their class.
+const (
+	cgroupKubepods   = "kubepods"
+	cgroupBurstable  = "burstable"
+	cgroupBestEffort = "besteffort"
+	cgroupPodPrefix  = "pod"
+)
+
+// oom_score_adj of the processes of pods by QoS class, the same as the ones of the kubelet
+// The score of Burstable pods lies in between, depending on their memory requests.
+const (
+	sandboxOOMScoreAdj    = -998
+	guaranteedOOMScoreAdj = -997
+	besteffortOOMScoreAdj = 1000
+)
+
+// A cgroupManager builds the cgroup hierarchy in which the instances of pods run
+// Every pod has a cgroup that enforces the limits of the pod as a whole (including its overhead), the instances
+// of the pod (and its sandbox) are created by the runtime in the cgroup of the pod.
+type cgroupManager struct {
+	// root is the path of the kubepods cgroup
+	root string
+	// v2 is set on hosts with only the unified hierarchy
+	v2 bool
+	// systemd is set if the cgroups are slices of systemd, which are named after their parents like with the kubelet
+	// (e.g. kubepods-burstable-pod<uid>.slice)
+	systemd   bool
+	pidsLimit int64
+}
+
+func newCgroupManager(ctx context.Context, config ResourcesConfig) (*cgroupManager, error) {
+	mode := cgroups.Mode()
+	if mode == cgroups.Unavailable {
+		return nil, errors.New("cgroups are not available")
+	}
+	m := &cgroupManager{
+		v2:        mode == cgroups.Unified,
+		systemd:   config.CgroupDriver == CgroupDriverSystemd,
+		pidsLimit: config.PodPidsLimit,
+	}
+	parent := filepath.Join("/", config.CgroupParent)
+	if m.systemd && parent != "/" && !strings.HasSuffix(parent, ".slice") {
+		return nil, errors.Errorf("cgroup parent %q is not a slice of systemd", config.CgroupParent)
+	}
+	m.root = m.child(parent, cgroupKubepods)
+	// BestEffort pods only get CPU time that the other pods leave
+	shares := uint64(minShares)
+	qosCgroups := []string{m.root, m.child(m.root, cgroupBurstable), m.child(m.root, cgroupBestEffort)}
+	qosResources := []*specs.LinuxResources{{}, {}, {CPU: &specs.LinuxCPU{Shares: &shares}}}
+	for i, path := range qosCgroups {
+		if err := m.create(ctx, path, qosResources[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to create cgroup %q", path)
+		}
+	}
+	// Remove the cgroups of pods that are left from an earlier run, their instances are already gone
+	for _, path := range qosCgroups {
+		entries, err := os.ReadDir(m.hostPath(path))
+		if err != nil {
+			continue
+		}
+		podPrefix := strings.TrimSuffix(filepath.Base(m.child(path, cgroupPodPrefix)), ".slice")
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), podPrefix) {
+				continue
+			}
+			if err = m.delete(ctx, filepath.Join(path, entry.Name())); err != nil {
+				log.G(ctx).Warnf("failed to remove cgroup of old pod %q: %s", entry.Name(), err)
+			}
+		}
+	}
+	log.G(ctx).Infof("using cgroup %q for pods with the %s cgroup driver", m.root, config.CgroupDriver)
+	return m, nil
+}
+
+// child returns the path of a child cgroup, with systemd the child is a slice named after its parent and dashes in
+// the name of the child are escaped
+func (m *cgroupManager) child(parent, name string) string {
+	if !m.systemd {
+		return filepath.Join(parent, name)
+	}
+	name = strings.ReplaceAll(name, "-", "_")
+	if prefix := strings.TrimSuffix(filepath.Base(parent), ".slice"); parent != "/" && prefix != "-" {
+		name = prefix + "-" + name
+	}
+	return filepath.Join(parent, name+".slice")
+}
+
+// podCgroup returns the path of the cgroup of a pod
+func (m *cgroupManager) podCgroup(pod *corev1.Pod) string {
+	parent := m.root
+	switch podQOSClass(pod) {
+	case corev1.PodQOSBurstable:
+		parent = m.child(m.root, cgroupBurstable)
+	case corev1.PodQOSBestEffort:
+		parent = m.child(m.root, cgroupBestEffort)
+	}
+	return m.child(parent, cgroupPodPrefix+string(pod.UID))
+}
+
+// createPod creates the cgroup of a pod with the limits of the pod and returns its path
+func (m *cgroupManager) createPod(ctx context.Context, pod *corev1.Pod) (string, error) {
+	requests, limits := podResources(pod)
+	resources := &specs.LinuxResources{CPU: &specs.LinuxCPU{}}
+	// CPU
+	shares := uint64(minShares)
+	if podQOSClass(pod) != corev1.PodQOSBestEffort {
+		shares = milliCPUToShares(requests.Cpu().MilliValue())
+	}
+	resources.CPU.Shares = &shares
+	if cpuLimitMillis := limits.Cpu().MilliValue(); cpuLimitMillis > 0 {
+		period := uint64(100000)
+		quota := 100 * cpuLimitMillis
+		resources.CPU.Period = &period
+		resources.CPU.Quota = &quota
+	}
+	// Memory
+	if memoryLimit := limits.Memory().Value(); memoryLimit > 0 {
+		resources.Memory = &specs.LinuxMemory{Limit: &memoryLimit}
+	}
+	// Huge pages
+	hugePages, err := hugePageLimits(limits)
+	if err != nil {
+		return "", err
+	}
+	for pageSize, limit := range hugePages {
+		resources.HugepageLimits = append(resources.HugepageLimits, specs.LinuxHugepageLimit{Pagesize: pageSize, Limit: limit})
+	}
+	// Processes
+	if m.pidsLimit > 0 {
+		resources.Pids = &specs.LinuxPids{Limit: m.pidsLimit}
+	}
+
+	path := m.podCgroup(pod)
+	if err = m.create(ctx, path, resources); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// deletePod removes the cgroup of a pod, which fails as long as processes of the pod remain
+func (m *cgroupManager) deletePod(ctx context.Context, pod *corev1.Pod) error {
+	return m.delete(ctx, m.podCgroup(pod))
+}
+
+// podStats returns the usage of all processes in the cgroup of a pod
+func (m *cgroupManager) podStats(pod *corev1.Pod) (InstanceStats, error) {
+	path := m.podCgroup(pod)
+	if m.v2 {
+		cg, err := cgroupsv2.LoadManager(unifiedMountpoint, path)
+		if err != nil {
+			return InstanceStats{}, err
+		}
+		metrics, err := cg.Stat()
+		if err != nil {
+			return InstanceStats{}, err
+		}
+		return instanceStatsFromCgroupV2(metrics), nil
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(path))
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	metrics, err := cg.Stat(cgroups.IgnoreNotExist)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	return instanceStatsFromCgroupV1(metrics), nil
+}
+
+// create creates a cgroup with resources, with systemd the slice is started first
+// The resources are written to the cgroup as well, systemd has no properties for some of them (e.g. huge pages).
+func (m *cgroupManager) create(ctx context.Context, path string, resources *specs.LinuxResources) error {
+	if m.systemd {
+		if err := m.startSlice(ctx, filepath.Base(path), resources); err != nil {
+			return err
+		}
+	}
+	if m.v2 {
+		_, err := cgroupsv2.NewManager(unifiedMountpoint, path, cgroupsv2.ToResources(resources))
+		return err
+	}
+	_, err := cgroups.New(cgroups.V1, cgroups.StaticPath(path), resources)
+	return err
+}
+
+func (m *cgroupManager) delete(ctx context.Context, path string) error {
+	if m.systemd {
+		if err := m.stopSlice(ctx, filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+	if m.v2 {
+		if _, err := os.Stat(m.hostPath(path)); os.IsNotExist(err) {
+			return nil
+		}
+		cg, err := cgroupsv2.LoadManager(unifiedMountpoint, path)
+		if err != nil {
+			return err
+		}
+		return cg.Delete()
+	}
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(path))
+	if err == cgroups.ErrCgroupDeleted {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cg.Delete()
+}
+
+// startSlice starts the slice of a cgroup with the properties of its resources, or updates them if it exists already
+// Otherwise systemd resets the resources that were written to the cgroup whenever it reloads.
+func (m *cgroupManager) startSlice(ctx context.Context, name string, resources *specs.LinuxResources) error {
+	conn, err := systemddbus.NewWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to systemd")
+	}
+	defer conn.Close()
+
+	properties := m.sliceProperties(resources)
+	done := make(chan string, 1)
+	_, err = conn.StartTransientUnitContext(ctx, name, "replace", append([]systemddbus.Property{
+		systemddbus.PropDescription("fledge cgroup " + name),
+		systemddbus.Property{Name: "DefaultDependencies", Value: dbus.MakeVariant(false)},
+	}, properties...), done)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.UnitExists" {
+		return conn.SetUnitPropertiesContext(ctx, name, true, properties...)
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case result := <-done:
+		if result != "done" {
+			return errors.Errorf("failed to start slice %q: %s", name, result)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// sliceProperties converts resources to the properties of a slice, like runc does
+func (m *cgroupManager) sliceProperties(resources *specs.LinuxResources) []systemddbus.Property {
+	property := func(name string, value interface{}) systemddbus.Property {
+		return systemddbus.Property{Name: name, Value: dbus.MakeVariant(value)}
+	}
+	properties := []systemddbus.Property{
+		property("MemoryAccounting", true),
+		property("CPUAccounting", true),
+		property("TasksAccounting", true),
+	}
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil {
+			if m.v2 {
+				properties = append(properties, property("CPUWeight", sharesToWeight(*cpu.Shares)))
+			} else {
+				properties = append(properties, property("CPUShares", *cpu.Shares))
+			}
+		}
+		if cpu.Quota != nil && cpu.Period != nil && *cpu.Quota > 0 && *cpu.Period > 0 {
+			// systemd only has a quota per second in steps of 10ms, the quota and period are written as well
+			quota := uint64(*cpu.Quota) * 1000000 / *cpu.Period
+			if quota%10000 != 0 {
+				quota = (quota/10000 + 1) * 10000
+			}
+			properties = append(properties, property("CPUQuotaPerSecUSec", quota))
+		}
+	}
+	if resources.Memory != nil && resources.Memory.Limit != nil && *resources.Memory.Limit > 0 {
+		if m.v2 {
+			properties = append(properties, property("MemoryMax", uint64(*resources.Memory.Limit)))
+		} else {
+			properties = append(properties, property("MemoryLimit", uint64(*resources.Memory.Limit)))
+		}
+	}
+	if resources.Pids != nil && resources.Pids.Limit > 0 {
+		properties = append(properties, property("TasksMax", uint64(resources.Pids.Limit)))
+	}
+	return properties
+}
+
+// stopSlice stops the slice of a cgroup, which removes the cgroup
+func (m *cgroupManager) stopSlice(ctx context.Context, name string) error {
+	conn, err := systemddbus.NewWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to systemd")
+	}
+	defer conn.Close()
+	done := make(chan string, 1)
+	_, err = conn.StopUnitContext(ctx, name, "replace", done)
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.systemd1.NoSuchUnit" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case result := <-done:
+		if result != "done" {
+			return errors.Errorf("failed to stop slice %q: %s", name, result)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// hostPath returns the directory of a cgroup, for cgroup v1 the one of the memory controller
+func (m *cgroupManager) hostPath(path string) string {
+	if m.v2 {
+		return filepath.Join(unifiedMountpoint, path)
+	}
+	return filepath.Join(unifiedMountpoint, string(cgroups.Memory), path)
+}
+
+// deletePodCgroup removes the cgroup of a pod once all of its instances are gone
+func (p *Provider) deletePodCgroup(ctx context.Context, pod *corev1.Pod) {
+	if p.cgroups == nil {
+		return
+	}
+	if err := p.cgroups.deletePod(ctx, pod); err != nil {
+		log.G(ctx).Errorf("failed to remove cgroup of pod %q: %s", podToIdentifier(pod), err)
+	}
+}
+
+// podResources returns the resources of a pod as a whole, like the kubelet
+// The instances run at the same time, so their resources add up. The init containers run one after the other before
+// them, so only the largest one counts if it exceeds the sum. A resource is only limited if every container limits
+// it. The overhead of the pod is added on top.
+func podResources(pod *corev1.Pod) (corev1.ResourceList, corev1.ResourceList) {
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	unlimited := map[corev1.ResourceName]bool{}
+	limited := func(name corev1.ResourceName, containers []corev1.Container) bool {
+		for _, container := range containers {
+			if _, ok := container.Resources.Limits[name]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if !limited(name, pod.Spec.Containers) || !limited(name, pod.Spec.InitContainers) {
+			unlimited[name] = true
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		addResourceList(requests, container.Resources.Requests)
+		addResourceList(limits, container.Resources.Limits)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		maxResourceList(requests, container.Resources.Requests)
+		maxResourceList(limits, container.Resources.Limits)
+	}
+	for name := range unlimited {
+		delete(limits, name)
+	}
+	addResourceList(requests, pod.Spec.Overhead)
+	if len(limits) > 0 {
+		addResourceList(limits, pod.Spec.Overhead)
+	}
+	return requests, limits
+}
+
+func addResourceList(list corev1.ResourceList, add corev1.ResourceList) {
+	for name, quantity := range add {
+		sum := list[name]
+		sum.Add(quantity)
+		list[name] = sum
+	}
+}
+
+func maxResourceList(list corev1.ResourceList, other corev1.ResourceList) {
+	for name, quantity := range other {
+		if current, ok := list[name]; !ok || quantity.Cmp(current) > 0 {
+			list[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+// oomScoreAdj returns the oom_score_adj of the processes of an instance, Burstable instances that request more
+// memory are less likely to be killed
+func oomScoreAdj(qosClass corev1.PodQOSClass, memoryRequest int64) int {
+	switch qosClass {
+	case corev1.PodQOSGuaranteed:
+		return guaranteedOOMScoreAdj
+	case corev1.PodQOSBestEffort:
+		return besteffortOOMScoreAdj
+	}
+	nodeMemory, _, err := nodeMemoryAndSwap()
+	if err != nil || nodeMemory == 0 {
+		return besteffortOOMScoreAdj - 1
+	}
+	score := besteffortOOMScoreAdj - int(1000*float64(memoryRequest)/float64(nodeMemory))
+	if score < 1000+guaranteedOOMScoreAdj {
+		return 1000 + guaranteedOOMScoreAdj
+	}
+	if score >= besteffortOOMScoreAdj {
+		return besteffortOOMScoreAdj - 1
+	}
+	return score
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPodCgroup(t *testing.T) {
+	burstable := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{UID: types.UID("1b4e28ba-2fa1-11d2")},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}},
+		}}},
+	}
+	tests := []struct {
+		driver   string
+		parent   string
+		expected string
+		instance string
+	}{
+		{CgroupDriverCgroupfs, "/", "/kubepods/burstable/pod1b4e28ba-2fa1-11d2", "/kubepods/burstable/pod1b4e28ba-2fa1-11d2/default-pod-c"},
+		{CgroupDriverCgroupfs, "/fledge", "/fledge/kubepods/burstable/pod1b4e28ba-2fa1-11d2", "/fledge/kubepods/burstable/pod1b4e28ba-2fa1-11d2/default-pod-c"},
+		{CgroupDriverSystemd, "/", "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b4e28ba_2fa1_11d2.slice", "kubepods-burstable-pod1b4e28ba_2fa1_11d2.slice:fledge:default-pod-c"},
+		{CgroupDriverSystemd, "/fledge.slice", "/fledge.slice/fledge-kubepods.slice/fledge-kubepods-burstable.slice/fledge-kubepods-burstable-pod1b4e28ba_2fa1_11d2.slice", "fledge-kubepods-burstable-pod1b4e28ba_2fa1_11d2.slice:fledge:default-pod-c"},
+	}
+	for _, test := range tests {
+		m := &cgroupManager{systemd: test.driver == CgroupDriverSystemd}
+		m.root = m.child(test.parent, cgroupKubepods)
+		path := m.podCgroup(burstable)
+		if path != test.expected {
+			t.Errorf("expected cgroup %q with the %s driver under %q, got %q", test.expected, test.driver, test.parent, path)
+		}
+		b := &ContainerdBackend{config: Config{Resources: ResourcesConfig{CgroupDriver: test.driver}}}
+		if instance := b.cgroupsPath(path, "default-pod-c"); instance != test.instance {
+			t.Errorf("expected instance cgroup %q with the %s driver, got %q", test.instance, test.driver, instance)
+		}
+	}
+}
+
+func TestSliceProperties(t *testing.T) {
+	shares := uint64(512)
+	quota := int64(15000)
+	period := uint64(100000)
+	memory := int64(1 << 30)
+	resources := &specs.LinuxResources{
+		CPU:    &specs.LinuxCPU{Shares: &shares, Quota: &quota, Period: &period},
+		Memory: &specs.LinuxMemory{Limit: &memory},
+		Pids:   &specs.LinuxPids{Limit: 100},
+	}
+	for _, v2 := range []bool{false, true} {
+		m := &cgroupManager{systemd: true, v2: v2}
+		values := map[string]interface{}{}
+		for _, property := range m.sliceProperties(resources) {
+			values[property.Name] = property.Value.Value()
+		}
+		expected := map[string]interface{}{
+			"MemoryAccounting":   true,
+			"CPUAccounting":      true,
+			"TasksAccounting":    true,
+			"CPUQuotaPerSecUSec": uint64(150000),
+			"TasksMax":           uint64(100),
+		}
+		if v2 {
+			expected["CPUWeight"] = sharesToWeight(shares)
+			expected["MemoryMax"] = uint64(memory)
+		} else {
+			expected["CPUShares"] = shares
+			expected["MemoryLimit"] = uint64(memory)
+		}
+		if len(values) != len(expected) {
+			t.Errorf("expected the properties %v (v2: %t), got %v", expected, v2, values)
+		}
+		for name, value := range expected {
+			if values[name] != value {
+				t.Errorf("expected property %s to be %v (v2: %t), got %v", name, value, v2, values[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// annotationRestorePrefix followed by the name of a container restores the container from the checkpoint at the
+// location in the value, either an image reference or the absolute path of an archive
+const annotationRestorePrefix = "restore.fledge.io/"
+
+// mediaTypeCheckpointConfig is the media type of the config of checkpoint images
+const mediaTypeCheckpointConfig = "application/vnd.fledge.checkpoint.config.v1+json"
+
+// A checkpointConfig is the config of a checkpoint image, its layers are the blobs of the checkpoint of the backend
+type checkpointConfig struct {
+	// Image is the image of the checkpointed instance, which is restored on top of it
+	Image string `json:"image"`
+	// Instance is the identifier of the checkpointed instance
+	Instance string `json:"instance"`
+	// Created is the time of the checkpoint
+	Created time.Time `json:"created"`
+}
+
+// A CheckpointBackend is a Backend that can checkpoint running instances and restore instances from checkpoints
+type CheckpointBackend interface {
+	Backend
+	// CheckpointInstance checkpoints the processes and the root filesystem of a running instance, which keeps
+	// running, and exports the checkpoint to a location (an image reference or the absolute path of an archive)
+	CheckpointInstance(ctx context.Context, instance *Instance, location string) error
+}
+
+// CheckpointContainer checkpoints a container of a pod and returns the location of the checkpoint
+// The location can be used in the restore annotation of a pod on any node that can reach it.
+func (p *Provider) CheckpointContainer(ctx context.Context, namespace, pod, container string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "CheckpointContainer")
+	defer span.End()
+
+	// Add the pod's coordinates to the current span.
+	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, pod, containerNameKey, container)
+
+	log.G(ctx).Debugf("receive CheckpointContainer %q", container)
+
+	// CRIU needs root
+	if p.rootless != nil {
+		return "", errdefs.InvalidInput("checkpoints are not available in rootless mode")
+	}
+
+	instance, ok := p.getInstance(namespace, pod, container)
+	if !ok {
+		return "", errdefs.NotFoundf("container %q of pod %s/%s not found", container, namespace, pod)
+	}
+	backend, ok := instance.Backend.(CheckpointBackend)
+	if !ok {
+		return "", errdefs.InvalidInputf("backend %q can not checkpoint instances", instance.BackendName())
+	}
+
+	location, err := p.checkpointLocation(namespace, pod, container)
+	if err != nil {
+		return "", err
+	}
+	log.G(ctx).Infof("checkpointing instance %q to %q", instance.ID, location)
+	start := time.Now()
+	if err = backend.CheckpointInstance(ctx, instance, location); err != nil {
+		return "", countError(instance.BackendName(), operationCheckpoint, err)
+	}
+	log.G(ctx).Infof("checkpointed instance %q in %s", instance.ID, time.Since(start).Round(time.Millisecond))
+	return location, nil
+}
+
+// checkpointLocation returns where a new checkpoint of a container is exported to, named like the checkpoints of the
+// kubelet
+func (p *Provider) checkpointLocation(namespace, pod, container string) (string, error) {
+	name := fmt.Sprintf("checkpoint-%s_%s-%s-%s", pod, namespace, container, time.Now().UTC().Format("2006-01-02T15-04-05Z"))
+	if p.config.Checkpoint.Repository != "" {
+		named, err := docker.ParseDockerRef(p.config.Checkpoint.Repository + ":" + name)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid checkpoint repository %q", p.config.Checkpoint.Repository)
+		}
+		return named.String(), nil
+	}
+	dir, err := p.config.Checkpoint.directory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".tar"), nil
+}
+
+// directory returns the absolute path of the directory of checkpoint archives
+func (c CheckpointConfig) directory() (string, error) {
+	dir := c.Directory
+	if dir == "" {
+		dir = storage.CheckpointsPath()
+	}
+	return filepath.Abs(dir)
+}
+
+// inDirectory reports whether a path is below a directory, without following symlinks
+func inDirectory(dir, path string) bool {
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// restoreLocation returns the location of the checkpoint from which a container of a pod is restored, empty if the
+// container starts anew
+// Archives are read as root, so pods can only restore the archives in the checkpoint directory.
+func (p *Provider) restoreLocation(pod *corev1.Pod, container *corev1.Container) (string, error) {
+	location := pod.Annotations[annotationRestorePrefix+container.Name]
+	if location == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(location) {
+		dir, err := p.config.Checkpoint.directory()
+		if err != nil {
+			return "", err
+		}
+		if !inDirectory(dir, location) {
+			return "", errors.Errorf("checkpoint %q is not in the checkpoint directory %q", location, dir)
+		}
+		return filepath.Clean(location), nil
+	}
+	named, err := docker.ParseDockerRef(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid checkpoint location %q", location)
+	}
+	return named.String(), nil
+}
@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// memoryLabelStore keeps the labels of a local content store in memory
+type memoryLabelStore struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *memoryLabelStore) Get(d digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[d], nil
+}
+
+func (s *memoryLabelStore) Set(d digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[d] = labels
+	return nil
+}
+
+func (s *memoryLabelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[d]
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[d] = labels
+	return labels, nil
+}
+
+func newTestContentStore(t *testing.T) content.Store {
+	t.Helper()
+	store, err := local.NewLabeledStore(t.TempDir(), &memoryLabelStore{labels: map[digest.Digest]map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func writeTestBlob(t *testing.T, ctx context.Context, store content.Store, mediaType string, data []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestCheckpointArchive(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A checkpoint of containerd is an index of the blobs of CRIU and the runtime
+	source := newTestContentStore(t)
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			writeTestBlob(t, ctx, source, images.MediaTypeContainerd1Checkpoint, []byte("criu images")),
+			writeTestBlob(t, ctx, source, images.MediaTypeContainerd1CheckpointRuntimeName, []byte("io.containerd.runc.v2")),
+		},
+	}
+	index.SchemaVersion = 2
+	indexDesc, err := writeJSONBlob(ctx, source, index.MediaType, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := checkpointConfig{Image: "docker.io/library/busybox:latest", Instance: "default-pod-busybox", Created: time.Now().UTC()}
+	manifestDesc, err := writeCheckpointManifest(ctx, source, indexDesc, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "checkpoint.tar")
+	if err = exportCheckpoint(ctx, source, manifestDesc, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node restores the index from the archive
+	target := newTestContentStore(t)
+	imported, err := importCheckpoint(ctx, target, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Digest != manifestDesc.Digest || len(imported.Annotations) != 0 {
+		t.Fatalf("expected the manifest %s without the names of the archive, got %+v", manifestDesc.Digest, imported)
+	}
+	info, err := target.Info(ctx, imported.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Labels) != len(index.Manifests)+1 {
+		t.Fatalf("expected the manifest to reference the config and the blobs of the checkpoint, got labels %v", info.Labels)
+	}
+	_, restored, err := writeCheckpointIndex(ctx, target, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Manifests, index.Manifests) {
+		t.Fatalf("expected the blobs %v, got %v", index.Manifests, restored.Manifests)
+	}
+	for _, desc := range restored.Manifests {
+		if _, err = content.ReadBlob(ctx, target, desc); err != nil {
+			t.Fatalf("blob %s of the checkpoint was not imported: %s", desc.Digest, err)
+		}
+	}
+
+	// The names in an archive are ignored, they could replace the images of the node
+	named := filepath.Join(dir, "named.tar")
+	f, err := os.Create(named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Export(ctx, source, f, archive.WithManifest(manifestDesc, "registry.k8s.io/pause:3.9"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, err = importCheckpoint(ctx, target, named); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Digest != manifestDesc.Digest || len(imported.Annotations) != 0 {
+		t.Fatalf("expected the manifest %s without the names of the archive, got %+v", manifestDesc.Digest, imported)
+	}
+
+	// Images are no checkpoints
+	notCheckpoint, err := writeJSONBlob(ctx, target, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    writeTestBlob(t, ctx, target, ocispec.MediaTypeImageConfig, []byte("{}")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = writeCheckpointIndex(ctx, target, notCheckpoint); err == nil {
+		t.Fatal("expected an image that is no checkpoint to be refused")
+	}
+}
+
+func TestRestoreLocation(t *testing.T) {
+	dir := t.TempDir()
+	p := &Provider{config: Config{Checkpoint: CheckpointConfig{Directory: dir}}}
+	tests := []struct {
+		location string
+		expected string
+		fail     bool
+	}{
+		{location: "", expected: ""},
+		{location: "registry.example.com/checkpoints:checkpoint-a", expected: "registry.example.com/checkpoints:checkpoint-a"},
+		{location: "busybox", expected: "docker.io/library/busybox:latest"},
+		{location: "Invalid:Reference", fail: true},
+		{location: filepath.Join(dir, "checkpoint.tar"), expected: filepath.Join(dir, "checkpoint.tar")},
+		{location: dir + "/sub/../checkpoint.tar", expected: filepath.Join(dir, "checkpoint.tar")},
+		{location: dir, fail: true},
+		{location: dir + "/../checkpoint.tar", fail: true},
+		{location: dir + "-other/checkpoint.tar", fail: true},
+		{location: "/etc/shadow", fail: true},
+	}
+	container := &corev1.Container{Name: "c"}
+	for _, test := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationRestorePrefix + "c": test.location}}}
+		location, err := p.restoreLocation(pod, container)
+		if test.fail {
+			if err == nil || !strings.Contains(err.Error(), "checkpoint") {
+				t.Errorf("expected location %q to be refused, got %q (%v)", test.location, location, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("location %q: %s", test.location, err)
+		} else if location != test.expected {
+			t.Errorf("expected location %q for %q, got %q", test.expected, test.location, location)
+		}
+	}
+}
@@ -2,17 +2,236 @@ package provider
 
 import (
 	"gitlab.ilabt.imec.be/fledge/service/pkg/config"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/devices"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
 )
 
 // Defaults for the provider
 var defaultConfig = Config{
 	Default: BackendContainerd,
 	Enabled: []string{BackendContainerd},
+	Containerd: ContainerdConfig{
+		Address:        "/run/containerd/containerd.sock",
+		Namespace:      "fledge",
+		Root:           "/var/lib/containerd",
+		Snapshotter:    "overlayfs",
+		DefaultRuntime: "io.containerd.runc.v2",
+	},
+	EphemeralStorage: EphemeralStorageConfig{
+		Period: metav1.Duration{Duration: 10 * time.Second},
+	},
+	Network: NetworkConfig{
+		ConfDir:  "/etc/cni/net.d",
+		BinDirs:  []string{"/opt/cni/bin"},
+		NetNSDir: "/var/run/fledge/netns",
+		Bridge:   "fledge0",
+		Subnet:   "10.88.0.0/16",
+	},
+	Sandbox: SandboxConfig{
+		PauseImage: "registry.k8s.io/pause:3.9",
+	},
+	Security: SecurityConfig{
+		SeccompProfileRoot: "/var/lib/kubelet/seccomp",
+	},
+	Logs: LogsConfig{
+		MaxSize:  resource.MustParse("10Mi"),
+		MaxFiles: 5,
+	},
+	ImagePull: ImagePullConfig{
+		BackOff:          metav1.Duration{Duration: 10 * time.Second},
+		MaxBackOff:       metav1.Duration{Duration: 5 * time.Minute},
+		MaxParallelPulls: 3,
+	},
+	ImageGC: ImageGCConfig{
+		Period:               metav1.Duration{Duration: 5 * time.Minute},
+		HighThresholdPercent: 85,
+		LowThresholdPercent:  80,
+		MinAge:               metav1.Duration{Duration: 2 * time.Minute},
+	},
+	Resources: ResourcesConfig{
+		CgroupParent:       "/",
+		CgroupDriver:       CgroupDriverCgroupfs,
+		SwapBehavior:       SwapBehaviorNo,
+		CPUManagerPolicy:   CPUManagerPolicyNone,
+		CPUReconcilePeriod: metav1.Duration{Duration: 10 * time.Second},
+	},
+	Devices: DevicesConfig{
+		PluginDir:       "/var/lib/kubelet/device-plugins",
+		Root:            "/",
+		DiscoveryPeriod: metav1.Duration{Duration: 5 * time.Second},
+	},
 }
 
 // Config contains a provider virtual-kubelet's configurable parameters.
 type Config struct { //nolint:golint
 	config.Config
-	Default string   `json:"default,omitempty"`
-	Enabled []string `json:"enabled,omitempty"`
+	Default          string                 `json:"default,omitempty"`
+	Enabled          []string               `json:"enabled,omitempty"`
+	RuntimeClasses   map[string]string      `json:"runtimeClasses,omitempty"`
+	Containerd       ContainerdConfig       `json:"containerd,omitempty"`
+	EphemeralStorage EphemeralStorageConfig `json:"ephemeralStorage,omitempty"`
+	Network          NetworkConfig          `json:"network,omitempty"`
+	Sandbox          SandboxConfig          `json:"sandbox,omitempty"`
+	Security         SecurityConfig         `json:"security,omitempty"`
+	Logs             LogsConfig             `json:"logs,omitempty"`
+	ImagePull        ImagePullConfig        `json:"imagePull,omitempty"`
+	ImageGC          ImageGCConfig          `json:"imageGC,omitempty"`
+	Resources        ResourcesConfig        `json:"resources,omitempty"`
+	Checkpoint       CheckpointConfig       `json:"checkpoint,omitempty"`
+	Rootless         RootlessConfig         `json:"rootless,omitempty"`
+	Devices          DevicesConfig          `json:"devices,omitempty"`
+	Migration        MigrationConfig        `json:"migration,omitempty"`
+}
+
+// ContainerdConfig contains the parameters for the connection to containerd and the containers it creates.
+type ContainerdConfig struct {
+	// Address is the path of the socket of containerd (e.g. /run/k3s/containerd/containerd.sock for k3s).
+	Address string `json:"address,omitempty"`
+	// Namespace is the containerd namespace of the images and containers of fledge.
+	Namespace string `json:"namespace,omitempty"`
+	// Root is the root directory of containerd, it holds the content and snapshots of the images.
+	Root string `json:"root,omitempty"`
+	// Snapshotter unpacks the images and prepares the root filesystems of instances (e.g. overlayfs, native or stargz).
+	Snapshotter string `json:"snapshotter,omitempty"`
+	// DefaultRuntime is the runtime of pods without a runtime class.
+	DefaultRuntime string `json:"defaultRuntime,omitempty"`
+	// RuntimeHandlers maps the names of runtime classes to runtimes (e.g. "gvisor": "io.containerd.runsc.v1" or
+	// "kata": "io.containerd.kata.v2"), pods with another runtime class are not created.
+	RuntimeHandlers map[string]string `json:"runtimeHandlers,omitempty"`
+}
+
+// EphemeralStorageConfig contains the parameters for the accounting and enforcement of ephemeral storage.
+type EphemeralStorageConfig struct {
+	// Period is the interval between two measurements of the disk usage of the pods.
+	Period metav1.Duration `json:"period,omitempty"`
+	// DisableEviction only reports the disk usage and never evicts pods that exceed their limits.
+	DisableEviction bool `json:"disableEviction,omitempty"`
+}
+
+// NetworkConfig contains the parameters for the CNI networking of pods.
+type NetworkConfig struct {
+	// ConfDir is the directory with CNI network configurations, the first one (in lexicographical order) is used.
+	ConfDir string `json:"confDir,omitempty"`
+	// BinDirs are the directories in which CNI plugins are looked up.
+	BinDirs []string `json:"binDirs,omitempty"`
+	// NetNSDir is the directory in which the network namespaces of pods are pinned.
+	NetNSDir string `json:"netnsDir,omitempty"`
+	// Bridge is the bridge of the default network, used when ConfDir contains no configuration.
+	Bridge string `json:"bridge,omitempty"`
+	// Subnet is the range from which the default network assigns pod IPs.
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// SandboxConfig contains the parameters for the sandboxes that hold the shared namespaces of pods.
+type SandboxConfig struct {
+	// PauseImage is the image of the infra task that keeps the namespaces of a pod alive.
+	PauseImage string `json:"pauseImage,omitempty"`
+}
+
+// SecurityConfig contains the parameters for the security contexts of pods.
+type SecurityConfig struct {
+	// SeccompProfileRoot is the directory in which localhost seccomp profiles are looked up.
+	SeccompProfileRoot string `json:"seccompProfileRoot,omitempty"`
+}
+
+// LogsConfig contains the parameters for the logs of instances.
+type LogsConfig struct {
+	// MaxSize is the size at which the log file of an instance is rotated.
+	MaxSize resource.Quantity `json:"maxSize,omitempty"`
+	// MaxFiles is the maximum number of log files of an instance, including the one that is being written.
+	MaxFiles int `json:"maxFiles,omitempty"`
+}
+
+// ImagePullConfig contains the parameters for pulling the images of instances.
+type ImagePullConfig struct {
+	// BackOff is the delay before the first retry of a failed pull, it doubles with every failure.
+	BackOff metav1.Duration `json:"backOff,omitempty"`
+	// MaxBackOff is the maximum delay between two retries of a failed pull.
+	MaxBackOff metav1.Duration `json:"maxBackOff,omitempty"`
+	// MaxParallelPulls is the maximum number of images that are pulled at the same time, concurrent pulls of the
+	// same image count as one.
+	MaxParallelPulls int `json:"maxParallelPulls,omitempty"`
+	// MaxBandwidth is the maximum number of bytes per second that all pulls download together, there is no limit if
+	// it is zero.
+	MaxBandwidth resource.Quantity `json:"maxBandwidth,omitempty"`
+}
+
+// ImageGCConfig contains the parameters for the garbage collection of unused images.
+type ImageGCConfig struct {
+	// Period is the interval between two checks of the disk usage of the images.
+	Period metav1.Duration `json:"period,omitempty"`
+	// HighThresholdPercent is the disk usage after which images are garbage collected, 100 disables garbage collection.
+	HighThresholdPercent int `json:"highThresholdPercent,omitempty"`
+	// LowThresholdPercent is the disk usage to which garbage collection attempts to free.
+	LowThresholdPercent int `json:"lowThresholdPercent,omitempty"`
+	// MinAge is the minimum time an unused image is kept before it is garbage collected.
+	MinAge metav1.Duration `json:"minAge,omitempty"`
+	// PinnedImages are never garbage collected, the pause image of the sandboxes is always pinned.
+	PinnedImages []string `json:"pinnedImages,omitempty"`
+}
+
+// ResourcesConfig contains the parameters for the compute resources of instances.
+type ResourcesConfig struct {
+	// CgroupParent is the cgroup in which the kubepods hierarchy with the cgroups of the pods is created.
+	CgroupParent string `json:"cgroupParent,omitempty"`
+	// CgroupDriver is cgroupfs, where fledge and runc write the cgroups directly, or systemd, where the cgroups of pods
+	// are slices and the instances run in scopes (the cgroup parent is then a slice, e.g. / or /fledge.slice).
+	CgroupDriver string `json:"cgroupDriver,omitempty"`
+	// PodPidsLimit is the maximum number of processes in a pod, there is no limit if it is zero.
+	PodPidsLimit int64 `json:"podPidsLimit,omitempty"`
+	// SwapBehavior is NoSwap, LimitedSwap (only on cgroup v2, where Burstable pods get swap in proportion to their
+	// memory requests) or UnlimitedSwap.
+	SwapBehavior string `json:"swapBehavior,omitempty"`
+	// CPUManagerPolicy is none, where all instances share the CPUs, or static, where the instances of Guaranteed pods
+	// with integer CPU requests get exclusive CPUs.
+	CPUManagerPolicy string `json:"cpuManagerPolicy,omitempty"`
+	// ReservedCPUs are the CPUs (in cpuset format) that are never given exclusively to an instance.
+	ReservedCPUs string `json:"reservedCPUs,omitempty"`
+	// CPUReconcilePeriod is the interval between two updates of the cpusets of the running instances with the static
+	// policy, they are also updated whenever exclusive CPUs are allocated or released.
+	CPUReconcilePeriod metav1.Duration `json:"cpuReconcilePeriod,omitempty"`
+}
+
+// CheckpointConfig contains the parameters for the checkpoints of instances.
+type CheckpointConfig struct {
+	// Repository is the repository in a registry to which checkpoints are pushed, with a tag per checkpoint. When
+	// it is empty, checkpoints are written to archives in Directory.
+	Repository string `json:"repository,omitempty"`
+	// Directory is where the archives of checkpoints are written, the checkpoints directory of the storage root by
+	// default.
+	Directory string `json:"directory,omitempty"`
+}
+
+// RootlessConfig contains the parameters for running fledge without root, next to a rootless containerd.
+type RootlessConfig struct {
+	// Enabled runs fledge in rootless mode, which is always the case when it does not run as root.
+	Enabled bool `json:"enabled,omitempty"`
+	// StateDir is the state directory of the RootlessKit of containerd, with its child_pid and api.sock
+	// ($XDG_RUNTIME_DIR/containerd-rootless by default).
+	StateDir string `json:"stateDir,omitempty"`
+}
+
+// DevicesConfig contains the parameters for the devices of extended resources.
+type DevicesConfig struct {
+	// PluginDir is the directory of the socket (kubelet.sock) with which device plugins register themselves, they put
+	// their own sockets there too.
+	PluginDir string `json:"pluginDir,omitempty"`
+	// Root is where the /dev, /sys and /run/udev of the host are, in which the devices of the rules are discovered.
+	Root string `json:"root,omitempty"`
+	// DiscoveryPeriod is the interval between two scans for devices that were plugged in or removed.
+	DiscoveryPeriod metav1.Duration `json:"discoveryPeriod,omitempty"`
+	// Rules advertise the devices of the host that match them (e.g. serial ports, I2C buses, GPIO chips or cameras)
+	// as extended resources.
+	Rules []devices.Rule `json:"rules,omitempty"`
+}
+
+// MigrationConfig contains the parameters for the live migration of instances between nodes.
+type MigrationConfig struct {
+	// Address is the IP on which instances wait for incoming migrations, the internal IP of the node by default.
+	Address string `json:"address,omitempty"`
+	// CredentialsDir holds the pre-shared key of the nodes (keys.psk, with a line qemu:<key in hex>), with which
+	// migrations are authenticated and encrypted over TLS. Instances are not migrated without it.
+	CredentialsDir string `json:"credentialsDir,omitempty"`
 }
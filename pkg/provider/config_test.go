@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	runcoptions "github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/typeurl/v2"
+)
+
+func TestGetRuntimeOpts(t *testing.T) {
+	handlers := map[string]string{"gvisor": "io.containerd.runsc.v1", "runc": "io.containerd.runc.v2"}
+	tests := []struct {
+		name         string
+		driver       string
+		runtimeClass string
+		// runtime is empty if the container keeps the default runtime of the client
+		runtime       string
+		systemdCgroup bool
+		err           bool
+	}{
+		{name: "default runtime", driver: CgroupDriverCgroupfs},
+		{name: "runtime class", driver: CgroupDriverCgroupfs, runtimeClass: "gvisor", runtime: "io.containerd.runsc.v1"},
+		{name: "unknown runtime class", driver: CgroupDriverCgroupfs, runtimeClass: "kata", err: true},
+		// runc creates systemd scopes with the systemd cgroup driver, other runtimes do not know the option
+		{name: "default runtime with systemd", driver: CgroupDriverSystemd, runtime: "io.containerd.runc.v2", systemdCgroup: true},
+		{name: "runc runtime class with systemd", driver: CgroupDriverSystemd, runtimeClass: "runc", runtime: "io.containerd.runc.v2", systemdCgroup: true},
+		{name: "other runtime class with systemd", driver: CgroupDriverSystemd, runtimeClass: "gvisor", runtime: "io.containerd.runsc.v1"},
+	}
+	for _, test := range tests {
+		b := &ContainerdBackend{config: Config{
+			Containerd: ContainerdConfig{DefaultRuntime: "io.containerd.runc.v2", RuntimeHandlers: handlers},
+			Resources:  ResourcesConfig{CgroupDriver: test.driver},
+		}}
+		opts, err := b.getRuntimeOpts(test.runtimeClass)
+		if test.err != (err != nil) {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		container := &containers.Container{}
+		for _, opt := range opts {
+			if err = opt(context.Background(), nil, container); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if container.Runtime.Name != test.runtime {
+			t.Errorf("%s: expected the runtime %q, got %q", test.name, test.runtime, container.Runtime.Name)
+		}
+		systemdCgroup := false
+		if container.Runtime.Options != nil {
+			options, err := typeurl.UnmarshalAny(container.Runtime.Options)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			systemdCgroup = options.(*runcoptions.Options).SystemdCgroup
+		}
+		if systemdCgroup != test.systemdCgroup {
+			t.Errorf("%s: expected the systemd cgroup option %t, got %t", test.name, test.systemdCgroup, systemdCgroup)
+		}
+	}
+}
@@ -43,18 +43,24 @@ func (p *Provider) RunInContainer(ctx context.Context, namespace, podName, conta
 	if !found {
 		return errors.Errorf("failed to find instance (namespace=%s, podName=%s, containerName=%s)", namespace, podName, containerName)
 	}
-	return instance.Run(cmd, attach)
+	return instance.Run(ctx, cmd, attach)
 }
 
 // AttachToContainer attaches to the executing process of a container in the pod, copying data
 // between in/out/err and the container's stdin/stdout/stderr.
 func (p *Provider) AttachToContainer(ctx context.Context, namespace, name, container string, attach api.AttachIO) error {
-	ctx, span := trace.StartSpan(ctx, "RunInContainer")
+	ctx, span := trace.StartSpan(ctx, "AttachToContainer")
 	defer span.End()
 
 	// Add pod and container attributes to the current span.
 	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, name, containerNameKey, container)
 
 	log.G(ctx).Debugf("receive AttachToContainer %q", container)
-	return nil
+
+	// Attach to the main process of the instance
+	instance, found := p.getInstance(namespace, name, container)
+	if !found {
+		return errors.Errorf("failed to find instance (namespace=%s, podName=%s, containerName=%s)", namespace, name, container)
+	}
+	return instance.Attach(ctx, attach)
 }
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reasonUnexpectedAdmissionError is the reason of pods that are rejected because their devices can not be allocated,
+// like the kubelet does
+const reasonUnexpectedAdmissionError = "UnexpectedAdmissionError"
+
+// allocateDevices allocates the devices of the extended resources that the containers of a pod ask for, the instances
+// of the containers get them once they are created. Pods that can not get them are rejected.
+func (p *Provider) allocateDevices(ctx context.Context, pod *corev1.Pod) error {
+	podID := podToIdentifier(pod)
+	for i, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if _, err := p.devices.Allocate(ctx, podID, &c, i < len(pod.Spec.InitContainers)); err != nil {
+			p.devices.Release(podID)
+			return &rejectionError{
+				Reason:  reasonUnexpectedAdmissionError,
+				Message: fmt.Sprintf("Allocate failed due to %s, which is unexpected", err),
+			}
+		}
+	}
+	return nil
+}
+
+// isInitContainer reports whether a container is an init container of a pod
+func isInitContainer(pod *corev1.Pod, container *corev1.Container) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == container.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Ping reports whether the node is still active, which it is as long as the provider runs
+func (p *Provider) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// NotifyNodeStatus calls cb with the status of the node whenever the devices of extended resources change
+func (p *Provider) NotifyNodeStatus(ctx context.Context, cb func(*corev1.Node)) {
+	changes := make(chan struct{}, 1)
+	p.devices.Notify(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+			}
+			p.mu.RLock()
+			node := p.node.DeepCopy()
+			p.mu.RUnlock()
+			if node == nil {
+				continue
+			}
+			p.ConfigureNode(ctx, node)
+			cb(node)
+		}
+	}()
+}
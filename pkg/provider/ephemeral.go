@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"syscall"
+	"time"
+)
+
+const podEvictedReason = "Evicted"
+
+// InstanceStorageUsage is the disk space consumed by an Instance outside its volumes
+type InstanceStorageUsage struct {
+	// Rootfs is the writable layer (containerd) or disk overlay (OSv) of the instance
+	Rootfs storage.Usage
+	// Logs are the log files of the instance
+	Logs storage.Usage
+}
+
+// Total returns the ephemeral storage that is accounted to the instance
+func (u InstanceStorageUsage) Total() storage.Usage {
+	return u.Rootfs.Add(u.Logs)
+}
+
+// podStorageUsage is a measurement of the ephemeral storage used by a pod
+type podStorageUsage struct {
+	Time       time.Time
+	Containers map[string]InstanceStorageUsage
+	Volumes    map[string]storage.Usage
+}
+
+// Total returns the ephemeral storage that is accounted to the pod
+func (u *podStorageUsage) Total() storage.Usage {
+	total := storage.Usage{}
+	for _, c := range u.Containers {
+		total = total.Add(c.Total())
+	}
+	for _, v := range u.Volumes {
+		total = total.Add(v)
+	}
+	return total
+}
+
+// runStorageTracker periodically measures the disk usage of all pods and evicts the ones that exceed their limits
+func (p *Provider) runStorageTracker(ctx context.Context) {
+	ticker := time.NewTicker(p.config.EphemeralStorage.Period.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, pod := range p.listPods() {
+			if _, evicted := p.getEviction(pod); evicted {
+				continue
+			}
+			usage := p.measurePodStorage(ctx, pod)
+			p.mu.Lock()
+			p.storageUsage[podToIdentifier(pod)] = usage
+			p.mu.Unlock()
+			if p.config.EphemeralStorage.DisableEviction {
+				continue
+			}
+			if message := podStorageLimitExceeded(pod, usage); message != "" {
+				p.evictPod(ctx, pod, message)
+			}
+		}
+	}
+}
+
+// measurePodStorage walks the instances and volumes of a pod to determine its disk usage
+func (p *Provider) measurePodStorage(ctx context.Context, pod *corev1.Pod) *podStorageUsage {
+	usage := &podStorageUsage{
+		Time:       time.Now(),
+		Containers: map[string]InstanceStorageUsage{},
+		Volumes:    map[string]storage.Usage{},
+	}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		instance, ok := p.getInstance(pod.Namespace, pod.Name, c.Name)
+		if !ok {
+			continue
+		}
+		instanceUsage, err := instance.StorageUsage()
+		if err != nil {
+			log.G(ctx).Warnf("failed to measure storage of instance %q: %s", instance.ID, err)
+			continue
+		}
+		usage.Containers[c.Name] = instanceUsage
+	}
+	for _, v := range pod.Spec.Volumes {
+		// Only emptyDirs on disk are accounted as ephemeral storage
+		if v.EmptyDir == nil || v.EmptyDir.Medium == corev1.StorageMediumMemory {
+			continue
+		}
+		volumeUsage, err := storage.PathUsage(storage.VolumePath(podAndVolumeToIdentifier(pod, &v)))
+		if err != nil {
+			log.G(ctx).Warnf("failed to measure storage of volume %q: %s", v.Name, err)
+			continue
+		}
+		usage.Volumes[v.Name] = volumeUsage
+	}
+	return usage
+}
+
+// podStorageLimitExceeded returns why the pod should be evicted, or an empty string if it is within its limits
+// The checks and messages follow the ones of the kubelet's eviction manager
+func podStorageLimitExceeded(pod *corev1.Pod, usage *podStorageUsage) string {
+	// emptyDir.sizeLimit
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir == nil || v.EmptyDir.SizeLimit == nil || v.EmptyDir.SizeLimit.IsZero() {
+			continue
+		}
+		volumeUsage, ok := usage.Volumes[v.Name]
+		if ok && exceedsQuantity(volumeUsage.Bytes, *v.EmptyDir.SizeLimit) {
+			return fmt.Sprintf("Usage of EmptyDir volume %q exceeds the limit %q.", v.Name, v.EmptyDir.SizeLimit.String())
+		}
+	}
+	// Container.Resources.Limits[ephemeral-storage]
+	podLimited := true
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		limit, ok := c.Resources.Limits[corev1.ResourceEphemeralStorage]
+		if !ok || limit.IsZero() {
+			podLimited = false
+			continue
+		}
+		containerUsage, ok := usage.Containers[c.Name]
+		if ok && exceedsQuantity(containerUsage.Total().Bytes, limit) {
+			return fmt.Sprintf("Container %s exceeded its local ephemeral storage limit %q.", c.Name, limit.String())
+		}
+	}
+	// The limit of the pod, like its other resources: the sum of the containers, or the largest init container if it
+	// exceeds the sum
+	_, podLimits := podResources(pod)
+	podLimit, ok := podLimits[corev1.ResourceEphemeralStorage]
+	if podLimited && ok && exceedsQuantity(usage.Total().Bytes, podLimit) {
+		return fmt.Sprintf("Pod ephemeral local storage usage exceeds the total limit of containers %s.", podLimit.String())
+	}
+	return ""
+}
+
+func exceedsQuantity(bytes uint64, limit resource.Quantity) bool {
+	return resource.NewQuantity(int64(bytes), resource.BinarySI).Cmp(limit) > 0
+}
+
+// evictPod kills and removes all instances of a pod to reclaim its disk space, and tears the pod down like DeletePod
+// The pod is reported as failed until it is deleted
+func (p *Provider) evictPod(ctx context.Context, pod *corev1.Pod, message string) {
+	podID := podToIdentifier(pod)
+	log.G(ctx).Warnf("evicting pod %q: %s", podID, message)
+
+	p.mu.Lock()
+	p.evictions[podID] = message
+	p.mu.Unlock()
+
+	// Evicted instances get no grace period
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		instance, found := p.getInstance(pod.Namespace, pod.Name, c.Name)
+		if !found {
+			continue
+		}
+		if err := instance.Kill(syscall.SIGKILL); err != nil {
+			log.G(ctx).Warnf("failed to kill instance %q: %s", instance.ID, err)
+		}
+	}
+	p.deletePodInstances(ctx, pod)
+}
+
+func (p *Provider) getEviction(pod *corev1.Pod) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	message, ok := p.evictions[podToIdentifier(pod)]
+	return message, ok
+}
+
+func (p *Provider) getStorageUsage(pod *corev1.Pod) (*podStorageUsage, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	usage, ok := p.storageUsage[podToIdentifier(pod)]
+	return usage, ok
+}
+
+// evictedPodStatus returns the terminal status of an evicted pod
+func evictedPodStatus(pod *corev1.Pod, message string) *corev1.PodStatus {
+	now := metav1.Now()
+	status := &corev1.PodStatus{
+		Phase:   corev1.PodFailed,
+		Reason:  podEvictedReason,
+		Message: message,
+	}
+	terminated := func(c corev1.Container) corev1.ContainerStatus {
+		return corev1.ContainerStatus{
+			Name:  c.Name,
+			Image: c.Image,
+			State: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{
+					ExitCode:   137,
+					Signal:     int32(syscall.SIGKILL),
+					Reason:     podEvictedReason,
+					Message:    message,
+					FinishedAt: now,
+				},
+			},
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		status.InitContainerStatuses = append(status.InitContainerStatuses, terminated(c))
+	}
+	for _, c := range pod.Spec.Containers {
+		status.ContainerStatuses = append(status.ContainerStatuses, terminated(c))
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"testing"
+
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestPodStorageLimitExceeded(t *testing.T) {
+	const gi = 1 << 30
+	container := func(name, limit string) corev1.Container {
+		return corev1.Container{Name: name, Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse(limit)},
+		}}
+	}
+	usage := func(containers map[string]uint64, volume uint64) *podStorageUsage {
+		u := &podStorageUsage{Containers: map[string]InstanceStorageUsage{}, Volumes: map[string]storage.Usage{"data": {Bytes: volume}}}
+		for name, bytes := range containers {
+			u.Containers[name] = InstanceStorageUsage{Rootfs: storage.Usage{Bytes: bytes}}
+		}
+		return u
+	}
+	tests := []struct {
+		name     string
+		init     string
+		usage    *podStorageUsage
+		expected string
+	}{
+		{
+			name:  "within the sum of the app containers",
+			init:  "1Gi",
+			usage: usage(map[string]uint64{"init": gi / 10, "a": gi * 9 / 10, "b": gi * 9 / 10}, 0),
+		},
+		{
+			// The init container does not run next to the app containers, its limit does not add up
+			name:     "exceeds the sum of the app containers",
+			init:     "1Gi",
+			usage:    usage(map[string]uint64{"init": gi / 2, "a": gi * 9 / 10, "b": gi * 9 / 10}, gi/2),
+			expected: "Pod ephemeral local storage usage exceeds the total limit of containers 2Gi.",
+		},
+		{
+			name:  "within the largest init container",
+			init:  "4Gi",
+			usage: usage(map[string]uint64{"init": gi / 2, "a": gi * 9 / 10, "b": gi * 9 / 10}, gi),
+		},
+		{
+			name:     "exceeds the limit of a container",
+			init:     "1Gi",
+			usage:    usage(map[string]uint64{"a": gi * 3 / 2}, 0),
+			expected: `Container a exceeded its local ephemeral storage limit "1Gi".`,
+		},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{container("init", test.init)},
+			Containers:     []corev1.Container{container("a", "1Gi"), container("b", "1Gi")},
+			Volumes:        []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		}}
+		message := podStorageLimitExceeded(pod, test.usage)
+		if message != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, message)
+		}
+	}
+
+	// A container without a limit leaves the pod unlimited
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{container("a", "1Gi"), {Name: "b"}}}}
+	if message := podStorageLimitExceeded(pod, usage(map[string]uint64{"a": gi / 2, "b": 10 * gi}, 0)); message != "" {
+		t.Errorf("expected a pod without a total limit, got %q", message)
+	}
+}
@@ -0,0 +1,33 @@
+package provider
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// recordContainerEvent records an event about a container of a pod, if the provider has an event recorder
+func (p *Provider) recordContainerEvent(pod *corev1.Pod, containerName, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.eventRecorder == nil {
+		return
+	}
+	p.eventRecorder.Eventf(containerReference(pod, containerName), eventType, reason, messageFmt, args...)
+}
+
+// containerReference refers to a container in the spec of a pod, the way the kubelet does in its events
+func containerReference(pod *corev1.Pod, containerName string) *corev1.ObjectReference {
+	fieldPath := fmt.Sprintf("spec.containers{%s}", containerName)
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == containerName {
+			fieldPath = fmt.Sprintf("spec.initContainers{%s}", containerName)
+		}
+	}
+	return &corev1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		UID:             pod.UID,
+		ResourceVersion: pod.ResourceVersion,
+		FieldPath:       fieldPath,
+	}
+}
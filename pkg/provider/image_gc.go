@@ -0,0 +1,228 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/system"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// An ImageBackend is a Backend that keeps images on the node, these are garbage collected by the provider
+type ImageBackend interface {
+	Backend
+	// ImageID returns the ID under which the image of a reference is stored
+	ImageID(ref string) string
+	// ListImages returns the images that are stored on the node
+	ListImages() ([]ImageInfo, error)
+	// RemoveImage removes an image, it fails if the image is still in use by the backend
+	RemoveImage(id string) error
+	// ImageFsPath is a path on the filesystem that holds the images
+	ImageFsPath() string
+}
+
+// ImageInfo describes an image that is stored by an ImageBackend
+type ImageInfo struct {
+	ID string
+	// Size is the disk space that is freed by removing the image
+	Size uint64
+}
+
+// imageRecord is what the garbage collector knows about an image
+type imageRecord struct {
+	backend       string
+	id            string
+	size          uint64
+	firstDetected time.Time
+	lastUsed      time.Time
+}
+
+// imageGCManager removes unused images in LRU order when the disk usage of the images exceeds the high threshold
+// The thresholds and their semantics follow the image garbage collection of the kubelet
+type imageGCManager struct {
+	config   ImageGCConfig
+	backends map[string]ImageBackend
+	// records are only accessed by the goroutine that collects
+	records map[string]*imageRecord
+}
+
+func newImageGCManager(config ImageGCConfig, backends map[string]Backend) *imageGCManager {
+	m := &imageGCManager{
+		config:   config,
+		backends: map[string]ImageBackend{},
+		records:  map[string]*imageRecord{},
+	}
+	for name, backend := range backends {
+		if b, ok := backend.(ImageBackend); ok {
+			m.backends[name] = b
+		}
+	}
+	return m
+}
+
+// runImageGC periodically garbage collects the images of all backends
+func (p *Provider) runImageGC(ctx context.Context) {
+	ticker := time.NewTicker(p.config.ImageGC.Period.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.imageGC.collect(ctx, p.imagesInUse()); err != nil {
+			log.G(ctx).Errorf("image garbage collection failed: %s", err)
+		}
+	}
+}
+
+// imagesInUse returns the keys of the images of all instances, whether they are running or not, and of the pulled
+// instances of pods that are still deploying
+func (p *Provider) imagesInUse() map[string]bool {
+	inUse := map[string]bool{}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	instances := make([]*Instance, 0, len(p.instances))
+	for _, instance := range p.instances {
+		instances = append(instances, instance)
+	}
+	for _, deployment := range p.deployments {
+		instances = append(instances, deployment.instances...)
+	}
+	for _, instance := range instances {
+		for name, backend := range p.imageGC.backends {
+			if backend == instance.Backend {
+				inUse[imageKey(name, backend.ImageID(instance.Image))] = true
+			}
+		}
+	}
+	return inUse
+}
+
+func imageKey(backend, id string) string {
+	return joinIdentifierFromParts(backend, id)
+}
+
+// collect updates the records of the images and frees space on every filesystem that exceeds the high threshold
+func (m *imageGCManager) collect(ctx context.Context, inUse map[string]bool) error {
+	now := time.Now()
+	pinned := map[string]bool{}
+	for name, backend := range m.backends {
+		for _, ref := range m.config.PinnedImages {
+			pinned[imageKey(name, backend.ImageID(ref))] = true
+		}
+	}
+
+	// Detect new images and forget the ones that are gone
+	detected := map[string]bool{}
+	byDevice := map[uint64][]string{}
+	fsPaths := map[uint64]string{}
+	for name, backend := range m.backends {
+		images, err := backend.ListImages()
+		if err != nil {
+			return errors.Wrapf(err, "failed to list images of backend %q", name)
+		}
+		if len(images) == 0 {
+			continue
+		}
+		device, err := pathDevice(backend.ImageFsPath())
+		if err != nil {
+			return err
+		}
+		fsPaths[device] = backend.ImageFsPath()
+		for _, image := range images {
+			key := imageKey(name, image.ID)
+			detected[key] = true
+			record, ok := m.records[key]
+			if !ok {
+				record = &imageRecord{backend: name, id: image.ID, firstDetected: now}
+				m.records[key] = record
+			}
+			record.size = image.Size
+			if inUse[key] {
+				record.lastUsed = now
+			}
+			byDevice[device] = append(byDevice[device], key)
+		}
+	}
+	for key := range m.records {
+		if !detected[key] {
+			delete(m.records, key)
+		}
+	}
+
+	// Images of different backends compete for the same filesystem
+	for device, keys := range byDevice {
+		info, err := system.StorageInfo(fsPaths[device])
+		if err != nil {
+			return err
+		}
+		if info.Capacity == 0 {
+			continue
+		}
+		usagePercent := int(info.Used * 100 / info.Capacity)
+		if usagePercent < m.config.HighThresholdPercent {
+			continue
+		}
+		goal := int64(info.Used) - int64(info.Capacity)*int64(m.config.LowThresholdPercent)/100
+		log.G(ctx).Infof("disk usage of %q is at %d%% which is over the high threshold (%d%%), trying to free %d bytes", fsPaths[device], usagePercent, m.config.HighThresholdPercent, goal)
+		freed := m.freeSpace(ctx, keys, inUse, pinned, goal, now)
+		if freed < goal {
+			log.G(ctx).Warnf("failed to free %d bytes on %q, only freed %d bytes", goal, fsPaths[device], freed)
+		}
+	}
+	return nil
+}
+
+// freeSpace removes unused images, least recently used first, until goal bytes are freed
+func (m *imageGCManager) freeSpace(ctx context.Context, keys []string, inUse, pinned map[string]bool, goal int64, now time.Time) int64 {
+	var candidates []*imageRecord
+	for _, key := range keys {
+		record := m.records[key]
+		if inUse[key] || pinned[key] {
+			continue
+		}
+		// Give new images the chance to be used
+		if now.Sub(record.firstDetected) < m.config.MinAge.Duration {
+			continue
+		}
+		candidates = append(candidates, record)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].lastUsed.Equal(candidates[j].lastUsed) {
+			return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+		}
+		return candidates[i].firstDetected.Before(candidates[j].firstDetected)
+	})
+
+	var freed int64
+	for _, record := range candidates {
+		if freed >= goal {
+			break
+		}
+		log.G(ctx).Infof("removing image %q of backend %q (%d bytes)", record.id, record.backend, record.size)
+		if err := m.backends[record.backend].RemoveImage(record.id); err != nil {
+			log.G(ctx).Errorf("failed to remove image %q of backend %q: %s", record.id, record.backend, err)
+			continue
+		}
+		delete(m.records, imageKey(record.backend, record.id))
+		freed += int64(record.size)
+	}
+	return freed
+}
+
+// pathDevice returns the device of the filesystem that contains a path
+func pathDevice(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.Errorf("unable to determine the device of %q", path)
+	}
+	return uint64(stat.Dev), nil
+}
@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testImageBackend keeps images in memory, the removal of images in failures fails
+type testImageBackend struct {
+	DummyBackend
+	dir      string
+	images   []ImageInfo
+	failures map[string]bool
+	removed  []string
+}
+
+func (b *testImageBackend) ImageID(ref string) string {
+	return "sha256:" + ref
+}
+
+func (b *testImageBackend) ListImages() ([]ImageInfo, error) {
+	return b.images, nil
+}
+
+func (b *testImageBackend) RemoveImage(id string) error {
+	if b.failures[id] {
+		return errors.Errorf("image %q is in use", id)
+	}
+	b.removed = append(b.removed, id)
+	return nil
+}
+
+func (b *testImageBackend) ImageFsPath() string {
+	return b.dir
+}
+
+func TestImageGCFreeSpace(t *testing.T) {
+	now := time.Now()
+	records := func() map[string]*imageRecord {
+		day := now.Add(-24 * time.Hour)
+		return map[string]*imageRecord{
+			"never":  {id: "never", size: 100, firstDetected: day},
+			"old":    {id: "old", size: 100, firstDetected: day, lastUsed: now.Add(-3 * time.Hour)},
+			"recent": {id: "recent", size: 100, firstDetected: day, lastUsed: now.Add(-time.Hour)},
+			// Images that were used at the same time are removed in the order they were detected
+			"tie":    {id: "tie", size: 50, firstDetected: day.Add(-time.Hour), lastUsed: now.Add(-time.Hour)},
+			"young":  {id: "young", size: 100, firstDetected: now.Add(-time.Minute)},
+			"in-use": {id: "in-use", size: 100, firstDetected: day, lastUsed: now},
+			"pinned": {id: "pinned", size: 100, firstDetected: day},
+		}
+	}
+	tests := []struct {
+		name     string
+		goal     int64
+		failures map[string]bool
+		removed  []string
+		freed    int64
+	}{
+		{name: "nothing to free"},
+		{name: "least recently used first", goal: 150, removed: []string{"never", "old"}, freed: 200},
+		{name: "exactly the goal", goal: 100, removed: []string{"never"}, freed: 100},
+		{name: "all candidates", goal: 1000, removed: []string{"never", "old", "tie", "recent"}, freed: 350},
+		{name: "failed removal", goal: 150, failures: map[string]bool{"old": true}, removed: []string{"never", "tie"}, freed: 150},
+	}
+	for _, test := range tests {
+		backend := &testImageBackend{failures: test.failures}
+		m := &imageGCManager{
+			config:   ImageGCConfig{MinAge: metav1.Duration{Duration: time.Hour}},
+			backends: map[string]ImageBackend{"test": backend},
+			records:  map[string]*imageRecord{},
+		}
+		var keys []string
+		for id, record := range records() {
+			record.backend = "test"
+			m.records[imageKey("test", id)] = record
+			keys = append(keys, imageKey("test", id))
+		}
+		sort.Strings(keys)
+		inUse := map[string]bool{imageKey("test", "in-use"): true}
+		pinned := map[string]bool{imageKey("test", "pinned"): true}
+
+		freed := m.freeSpace(context.Background(), keys, inUse, pinned, test.goal, now)
+		if freed != test.freed {
+			t.Errorf("%s: expected %d bytes to be freed, got %d", test.name, test.freed, freed)
+		}
+		if !reflect.DeepEqual(backend.removed, test.removed) {
+			t.Errorf("%s: expected the images %v to be removed, got %v", test.name, test.removed, backend.removed)
+		}
+		for _, id := range test.removed {
+			if _, ok := m.records[imageKey("test", id)]; ok {
+				t.Errorf("%s: expected the record of %q to be removed", test.name, id)
+			}
+		}
+	}
+}
+
+func TestImageGCCollectRecords(t *testing.T) {
+	backend := &testImageBackend{dir: t.TempDir(), images: []ImageInfo{{ID: "a", Size: 10}, {ID: "b", Size: 20}}}
+	// The disk is never full enough to remove images
+	m := newImageGCManager(ImageGCConfig{HighThresholdPercent: 101}, map[string]Backend{"test": backend, "other": newTestBackend(nil)})
+	if len(m.backends) != 1 {
+		t.Fatalf("expected only the backend that keeps images, got %v", m.backends)
+	}
+
+	inUse := map[string]bool{imageKey("test", "a"): true}
+	if err := m.collect(context.Background(), inUse); err != nil {
+		t.Fatal(err)
+	}
+	a, b := m.records[imageKey("test", "a")], m.records[imageKey("test", "b")]
+	if a == nil || b == nil || a.size != 10 || b.size != 20 {
+		t.Fatalf("expected records of the images, got %v", m.records)
+	}
+	if a.lastUsed.IsZero() || !b.lastUsed.IsZero() {
+		t.Errorf("expected only the image in use to be used, got %s and %s", a.lastUsed, b.lastUsed)
+	}
+	firstDetected := b.firstDetected
+
+	// Images that are gone are forgotten, the others keep when they were first detected
+	backend.images = backend.images[1:]
+	if err := m.collect(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.records[imageKey("test", "a")]; ok {
+		t.Errorf("expected the record of the removed image to be forgotten")
+	}
+	if b = m.records[imageKey("test", "b")]; b == nil || !b.firstDetected.Equal(firstDetected) {
+		t.Errorf("expected the record of the image to be kept, got %+v", b)
+	}
+	if len(backend.removed) != 0 {
+		t.Errorf("expected no images to be removed, got %v", backend.removed)
+	}
+}
@@ -0,0 +1,194 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+	ociv1ext "gitlab.ilabt.imec.be/fledge/service/pkg/oci/v1/ext"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"time"
+)
+
+const (
+	// Reasons of the waiting state of containers, these are the same as the ones of the kubelet
+	reasonContainerCreating          = "ContainerCreating"
+	reasonErrImagePull               = "ErrImagePull"
+	reasonImagePullBackOff           = "ImagePullBackOff"
+	reasonInvalidImageName           = "InvalidImageName"
+	reasonCreateContainerConfigError = "CreateContainerConfigError"
+	reasonCreateContainerError       = "CreateContainerError"
+
+	// Reasons of the events about containers
+	eventPulling       = "Pulling"
+	eventPulled        = "Pulled"
+	eventFailed        = "Failed"
+	eventBackOff       = "BackOff"
+	eventInspectFailed = "InspectFailed"
+)
+
+// ImagePull is the outcome of pulling the image of an instance
+type ImagePull struct {
+	// Pulled is false if the image was already present on the node
+	Pulled bool
+	// Size is the size of the image in bytes
+	Size uint64
+}
+
+// backOff is an exponentially growing delay between retries
+type backOff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+func newBackOff(config ImagePullConfig) *backOff {
+	return &backOff{delay: config.BackOff.Duration, max: config.MaxBackOff.Duration}
+}
+
+// wait sleeps for the current delay and doubles it, it returns false if the context is done first
+func (b *backOff) wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+	b.delay *= 2
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+	return true
+}
+
+// pullInstance resolves the image of a container and pulls it with its backend
+// Failed pulls are retried with an exponential back-off until they succeed or the pod is deleted, in the meantime
+// the waiting state of the container explains why it is not created yet
+func (p *Provider) pullInstance(ctx context.Context, pod *corev1.Pod, container *corev1.Container) *Instance {
+	instanceID := podAndContainerToIdentifier(pod, container)
+
+	// Invalid image names will never be pulled
+	if _, err := docker.ParseDockerRef(container.Image); err != nil {
+		message := fmt.Sprintf("Failed to apply default image tag %q: %s", container.Image, err)
+		p.setWaiting(instanceID, reasonInvalidImageName, message)
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeWarning, eventInspectFailed, message)
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeWarning, eventFailed, "Error: %s", reasonInvalidImageName)
+		return nil
+	}
+
+	delay := newBackOff(p.config.ImagePull)
+	for failures := 0; ; failures++ {
+		instance, reason, err := p.tryPullInstance(ctx, pod, container)
+		if err == nil {
+			return instance
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		// The image selects a backend that is not enabled, retrying does not help
+		var rejection *rejectionError
+		if errors.As(err, &rejection) {
+			p.rejectPod(ctx, pod, rejection)
+			return nil
+		}
+		log.G(ctx).Warnf("failed to pull image of instance %q: %s", instanceID, err)
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeWarning, eventFailed, err.Error())
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeWarning, eventFailed, "Error: %s", reason)
+		// The error is shown until the first retry, after which the container shows that it backs off
+		if failures == 0 || reason != reasonErrImagePull {
+			p.setWaiting(instanceID, reason, err.Error())
+		} else {
+			message := fmt.Sprintf("Back-off pulling image %q", container.Image)
+			p.setWaiting(instanceID, reasonImagePullBackOff, message)
+			p.recordContainerEvent(pod, container.Name, corev1.EventTypeNormal, eventBackOff, message)
+		}
+		if !delay.wait(ctx) {
+			return nil
+		}
+	}
+}
+
+// tryPullInstance makes an instance for a container and pulls its image, on failure it returns the reason of the
+// waiting state of the container
+func (p *Provider) tryPullInstance(ctx context.Context, pod *corev1.Pod, container *corev1.Container) (*Instance, string, error) {
+	// Pod.ImagePullSecrets
+	keyring := p.getPullSecrets(ctx, pod)
+
+	// Get the config of the image, which selects the backend unless the pod does (only OSv needs it otherwise)
+	backendName, err := p.podBackendName(pod)
+	if err != nil {
+		return nil, reasonCreateContainerConfigError, err
+	}
+	var im ociv1ext.Image
+	if backendName != BackendContainerd {
+		if im, err = storage.ImageGetConfig(ctx, container.Image, keyring); err != nil {
+			return nil, reasonErrImagePull, errors.Wrapf(err, "Failed to pull image %q", container.Image)
+		}
+	}
+
+	// New Instance
+	instance, err := p.newInstance(ctx, pod, container, keyring, im)
+	if err != nil {
+		return nil, reasonCreateContainerConfigError, err
+	}
+
+	// Pull the image with the backend of the instance
+	p.recordContainerEvent(pod, container.Name, corev1.EventTypeNormal, eventPulling, "Pulling image %q", container.Image)
+	start := time.Now()
+	pull, err := instance.PullImage(ctx)
+	if err != nil {
+		return nil, reasonErrImagePull, errors.Wrapf(err, "Failed to pull image %q", container.Image)
+	}
+	if pull.Pulled {
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeNormal, eventPulled, "Successfully pulled image %q in %s. Image size: %d bytes.", container.Image, time.Since(start).Round(time.Millisecond), pull.Size)
+	} else {
+		p.recordContainerEvent(pod, container.Name, corev1.EventTypeNormal, eventPulled, "Container image %q already present on machine", container.Image)
+	}
+	return instance, "", nil
+}
+
+// repullImages pulls the images of instances again before they are created anew, as their pull policies say. It
+// reports whether all images are present, otherwise the waiting state of the container shows why not.
+func (p *Provider) repullImages(ctx context.Context, pod *corev1.Pod, instances []*Instance) bool {
+	for _, instance := range instances {
+		start := time.Now()
+		pull, err := instance.PullImage(ctx)
+		if err != nil {
+			err = errors.Wrapf(err, "Failed to pull image %q", instance.Image)
+			log.G(ctx).Warnf("failed to pull image of instance %q: %s", instance.ID, err)
+			p.setWaiting(instance.ID, reasonErrImagePull, err.Error())
+			p.recordContainerEvent(pod, instance.Name, corev1.EventTypeWarning, eventFailed, err.Error())
+			return false
+		}
+		if pull.Pulled {
+			p.recordContainerEvent(pod, instance.Name, corev1.EventTypeNormal, eventPulled, "Successfully pulled image %q in %s. Image size: %d bytes.", instance.Image, time.Since(start).Round(time.Millisecond), pull.Size)
+		}
+	}
+	return true
+}
+
+// setWaiting sets the reason why a container has no (running) instance yet
+func (p *Provider) setWaiting(instanceID, reason, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiting[instanceID] = &corev1.ContainerStateWaiting{Reason: reason, Message: message}
+}
+
+func (p *Provider) getWaiting(instanceID string) (*corev1.ContainerStateWaiting, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	waiting, ok := p.waiting[instanceID]
+	if !ok {
+		return nil, false
+	}
+	w := *waiting
+	return &w, true
+}
+
+func (p *Provider) clearWaiting(instanceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, instanceID)
+}
@@ -5,7 +5,9 @@ import (
 	"github.com/containerd/containerd/reference/docker"
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
-	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/credentials"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/devices"
+	ociv1ext "gitlab.ilabt.imec.be/fledge/service/pkg/oci/v1/ext"
 	"io"
 	corev1 "k8s.io/api/core/v1"
 	"syscall"
@@ -19,15 +21,42 @@ type Instance struct {
 	*corev1.Container
 	VolumeMounts []InstanceVolumeMount
 	HostNetwork  bool
+	// PodSecurityContext applies to all instances of the pod
+	PodSecurityContext *corev1.PodSecurityContext
+	// QOSClass is the quality of service class of the pod
+	QOSClass corev1.PodQOSClass
+	// RuntimeClassName selects the runtime handler of the backend, empty for the default one
+	RuntimeClassName string
+	// CgroupParent is the cgroup of the pod, empty if the instance is not created in a cgroup of the pod
+	CgroupParent string
+	// Sandbox holds the namespaces the instance shares with the rest of the pod, nil if the backend has no sandboxes
+	Sandbox *Sandbox
+	// Keyring holds the credentials of the image pull secrets of the pod
+	Keyring *credentials.Keyring
+	// Checkpoint is the location of the checkpoint from which the instance is restored, empty if it starts anew
+	Checkpoint string
+	// IncomingMigrationPort is the port on which the instance waits for its migration from another node, zero if it
+	// starts anew
+	IncomingMigrationPort int
+	// Devices holds what the instance needs to use the devices of extended resources that were allocated to it, nil
+	// if it has none
+	Devices *devices.Allocation
+	// ImageConfig is the config of the image in the registry (empty if the pod selects containerd), its backend
+	// field holds the selected backend
+	ImageConfig ociv1ext.Image
 }
 
 // newInstance extracts the information it needs from the Pod and lets all the rest be handled by the Backend
 // This is a heavy function right now, but it lets us deal with the important stuff in the backend so that we
 // can let the provider handle everything else
-func (p *Provider) newInstance(ctx context.Context, pod *corev1.Pod, container *corev1.Container) (*Instance, error) {
+// The image config is retrieved from the registry beforehand, since it determines the backend
+func (p *Provider) newInstance(ctx context.Context, pod *corev1.Pod, container *corev1.Container, keyring *credentials.Keyring, im ociv1ext.Image) (*Instance, error) {
 	// Check for name collision just in case
 	instanceID := podAndContainerToIdentifier(pod, container)
-	if _, ok := p.instances[instanceID]; ok {
+	p.mu.RLock()
+	_, ok := p.instances[instanceID]
+	p.mu.RUnlock()
+	if ok {
 		return nil, errors.Errorf("name collision for instance %q", instanceID)
 	}
 
@@ -38,19 +67,33 @@ func (p *Provider) newInstance(ctx context.Context, pod *corev1.Pod, container *
 	}
 	container.Image = imageRef.String()
 
-	// Get the config of the image to determine the backend
-	im, err := storage.ImageGetConfig(ctx, container.Image)
+	// Select an enabled backend
+	if im.Backend, err = p.instanceBackendName(pod, im); err != nil {
+		return nil, err
+	}
+	backend := p.backends[im.Backend]
+
+	// Restore from a checkpoint, if the pod asks so
+	checkpoint, err := p.restoreLocation(pod, container)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to get image config of %q", container.Image)
+		return nil, err
 	}
-	// If no backend is defined, it's a non-FLEDGE and should be run with containerd
-	if im.Backend == "" {
-		im.Backend = BackendContainerd
+	if _, ok := backend.(CheckpointBackend); checkpoint != "" && !ok {
+		return nil, errors.Errorf("backend %q can not restore instances from checkpoints", im.Backend)
 	}
-	// Check if the required backend is enabled
-	backend := p.backends[im.Backend]
-	if backend == nil {
-		return nil, errors.Wrapf(err, "failed to find enabled backend %q", im.Backend)
+
+	// Wait for a migration from another node, if the pod asks so
+	incomingPort, err := incomingMigrationPort(pod, container)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := backend.(MigrationBackend); incomingPort != 0 && !ok {
+		return nil, errors.Errorf("backend %q can not migrate instances", im.Backend)
+	}
+	// Container.Resources (devices of extended resources, allocated when the pod was admitted)
+	allocation, err := p.devices.Allocate(ctx, podToIdentifier(pod), container, isInitContainer(pod, container))
+	if err != nil {
+		return nil, err
 	}
 
 	// Make a lookup for Volumes
@@ -80,42 +123,90 @@ func (p *Provider) newInstance(ctx context.Context, pod *corev1.Pod, container *
 
 	// Make Instance
 	return &Instance{
-		ID:           instanceID,
-		Backend:      backend,
-		Container:    container,
-		VolumeMounts: volumeMounts,
-		HostNetwork:  pod.Spec.HostNetwork,
+		ID:                    instanceID,
+		Backend:               backend,
+		Container:             container,
+		VolumeMounts:          volumeMounts,
+		HostNetwork:           pod.Spec.HostNetwork,
+		PodSecurityContext:    pod.Spec.SecurityContext,
+		QOSClass:              podQOSClass(pod),
+		RuntimeClassName:      runtimeClassName(pod),
+		Keyring:               keyring,
+		Checkpoint:            checkpoint,
+		IncomingMigrationPort: incomingPort,
+		Devices:               allocation,
+		ImageConfig:           im,
 	}, nil
 }
 
+// BackendName is the name of the backend of the instance
+func (i *Instance) BackendName() string {
+	return i.ImageConfig.Backend
+}
+
 func (i *Instance) Status() (corev1.ContainerStatus, error) {
 	return i.Backend.GetInstanceStatus(i)
 }
 
+func (i *Instance) Stats() (InstanceStats, error) {
+	return i.Backend.GetInstanceStats(i)
+}
+
+func (i *Instance) PullImage(ctx context.Context) (ImagePull, error) {
+	pull, err := i.Backend.PullInstanceImage(ctx, i)
+	if err != nil {
+		// Pulls that are canceled because the pod is deleted did not fail
+		if ctx.Err() == nil {
+			countError(i.BackendName(), operationPull, err)
+		}
+	}
+	return pull, err
+}
+
 func (i *Instance) Create() error {
-	return i.Backend.CreateInstance(i)
+	return countError(i.BackendName(), operationCreate, i.Backend.CreateInstance(i))
 }
 
 func (i *Instance) Start() error {
-	return i.Backend.StartInstance(i)
+	return countError(i.BackendName(), operationStart, i.Backend.StartInstance(i))
 }
 
 func (i *Instance) Kill(signal syscall.Signal) error {
-	return i.Backend.KillInstance(i, signal)
+	return countError(i.BackendName(), operationKill, i.Backend.KillInstance(i, signal))
 }
 
 func (i *Instance) Update() error {
-	return i.Backend.UpdateInstance(i)
+	return countError(i.BackendName(), operationUpdate, i.Backend.UpdateInstance(i))
 }
 
 func (i *Instance) Delete() error {
-	return i.Backend.DeleteInstance(i)
+	return countError(i.BackendName(), operationDelete, i.Backend.DeleteInstance(i))
 }
 
 func (i *Instance) Logs(opts api.ContainerLogOpts) (io.ReadCloser, error) {
 	return i.Backend.GetInstanceLogs(i, opts)
 }
 
-func (i *Instance) Run(cmd []string, attach api.AttachIO) error {
-	return i.Backend.RunInInstance(i, cmd, attach)
+func (i *Instance) Run(ctx context.Context, cmd []string, attach api.AttachIO) error {
+	return i.Backend.RunInInstance(ctx, i, cmd, attach)
+}
+
+func (i *Instance) Attach(ctx context.Context, attach api.AttachIO) error {
+	return i.Backend.AttachToInstance(ctx, i, attach)
+}
+
+func (i *Instance) PortForward(ctx context.Context, port int32, stream io.ReadWriteCloser) error {
+	return i.Backend.PortForwardInstance(ctx, i, port, stream)
+}
+
+func (i *Instance) StorageUsage() (InstanceStorageUsage, error) {
+	return i.Backend.GetInstanceStorageUsage(i)
+}
+
+// runtimeClassName returns the name of the runtime class of a pod, empty if it has none
+func runtimeClassName(pod *corev1.Pod) string {
+	if pod.Spec.RuntimeClassName == nil {
+		return ""
+	}
+	return *pod.Spec.RuntimeClassName
 }
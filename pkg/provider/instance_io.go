@@ -0,0 +1,236 @@
+package provider
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"io"
+	"os"
+	"sync"
+)
+
+// attachedClientBuffer is the number of writes of the process that are buffered for an attached client, a client that
+// falls further behind is detached
+const attachedClientBuffer = 256
+
+// InstanceIO multiplexes the standard streams of the main process of an Instance
+// Output is always written to the logs and to every attached client, stdin is only forwarded if Container.Stdin is set.
+// Every client has its own buffer, so a slow client never holds up the process or its logs.
+type InstanceIO struct {
+	mu         sync.Mutex
+	stdoutLogs io.Writer
+	stderrLogs io.Writer
+	clients    map[*attachedClient]struct{}
+	stdin      *os.File
+	stdinOnce  bool
+	resize     func(size api.TermSize) error
+	done       chan struct{}
+	closed     bool
+}
+
+type attachedClient struct {
+	stdout   io.Writer
+	stderr   io.Writer
+	output   chan attachedOutput
+	detached chan struct{}
+	once     sync.Once
+}
+
+// attachedOutput is a write of the process that is buffered for a client
+type attachedOutput struct {
+	data   []byte
+	stderr bool
+}
+
+func (c *attachedClient) detach() {
+	c.once.Do(func() { close(c.detached) })
+}
+
+// forward writes the buffered output to the client until the output is closed or the client detaches
+func (c *attachedClient) forward(forwarded chan<- struct{}) {
+	defer close(forwarded)
+	for {
+		select {
+		case out, ok := <-c.output:
+			if !ok {
+				return
+			}
+			w := c.stdout
+			if out.stderr {
+				w = c.stderr
+			}
+			// A client whose stream is broken is detached
+			if _, err := w.Write(out.data); err != nil {
+				c.detach()
+				return
+			}
+		case <-c.detached:
+			return
+		}
+	}
+}
+
+// NewInstanceIO creates the streams of an instance that writes its output to logs
+// The returned file is the stdin of the process, or nil if the instance has no stdin
+func NewInstanceIO(instance *Instance, logs *ContainerLogWriter) (*InstanceIO, *os.File, error) {
+	s := &InstanceIO{
+		stdoutLogs: logs.Stdout(),
+		stderrLogs: logs.Stderr(),
+		clients:    map[*attachedClient]struct{}{},
+		stdinOnce:  instance.StdinOnce,
+		done:       make(chan struct{}),
+	}
+	if !instance.Stdin {
+		return s, nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.stdin = w
+	return s, r, nil
+}
+
+// SetResize sets how the terminal of the process is resized, if it has one
+func (s *InstanceIO) SetResize(resize func(size api.TermSize) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resize = resize
+}
+
+// Stdout is the writer for the stdout of the process
+func (s *InstanceIO) Stdout() io.Writer {
+	return instanceIOWriter{s: s, stderr: false}
+}
+
+// Stderr is the writer for the stderr of the process
+func (s *InstanceIO) Stderr() io.Writer {
+	return instanceIOWriter{s: s, stderr: true}
+}
+
+// Done is closed once the process has exited
+func (s *InstanceIO) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close detaches all clients once the process has exited
+func (s *InstanceIO) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.closeStdinLocked()
+}
+
+// Attach streams the output of the process to the client and forwards its input until it detaches or the process exits
+func (s *InstanceIO) Attach(ctx context.Context, attach api.AttachIO) error {
+	client := &attachedClient{
+		stdout:   attach.Stdout(),
+		stderr:   attach.Stderr(),
+		output:   make(chan attachedOutput, attachedClientBuffer),
+		detached: make(chan struct{}),
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("process has exited")
+	}
+	s.clients[client] = struct{}{}
+	stdin := s.stdin
+	resize := s.resize
+	s.mu.Unlock()
+	forwarded := make(chan struct{})
+	go client.forward(forwarded)
+
+	// Forward stdin, the client detaches when it closes its stdin
+	attachedStdin := attach.Stdin() != nil && stdin != nil
+	if attachedStdin {
+		go func() {
+			_, _ = io.Copy(stdin, attach.Stdin())
+			client.detach()
+		}()
+	}
+	// Forward terminal size changes
+	if attach.Resize() != nil && resize != nil {
+		go func() {
+			for {
+				select {
+				case size := <-attach.Resize():
+					_ = resize(size)
+				case <-client.detached:
+					return
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		client.detach()
+	case <-client.detached:
+	case <-s.done:
+	}
+	// The client gets no more output, what is buffered is still forwarded after the process exited
+	s.mu.Lock()
+	delete(s.clients, client)
+	s.mu.Unlock()
+	close(client.output)
+	select {
+	case <-forwarded:
+	case <-client.detached:
+	case <-ctx.Done():
+	}
+	client.detach()
+
+	// Container.StdinOnce closes stdin after the first client detaches
+	if attachedStdin && s.stdinOnce {
+		s.mu.Lock()
+		s.closeStdinLocked()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *InstanceIO) closeStdinLocked() {
+	if s.stdin != nil {
+		_ = s.stdin.Close()
+		s.stdin = nil
+	}
+}
+
+func (s *InstanceIO) write(p []byte, stderr bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logs := s.stdoutLogs
+	if stderr {
+		logs = s.stderrLogs
+	}
+	n, err := logs.Write(p)
+	for client := range s.clients {
+		if (stderr && client.stderr == nil) || (!stderr && client.stdout == nil) {
+			continue
+		}
+		// A client whose buffer is full is detached instead of waiting for it, p is reused by the caller
+		select {
+		case client.output <- attachedOutput{data: append([]byte(nil), p...), stderr: stderr}:
+		default:
+			delete(s.clients, client)
+			client.detach()
+		}
+	}
+	return n, err
+}
+
+type instanceIOWriter struct {
+	s      *InstanceIO
+	stderr bool
+}
+
+func (w instanceIOWriter) Write(p []byte) (int, error) {
+	return w.s.write(p, w.stderr)
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeAttachIO is a client that only reads stdout
+type fakeAttachIO struct {
+	stdout io.WriteCloser
+}
+
+func (a fakeAttachIO) Stdin() io.Reader            { return nil }
+func (a fakeAttachIO) Stdout() io.WriteCloser      { return a.stdout }
+func (a fakeAttachIO) Stderr() io.WriteCloser      { return nil }
+func (a fakeAttachIO) TTY() bool                   { return false }
+func (a fakeAttachIO) Resize() <-chan api.TermSize { return nil }
+
+// stalledWriter blocks every write until it is released
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func (w stalledWriter) Close() error { return nil }
+
+type bufferWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *bufferWriter) Close() error { return nil }
+
+func (w *bufferWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func newTestInstanceIO(t *testing.T) *InstanceIO {
+	t.Helper()
+	logs, err := NewContainerLogWriter(filepath.Join(t.TempDir(), "instance.log"), 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logs.Close() })
+	s, _, err := NewInstanceIO(&Instance{Container: &corev1.Container{}}, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// attach attaches a client in the background, the returned channel receives the result of Attach
+func attach(t *testing.T, s *InstanceIO, stdout io.WriteCloser) <-chan error {
+	t.Helper()
+	attached := make(chan error, 1)
+	go func() { attached <- s.Attach(context.Background(), fakeAttachIO{stdout: stdout}) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n > 0 {
+			return attached
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not attach")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitFor(t *testing.T, c <-chan error, what string) {
+	t.Helper()
+	select {
+	case err := <-c:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestInstanceIODetachesStalledClient(t *testing.T) {
+	s := newTestInstanceIO(t)
+	stalled := stalledWriter{release: make(chan struct{})}
+	defer close(stalled.release)
+	attached := attach(t, s, stalled)
+
+	// The process and its logs continue while the client does not read
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2*attachedClientBuffer; i++ {
+			if _, err := s.Stdout().Write([]byte("line\n")); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	waitFor(t, written, "the output of the process")
+	waitFor(t, attached, "the stalled client to be detached")
+}
+
+func TestInstanceIOForwardsOutputBeforeExit(t *testing.T) {
+	s := newTestInstanceIO(t)
+	stdout := &bufferWriter{}
+	attached := attach(t, s, stdout)
+	for _, line := range []string{"hello\n", "world\n"} {
+		if _, err := s.Stdout().Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+	waitFor(t, attached, "the client to be detached")
+	if out := stdout.String(); out != "hello\nworld\n" {
+		t.Fatalf("expected all output before the exit, got %q", out)
+	}
+}
@@ -1,11 +1,15 @@
 package provider
 
 import (
+	"context"
 	"fmt"
+	"github.com/containerd/containerd/log"
 	"github.com/pkg/errors"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
 )
 
 // InstanceVolume is a Volume with an expanded VolumeSource
@@ -175,3 +179,14 @@ func (p *Provider) newInstanceVolume(pod *corev1.Pod, volume corev1.Volume) (Ins
 	}
 	return instanceVolume, nil
 }
+
+// deletePodVolumes removes the data that the backends stored for the volumes of a pod (e.g. emptyDirs)
+// Volumes that live outside the storage of FLEDGE (e.g. hostPaths) are left untouched
+func (p *Provider) deletePodVolumes(ctx context.Context, pod *corev1.Pod) {
+	for _, v := range pod.Spec.Volumes {
+		path := storage.VolumePath(podAndVolumeToIdentifier(pod, &v))
+		if err := os.RemoveAll(path); err != nil {
+			log.G(ctx).Warnf("failed to delete volume %q: %s", path, err)
+		}
+	}
+}
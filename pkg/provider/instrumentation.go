@@ -0,0 +1,142 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+// Operations of pods and instances in the labels of the operational metrics
+const (
+	operationPull       = "pull"
+	operationCreate     = "create"
+	operationStart      = "start"
+	operationUpdate     = "update"
+	operationKill       = "kill"
+	operationDelete     = "delete"
+	operationCheckpoint = "checkpoint"
+	operationMigrate    = "migrate"
+)
+
+// backendMixed is the backend label of pods with instances of more than one backend
+const backendMixed = "mixed"
+
+var (
+	podOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "fledge",
+		Subsystem: "pod",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of creating, starting and deleting the instances of pods, by backend and operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"backend", "operation"})
+	backendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fledge",
+		Subsystem: "backend",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed operations on instances, by backend, operation and reason.",
+	}, []string{"backend", "operation", "reason"})
+	instancesDesc = prometheus.NewDesc(
+		"fledge_instances",
+		"Number of instances, by backend and state.",
+		[]string{"backend", "state"}, nil,
+	)
+)
+
+// errorReason classifies an error of a backend for the reason label
+func errorReason(err error) string {
+	switch {
+	case errdefs.IsNotFound(err):
+		return "not_found"
+	case errdefs.IsAlreadyExists(err):
+		return "already_exists"
+	case errdefs.IsInvalidArgument(err):
+		return "invalid_argument"
+	case errdefs.IsFailedPrecondition(err):
+		return "failed_precondition"
+	case errdefs.IsUnavailable(err):
+		return "unavailable"
+	case errdefs.IsNotImplemented(err):
+		return "not_implemented"
+	case errdefs.IsCanceled(err):
+		return "canceled"
+	case errdefs.IsDeadlineExceeded(err):
+		return "deadline_exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// countError counts a failed operation of a backend and returns the error
+func countError(backend, operation string, err error) error {
+	if err != nil {
+		backendErrors.WithLabelValues(backend, operation, errorReason(err)).Inc()
+	}
+	return err
+}
+
+// observePodOperation records how long an operation on the instances of a pod took
+func observePodOperation(instances []*Instance, operation string, start time.Time) {
+	if len(instances) == 0 {
+		return
+	}
+	podOperationDuration.WithLabelValues(podBackend(instances), operation).Observe(time.Since(start).Seconds())
+}
+
+// podBackend returns the backend of the instances of a pod, or backendMixed if they use different ones
+func podBackend(instances []*Instance) string {
+	backend := instances[0].BackendName()
+	for _, instance := range instances[1:] {
+		if instance.BackendName() != backend {
+			return backendMixed
+		}
+	}
+	return backend
+}
+
+// An instanceCollector counts the instances of a provider by their state whenever the metrics are gathered
+type instanceCollector struct {
+	p *Provider
+}
+
+func (c instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+}
+
+func (c instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.p.mu.RLock()
+	instances := make([]*Instance, 0, len(c.p.instances))
+	for _, instance := range c.p.instances {
+		instances = append(instances, instance)
+	}
+	c.p.mu.RUnlock()
+
+	type key struct{ backend, state string }
+	counts := map[key]int{}
+	for _, instance := range instances {
+		state := "unknown"
+		if status, err := instance.Status(); err == nil {
+			switch {
+			case status.State.Running != nil:
+				state = "running"
+			case status.State.Terminated != nil:
+				state = "terminated"
+			case status.State.Waiting != nil:
+				state = "waiting"
+			}
+		}
+		counts[key{instance.BackendName(), state}]++
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(count), k.backend, k.state)
+	}
+}
+
+// registerInstanceCollector exposes the instance counts of the provider, there is only one provider per process
+func (p *Provider) registerInstanceCollector(ctx context.Context) {
+	if err := prometheus.Register(instanceCollector{p: p}); err != nil {
+		log.G(ctx).Warnf("failed to register instance metrics: %s", err)
+	}
+}
@@ -1,29 +1,489 @@
 package provider
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
-type ContainerLogger struct {
-	file *os.File
-	opts api.ContainerLogOpts
+// Logs are written in the CRI format, every line is "<timestamp> <stream> <tag> <content>"
+// https://github.com/kubernetes/design-proposals-archive/blob/main/node/kubelet-cri-logging.md
+const (
+	logStreamStdout = "stdout"
+	logStreamStderr = "stderr"
+	// logTagPartial marks a line that is continued on the next one, logTagFull ends it
+	logTagPartial = "P"
+	logTagFull    = "F"
+	// maxLogLineSize is the size at which a line is split into partial lines
+	maxLogLineSize = 16 * 1024
+	// previousLogSuffix is appended to the path of the logs of the previous run of an instance
+	previousLogSuffix = ".previous"
+)
+
+// A ContainerLogWriter writes the output of an instance to a log file and rotates it by size
+// The rotated files are "<path>.1" (newest) up to "<path>.<maxFiles-1>" (oldest)
+type ContainerLogWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	streams []*logStreamWriter
+}
+
+// NewContainerLogWriter starts the logs of a new run of an instance, the logs of the last run are kept as its previous logs
+// A maxSize of 0 disables rotation
+func NewContainerLogWriter(path string, maxSize int64, maxFiles int) (*ContainerLogWriter, error) {
+	previous := path + previousLogSuffix
+	for _, p := range containerLogFiles(previous) {
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	files := containerLogFiles(path)
+	for i, p := range files {
+		if err := os.Rename(p, rotatedLogPath(previous, len(files)-1-i)); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerLogWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		file:     file,
+	}, nil
+}
+
+// Stdout returns a writer for the stdout of a process, every process should have its own
+func (w *ContainerLogWriter) Stdout() io.Writer {
+	return w.newStream(logStreamStdout)
+}
+
+// Stderr returns a writer for the stderr of a process, every process should have its own
+func (w *ContainerLogWriter) Stderr() io.Writer {
+	return w.newStream(logStreamStderr)
+}
+
+// Close flushes the unfinished lines of all streams and closes the log file
+func (w *ContainerLogWriter) Close() error {
+	w.mu.Lock()
+	streams := w.streams
+	w.mu.Unlock()
+	for _, s := range streams {
+		s.flush()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *ContainerLogWriter) newStream(stream string) *logStreamWriter {
+	s := &logStreamWriter{w: w, stream: stream}
+	w.mu.Lock()
+	w.streams = append(w.streams, s)
+	w.mu.Unlock()
+	return s
+}
+
+func (w *ContainerLogWriter) writeLine(stream, tag string, content []byte) error {
+	line := make([]byte, 0, len(time.RFC3339Nano)+len(stream)+len(tag)+len(content)+4)
+	line = time.Now().AppendFormat(line, time.RFC3339Nano)
+	line = append(line, ' ')
+	line = append(line, stream...)
+	line = append(line, ' ')
+	line = append(line, tag...)
+	line = append(line, ' ')
+	line = append(line, content...)
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
 }
 
-func NewContainerLogger(path string, opts api.ContainerLogOpts) (*ContainerLogger, error) {
-	file, err := os.Open(path)
-	return &ContainerLogger{file: file, opts: opts}, err
+// rotate shifts the rotated files and starts a new log file, the oldest file is dropped
+func (w *ContainerLogWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	rotated := w.maxFiles - 1
+	if rotated < 1 {
+		if err := os.Remove(w.path); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(rotatedLogPath(w.path, rotated)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := rotated - 1; i >= 0; i-- {
+			if err := os.Rename(rotatedLogPath(w.path, i), rotatedLogPath(w.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		w.file = nil
+		return err
+	}
+	w.file = file
+	w.size = 0
+	return nil
+}
+
+// logStreamWriter splits the output of a stream into lines
+type logStreamWriter struct {
+	w      *ContainerLogWriter
+	stream string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (s *logStreamWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	for len(s.buf) > 0 {
+		if i := bytes.IndexByte(s.buf, '\n'); i >= 0 && i <= maxLogLineSize {
+			if err := s.w.writeLine(s.stream, logTagFull, s.buf[:i]); err != nil {
+				return 0, err
+			}
+			s.buf = s.buf[i+1:]
+		} else if len(s.buf) >= maxLogLineSize {
+			if err := s.w.writeLine(s.stream, logTagPartial, s.buf[:maxLogLineSize]); err != nil {
+				return 0, err
+			}
+			s.buf = s.buf[maxLogLineSize:]
+		} else {
+			break
+		}
+	}
+	return len(p), nil
+}
+
+func (s *logStreamWriter) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) > 0 {
+		_ = s.w.writeLine(s.stream, logTagFull, s.buf)
+		s.buf = nil
+	}
 }
 
-func (s *ContainerLogger) Read(p []byte) (n int, err error) {
-	n, err = s.file.Read(p)
-	if s.opts.Follow && err == io.EOF {
-		n, err = 0, nil
+// rotatedLogPath returns the path of the i-th rotated log file, 0 is the file that is being written
+func rotatedLogPath(path string, i int) string {
+	if i == 0 {
+		return path
 	}
-	return
+	return path + "." + strconv.Itoa(i)
+}
+
+// containerLogFiles returns the existing files of a log, from oldest to newest
+func containerLogFiles(path string) []string {
+	var files []string
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedLogPath(path, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedLogPath(path, i)}, files...)
+	}
+	return files
+}
+
+// ContainerLogger reads the logs of an instance and implements all the ContainerLogOpts
+type ContainerLogger struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+// NewContainerLogger starts reading the logs at path, exited is closed when the instance stops writing to it
+// The logs are followed until the instance exits or the logger is closed, an instance that is not running has a nil exited
+func NewContainerLogger(path string, opts api.ContainerLogOpts, exited <-chan struct{}) (*ContainerLogger, error) {
+	if opts.Previous {
+		path += previousLogSuffix
+		exited = nil
+	}
+	files := containerLogFiles(path)
+	if len(files) == 0 {
+		return nil, errors.Wrapf(os.ErrNotExist, "no logs at %q", path)
+	}
+	if exited == nil {
+		opts.Follow = false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	l := &containerLogReader{
+		path:   path,
+		opts:   opts,
+		exited: exited,
+		out:    w,
+	}
+	if !opts.SinceTime.IsZero() {
+		l.since = opts.SinceTime
+	}
+	if opts.SinceSeconds > 0 {
+		l.since = time.Now().Add(-time.Duration(opts.SinceSeconds) * time.Second)
+	}
+	if opts.LimitBytes > 0 {
+		l.remaining = int64(opts.LimitBytes)
+	}
+	go func() {
+		_ = w.CloseWithError(l.read(ctx, files))
+	}()
+	return &ContainerLogger{PipeReader: r, cancel: cancel}, nil
 }
 
 func (s *ContainerLogger) Close() error {
-	return s.file.Close()
+	s.cancel()
+	return s.PipeReader.Close()
+}
+
+type containerLogReader struct {
+	path   string
+	opts   api.ContainerLogOpts
+	exited <-chan struct{}
+	out    io.Writer
+	since  time.Time
+	// remaining is the number of bytes that can still be written if LimitBytes is set
+	remaining int64
+}
+
+var errLogLimitReached = errors.New("log limit reached")
+
+func (l *containerLogReader) read(ctx context.Context, files []string) error {
+	// Find where the last Tail lines start, looking at older files when the newer ones are too short
+	first, offset := 0, int64(0)
+	if l.opts.Tail > 0 {
+		lines := 0
+		first = -1
+		for i := len(files) - 1; i >= 0 && first < 0; i-- {
+			o, n, err := tailOffset(files[i], l.opts.Tail-lines)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			lines += n
+			if lines >= l.opts.Tail || i == 0 {
+				first, offset = i, o
+			}
+		}
+	}
+
+	// Older files are complete, only the newest one can be followed
+	for i := first; i < len(files)-1; i++ {
+		if err := l.readFile(ctx, files[i], offset, false); err != nil {
+			return l.done(err)
+		}
+		offset = 0
+	}
+	return l.done(l.readFile(ctx, files[len(files)-1], offset, l.opts.Follow))
+}
+
+func (l *containerLogReader) done(err error) error {
+	if err == errLogLimitReached || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readFile writes the lines of a file from offset, with follow it keeps waiting for new lines until the instance exits
+func (l *containerLogReader) readFile(ctx context.Context, path string, offset int64, follow bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var watcher *fsnotify.Watcher
+	if follow {
+		// Watch the directory to also see the file being rotated
+		if watcher, err = fsnotify.NewWatcher(); err != nil {
+			return err
+		}
+		defer watcher.Close()
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(f)
+	var pending []byte
+	exited := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		pending = append(pending, line...)
+		if err == nil {
+			if err := l.writeLine(pending); err != nil {
+				return err
+			}
+			pending = pending[:0]
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if !follow {
+			return nil
+		}
+
+		// The file was rotated, continue with the new one
+		if rotated, err := fileReplaced(f, path); err != nil {
+			return err
+		} else if rotated {
+			f.Close()
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+			reader.Reset(f)
+			pending = pending[:0]
+			continue
+		}
+		if exited {
+			return nil
+		}
+
+		// Wait for new lines, after the instance exited the file is read one last time
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.exited:
+			exited = true
+		case err := <-watcher.Errors:
+			return err
+		case <-watcher.Events:
+		}
+	}
+}
+
+// writeLine writes the content of a line in the CRI format to the output
+func (l *containerLogReader) writeLine(line []byte) error {
+	timestamp, rest, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok {
+		return nil
+	}
+	_, rest, _ = bytes.Cut(rest, []byte(" ")) // stream
+	tag, content, ok := bytes.Cut(rest, []byte(" "))
+	if !ok {
+		return nil
+	}
+	if !l.since.IsZero() {
+		t, err := time.Parse(time.RFC3339Nano, string(timestamp))
+		if err != nil || t.Before(l.since) {
+			return nil
+		}
+	}
+
+	var out []byte
+	if l.opts.Timestamps {
+		out = append(out, timestamp...)
+		out = append(out, ' ')
+	}
+	out = append(out, content...)
+	if string(tag) != logTagPartial {
+		out = append(out, '\n')
+	}
+	if l.opts.LimitBytes > 0 {
+		if int64(len(out)) >= l.remaining {
+			_, _ = l.out.Write(out[:l.remaining])
+			return errLogLimitReached
+		}
+		l.remaining -= int64(len(out))
+	}
+	_, err := l.out.Write(out)
+	return err
+}
+
+// tailOffset returns the offset at which the last n lines of a file start, or 0 and the number of lines if it has fewer
+func tailOffset(path string, n int) (int64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	end := info.Size()
+	if end == 0 {
+		return 0, 0, nil
+	}
+
+	buf := make([]byte, 32*1024)
+	lines := 0
+	for pos := end; pos > 0; {
+		size := int64(len(buf))
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		if _, err := f.ReadAt(buf[:size], pos); err != nil {
+			return 0, 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			// The newline that ends the last line does not start a line
+			if buf[i] != '\n' || pos+i == end-1 {
+				continue
+			}
+			lines++
+			if lines == n {
+				return pos + i + 1, n, nil
+			}
+		}
+	}
+	return 0, lines + 1, nil
+}
+
+// fileReplaced checks if the path no longer refers to the open file
+func fileReplaced(f *os.File, path string) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// Rotation is in progress
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(info, current), nil
 }
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+)
+
+// readLogs reads the logs at path of an instance that is not running
+func readLogs(t *testing.T, path string, opts api.ContainerLogOpts) string {
+	t.Helper()
+	logger, err := NewContainerLogger(path, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logs, err := io.ReadAll(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(logs)
+}
+
+// writeLogFile writes lines in the CRI format with the given timestamps to a log file
+func writeLogFile(t *testing.T, path string, timestamps []time.Time, lines ...string) {
+	t.Helper()
+	var content strings.Builder
+	for i, line := range lines {
+		fmt.Fprintf(&content, "%s %s %s\n", timestamps[i].Format(time.RFC3339Nano), logStreamStdout, line)
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeRun writes the lines of a run of an instance to its logs
+func writeRun(t *testing.T, path string, maxSize int64, maxFiles int, lines ...string) {
+	t.Helper()
+	w, err := NewContainerLogWriter(path, maxSize, maxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := w.Stdout()
+	for _, line := range lines {
+		if _, err = io.WriteString(stdout, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerLogWriterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.log")
+	// Every line exceeds the maximum size, so every line starts a new file
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("line-%d", i))
+	}
+	writeRun(t, path, 1, 3, lines...)
+
+	if files := containerLogFiles(path); len(files) != 3 || files[0] != path+".2" || files[2] != path {
+		t.Fatalf("expected the log and 2 rotated files, got %v", files)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected the oldest file to be dropped, got %v", err)
+	}
+	if logs := readLogs(t, path, api.ContainerLogOpts{}); logs != "line-7\nline-8\nline-9\n" {
+		t.Fatalf("expected the lines of the remaining files, got %q", logs)
+	}
+
+	// Lines that are too long are split in partial lines, which are joined again
+	long := strings.Repeat("x", maxLogLineSize+10)
+	path = filepath.Join(t.TempDir(), "c.log")
+	writeRun(t, path, 0, 1, long, "short")
+	if logs := readLogs(t, path, api.ContainerLogOpts{}); logs != long+"\nshort\n" {
+		t.Fatalf("expected the long line to be joined, got %d bytes", len(logs))
+	}
+}
+
+func TestContainerLogWriterPrevious(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.log")
+	writeRun(t, path, 1, 3, "first-0", "first-1")
+	writeRun(t, path, 0, 3, "second")
+
+	if logs := readLogs(t, path, api.ContainerLogOpts{}); logs != "second\n" {
+		t.Fatalf("expected the logs of the current run, got %q", logs)
+	}
+	// The rotated files of the last run are kept in order
+	if logs := readLogs(t, path, api.ContainerLogOpts{Previous: true}); logs != "first-0\nfirst-1\n" {
+		t.Fatalf("expected the logs of the previous run, got %q", logs)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected the rotated files to move to the previous logs, got %v", err)
+	}
+
+	// Only the last run is kept
+	writeRun(t, path, 0, 3, "third")
+	if logs := readLogs(t, path, api.ContainerLogOpts{Previous: true}); logs != "second\n" {
+		t.Fatalf("expected the logs of the second run, got %q", logs)
+	}
+	if files := containerLogFiles(path + previousLogSuffix); len(files) != 1 {
+		t.Fatalf("expected the rotated files of the first run to be removed, got %v", files)
+	}
+
+	if _, err := NewContainerLogger(filepath.Join(t.TempDir(), "c.log"), api.ContainerLogOpts{Previous: true}, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no previous logs, got %v", err)
+	}
+}
+
+func TestContainerLoggerOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.log")
+	start := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	at := func(hours ...int) []time.Time {
+		var timestamps []time.Time
+		for _, h := range hours {
+			timestamps = append(timestamps, start.Add(time.Duration(h)*time.Hour))
+		}
+		return timestamps
+	}
+	writeLogFile(t, path+".2", at(0), "F a")
+	writeLogFile(t, path+".1", at(1, 2, 3), "F b", "P c", "F d")
+	writeLogFile(t, path, at(4, 5), "F e", "F f")
+
+	tests := []struct {
+		name     string
+		opts     api.ContainerLogOpts
+		expected string
+	}{
+		{"all", api.ContainerLogOpts{}, "a\nb\ncd\ne\nf\n"},
+		{"tail in the newest file", api.ContainerLogOpts{Tail: 1}, "f\n"},
+		{"tail across rotated files", api.ContainerLogOpts{Tail: 3}, "d\ne\nf\n"},
+		// The partial line counts as a line of its own
+		{"tail across all files", api.ContainerLogOpts{Tail: 5}, "b\ncd\ne\nf\n"},
+		{"tail longer than the logs", api.ContainerLogOpts{Tail: 100}, "a\nb\ncd\ne\nf\n"},
+		{"since", api.ContainerLogOpts{SinceTime: start.Add(150 * time.Minute)}, "d\ne\nf\n"},
+		{"since and tail", api.ContainerLogOpts{SinceTime: start.Add(270 * time.Minute), Tail: 4}, "f\n"},
+		{"limit bytes", api.ContainerLogOpts{LimitBytes: 5}, "a\nb\nc"},
+		{"limit bytes at a line", api.ContainerLogOpts{LimitBytes: 4}, "a\nb\n"},
+		{"limit bytes and tail", api.ContainerLogOpts{LimitBytes: 3, Tail: 2}, "e\nf"},
+		{
+			"timestamps",
+			api.ContainerLogOpts{Timestamps: true, Tail: 1},
+			start.Add(5*time.Hour).Format(time.RFC3339Nano) + " f\n",
+		},
+	}
+	for _, test := range tests {
+		if logs := readLogs(t, path, test.opts); logs != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, logs)
+		}
+	}
+
+	// Since in seconds is relative to now
+	now := time.Now()
+	writeLogFile(t, path, []time.Time{now.Add(-time.Hour), now}, "F old", "F new")
+	if logs := readLogs(t, path, api.ContainerLogOpts{SinceSeconds: 60}); logs != "new\n" {
+		t.Errorf("expected the lines of the last minute, got %q", logs)
+	}
+}
@@ -2,130 +2,126 @@ package provider
 
 import (
 	"context"
+	"github.com/containerd/containerd/log"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
-	"strings"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func (p *Provider) generateMockMetrics(metricsMap map[string][]*dto.Metric, resourceType string, label []*dto.LabelPair) map[string][]*dto.Metric {
-	var (
-		cpuMetricSuffix    = "_cpu_usage_seconds_total"
-		memoryMetricSuffix = "_memory_working_set_bytes"
-		dummyValue         = float64(100)
-	)
+// Resource metrics and their labels, the same as the ones of the kubelet (/metrics/resource)
+const (
+	metricNodeCPUUsage              = "node_cpu_usage_seconds_total"
+	metricNodeMemoryWorkingSet      = "node_memory_working_set_bytes"
+	metricPodCPUUsage               = "pod_cpu_usage_seconds_total"
+	metricPodMemoryWorkingSet       = "pod_memory_working_set_bytes"
+	metricContainerCPUUsage         = "container_cpu_usage_seconds_total"
+	metricContainerMemoryWorkingSet = "container_memory_working_set_bytes"
+	metricContainerStartTime        = "container_start_time_seconds"
+	metricScrapeError               = "scrape_error"
+	metricLabelContainer            = "container"
+	metricLabelPod                  = "pod"
+	metricLabelNamespace            = "namespace"
+	metricHelpNodeCPUUsage          = "Cumulative cpu time consumed by the node in core-seconds"
+	metricHelpNodeMemory            = "Current working set of the node in bytes"
+	metricHelpPodCPUUsage           = "Cumulative cpu time consumed by the pod in core-seconds"
+	metricHelpPodMemory             = "Current working set of the pod in bytes"
+	metricHelpContainerCPUUsage     = "Cumulative cpu time consumed by the container in core-seconds"
+	metricHelpContainerMemory       = "Current working set of the container in bytes"
+	metricHelpContainerStart        = "Start time of the container since unix epoch in seconds"
+	metricHelpScrapeError           = "1 if there was an error while getting container metrics, 0 otherwise"
+)
 
-	if metricsMap == nil {
-		metricsMap = map[string][]*dto.Metric{}
-	}
+// resourceMetrics collects the metric families of the resource metrics
+type resourceMetrics struct {
+	families []*dto.MetricFamily
+	byName   map[string]*dto.MetricFamily
+}
 
-	finalCpuMetricName := resourceType + cpuMetricSuffix
-	finalMemoryMetricName := resourceType + memoryMetricSuffix
+func newResourceMetrics() *resourceMetrics {
+	return &resourceMetrics{byName: map[string]*dto.MetricFamily{}}
+}
 
-	newCPUMetric := dto.Metric{
-		Label: label,
-		Counter: &dto.Counter{
-			Value: &dummyValue,
-		},
+// add appends a sample to a metric family, which is created the first time
+func (m *resourceMetrics) add(name, help string, metricType dto.MetricType, value float64, time metav1.Time, labels ...string) {
+	family, ok := m.byName[name]
+	if !ok {
+		name, help, metricType := name, help, metricType
+		family = &dto.MetricFamily{Name: &name, Help: &help, Type: &metricType}
+		m.byName[name] = family
+		m.families = append(m.families, family)
 	}
-	newMemoryMetric := dto.Metric{
-		Label: label,
-		Gauge: &dto.Gauge{
-			Value: &dummyValue,
-		},
+	metric := &dto.Metric{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelName, labelValue := labels[i], labels[i+1]
+		metric.Label = append(metric.Label, &dto.LabelPair{Name: &labelName, Value: &labelValue})
 	}
-	// if metric family exists add to metric array
-	if cpuMetrics, ok := metricsMap[finalCpuMetricName]; ok {
-		metricsMap[finalCpuMetricName] = append(cpuMetrics, &newCPUMetric)
+	if metricType == dto.MetricType_COUNTER {
+		metric.Counter = &dto.Counter{Value: &value}
 	} else {
-		metricsMap[finalCpuMetricName] = []*dto.Metric{&newCPUMetric}
+		metric.Gauge = &dto.Gauge{Value: &value}
 	}
-	if memoryMetrics, ok := metricsMap[finalMemoryMetricName]; ok {
-		metricsMap[finalMemoryMetricName] = append(memoryMetrics, &newMemoryMetric)
-	} else {
-		metricsMap[finalMemoryMetricName] = []*dto.Metric{&newMemoryMetric}
+	if !time.IsZero() {
+		timestamp := time.UnixMilli()
+		metric.TimestampMs = &timestamp
 	}
-
-	return metricsMap
+	family.Metric = append(family.Metric, metric)
 }
 
-func (p *Provider) getMetricType(metricName string) *dto.MetricType {
-	var (
-		dtoCounterMetricType = dto.MetricType_COUNTER
-		dtoGaugeMetricType   = dto.MetricType_GAUGE
-		cpuMetricSuffix      = "_cpu_usage_seconds_total"
-		memoryMetricSuffix   = "_memory_working_set_bytes"
-	)
-	if strings.HasSuffix(metricName, cpuMetricSuffix) {
-		return &dtoCounterMetricType
-	}
-	if strings.HasSuffix(metricName, memoryMetricSuffix) {
-		return &dtoGaugeMetricType
+// addCPU adds the cumulative CPU usage in seconds, if it is known
+func (m *resourceMetrics) addCPU(name, help string, stats *statsv1alpha1.CPUStats, labels ...string) {
+	if stats == nil || stats.UsageCoreNanoSeconds == nil {
+		return
 	}
+	m.add(name, help, dto.MetricType_COUNTER, float64(*stats.UsageCoreNanoSeconds)/1e9, stats.Time, labels...)
+}
 
-	return nil
+// addMemory adds the working set in bytes, if it is known
+func (m *resourceMetrics) addMemory(name, help string, stats *statsv1alpha1.MemoryStats, labels ...string) {
+	if stats == nil || stats.WorkingSetBytes == nil {
+		return
+	}
+	m.add(name, help, dto.MetricType_GAUGE, float64(*stats.WorkingSetBytes), stats.Time, labels...)
 }
 
+// GetMetricsResource returns the resource metrics of the node, its pods and their containers
+// The metrics come from the same collectors as the stats summary. The instances of all backends (e.g. OSv virtual
+// machines) are containers of their pods.
 func (p *Provider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
-	var span trace.Span
-	ctx, span = trace.StartSpan(ctx, "GetMetricsResource") //nolint: ineffassign,staticcheck
+	ctx, span := trace.StartSpan(ctx, "GetMetricsResource")
 	defer span.End()
 
-	var (
-		nodeNameStr      = "NodeName"
-		podNameStr       = "PodName"
-		containerNameStr = "containerName"
-	)
-	nodeLabels := []*dto.LabelPair{
-		{
-			Name:  &nodeNameStr,
-			Value: &p.nodeName,
-		},
-	}
+	log.G(ctx).Debug("receive GetMetricsResource")
 
-	metricsMap := p.generateMockMetrics(nil, "node", nodeLabels)
-	for _, pod := range p.pods {
-		podLabels := []*dto.LabelPair{
-			{
-				Name:  &nodeNameStr,
-				Value: &p.nodeName,
-			},
-			{
-				Name:  &podNameStr,
-				Value: &pod.Name,
-			},
-		}
-		metricsMap = p.generateMockMetrics(metricsMap, "pod", podLabels)
-		for _, container := range pod.Spec.Containers {
-			containerLabels := []*dto.LabelPair{
-				{
-					Name:  &nodeNameStr,
-					Value: &p.nodeName,
-				},
-				{
-					Name:  &podNameStr,
-					Value: &pod.Name,
-				},
-				{
-					Name:  &containerNameStr,
-					Value: &container.Name,
-				},
-			}
-			metricsMap = p.generateMockMetrics(metricsMap, "container", containerLabels)
-		}
+	metrics := newResourceMetrics()
+	summary, err := p.GetStatsSummary(ctx)
+	scrapeError := float64(0)
+	if err != nil {
+		log.G(ctx).Errorf("failed to get stats summary: %s", err)
+		scrapeError = 1
+		summary = &statsv1alpha1.Summary{}
 	}
 
-	res := []*dto.MetricFamily{}
-	for metricName := range metricsMap {
-		tempName := metricName
-		tempMetrics := metricsMap[tempName]
+	// Node
+	metrics.addCPU(metricNodeCPUUsage, metricHelpNodeCPUUsage, summary.Node.CPU)
+	metrics.addMemory(metricNodeMemoryWorkingSet, metricHelpNodeMemory, summary.Node.Memory)
 
-		metricFamily := dto.MetricFamily{
-			Name:   &tempName,
-			Type:   p.getMetricType(tempName),
-			Metric: tempMetrics,
+	// Pods and their containers
+	for _, pod := range summary.Pods {
+		podLabels := []string{metricLabelPod, pod.PodRef.Name, metricLabelNamespace, pod.PodRef.Namespace}
+		metrics.addCPU(metricPodCPUUsage, metricHelpPodCPUUsage, pod.CPU, podLabels...)
+		metrics.addMemory(metricPodMemoryWorkingSet, metricHelpPodMemory, pod.Memory, podLabels...)
+		for _, container := range pod.Containers {
+			containerLabels := append([]string{metricLabelContainer, container.Name}, podLabels...)
+			metrics.addCPU(metricContainerCPUUsage, metricHelpContainerCPUUsage, container.CPU, containerLabels...)
+			metrics.addMemory(metricContainerMemoryWorkingSet, metricHelpContainerMemory, container.Memory, containerLabels...)
+			if !container.StartTime.IsZero() {
+				startTime := float64(container.StartTime.Unix())
+				metrics.add(metricContainerStartTime, metricHelpContainerStart, dto.MetricType_GAUGE, startTime, container.StartTime, containerLabels...)
+			}
 		}
-		res = append(res, &metricFamily)
 	}
 
-	return res, nil
+	metrics.add(metricScrapeError, metricHelpScrapeError, dto.MetricType_GAUGE, scrapeError, metav1.Time{})
+	return metrics.families, nil
 }
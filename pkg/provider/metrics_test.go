@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+)
+
+func TestGetMetricsResource(t *testing.T) {
+	storage.SetRootPath(t.TempDir())
+	defer storage.SetRootPath("")
+
+	now := time.Now()
+	start := now.Add(-time.Hour).Truncate(time.Second)
+	backend := statsBackend{testBackend: newTestBackend(nil), stats: map[string]InstanceStats{
+		"a": {Time: now, StartTime: start, CPUUsage: 1500000000, MemoryWorkingSet: 1024},
+	}}
+	p := newTestProvider(backend)
+	pod := newTestPod("a")
+	p.pods[podToIdentifier(pod)] = pod
+	p.instances[podAndContainerToIdentifier(pod, &pod.Spec.Containers[0])] = &Instance{Backend: backend, Container: &pod.Spec.Containers[0]}
+
+	families, err := p.GetMetricsResource(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	type sample struct {
+		labels map[string]string
+		value  float64
+	}
+	types := map[string]dto.MetricType{}
+	samples := map[string][]sample{}
+	for _, family := range families {
+		types[family.GetName()] = family.GetType()
+		for _, metric := range family.Metric {
+			s := sample{labels: map[string]string{}}
+			for _, label := range metric.Label {
+				s.labels[label.GetName()] = label.GetValue()
+			}
+			if family.GetType() == dto.MetricType_COUNTER {
+				s.value = metric.GetCounter().GetValue()
+			} else {
+				s.value = metric.GetGauge().GetValue()
+			}
+			if family.GetName() != metricScrapeError && metric.TimestampMs == nil {
+				t.Errorf("expected a timestamp on %s", family.GetName())
+			}
+			samples[family.GetName()] = append(samples[family.GetName()], s)
+		}
+	}
+
+	// The names, types and labels are the ones of the kubelet, which the metrics server relies on
+	podLabels := map[string]string{"pod": "pod", "namespace": "default"}
+	containerLabels := map[string]string{"container": "a", "pod": "pod", "namespace": "default"}
+	tests := []struct {
+		name       string
+		metricType dto.MetricType
+		expected   []sample
+	}{
+		{"pod_cpu_usage_seconds_total", dto.MetricType_COUNTER, []sample{{podLabels, 1.5}}},
+		{"pod_memory_working_set_bytes", dto.MetricType_GAUGE, []sample{{podLabels, 1024}}},
+		{"container_cpu_usage_seconds_total", dto.MetricType_COUNTER, []sample{{containerLabels, 1.5}}},
+		{"container_memory_working_set_bytes", dto.MetricType_GAUGE, []sample{{containerLabels, 1024}}},
+		{"container_start_time_seconds", dto.MetricType_GAUGE, []sample{{containerLabels, float64(start.Unix())}}},
+		{"scrape_error", dto.MetricType_GAUGE, []sample{{map[string]string{}, 0}}},
+	}
+	for _, test := range tests {
+		if types[test.name] != test.metricType {
+			t.Errorf("expected %s to be a %s, got %s", test.name, test.metricType, types[test.name])
+		}
+		if !reflect.DeepEqual(samples[test.name], test.expected) {
+			t.Errorf("expected the samples %v of %s, got %v", test.expected, test.name, samples[test.name])
+		}
+	}
+	// The node reports its own usage without labels
+	for _, name := range []string{"node_cpu_usage_seconds_total", "node_memory_working_set_bytes"} {
+		if node := samples[name]; len(node) != 1 || len(node[0].labels) != 0 {
+			t.Errorf("expected a sample of %s without labels, got %v", name, node)
+		}
+	}
+}
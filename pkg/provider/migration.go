@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"strconv"
+	"time"
+)
+
+// Instances are live migrated between nodes with two annotations:
+//  1. a pod on the target node with incoming.fledge.io/<container> set to a port starts the instance of the container
+//     without running it, it receives the guest on that port and the disk on the next port
+//  2. setting migrate.fledge.io/<container> of the pod on the source node to the address (host:port) of the target
+//     migrates the running instance of the container, which terminates with the reason Migrated once the target
+//     runs it
+//
+// Both pods need the same spec, so that the instances have the same image and resources. The nodes authenticate each
+// other with the pre-shared key in migration.credentialsDir.
+
+const (
+	// annotationIncomingPrefix followed by the name of a container waits for a migration of the container on the port
+	// in the value
+	annotationIncomingPrefix = "incoming.fledge.io/"
+	// annotationMigratePrefix followed by the name of a container migrates the container to the address in the value
+	annotationMigratePrefix = "migrate.fledge.io/"
+)
+
+const (
+	// reasonMigrating is the reason of instances that wait for an incoming migration
+	reasonMigrating = "Migrating"
+	// reasonMigrated is the reason of instances that terminated because they were migrated
+	reasonMigrated = "Migrated"
+
+	// Reasons of the events about migrations
+	eventMigrating       = "Migrating"
+	eventMigrated        = "Migrated"
+	eventMigrationFailed = "MigrationFailed"
+)
+
+// A MigrationBackend is a Backend that can live migrate instances to the same backend on another node
+// Instances with an incoming migration port wait for a migration when they are started, instead of running anew.
+type MigrationBackend interface {
+	Backend
+	// MigrateInstance migrates a running instance to the instance that waits for it at an address (host:port), the
+	// instance terminates once the migration completed
+	MigrateInstance(ctx context.Context, instance *Instance, address string) error
+}
+
+// incomingMigrationPort returns the port on which a container of a pod waits for its migration, zero if the container
+// starts anew
+func incomingMigrationPort(pod *corev1.Pod, container *corev1.Container) (int, error) {
+	value, ok := pod.Annotations[annotationIncomingPrefix+container.Name]
+	if !ok {
+		return 0, nil
+	}
+	// The disk is received on the next port
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65534 {
+		return 0, errors.Errorf("invalid incoming migration port %q", value)
+	}
+	return port, nil
+}
+
+// migratePod starts the migrations that an update of a pod asks for, it reports whether there were any
+func (p *Provider) migratePod(ctx context.Context, previous, pod *corev1.Pod) bool {
+	// Only annotations that were added or changed start a migration
+	addresses := map[string]string{}
+	for _, c := range pod.Spec.Containers {
+		key := annotationMigratePrefix + c.Name
+		if address := pod.Annotations[key]; address != "" && address != previous.Annotations[key] {
+			addresses[c.Name] = address
+		}
+	}
+	if len(addresses) == 0 {
+		return false
+	}
+	for container, address := range addresses {
+		go p.migrateContainer(log.WithLogger(p.context, log.G(ctx)), pod, container, address)
+	}
+	return true
+}
+
+// migrateContainer migrates the instance of a container of a pod to an address and records the outcome as events
+func (p *Provider) migrateContainer(ctx context.Context, pod *corev1.Pod, container, address string) {
+	err := func() error {
+		instance, ok := p.getInstance(pod.Namespace, pod.Name, container)
+		if !ok {
+			return errors.Errorf("container %q has no instance", container)
+		}
+		backend, ok := instance.Backend.(MigrationBackend)
+		if !ok {
+			return errors.Errorf("backend %q can not migrate instances", instance.BackendName())
+		}
+
+		log.G(ctx).Infof("migrating instance %q to %q", instance.ID, address)
+		p.recordContainerEvent(pod, container, corev1.EventTypeNormal, eventMigrating, "Migrating container to %s", address)
+		start := time.Now()
+		if err := backend.MigrateInstance(ctx, instance, address); err != nil {
+			return countError(instance.BackendName(), operationMigrate, err)
+		}
+		log.G(ctx).Infof("migrated instance %q in %s", instance.ID, time.Since(start).Round(time.Millisecond))
+		p.recordContainerEvent(pod, container, corev1.EventTypeNormal, eventMigrated, "Migrated container to %s in %s", address, time.Since(start).Round(time.Millisecond))
+		return nil
+	}()
+	if err != nil {
+		log.G(ctx).Errorf("failed to migrate container %q of pod %q: %s", container, podToIdentifier(pod), err)
+		p.recordContainerEvent(pod, container, corev1.EventTypeWarning, eventMigrationFailed, "Error: %s", err)
+	}
+}
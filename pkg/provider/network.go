@@ -0,0 +1,280 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/netns"
+	gocni "github.com/containerd/go-cni"
+	"github.com/containernetworking/cni/libcni"
+	"github.com/pkg/errors"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// defaultPodInterface is the interface in the network namespace of the pod that connects it to the network
+const defaultPodInterface = gocni.DefaultPrefix + "0"
+
+// defaultNetworkConfList is used when the conf dir does not contain any network configuration
+const defaultNetworkConfList = `{
+  "cniVersion": "1.0.0",
+  "name": "fledge",
+  "plugins": [
+    {
+      "type": "bridge",
+      "bridge": %q,
+      "isGateway": true,
+      "ipMasq": true,
+      "hairpinMode": true,
+      "ipam": {
+        "type": "host-local",
+        "ranges": [[{"subnet": %q}]],
+        "routes": [{"dst": "0.0.0.0/0"}]
+      }
+    },
+    {
+      "type": "portmap",
+      "capabilities": {"portMappings": true}
+    }
+  ]
+}`
+
+// A PodNetwork is the network namespace that is shared by all instances of a pod
+type PodNetwork struct {
+	netns *netns.NetNS
+	IPs   []string
+}
+
+// Path returns the path of the pinned network namespace
+func (n *PodNetwork) Path() string {
+	return n.netns.GetPath()
+}
+
+// networkManager sets up and tears down the networks of pods with CNI
+type networkManager struct {
+	config NetworkConfig
+	// recordDir holds a networkRecord for every network namespace, by the name of the namespace
+	recordDir string
+
+	mu  sync.Mutex
+	cni gocni.CNI
+}
+
+// A networkRecord holds the arguments with which a pod was attached to the network, the same arguments detach it
+type networkRecord struct {
+	ID           string              `json:"id"`
+	NetNS        string              `json:"netns"`
+	Labels       map[string]string   `json:"labels"`
+	PortMappings []gocni.PortMapping `json:"portMappings,omitempty"`
+}
+
+func newNetworkManager(ctx context.Context, cfg NetworkConfig) (*networkManager, error) {
+	cni, err := gocni.New(
+		gocni.WithPluginConfDir(cfg.ConfDir),
+		gocni.WithPluginDir(cfg.BinDirs),
+		gocni.WithMinNetworkCount(2),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "cni")
+	}
+	m := &networkManager{
+		config:    cfg,
+		recordDir: storage.NetworksPath(),
+		cni:       cni,
+	}
+	if err = m.removeStale(ctx); err != nil {
+		return nil, errors.Wrap(err, "cni")
+	}
+	return m, nil
+}
+
+// removeStale detaches the pods of an earlier run from the network, so that their IPs and port mappings are released,
+// and removes their network namespaces
+func (m *networkManager) removeStale(ctx context.Context) error {
+	records, err := os.ReadDir(m.recordDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(records) > 0 {
+		if err := m.load(); err != nil {
+			log.G(ctx).Warnf("failed to load the network configuration to detach old pods: %s", err)
+		}
+	}
+	for _, e := range records {
+		path := filepath.Join(m.recordDir, e.Name())
+		var record networkRecord
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &record)
+		}
+		if err != nil {
+			log.G(ctx).Warnf("skipping invalid network record %q: %s", path, err)
+		} else {
+			log.G(ctx).Infof("detaching old pod %q from the network", record.ID)
+			if err := m.cni.Remove(ctx, record.ID, record.NetNS, record.namespaceOpts()...); err != nil {
+				log.G(ctx).Error(errors.Wrap(err, "cni"))
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			log.G(ctx).Error(errors.Wrap(err, "cni"))
+		}
+	}
+
+	// Scrub network namespaces of old pods
+	entries, err := os.ReadDir(m.config.NetNSDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(m.config.NetNSDir, e.Name())
+		log.G(ctx).Infof("removing network namespace %q", path)
+		if err := netns.LoadNetNS(path).Remove(); err != nil {
+			log.G(ctx).Error(errors.Wrap(err, "cni"))
+		}
+	}
+	return nil
+}
+
+// load (re)loads the network configuration, so that changes in the conf dir are picked up for new pods
+func (m *networkManager) load() error {
+	opts := []gocni.Opt{gocni.WithLoNetwork}
+	if files, _ := libcni.ConfFiles(m.config.ConfDir, []string{".conf", ".conflist", ".json"}); len(files) > 0 {
+		opts = append(opts, gocni.WithDefaultConf)
+	} else {
+		confList := fmt.Sprintf(defaultNetworkConfList, m.config.Bridge, m.config.Subnet)
+		opts = append(opts, gocni.WithConfListBytes([]byte(confList)))
+	}
+	return m.cni.Load(opts...)
+}
+
+// Setup creates a network namespace for the pod and attaches it to the network
+func (m *networkManager) Setup(ctx context.Context, pod *corev1.Pod) (*PodNetwork, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		return nil, errors.Wrap(err, "cni")
+	}
+	if err := os.MkdirAll(m.config.NetNSDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "cni")
+	}
+	ns, err := netns.NewNetNS(m.config.NetNSDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cni")
+	}
+
+	// The record is written first, a pod that is only partially attached is detached as well
+	record := newNetworkRecord(pod, ns.GetPath())
+	if err = m.writeRecord(record); err != nil {
+		if err := ns.Remove(); err != nil {
+			log.G(ctx).Error(errors.Wrap(err, "cni"))
+		}
+		return nil, errors.Wrap(err, "cni")
+	}
+	result, err := m.cni.Setup(ctx, record.ID, record.NetNS, record.namespaceOpts()...)
+	if err != nil {
+		if err := m.cni.Remove(ctx, record.ID, record.NetNS, record.namespaceOpts()...); err != nil {
+			log.G(ctx).Error(errors.Wrap(err, "cni"))
+		}
+		if err := ns.Remove(); err != nil {
+			log.G(ctx).Error(errors.Wrap(err, "cni"))
+		}
+		m.removeRecord(ctx, record)
+		return nil, errors.Wrap(err, "cni")
+	}
+
+	network := &PodNetwork{netns: ns}
+	if iface, ok := result.Interfaces[defaultPodInterface]; ok {
+		for _, ipConfig := range iface.IPConfigs {
+			network.IPs = append(network.IPs, ipConfig.IP.String())
+		}
+	}
+	log.G(ctx).Infof("attached pod %q to the network with IPs %v", podToIdentifier(pod), network.IPs)
+	return network, nil
+}
+
+// Teardown detaches the pod from the network and removes its network namespace
+func (m *networkManager) Teardown(ctx context.Context, pod *corev1.Pod, network *PodNetwork) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record := newNetworkRecord(pod, network.Path())
+	if err := m.cni.Remove(ctx, record.ID, record.NetNS, record.namespaceOpts()...); err != nil {
+		log.G(ctx).Error(errors.Wrap(err, "cni"))
+	}
+	if err := network.netns.Remove(); err != nil {
+		return errors.Wrap(err, "cni")
+	}
+	m.removeRecord(ctx, record)
+	return nil
+}
+
+// recordPath returns the path of the record of a network namespace
+func (m *networkManager) recordPath(record networkRecord) string {
+	return filepath.Join(m.recordDir, filepath.Base(record.NetNS)+".json")
+}
+
+func (m *networkManager) writeRecord(record networkRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.recordDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(m.recordPath(record), data, 0644)
+}
+
+func (m *networkManager) removeRecord(ctx context.Context, record networkRecord) {
+	if err := os.Remove(m.recordPath(record)); err != nil && !os.IsNotExist(err) {
+		log.G(ctx).Error(errors.Wrap(err, "cni"))
+	}
+}
+
+// newNetworkRecord returns the arguments that are passed to the CNI plugins for a pod in a network namespace
+func newNetworkRecord(pod *corev1.Pod, netNS string) networkRecord {
+	record := networkRecord{
+		ID:    podToIdentifier(pod),
+		NetNS: netNS,
+		Labels: map[string]string{
+			"K8S_POD_NAMESPACE":          pod.Namespace,
+			"K8S_POD_NAME":               pod.Name,
+			"K8S_POD_INFRA_CONTAINER_ID": podToIdentifier(pod),
+			"K8S_POD_UID":                string(pod.UID),
+			"IgnoreUnknown":              "1",
+		},
+	}
+	// Container.Ports are published with the portmap plugin
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.HostPort == 0 {
+				continue
+			}
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			record.PortMappings = append(record.PortMappings, gocni.PortMapping{
+				HostPort:      p.HostPort,
+				ContainerPort: p.ContainerPort,
+				Protocol:      strings.ToLower(string(protocol)),
+				HostIP:        p.HostIP,
+			})
+		}
+	}
+	return record
+}
+
+// namespaceOpts returns the CNI options of the record
+func (r networkRecord) namespaceOpts() []gocni.NamespaceOpts {
+	opts := []gocni.NamespaceOpts{gocni.WithLabels(r.Labels)}
+	if len(r.PortMappings) > 0 {
+		opts = append(opts, gocni.WithCapabilityPortMap(r.PortMappings))
+	}
+	return opts
+}
@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	gocni "github.com/containerd/go-cni"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeCNI records the networks that are removed
+type fakeCNI struct {
+	gocni.CNI
+	loaded  bool
+	removed []string
+}
+
+func (c *fakeCNI) Load(opts ...gocni.Opt) error {
+	c.loaded = true
+	return nil
+}
+
+func (c *fakeCNI) Remove(ctx context.Context, id string, path string, opts ...gocni.NamespaceOpts) error {
+	c.removed = append(c.removed, id+" "+path)
+	return nil
+}
+
+func TestNewNetworkRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		ports    []corev1.ContainerPort
+		expected []gocni.PortMapping
+	}{
+		{"no ports", nil, nil},
+		{"no host port", []corev1.ContainerPort{{ContainerPort: 80}}, nil},
+		{
+			"host ports",
+			[]corev1.ContainerPort{
+				{ContainerPort: 80, HostPort: 8080},
+				{ContainerPort: 53, HostPort: 5353, Protocol: corev1.ProtocolUDP, HostIP: "127.0.0.1"},
+			},
+			[]gocni.PortMapping{
+				{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+				{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIP: "127.0.0.1"},
+			},
+		},
+	}
+	for _, test := range tests {
+		pod := newTestPod("a")
+		pod.Spec.Containers[0].Ports = test.ports
+		record := newNetworkRecord(pod, "/run/netns/cni-1")
+		if record.ID != podToIdentifier(pod) || record.NetNS != "/run/netns/cni-1" {
+			t.Errorf("%s: expected the pod and its namespace, got %q in %q", test.name, record.ID, record.NetNS)
+		}
+		if record.Labels["K8S_POD_NAME"] != "pod" || record.Labels["K8S_POD_UID"] != string(pod.UID) {
+			t.Errorf("%s: expected the labels of the pod, got %v", test.name, record.Labels)
+		}
+		if !reflect.DeepEqual(record.PortMappings, test.expected) {
+			t.Errorf("%s: expected the port mappings %+v, got %+v", test.name, test.expected, record.PortMappings)
+		}
+		// The port mappings are only passed to the plugins that have the capability if there are any
+		expectedOpts := 1
+		if len(test.expected) > 0 {
+			expectedOpts = 2
+		}
+		if opts := record.namespaceOpts(); len(opts) != expectedOpts {
+			t.Errorf("%s: expected %d options, got %d", test.name, expectedOpts, len(opts))
+		}
+	}
+}
+
+func TestNetworkManagerRemoveStale(t *testing.T) {
+	cni := &fakeCNI{}
+	m := &networkManager{
+		config:    NetworkConfig{NetNSDir: filepath.Join(t.TempDir(), "netns")},
+		recordDir: t.TempDir(),
+		cni:       cni,
+	}
+	pod := newTestPod("a")
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 8080}}
+	if err := m.writeRecord(newNetworkRecord(pod, "/run/netns/cni-1")); err != nil {
+		t.Fatal(err)
+	}
+	// Invalid records are removed without detaching anything
+	if err := os.WriteFile(filepath.Join(m.recordDir, "cni-2.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.removeStale(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !cni.loaded {
+		t.Errorf("expected the network configuration to be loaded")
+	}
+	if expected := []string{podToIdentifier(pod) + " /run/netns/cni-1"}; !reflect.DeepEqual(cni.removed, expected) {
+		t.Errorf("expected the networks %v to be removed, got %v", expected, cni.removed)
+	}
+	if entries, _ := os.ReadDir(m.recordDir); len(entries) != 0 {
+		t.Errorf("expected the records to be removed, got %d", len(entries))
+	}
+
+	// Without records the configuration is not needed
+	cni = &fakeCNI{}
+	m.cni = cni
+	if err := m.removeStale(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cni.loaded || len(cni.removed) != 0 {
+		t.Errorf("expected nothing to be removed, got %v", cni.removed)
+	}
+}
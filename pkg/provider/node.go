@@ -2,17 +2,27 @@ package provider
 
 import (
 	"context"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/system"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"runtime"
+	"strings"
 )
 
 func (p *Provider) ConfigureNode(ctx context.Context, n *corev1.Node) { //nolint:golint
 	n.Status.Addresses = p.nodeAddresses()
 	n.Status.Allocatable = p.nodeCapacity(ctx)
 	n.Status.Capacity = p.nodeCapacity(ctx)
+	// Devices of extended resources only count as allocatable while they are healthy
+	deviceCapacity, deviceAllocatable := p.devices.Capacity()
+	for name, quantity := range deviceCapacity {
+		n.Status.Capacity[name] = quantity
+	}
+	for name, quantity := range deviceAllocatable {
+		n.Status.Allocatable[name] = quantity
+	}
 	n.Status.Conditions = p.nodeConditions()
 	n.Status.DaemonEndpoints = p.nodeDaemonEndpoints()
 
@@ -25,6 +35,22 @@ func (p *Provider) ConfigureNode(ctx context.Context, n *corev1.Node) { //nolint
 	// Prevent load-balancers
 	n.ObjectMeta.Labels["alpha.service-controller.kubernetes.io/exclude-balancer"] = "true"
 	n.ObjectMeta.Labels["node.kubernetes.io/exclude-from-external-load-balancers"] = "true"
+
+	// Announce the features that rootless mode lacks
+	if p.config.Rootless.Enabled {
+		n.ObjectMeta.Labels[labelRootless] = "true"
+	}
+	if len(p.unavailableFeatures) > 0 {
+		if n.ObjectMeta.Annotations == nil {
+			n.ObjectMeta.Annotations = map[string]string{}
+		}
+		n.ObjectMeta.Annotations[annotationUnavailableFeatures] = strings.Join(p.unavailableFeatures, ",")
+	}
+
+	// Keep the node to update its status later on
+	p.mu.Lock()
+	p.node = n.DeepCopy()
+	p.mu.Unlock()
 }
 
 // NodeAddresses returns a list of addresses for the node status
@@ -53,6 +79,9 @@ func (p *Provider) nodeCapacity(ctx context.Context) corev1.ResourceList {
 	node[corev1.ResourceCPU], _ = system.CpuCount()
 	node[corev1.ResourceMemory], _ = system.MemoryTotal()
 	node[corev1.ResourceStorage], _ = system.StorageSize()
+	if fsInfo, err := system.StorageInfo(storage.RootPath()); err == nil {
+		node[corev1.ResourceEphemeralStorage] = *resource.NewQuantity(int64(fsInfo.Capacity), resource.BinarySI)
+	}
 	node[corev1.ResourcePods], _ = resource.ParseQuantity("10") // TODO: get from settings?
 
 	// Get resource requests and limits
@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+)
+
+// annotationPaused freezes all instances of a pod while it is true, they keep their memory and resume where they were
+const annotationPaused = "fledge.io/paused"
+
+// podConditionPaused is true while the instances of a pod are paused
+const podConditionPaused corev1.PodConditionType = "fledge.io/Paused"
+
+// Reasons of the paused condition and of the events about pausing pods
+const (
+	reasonPaused       = "Paused"
+	reasonResumed      = "Resumed"
+	reasonPauseFailed  = "PauseFailed"
+	reasonResumeFailed = "ResumeFailed"
+)
+
+// A PauseBackend is a Backend that can pause running instances
+type PauseBackend interface {
+	Backend
+	// PauseInstance freezes all processes of a running instance, which keeps its state
+	PauseInstance(ctx context.Context, instance *Instance) error
+	// ResumeInstance lets the processes of a paused instance continue
+	ResumeInstance(ctx context.Context, instance *Instance) error
+}
+
+// podPaused reports whether a pod asks for its instances to be paused
+func podPaused(pod *corev1.Pod) bool {
+	paused, _ := strconv.ParseBool(pod.Annotations[annotationPaused])
+	return paused
+}
+
+// pausePod pauses or resumes the instances of a pod when an update changes its paused annotation, it reports whether
+// it did
+func (p *Provider) pausePod(ctx context.Context, previous, pod *corev1.Pod) bool {
+	paused := podPaused(pod)
+	if paused == podPaused(previous) {
+		return false
+	}
+	p.setPodPaused(ctx, pod, paused)
+	return true
+}
+
+// setPodPaused pauses or resumes all instances of a pod and updates its paused condition
+// When not all instances can be paused, the ones that were paused are resumed again.
+func (p *Provider) setPodPaused(ctx context.Context, pod *corev1.Pod, paused bool) {
+	podID := podToIdentifier(pod)
+	var done []*Instance
+	err := func() error {
+		for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			instance, ok := p.getInstance(pod.Namespace, pod.Name, c.Name)
+			if !ok {
+				continue
+			}
+			// Instances that terminated have nothing to pause
+			if status, err := instance.Status(); err == nil && status.State.Running == nil {
+				continue
+			}
+			backend, ok := instance.Backend.(PauseBackend)
+			if !ok {
+				return errors.Errorf("backend %q can not pause instances", instance.BackendName())
+			}
+			var err error
+			if paused {
+				err = backend.PauseInstance(ctx, instance)
+			} else {
+				err = backend.ResumeInstance(ctx, instance)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "instance %q", instance.ID)
+			}
+			done = append(done, instance)
+		}
+		return nil
+	}()
+
+	condition := &corev1.PodCondition{
+		Type:               podConditionPaused,
+		Status:             corev1.ConditionFalse,
+		Reason:             reasonResumed,
+		LastTransitionTime: metav1.Now(),
+	}
+	eventType, message := corev1.EventTypeNormal, "Resumed all containers"
+	switch {
+	case err != nil && paused:
+		// Do not leave the pod half paused
+		for _, instance := range done {
+			if err := instance.Backend.(PauseBackend).ResumeInstance(ctx, instance); err != nil {
+				log.G(ctx).Errorf("failed to resume instance %q: %s", instance.ID, err)
+			}
+		}
+		condition.Reason = reasonPauseFailed
+		eventType, message = corev1.EventTypeWarning, "Failed to pause: "+err.Error()
+	case err != nil:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = reasonResumeFailed
+		eventType, message = corev1.EventTypeWarning, "Failed to resume: "+err.Error()
+	case paused:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = reasonPaused
+		message = "Paused all containers"
+	}
+	condition.Message = message
+	if err != nil {
+		log.G(ctx).Errorf("pod %q: %s", podID, message)
+	} else {
+		log.G(ctx).Infof("pod %q: %s", podID, message)
+	}
+
+	p.mu.Lock()
+	p.pauses[podID] = condition
+	p.mu.Unlock()
+	if p.eventRecorder != nil {
+		p.eventRecorder.Event(pod, eventType, condition.Reason, message)
+	}
+}
+
+// getPausedCondition returns the paused condition of a pod, if it was ever paused
+func (p *Provider) getPausedCondition(pod *corev1.Pod) (corev1.PodCondition, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	condition, ok := p.pauses[podToIdentifier(pod)]
+	if !ok {
+		return corev1.PodCondition{}, false
+	}
+	return *condition, true
+}
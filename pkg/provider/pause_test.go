@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pauseBackend is a test backend of which all instances run and can be paused
+type pauseBackend struct {
+	*testBackend
+}
+
+func (b pauseBackend) GetInstanceStatus(instance *Instance) (corev1.ContainerStatus, error) {
+	return corev1.ContainerStatus{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}, nil
+}
+
+func (b pauseBackend) PauseInstance(ctx context.Context, instance *Instance) error {
+	return b.call("pause", instance.Container.Name)
+}
+
+func (b pauseBackend) ResumeInstance(ctx context.Context, instance *Instance) error {
+	return b.call("resume", instance.Container.Name)
+}
+
+func TestSetPodPaused(t *testing.T) {
+	tests := []struct {
+		name     string
+		paused   bool
+		failures map[string]int
+		calls    []string
+		status   corev1.ConditionStatus
+		reason   string
+	}{
+		{
+			name:   "paused",
+			paused: true,
+			calls:  []string{"pause a", "pause b", "pause c"},
+			status: corev1.ConditionTrue,
+			reason: reasonPaused,
+		},
+		{
+			// The instances that were paused are resumed again
+			name:     "pause failed",
+			paused:   true,
+			failures: map[string]int{"pause c": 1},
+			calls:    []string{"pause a", "pause b", "pause c", "resume a", "resume b"},
+			status:   corev1.ConditionFalse,
+			reason:   reasonPauseFailed,
+		},
+		{
+			name:   "resumed",
+			calls:  []string{"resume a", "resume b", "resume c"},
+			status: corev1.ConditionFalse,
+			reason: reasonResumed,
+		},
+		{
+			// The pod stays paused as not all of its instances run
+			name:     "resume failed",
+			failures: map[string]int{"resume b": 1},
+			calls:    []string{"resume a", "resume b"},
+			status:   corev1.ConditionTrue,
+			reason:   reasonResumeFailed,
+		},
+	}
+	for _, test := range tests {
+		backend := pauseBackend{newTestBackend(test.failures)}
+		p := newTestProvider(backend)
+		pod := newTestPod("a", "b", "c")
+		for i := range pod.Spec.Containers {
+			p.instances[podAndContainerToIdentifier(pod, &pod.Spec.Containers[i])] = &Instance{
+				Container: &pod.Spec.Containers[i],
+				Backend:   backend,
+			}
+		}
+		p.setPodPaused(context.Background(), pod, test.paused)
+
+		if !reflect.DeepEqual(backend.calls, test.calls) {
+			t.Errorf("%s: expected the calls %v, got %v", test.name, test.calls, backend.calls)
+		}
+		condition, ok := p.getPausedCondition(pod)
+		if !ok {
+			t.Errorf("%s: expected a paused condition", test.name)
+			continue
+		}
+		if condition.Status != test.status || condition.Reason != test.reason {
+			t.Errorf("%s: expected the condition %s with reason %s, got %s with reason %s", test.name, test.status, test.reason, condition.Status, condition.Reason)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	corev1 "k8s.io/api/core/v1"
+	"sync"
+	"time"
 )
 
 // GetPod retrieves a pod by name from the provider (can be cached).
@@ -21,7 +23,9 @@ func (p *Provider) GetPod(ctx context.Context, namespace, name string) (*corev1.
 
 	log.G(ctx).Debugf("receive GetPod %q", name)
 
+	p.mu.RLock()
 	pod, found := p.pods[joinIdentifierFromParts(namespace, name)]
+	p.mu.RUnlock()
 	if !found {
 		return nil, errors.Errorf("Pod %s/%s not found", namespace, name)
 	}
@@ -38,11 +42,7 @@ func (p *Provider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
 
 	log.G(ctx).Debug("receive GetPods")
 
-	var pods []*corev1.Pod
-	for _, pod := range p.pods {
-		pods = append(pods, pod)
-	}
-	return pods, nil
+	return p.listPods(), nil
 }
 
 // CreatePod takes a Kubernetes Pod and deploys it within the provider.
@@ -57,7 +57,9 @@ func (p *Provider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 
 	// Register pod specification
 	podID := podToIdentifier(pod)
+	p.mu.Lock()
 	p.pods[podID] = pod
+	p.mu.Unlock()
 
 	// Do not deploy Kubernetes apps
 	k8sApp, ok := pod.Labels["k8s-app"]
@@ -65,6 +67,26 @@ func (p *Provider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 		return nil
 	}
 
+	// Reject pods that select a backend that is not available
+	if _, err := p.podBackendName(pod); err != nil {
+		var rejection *rejectionError
+		if errors.As(err, &rejection) {
+			p.rejectPod(ctx, pod, rejection)
+			return nil
+		}
+		return err
+	}
+
+	// Reject pods whose devices can not be allocated
+	if err := p.allocateDevices(ctx, pod); err != nil {
+		var rejection *rejectionError
+		if errors.As(err, &rejection) {
+			p.rejectPod(ctx, pod, rejection)
+			return nil
+		}
+		return err
+	}
+
 	// Parse volumes but create them on-demand in the provider
 	volumesToCreate := make(map[string]corev1.Volume)
 	for _, v := range pod.Spec.Volumes {
@@ -80,23 +102,14 @@ func (p *Provider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 	//tmpfs := strings.Join([]string{"/var", "/run"}, " ")
 	//
 	//previousUnit := ""
-	var instancesToStart []*Instance
-	for i, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for i := range containers {
+		c := &containers[i]
 		isInit := i < len(pod.Spec.InitContainers)
 		log.G(ctx).Debugf("processing container %d (init=%t)", i, isInit)
 
-		// New Instance
-		instance, err := p.newInstance(ctx, pod, &c)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create instance %q for pod %q", c.Name, podToIdentifier(pod))
-		}
-
-		// Create Instance
-		log.G(ctx).Infof("creating instance %q", instance.ID)
-		if err = instance.Create(); err != nil {
-			return errors.Wrapf(err, "failed to create instance %q", instance.ID)
-		}
-		instancesToStart = append(instancesToStart, instance)
+		// New Instance (made once its image is pulled)
+		p.setWaiting(podAndContainerToIdentifier(pod, c), reasonContainerCreating, "")
 
 		//bindmounts := []string{}
 		//bindmountsro := []string{}
@@ -239,17 +252,170 @@ func (p *Provider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 		//	previousUnit = name
 		//}
 	}
+
+	// Pull the images and create the instances in the background, the status of the pod shows the progress
+	deployCtx, cancel := context.WithCancel(log.WithLogger(p.context, log.G(ctx)))
+	deployment := &podDeployment{cancel: cancel, done: make(chan struct{})}
+	p.mu.Lock()
+	p.deployments[podID] = deployment
+	p.mu.Unlock()
+	go func() {
+		defer close(deployment.done)
+		defer cancel()
+		p.deployPod(deployCtx, deployment, pod, containers)
+		p.mu.Lock()
+		if p.deployments[podID] == deployment {
+			delete(p.deployments, podID)
+		}
+		p.mu.Unlock()
+	}()
+	//p.podResourceManager.Watch(pod)
+	return nil
+}
+
+// A podDeployment pulls the images of a pod and creates its instances in the background
+type podDeployment struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// instances are the instances of which the image was pulled, their images are in use until they are created
+	instances []*Instance
+}
+
+// deployPod pulls the images of all containers of a pod concurrently, after which it creates and starts their
+// instances. Failures are retried with an exponential back-off until the pod is deleted.
+func (p *Provider) deployPod(ctx context.Context, deployment *podDeployment, pod *corev1.Pod, containers []corev1.Container) {
+	instancesToStart := make([]*Instance, len(containers))
+	var wg sync.WaitGroup
+	for i := range containers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instance := p.pullInstance(ctx, pod, &containers[i])
+			if instance != nil {
+				p.mu.Lock()
+				deployment.instances = append(deployment.instances, instance)
+				p.mu.Unlock()
+			}
+			instancesToStart[i] = instance
+		}(i)
+	}
+	wg.Wait()
+	for _, instance := range instancesToStart {
+		// The pod is deleted or an image will never be pulled
+		if instance == nil {
+			return
+		}
+	}
+
+	delay := newBackOff(p.config.ImagePull)
+	for {
+		err := p.createInstances(ctx, pod, instancesToStart)
+		if err == nil {
+			return
+		}
+		log.G(ctx).Error(err)
+		for _, instance := range instancesToStart {
+			p.setWaiting(instance.ID, reasonCreateContainerError, err.Error())
+			p.recordContainerEvent(pod, instance.Name, corev1.EventTypeWarning, eventFailed, "Error: %s", err)
+		}
+		for {
+			if !delay.wait(ctx) {
+				return
+			}
+			// The images may be gone in the meantime (e.g. removed by hand), the instances are only created again
+			// once they are present
+			if p.repullImages(ctx, pod, instancesToStart) {
+				break
+			}
+		}
+	}
+}
+
+// createInstances creates and starts the instances of a pod in its sandbox
+// When an instance can not be created, the instances that were created before it and the sandbox are deleted again
+func (p *Provider) createInstances(ctx context.Context, pod *corev1.Pod, instancesToStart []*Instance) error {
+	// Pod sandbox (shared by all instances that can join its namespaces)
+	podID := podToIdentifier(pod)
+	var cgroupParent string
+	if p.cgroups != nil {
+		var err error
+		if cgroupParent, err = p.cgroups.createPod(ctx, pod); err != nil {
+			return errors.Wrapf(err, "failed to create cgroup of pod %q", podID)
+		}
+		for _, instance := range instancesToStart {
+			instance.CgroupParent = cgroupParent
+		}
+	}
+	sandbox, err := p.createSandbox(ctx, pod, instancesToStart, cgroupParent)
+	if err != nil {
+		p.deletePodCgroup(ctx, pod)
+		return errors.Wrapf(err, "failed to create sandbox of pod %q", podID)
+	}
+	if sandbox != nil {
+		for _, instance := range instancesToStart {
+			if instance.Backend == Backend(sandbox.Backend) {
+				instance.Sandbox = sandbox
+			}
+		}
+	}
+
+	// Create Instances
+	start := time.Now()
+	for i, instance := range instancesToStart {
+		log.G(ctx).Infof("creating instance %q", instance.ID)
+		if err := instance.Create(); err != nil {
+			// The instance that failed may be partially created as well
+			p.undoCreateInstances(ctx, pod, instancesToStart[:i+1])
+			return errors.Wrapf(err, "failed to create instance %q", instance.ID)
+		}
+	}
+	observePodOperation(instancesToStart, operationCreate, start)
+	start = time.Now()
 	for _, instance := range instancesToStart {
 		log.G(ctx).Infof("starting instance %q", instance.ID)
+		// The device plugins prepare the devices of the instance right before it starts, without them it can not
+		// start and the pod is deployed again
+		if err := p.devices.PreStart(ctx, podID, instance.Container.Name); err != nil {
+			p.undoCreateInstances(ctx, pod, instancesToStart)
+			return errors.Wrapf(err, "failed to prepare the devices of instance %q", instance.ID)
+		}
 		if err := instance.Start(); err != nil {
 			log.G(ctx).Errorf("failed to start instance %q: %s", instance.ID, err)
 		}
+		p.mu.Lock()
 		p.instances[instance.ID] = instance
+		delete(p.waiting, instance.ID)
+		p.mu.Unlock()
+	}
+	observePodOperation(instancesToStart, operationStart, start)
+
+	// The pod may have been paused while it was deployed
+	p.mu.RLock()
+	current, ok := p.pods[podID]
+	p.mu.RUnlock()
+	if ok && podPaused(current) {
+		p.setPodPaused(ctx, current, true)
 	}
-	//p.podResourceManager.Watch(pod)
 	return nil
 }
 
+// undoCreateInstances deletes instances of a pod that were created (and maybe started) by createInstances, together
+// with the sandbox and the cgroup of the pod
+func (p *Provider) undoCreateInstances(ctx context.Context, pod *corev1.Pod, instances []*Instance) {
+	for _, instance := range instances {
+		if err := instance.Delete(); err != nil {
+			log.G(ctx).Errorf("failed to delete instance %q: %s", instance.ID, err)
+		}
+		p.mu.Lock()
+		if p.instances[instance.ID] == instance {
+			delete(p.instances, instance.ID)
+		}
+		p.mu.Unlock()
+	}
+	p.deleteSandbox(ctx, pod)
+	p.deletePodCgroup(ctx, pod)
+}
+
 // GetPodStatus retrieves the status of a pod by name from the provider.
 // The PodStatus returned is expected to be immutable, and may be accessed
 // concurrently outside of the calling goroutine. Therefore it is recommended
@@ -276,13 +442,17 @@ func (p *Provider) GetPodStatus(ctx context.Context, namespace, name string) (*c
 		return nil, err
 	}
 
+	// Rejected pods never had instances, evicted pods no longer have them
+	if rejection, rejected := p.getRejection(pod); rejected {
+		return rejectedPodStatus(rejection), nil
+	}
+	if message, evicted := p.getEviction(pod); evicted {
+		return evictedPodStatus(pod, message), nil
+	}
+
 	initInstanceStatuses := make([]corev1.ContainerStatus, 0)
-	for _, c := range pod.Spec.InitContainers {
-		instance, ok := p.getInstance(pod.Namespace, pod.Name, c.Name)
-		if !ok {
-			return &corev1.PodStatus{Phase: corev1.PodPending}, nil
-		}
-		instanceStatus, err := instance.Status()
+	for i := range pod.Spec.InitContainers {
+		instanceStatus, err := p.containerStatus(pod, &pod.Spec.InitContainers[i])
 		if err != nil {
 			return nil, errors.Wrap(err, "osv")
 		}
@@ -291,13 +461,10 @@ func (p *Provider) GetPodStatus(ctx context.Context, namespace, name string) (*c
 
 	started := true
 	running := true
+	succeeded := true
 	instanceStatuses := make([]corev1.ContainerStatus, 0)
-	for _, c := range pod.Spec.Containers {
-		instance, ok := p.getInstance(pod.Namespace, pod.Name, c.Name)
-		if !ok {
-			return &corev1.PodStatus{Phase: corev1.PodPending}, nil
-		}
-		instanceStatus, err := instance.Status()
+	for i := range pod.Spec.Containers {
+		instanceStatus, err := p.containerStatus(pod, &pod.Spec.Containers[i])
 		if err != nil {
 			return nil, errors.Wrap(err, "osv")
 		}
@@ -306,6 +473,7 @@ func (p *Provider) GetPodStatus(ctx context.Context, namespace, name string) (*c
 				started = false
 			} else {
 				running = false
+				succeeded = succeeded && instanceStatus.State.Terminated.ExitCode == 0
 			}
 		}
 		instanceStatuses = append(instanceStatuses, instanceStatus)
@@ -313,13 +481,27 @@ func (p *Provider) GetPodStatus(ctx context.Context, namespace, name string) (*c
 
 	status := &corev1.PodStatus{
 		Phase:                 corev1.PodPending,
+		HostIP:                p.internalIP,
 		InitContainerStatuses: initInstanceStatuses,
 		ContainerStatuses:     instanceStatuses,
 	}
+	if condition, ok := p.getPausedCondition(pod); ok {
+		status.Conditions = append(status.Conditions, condition)
+	}
+
+	if ips := p.podIPs(pod); len(ips) > 0 {
+		status.PodIP = ips[0]
+		for _, ip := range ips {
+			status.PodIPs = append(status.PodIPs, corev1.PodIP{IP: ip})
+		}
+	}
 
 	// Simple way of determining the phase
 	if running {
 		status.Phase = corev1.PodRunning
+	} else if started && succeeded {
+		// e.g. all containers were migrated to another node
+		status.Phase = corev1.PodSucceeded
 	} else if started {
 		status.Phase = corev1.PodFailed
 	}
@@ -335,6 +517,21 @@ func (p *Provider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 	// Add the pod's coordinates to the current span.
 	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
 
+	// Pods that are migrated, paused or resumed keep their instances, other changes to them are ignored
+	p.mu.RLock()
+	previous, ok := p.pods[podToIdentifier(pod)]
+	p.mu.RUnlock()
+	if ok {
+		migrating := p.migratePod(ctx, previous, pod)
+		pausing := p.pausePod(ctx, previous, pod)
+		if migrating || pausing {
+			p.mu.Lock()
+			p.pods[podToIdentifier(pod)] = pod
+			p.mu.Unlock()
+			return nil
+		}
+	}
+
 	// TODO: Can we do this more performant?
 	if err := p.DeletePod(ctx, pod); err != nil {
 		return err
@@ -354,25 +551,124 @@ func (p *Provider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
 
 	log.G(ctx).Debugf("receive DeletePod %q", pod.Name)
 
+	podID := podToIdentifier(pod)
+	start := time.Now()
+	deleted := p.deletePodInstances(ctx, pod)
+	observePodOperation(deleted, operationDelete, start)
+
+	// Forget everything that was tracked about the pod
+	p.mu.Lock()
+	delete(p.evictions, podID)
+	delete(p.rejections, podID)
+	delete(p.pauses, podID)
+	delete(p.storageUsage, podID)
+	delete(p.cpuSamples, podID)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// deletePodInstances stops the deployment of a pod and deletes its instances, the data of its volumes, its sandbox,
+// its cgroup and its devices, and returns the instances that were deleted
+func (p *Provider) deletePodInstances(ctx context.Context, pod *corev1.Pod) []*Instance {
+	// Stop the deployment of the pod, it creates no more instances once it is done
+	podID := podToIdentifier(pod)
+	p.mu.Lock()
+	deployment, deploying := p.deployments[podID]
+	delete(p.deployments, podID)
+	p.mu.Unlock()
+	if deploying {
+		deployment.cancel()
+		<-deployment.done
+	}
+
 	// Delete instances
+	var deleted []*Instance
 	for i, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
 		isInit := i < len(pod.Spec.InitContainers)
 		log.G(ctx).Debugf("processing container %d (init=%t)", i, isInit)
 
 		// Delete instance
 		instanceID := podAndContainerToIdentifier(pod, &c)
+		p.mu.Lock()
 		instance, found := p.instances[instanceID]
+		delete(p.instances, instanceID)
+		delete(p.waiting, instanceID)
+		delete(p.cpuSamples, instanceID)
+		p.mu.Unlock()
 		if found {
 			log.G(ctx).Debugf("deleting instance %q", instanceID)
 			instance.Delete()
+			deleted = append(deleted, instance)
 		}
 	}
 
+	// Delete the data of volumes that live as long as the pod
+	p.deletePodVolumes(ctx, pod)
+
+	// Delete the sandbox once all instances left its namespaces
+	p.deleteSandbox(ctx, pod)
+
+	// Delete the cgroup of the pod once it has no more processes
+	p.deletePodCgroup(ctx, pod)
+
+	// Free the devices of the pod
+	p.devices.Release(podID)
+	return deleted
+}
+
+func (p *Provider) listPods() []*corev1.Pod {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var pods []*corev1.Pod
+	for _, pod := range p.pods {
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+// containerStatus returns the status of the instance of a container, or why it is still waiting for its instance
+func (p *Provider) containerStatus(pod *corev1.Pod, container *corev1.Container) (corev1.ContainerStatus, error) {
+	if instance, ok := p.getInstance(pod.Namespace, pod.Name, container.Name); ok {
+		return instance.Status()
+	}
+	waiting, ok := p.getWaiting(podAndContainerToIdentifier(pod, container))
+	if !ok {
+		waiting = &corev1.ContainerStateWaiting{Reason: reasonContainerCreating}
+	}
+	return corev1.ContainerStatus{
+		Name:  container.Name,
+		Image: container.Image,
+		State: corev1.ContainerState{Waiting: waiting},
+	}, nil
+}
+
+// podIPs returns the IPs of a pod, none while they are not known yet (e.g. while its images are pulled)
+// Pods without a network of their own are reachable through the node: pods on the host network, rootless pods and
+// pods of which the backend has no sandboxes.
+func (p *Provider) podIPs(pod *corev1.Pod) []string {
+	if sandbox, ok := p.getSandbox(pod); ok && sandbox.Network != nil {
+		return sandbox.Network.IPs
+	}
+	if pod.Spec.HostNetwork || p.rootless != nil {
+		return []string{p.internalIP}
+	}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		instance, ok := p.getInstance(pod.Namespace, pod.Name, c.Name)
+		if !ok {
+			continue
+		}
+		if _, ok := instance.Backend.(SandboxBackend); !ok {
+			return []string{p.internalIP}
+		}
+	}
 	return nil
 }
 
 func (p *Provider) getInstance(namespace string, podName string, containerName string) (*Instance, bool) {
 	instanceID := joinIdentifierFromParts(namespace, podName, containerName)
+	p.mu.RLock()
 	instance, ok := p.instances[instanceID]
+	p.mu.RUnlock()
 	return instance, ok
 }
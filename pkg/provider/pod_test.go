@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/devices"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testBackend is a dummy backend that records the operations on instances and fails them as often as configured
+type testBackend struct {
+	DummyBackend
+	mu sync.Mutex
+	// failures is the number of times that an operation on a container still fails, e.g. "create a"
+	failures map[string]int
+	// pulls counts the pulls of every container, they run concurrently
+	pulls map[string]int
+	// calls are the other operations in order
+	calls []string
+}
+
+func newTestBackend(failures map[string]int) *testBackend {
+	return &testBackend{failures: failures, pulls: map[string]int{}}
+}
+
+func (b *testBackend) call(operation string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	call := operation + " " + name
+	if operation == "pull" {
+		b.pulls[name]++
+	} else {
+		b.calls = append(b.calls, call)
+	}
+	if b.failures[call] > 0 {
+		b.failures[call]--
+		return errors.Errorf("%s failed", call)
+	}
+	return nil
+}
+
+func (b *testBackend) PullInstanceImage(ctx context.Context, instance *Instance) (ImagePull, error) {
+	return ImagePull{}, b.call("pull", instance.Container.Name)
+}
+
+func (b *testBackend) CreateInstance(instance *Instance) error {
+	return b.call("create", instance.Container.Name)
+}
+
+func (b *testBackend) StartInstance(instance *Instance) error {
+	return b.call("start", instance.Container.Name)
+}
+
+func (b *testBackend) DeleteInstance(instance *Instance) error {
+	return b.call("delete", instance.Container.Name)
+}
+
+func (b *testBackend) PortForwardInstance(ctx context.Context, instance *Instance, port int32, stream io.ReadWriteCloser) error {
+	return b.call(fmt.Sprintf("forward %d to", port), instance.Container.Name)
+}
+
+// testSandboxBackend is a test backend that runs its instances in sandboxes, the operations on which are recorded
+// as the ones on a container named "sandbox"
+type testSandboxBackend struct {
+	*testBackend
+}
+
+func (b testSandboxBackend) CreateSandbox(sandbox *Sandbox) error {
+	return b.call("create", "sandbox")
+}
+
+func (b testSandboxBackend) DeleteSandbox(sandbox *Sandbox) error {
+	return b.call("delete", "sandbox")
+}
+
+// newTestProvider creates a provider of which the test backend is the only backend, in place of containerd as the
+// config of the images of other backends is fetched from their registry
+func newTestProvider(backend Backend) *Provider {
+	return &Provider{
+		context:  context.Background(),
+		nodeName: "node",
+		config: Config{
+			Default:   BackendContainerd,
+			ImagePull: ImagePullConfig{BackOff: metav1.Duration{Duration: time.Millisecond}, MaxBackOff: metav1.Duration{Duration: 10 * time.Millisecond}},
+		},
+		backends:     map[string]Backend{BackendContainerd: backend},
+		devices:      devices.New(devices.Config{}),
+		pods:         map[string]*corev1.Pod{},
+		instances:    map[string]*Instance{},
+		evictions:    map[string]string{},
+		rejections:   map[string]*rejectionError{},
+		pauses:       map[string]*corev1.PodCondition{},
+		storageUsage: map[string]*podStorageUsage{},
+		sandboxes:    map[string]*Sandbox{},
+		waiting:      map[string]*corev1.ContainerStateWaiting{},
+		deployments:  map[string]*podDeployment{},
+		cpuSamples:   map[string]cpuSample{},
+	}
+}
+
+func newTestPod(containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "pod",
+		UID:         "1b4e28ba-2fa1-11d2",
+		Annotations: map[string]string{annotationBackend: BackendContainerd},
+	}}
+	for _, name := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name, Image: "busybox"})
+	}
+	return pod
+}
+
+func TestDeployPod(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures map[string]int
+		pulls    map[string]int
+		calls    []string
+	}{
+		{
+			name:  "created and started",
+			pulls: map[string]int{"a": 1, "b": 1},
+			calls: []string{"create a", "create b", "start a", "start b"},
+		},
+		{
+			name:     "pull retried",
+			failures: map[string]int{"pull a": 2},
+			pulls:    map[string]int{"a": 3, "b": 1},
+			calls:    []string{"create a", "create b", "start a", "start b"},
+		},
+		{
+			// The instance that failed is deleted as well, the images are pulled again before the retry
+			name:     "failed create undone and retried",
+			failures: map[string]int{"create b": 1},
+			pulls:    map[string]int{"a": 2, "b": 2},
+			calls:    []string{"create a", "create b", "delete a", "delete b", "create a", "create b", "start a", "start b"},
+		},
+		{
+			name:     "failed start not retried",
+			failures: map[string]int{"start a": 1},
+			pulls:    map[string]int{"a": 1, "b": 1},
+			calls:    []string{"create a", "create b", "start a", "start b"},
+		},
+	}
+	for _, test := range tests {
+		backend := newTestBackend(test.failures)
+		p := newTestProvider(backend)
+		pod := newTestPod("a", "b")
+		p.deployPod(context.Background(), &podDeployment{}, pod, append([]corev1.Container{}, pod.Spec.Containers...))
+
+		if !reflect.DeepEqual(backend.pulls, test.pulls) {
+			t.Errorf("%s: expected the pulls %v, got %v", test.name, test.pulls, backend.pulls)
+		}
+		if !reflect.DeepEqual(backend.calls, test.calls) {
+			t.Errorf("%s: expected the calls %v, got %v", test.name, test.calls, backend.calls)
+		}
+		for i := range pod.Spec.Containers {
+			instanceID := podAndContainerToIdentifier(pod, &pod.Spec.Containers[i])
+			if _, ok := p.instances[instanceID]; !ok {
+				t.Errorf("%s: expected instance %q, got %v", test.name, instanceID, p.instances)
+			}
+			if waiting, ok := p.getWaiting(instanceID); ok {
+				t.Errorf("%s: expected instance %q to no longer wait, got %+v", test.name, instanceID, waiting)
+			}
+		}
+	}
+}
+
+func TestDeployPodCanceled(t *testing.T) {
+	backend := newTestBackend(map[string]int{"create b": 1000})
+	p := newTestProvider(backend)
+	pod := newTestPod("a", "b")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.deployPod(ctx, &podDeployment{}, pod, append([]corev1.Container{}, pod.Spec.Containers...))
+	}()
+
+	// The containers show why they are not created while the deployment backs off
+	instanceID := podAndContainerToIdentifier(pod, &pod.Spec.Containers[0])
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if waiting, ok := p.getWaiting(instanceID); ok && waiting.Reason == reasonCreateContainerError {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the reason %s", reasonCreateContainerError)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the deployment to stop once it is canceled")
+	}
+
+	if len(p.instances) != 0 {
+		t.Errorf("expected no instances, got %v", p.instances)
+	}
+	// Every instance that was created is deleted again
+	created := map[string]int{}
+	for _, call := range backend.calls {
+		switch call {
+		case "create a", "create b":
+			created[call[len("create "):]]++
+		case "delete a", "delete b":
+			created[call[len("delete "):]]--
+		default:
+			t.Errorf("expected only creates and deletes, got %q", call)
+		}
+	}
+	for name, count := range created {
+		if count != 0 {
+			t.Errorf("expected every create of %q to be undone, got %d more creates than deletes", name, count)
+		}
+	}
+}
+
+func TestPodIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostNetwork bool
+		rootless    bool
+		sandbox     bool
+		network     *PodNetwork
+		expected    []string
+	}{
+		{name: "network of the sandbox", sandbox: true, network: &PodNetwork{IPs: []string{"10.88.0.2"}}, expected: []string{"10.88.0.2"}},
+		{name: "host network", sandbox: true, hostNetwork: true, expected: []string{"192.168.1.10"}},
+		{name: "rootless", sandbox: true, rootless: true, expected: []string{"192.168.1.10"}},
+		{name: "backend without sandboxes", expected: []string{"192.168.1.10"}},
+		// The pod gets an IP of its own once its network exists
+		{name: "network not set up yet", sandbox: true},
+	}
+	for _, test := range tests {
+		var backend Backend = newTestBackend(nil)
+		if test.sandbox {
+			backend = testSandboxBackend{newTestBackend(nil)}
+		}
+		p := newTestProvider(backend)
+		p.internalIP = "192.168.1.10"
+		if test.rootless {
+			p.rootless = &rootlessKit{}
+		}
+		pod := newTestPod("a")
+		pod.Spec.HostNetwork = test.hostNetwork
+		p.instances[podAndContainerToIdentifier(pod, &pod.Spec.Containers[0])] = &Instance{Backend: backend}
+		if test.network != nil {
+			p.sandboxes[podToIdentifier(pod)] = &Sandbox{Network: test.network}
+		}
+		if ips := p.podIPs(pod); !reflect.DeepEqual(ips, test.expected) {
+			t.Errorf("%s: expected the IPs %v, got %v", test.name, test.expected, ips)
+		}
+	}
+}
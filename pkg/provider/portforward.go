@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"io"
+	"net"
+)
+
+// PortForward forwards a stream to a port of a pod, as used by kubectl port-forward
+func (p *Provider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	ctx, span := trace.StartSpan(ctx, "PortForward")
+	defer span.End()
+
+	// Add the pod's coordinates to the current span.
+	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, pod)
+
+	log.G(ctx).Debugf("receive PortForward %q (port=%d)", pod, port)
+
+	p.mu.RLock()
+	k8sPod, found := p.pods[joinIdentifierFromParts(namespace, pod)]
+	p.mu.RUnlock()
+	if !found {
+		return errors.Errorf("Pod %s/%s not found", namespace, pod)
+	}
+
+	// Prefer the instance that declares the port, instances of a sandbox share the network anyway
+	var instance *Instance
+	for _, c := range k8sPod.Spec.Containers {
+		i, ok := p.getInstance(namespace, pod, c.Name)
+		if !ok {
+			continue
+		}
+		if instance == nil {
+			instance = i
+		}
+		for _, cp := range c.Ports {
+			if cp.ContainerPort == port {
+				return i.PortForward(ctx, port, stream)
+			}
+		}
+	}
+	if instance == nil {
+		return errors.Errorf("failed to find instances of pod (namespace=%s, podName=%s)", namespace, pod)
+	}
+	return instance.PortForward(ctx, port, stream)
+}
+
+// forwardStream copies data between a stream and a connection until the connection is done or the context is cancelled
+func forwardStream(ctx context.Context, conn net.Conn, stream io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stream, conn)
+		done <- err
+	}()
+	go func() {
+		// Let the other side know the client is done writing, but keep reading its response
+		if _, err := io.Copy(conn, stream); err != nil {
+			log.G(ctx).Debugf("stopped copying to %s: %s", conn.RemoteAddr(), err)
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPortForward(t *testing.T) {
+	tests := []struct {
+		name      string
+		pod       string
+		instances []string
+		port      int32
+		expected  []string
+		err       bool
+	}{
+		{name: "declared port", pod: "pod", instances: []string{"a", "b"}, port: 8080, expected: []string{"forward 8080 to b"}},
+		// The instances share the network of the pod, so any instance can reach the port
+		{name: "undeclared port", pod: "pod", instances: []string{"a", "b"}, port: 9090, expected: []string{"forward 9090 to a"}},
+		{name: "declaring instance missing", pod: "pod", instances: []string{"a"}, port: 8080, expected: []string{"forward 8080 to a"}},
+		{name: "no instances", pod: "pod", port: 8080, err: true},
+		{name: "unknown pod", pod: "other", instances: []string{"a", "b"}, port: 8080, err: true},
+	}
+	for _, test := range tests {
+		backend := newTestBackend(nil)
+		p := newTestProvider(backend)
+		pod := newTestPod("a", "b")
+		pod.Spec.Containers[1].Ports = []corev1.ContainerPort{{ContainerPort: 8080}}
+		p.pods[podToIdentifier(pod)] = pod
+		for _, name := range test.instances {
+			for i := range pod.Spec.Containers {
+				if c := &pod.Spec.Containers[i]; c.Name == name {
+					p.instances[podAndContainerToIdentifier(pod, c)] = &Instance{Backend: backend, Container: c}
+				}
+			}
+		}
+
+		err := p.PortForward(context.Background(), pod.Namespace, test.pod, test.port, nil)
+		if test.err != (err != nil) {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+		}
+		if !reflect.DeepEqual(backend.calls, test.expected) {
+			t.Errorf("%s: expected the calls %v, got %v", test.name, test.expected, backend.calls)
+		}
+	}
+}
+
+// testStream is the stream of a client that writes a request and reads the response
+type testStream struct {
+	request  io.Reader
+	response bytes.Buffer
+}
+
+func (s *testStream) Read(p []byte) (int, error) {
+	return s.request.Read(p)
+}
+
+func (s *testStream) Write(p []byte) (int, error) {
+	return s.response.Write(p)
+}
+
+func (s *testStream) Close() error {
+	return nil
+}
+
+func TestForwardStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The server only answers once the client is done writing
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(bytes.ToUpper(request))
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &testStream{request: strings.NewReader("hello")}
+	if err = forwardStream(context.Background(), conn, stream); err != nil {
+		t.Fatal(err)
+	}
+	if response := stream.response.String(); response != "HELLO" {
+		t.Errorf("expected the response of the server, got %q", response)
+	}
+
+	// The forward stops when the context is done
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = forwardStream(ctx, conn, &testStream{request: strings.NewReader("")}); err != context.Canceled {
+		t.Errorf("expected the forward to be canceled, got %v", err)
+	}
+}
@@ -2,7 +2,11 @@ package provider
 
 import (
 	"context"
+	"github.com/containerd/containerd/log"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/devices"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/manager"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/puller"
+	"sync"
 	"time"
 )
 
@@ -12,7 +16,9 @@ import (
 	"fmt"
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"os"
+	"strings"
 )
 
 const (
@@ -24,69 +30,286 @@ const (
 
 // Provider implements the virtual-kubelet provider interface and forwards calls to runtimes.
 type Provider struct {
+	context            context.Context
 	nodeName           string
 	operatingSystem    string
 	resourceManager    *manager.ResourceManager
+	eventRecorder      record.EventRecorder
 	internalIP         string
 	daemonEndpointPort int32
 	config             Config
 	startTime          time.Time
 	backends           map[string]Backend
-	pods               map[string]*corev1.Pod
-	instances          map[string]*Instance
+	network            *networkManager
+	cgroups            *cgroupManager
+	rootless           *rootlessKit
+	devices            *devices.Manager
+	imageGC            *imageGCManager
+	// unavailableFeatures are the features that the node does not offer (in rootless mode)
+	unavailableFeatures []string
+
+	mu           sync.RWMutex
+	pods         map[string]*corev1.Pod
+	instances    map[string]*Instance
+	evictions    map[string]string
+	rejections   map[string]*rejectionError
+	pauses       map[string]*corev1.PodCondition
+	storageUsage map[string]*podStorageUsage
+	sandboxes    map[string]*Sandbox
+	waiting      map[string]*corev1.ContainerStateWaiting
+	deployments  map[string]*podDeployment
+	cpuSamples   map[string]cpuSample
+	// node is the node as configured last, its status is updated when the devices change
+	node *corev1.Node
 }
 
 // NewProviderConfig creates a new Provider.
-func NewProviderConfig(ctx context.Context, config Config, nodeName, operatingSystem string, resourceManager *manager.ResourceManager, internalIP string, daemonEndpointPort int32) (*Provider, error) {
-	// set defaults
+// Events about pods (e.g. image pulls) are recorded with the event recorder, which may be nil.
+func NewProviderConfig(ctx context.Context, config Config, nodeName, operatingSystem string, resourceManager *manager.ResourceManager, eventRecorder record.EventRecorder, internalIP string, daemonEndpointPort int32) (*Provider, error) {
+	// set defaults (rootless mode has its own, which go first)
+	unavailableFeatures := rootlessDefaults(ctx, &config)
 	if config.Default == "" {
 		config.Default = defaultConfig.Default
 	}
 	if len(config.Enabled) == 0 {
 		config.Enabled = defaultConfig.Enabled
 	}
+	if config.Containerd.Address == "" {
+		config.Containerd.Address = defaultConfig.Containerd.Address
+	}
+	if config.Containerd.Namespace == "" {
+		config.Containerd.Namespace = defaultConfig.Containerd.Namespace
+	}
+	if config.Containerd.Root == "" {
+		config.Containerd.Root = defaultConfig.Containerd.Root
+	}
+	if config.Containerd.Snapshotter == "" {
+		config.Containerd.Snapshotter = defaultConfig.Containerd.Snapshotter
+	}
+	if config.Containerd.DefaultRuntime == "" {
+		config.Containerd.DefaultRuntime = defaultConfig.Containerd.DefaultRuntime
+	}
+	if config.EphemeralStorage.Period.Duration == 0 {
+		config.EphemeralStorage.Period = defaultConfig.EphemeralStorage.Period
+	}
+	if config.Network.ConfDir == "" {
+		config.Network.ConfDir = defaultConfig.Network.ConfDir
+	}
+	if len(config.Network.BinDirs) == 0 {
+		config.Network.BinDirs = defaultConfig.Network.BinDirs
+	}
+	if config.Network.NetNSDir == "" {
+		config.Network.NetNSDir = defaultConfig.Network.NetNSDir
+	}
+	if config.Network.Bridge == "" {
+		config.Network.Bridge = defaultConfig.Network.Bridge
+	}
+	if config.Network.Subnet == "" {
+		config.Network.Subnet = defaultConfig.Network.Subnet
+	}
+	if config.Sandbox.PauseImage == "" {
+		config.Sandbox.PauseImage = defaultConfig.Sandbox.PauseImage
+	}
+	if config.Security.SeccompProfileRoot == "" {
+		config.Security.SeccompProfileRoot = defaultConfig.Security.SeccompProfileRoot
+	}
+	if config.Logs.MaxSize.IsZero() {
+		config.Logs.MaxSize = defaultConfig.Logs.MaxSize
+	}
+	if config.Logs.MaxFiles == 0 {
+		config.Logs.MaxFiles = defaultConfig.Logs.MaxFiles
+	}
+	if config.ImagePull.BackOff.Duration == 0 {
+		config.ImagePull.BackOff = defaultConfig.ImagePull.BackOff
+	}
+	if config.ImagePull.MaxBackOff.Duration == 0 {
+		config.ImagePull.MaxBackOff = defaultConfig.ImagePull.MaxBackOff
+	}
+	if config.ImagePull.MaxParallelPulls == 0 {
+		config.ImagePull.MaxParallelPulls = defaultConfig.ImagePull.MaxParallelPulls
+	}
+	if config.ImageGC.Period.Duration == 0 {
+		config.ImageGC.Period = defaultConfig.ImageGC.Period
+	}
+	if config.ImageGC.HighThresholdPercent == 0 {
+		config.ImageGC.HighThresholdPercent = defaultConfig.ImageGC.HighThresholdPercent
+	}
+	if config.ImageGC.LowThresholdPercent == 0 {
+		config.ImageGC.LowThresholdPercent = defaultConfig.ImageGC.LowThresholdPercent
+	}
+	if config.ImageGC.MinAge.Duration == 0 {
+		config.ImageGC.MinAge = defaultConfig.ImageGC.MinAge
+	}
+	if config.ImageGC.LowThresholdPercent > config.ImageGC.HighThresholdPercent {
+		return nil, fmt.Errorf("image gc low threshold (%d%%) is higher than the high threshold (%d%%)", config.ImageGC.LowThresholdPercent, config.ImageGC.HighThresholdPercent)
+	}
+	config.ImageGC.PinnedImages = append(config.ImageGC.PinnedImages, config.Sandbox.PauseImage)
+	if config.Resources.CgroupParent == "" {
+		config.Resources.CgroupParent = defaultConfig.Resources.CgroupParent
+	}
+	if config.Resources.CgroupDriver == "" {
+		config.Resources.CgroupDriver = defaultConfig.Resources.CgroupDriver
+	}
+	switch config.Resources.CgroupDriver {
+	case CgroupDriverCgroupfs:
+	case CgroupDriverSystemd:
+		// The slices of pods need a systemd that manages the cgroups of the host
+		if _, err := os.Stat("/run/systemd/system"); err != nil {
+			return nil, fmt.Errorf("cgroup driver %q needs systemd as init system", config.Resources.CgroupDriver)
+		}
+	default:
+		return nil, fmt.Errorf("unknown cgroup driver %q", config.Resources.CgroupDriver)
+	}
+	if config.Resources.SwapBehavior == "" {
+		config.Resources.SwapBehavior = defaultConfig.Resources.SwapBehavior
+	}
+	switch config.Resources.SwapBehavior {
+	case SwapBehaviorNo, SwapBehaviorLimited, SwapBehaviorUnlimited:
+	default:
+		return nil, fmt.Errorf("unknown swap behavior %q", config.Resources.SwapBehavior)
+	}
+	if config.Resources.CPUManagerPolicy == "" {
+		config.Resources.CPUManagerPolicy = defaultConfig.Resources.CPUManagerPolicy
+	}
+	switch config.Resources.CPUManagerPolicy {
+	case CPUManagerPolicyNone, CPUManagerPolicyStatic:
+	default:
+		return nil, fmt.Errorf("unknown cpu manager policy %q", config.Resources.CPUManagerPolicy)
+	}
+	if config.Resources.CPUReconcilePeriod.Duration <= 0 {
+		config.Resources.CPUReconcilePeriod = defaultConfig.Resources.CPUReconcilePeriod
+	}
+	if config.Devices.PluginDir == "" {
+		config.Devices.PluginDir = defaultConfig.Devices.PluginDir
+	}
+	if config.Devices.Root == "" {
+		config.Devices.Root = defaultConfig.Devices.Root
+	}
+	if config.Devices.DiscoveryPeriod.Duration == 0 {
+		config.Devices.DiscoveryPeriod = defaultConfig.Devices.DiscoveryPeriod
+	}
+	if config.Migration.Address == "" {
+		config.Migration.Address = internalIP
+	}
+	// setup image pulls (shared by all backends)
+	imagePuller := puller.New(puller.Config{
+		MaxParallel:  config.ImagePull.MaxParallelPulls,
+		MaxBandwidth: config.ImagePull.MaxBandwidth.Value(),
+	})
 	// setup backend
 	backends := map[string]Backend{}
 	var err error
 	for _, e := range config.Enabled {
 		switch e {
 		case BackendContainerd:
-			if backends[e], err = NewContainerdBackend(ctx, config); err != nil {
+			if backends[e], err = NewContainerdBackend(ctx, config, imagePuller); err != nil {
 				return nil, err
 			}
 		case BackendOsv:
-			if backends[e], err = NewOSvBackend(ctx, config); err != nil {
+			if backends[e], err = NewOSvBackend(ctx, config, imagePuller); err != nil {
 				return nil, err
 			}
 		default:
 			return nil, errors.New(fmt.Sprintf("backend '%s' is not supported\n", e))
 		}
 	}
+	if backends[config.Default] == nil {
+		return nil, fmt.Errorf("default backend %q is not enabled", config.Default)
+	}
+	for runtimeClass, backend := range config.RuntimeClasses {
+		if backends[backend] == nil {
+			log.G(ctx).Warnf("backend %q of runtime class %q is not enabled", backend, runtimeClass)
+		}
+	}
+	// setup pod networking (only containers can join a network namespace, rootless pods share the network of
+	// RootlessKit)
+	var network *networkManager
+	var rootless *rootlessKit
+	if config.Rootless.Enabled {
+		rootless = newRootlessKit(config.Rootless.StateDir)
+	} else if backends[BackendContainerd] != nil {
+		if network, err = newNetworkManager(ctx, config.Network); err != nil {
+			return nil, err
+		}
+	}
+	// setup pod cgroups (after the backends removed the instances of an earlier run)
+	var cgroupManager *cgroupManager
+	if backends[BackendContainerd] != nil {
+		cgroupManager, err = newCgroupManager(ctx, config.Resources)
+		switch {
+		case err != nil && config.Rootless.Enabled:
+			log.G(ctx).Warnf("pods have no cgroups, the cgroup %q is not delegated: %s", config.Resources.CgroupParent, err)
+			unavailableFeatures = append(unavailableFeatures, featurePodCgroups)
+		case err != nil:
+			return nil, err
+		}
+	}
+	// setup the devices of extended resources, which device plugins advertise or the rules discover
+	deviceManager := devices.New(devices.Config{SocketDir: config.Devices.PluginDir})
+	if err = deviceManager.Start(ctx); err != nil {
+		return nil, err
+	}
+	err = deviceManager.StartDiscovery(ctx, devices.DiscoveryConfig{
+		Root:   config.Devices.Root,
+		Period: config.Devices.DiscoveryPeriod.Duration,
+		Rules:  config.Devices.Rules,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(unavailableFeatures) > 0 {
+		log.G(ctx).Warnf("unavailable features: %s", strings.Join(unavailableFeatures, ", "))
+	}
 
 	// setup provider
 	provider := Provider{
-		nodeName:           nodeName,
-		operatingSystem:    operatingSystem,
-		resourceManager:    resourceManager,
-		internalIP:         internalIP,
-		daemonEndpointPort: daemonEndpointPort,
-		pods:               map[string]*corev1.Pod{},
-		config:             config,
-		startTime:          time.Now(),
-		backends:           backends,
-		instances:          map[string]*Instance{},
+		context:             ctx,
+		nodeName:            nodeName,
+		operatingSystem:     operatingSystem,
+		resourceManager:     resourceManager,
+		eventRecorder:       eventRecorder,
+		internalIP:          internalIP,
+		daemonEndpointPort:  daemonEndpointPort,
+		pods:                map[string]*corev1.Pod{},
+		config:              config,
+		startTime:           time.Now(),
+		backends:            backends,
+		network:             network,
+		cgroups:             cgroupManager,
+		rootless:            rootless,
+		imageGC:             newImageGCManager(config.ImageGC, backends),
+		unavailableFeatures: unavailableFeatures,
+		instances:           map[string]*Instance{},
+		evictions:           map[string]string{},
+		rejections:          map[string]*rejectionError{},
+		pauses:              map[string]*corev1.PodCondition{},
+		storageUsage:        map[string]*podStorageUsage{},
+		sandboxes:           map[string]*Sandbox{},
+		waiting:             map[string]*corev1.ContainerStateWaiting{},
+		deployments:         map[string]*podDeployment{},
+		cpuSamples:          map[string]cpuSample{},
 	}
+
+	// Expose the number of instances by state
+	provider.registerInstanceCollector(ctx)
+	// Measure the disk usage of pods in the background
+	go provider.runStorageTracker(ctx)
+	// Remove unused images when the disk fills up
+	if config.ImageGC.HighThresholdPercent < 100 {
+		go provider.runImageGC(ctx)
+	}
+
 	return &provider, nil
 }
 
 // NewProvider creates a new Provider, which implements the PodNotifier interface
-func NewProvider(ctx context.Context, providerConfig, nodeName, operatingSystem string, resourceManager *manager.ResourceManager, internalIP string, daemonEndpointPort int32) (*Provider, error) {
+func NewProvider(ctx context.Context, providerConfig, nodeName, operatingSystem string, resourceManager *manager.ResourceManager, eventRecorder record.EventRecorder, internalIP string, daemonEndpointPort int32) (*Provider, error) {
 	cfg, err := loadConfig(providerConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewProviderConfig(ctx, cfg, nodeName, operatingSystem, resourceManager, internalIP, daemonEndpointPort)
+	return NewProviderConfig(ctx, cfg, nodeName, operatingSystem, resourceManager, eventRecorder, internalIP, daemonEndpointPort)
 }
 
 // loadConfig loads the given json configuration files.
@@ -0,0 +1,51 @@
+package provider
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/nerdctl/pkg/imgutil/dockerconfigresolver"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/credentials"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getPullSecrets reads the image pull secrets of a pod into a keyring
+// The pull secrets of the service account are already added to the pod by the admission controller
+func (p *Provider) getPullSecrets(ctx context.Context, pod *corev1.Pod) *credentials.Keyring {
+	var secrets []*corev1.Secret
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		secret, err := p.resourceManager.GetSecret(ref.Name, pod.Namespace)
+		if err != nil {
+			// Like the kubelet, the pull is still attempted without the secret
+			log.G(ctx).Warnf("unable to retrieve pull secret %s/%s for pod %q, the image pull may not succeed: %s", pod.Namespace, ref.Name, podToIdentifier(pod), err)
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return credentials.NewKeyring(ctx, secrets)
+}
+
+// newResolvers creates resolvers for the registry of an image, one for every credential of the pull secrets that
+// matches the image (from most to least specific) and finally one with the docker config of the host
+func newResolvers(ctx context.Context, named refdocker.Named, keyring *credentials.Keyring) ([]remotes.Resolver, error) {
+	var resolverOpts [][]dockerconfigresolver.Opt
+	for _, cred := range keyring.Lookup(named.String()) {
+		cred := cred
+		resolverOpts = append(resolverOpts, []dockerconfigresolver.Opt{
+			dockerconfigresolver.WithAuthCreds(func(string) (string, string, error) {
+				return cred.Username, cred.Password, nil
+			}),
+		})
+	}
+	resolverOpts = append(resolverOpts, nil)
+	var resolvers []remotes.Resolver
+	for _, opts := range resolverOpts {
+		resolver, err := dockerconfigresolver.New(ctx, refdocker.Domain(named), opts...)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return resolvers, nil
+}
@@ -0,0 +1,327 @@
+package provider
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Behaviors for the swap of instances, the same as the ones of the kubelet
+const (
+	SwapBehaviorNo        = "NoSwap"
+	SwapBehaviorLimited   = "LimitedSwap"
+	SwapBehaviorUnlimited = "UnlimitedSwap"
+)
+
+// Policies for the CPUs of instances, the same as the ones of the CPU manager of the kubelet
+const (
+	CPUManagerPolicyNone   = "none"
+	CPUManagerPolicyStatic = "static"
+)
+
+// Bounds of the CPU shares (cgroup v1) and the CPU weight (cgroup v2)
+const (
+	minShares    = 2
+	maxShares    = 262144
+	sharesPerCPU = 1024
+	minWeight    = 1
+	maxWeight    = 10000
+)
+
+// onlineCPUsPath lists the CPUs that are online in cpuset format
+const onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+// podQOSClass determines the quality of service class of a pod, like the kubelet only CPU and memory are considered
+func podQOSClass(pod *corev1.Pod) corev1.PodQOSClass {
+	if pod.Status.QOSClass != "" {
+		return pod.Status.QOSClass
+	}
+	supported := []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	guaranteed := true
+	containers := append(append([]corev1.Container{}, pod.Spec.Containers...), pod.Spec.InitContainers...)
+	for _, container := range containers {
+		for _, name := range supported {
+			if quantity, ok := container.Resources.Requests[name]; ok && quantity.Sign() > 0 {
+				sum := requests[name]
+				sum.Add(quantity)
+				requests[name] = sum
+			}
+			if quantity, ok := container.Resources.Limits[name]; ok && quantity.Sign() > 0 {
+				sum := limits[name]
+				sum.Add(quantity)
+				limits[name] = sum
+			} else {
+				// Every container needs a limit for all supported resources
+				guaranteed = false
+			}
+		}
+	}
+	if len(requests) == 0 && len(limits) == 0 {
+		return corev1.PodQOSBestEffort
+	}
+	if guaranteed {
+		for name, request := range requests {
+			if limit, ok := limits[name]; !ok || limit.Cmp(request) != 0 {
+				guaranteed = false
+				break
+			}
+		}
+	}
+	if guaranteed && len(requests) == len(limits) {
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
+
+// milliCPUToShares converts a CPU request to CPU shares, instances without a request get the minimum
+func milliCPUToShares(milliCPU int64) uint64 {
+	if milliCPU <= 0 {
+		return minShares
+	}
+	shares := milliCPU * sharesPerCPU / 1000
+	if shares < minShares {
+		return minShares
+	}
+	if shares > maxShares {
+		return maxShares
+	}
+	return uint64(shares)
+}
+
+// sharesToWeight converts CPU shares to the CPU weight of cgroup v2, with the same formula as the OCI runtimes
+func sharesToWeight(shares uint64) uint64 {
+	if shares < minShares {
+		shares = minShares
+	}
+	if shares > maxShares {
+		shares = maxShares
+	}
+	return minWeight + ((shares-minShares)*(maxWeight-minWeight))/(maxShares-minShares)
+}
+
+// hugePageLimits converts the hugepages-<size> limits of a container to the page sizes of the OCI runtimes (e.g. 2MB)
+func hugePageLimits(limits corev1.ResourceList) (map[string]uint64, error) {
+	hugePages := map[string]uint64{}
+	for name, quantity := range limits {
+		if !strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) {
+			continue
+		}
+		size, err := resource.ParseQuantity(strings.TrimPrefix(string(name), corev1.ResourceHugePagesPrefix))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid huge page size of %q", name)
+		}
+		pageSize := size.Value()
+		if pageSize <= 0 || quantity.Value()%pageSize != 0 {
+			return nil, errors.Errorf("limit of %q is not a multiple of the page size", name)
+		}
+		unit := 0
+		units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+		for pageSize >= 1024 && pageSize%1024 == 0 && unit < len(units)-1 {
+			pageSize /= 1024
+			unit++
+		}
+		hugePages[fmt.Sprintf("%d%s", pageSize, units[unit])] = uint64(quantity.Value())
+	}
+	return hugePages, nil
+}
+
+// nodeMemoryAndSwap returns the total memory and swap of the node in bytes
+func nodeMemoryAndSwap() (uint64, uint64, error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, 0, err
+	}
+	return info.Totalram * uint64(info.Unit), info.Totalswap * uint64(info.Unit), nil
+}
+
+// limitedSwap divides the swap of the node between Burstable instances, proportional to their memory requests
+// Guaranteed and BestEffort instances do not swap, like with the LimitedSwap behavior of the kubelet
+func limitedSwap(qosClass corev1.PodQOSClass, memoryRequest, memoryLimit int64) (int64, error) {
+	if qosClass != corev1.PodQOSBurstable || memoryRequest <= 0 || memoryRequest == memoryLimit {
+		return 0, nil
+	}
+	nodeMemory, nodeSwap, err := nodeMemoryAndSwap()
+	if err != nil || nodeMemory == 0 {
+		return 0, err
+	}
+	return int64(float64(memoryRequest) / float64(nodeMemory) * float64(nodeSwap)), nil
+}
+
+// parseCPUSet parses a list of CPUs in cpuset format (e.g. "0-3,6")
+func parseCPUSet(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid cpuset %q", s)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, errors.Errorf("invalid cpuset %q", s)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// formatCPUSet formats a sorted list of CPUs in cpuset format
+func formatCPUSet(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// onlineCPUs returns the CPUs of the node that are online
+func onlineCPUs() ([]int, error) {
+	data, err := os.ReadFile(onlineCPUsPath)
+	if os.IsNotExist(err) {
+		cpus := make([]int, runtime.NumCPU())
+		for i := range cpus {
+			cpus[i] = i
+		}
+		return cpus, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUSet(string(data))
+}
+
+// A cpuAllocator gives exclusive CPUs to instances, like the static policy of the CPU manager of the kubelet
+// The instances without exclusive CPUs share the rest, including the reserved CPUs which are never given out.
+type cpuAllocator struct {
+	mu       sync.Mutex
+	online   []int
+	reserved map[int]bool
+	assigned map[string][]int
+	inUse    map[int]bool
+	// changed is signalled when CPUs are allocated or released, the cpusets of the running instances are outdated
+	changed chan struct{}
+}
+
+func newCPUAllocator(reservedCPUs string) (*cpuAllocator, error) {
+	online, err := onlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := parseCPUSet(reservedCPUs)
+	if err != nil {
+		return nil, err
+	}
+	a := &cpuAllocator{
+		online:   online,
+		reserved: map[int]bool{},
+		assigned: map[string][]int{},
+		inUse:    map[int]bool{},
+		changed:  make(chan struct{}, 1),
+	}
+	for _, cpu := range reserved {
+		a.reserved[cpu] = true
+	}
+	return a, nil
+}
+
+// allocate gives n exclusive CPUs to an instance, an instance that already has CPUs keeps them
+// At least one CPU always remains for the instances that share CPUs.
+func (a *cpuAllocator) allocate(id string, n int) ([]int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cpus, ok := a.assigned[id]; ok {
+		return cpus, nil
+	}
+	var free []int
+	for _, cpu := range a.online {
+		if !a.reserved[cpu] && !a.inUse[cpu] {
+			free = append(free, cpu)
+		}
+	}
+	shared := len(a.online) - len(a.inUse)
+	if n > len(free) || shared-n < 1 {
+		return nil, errors.Errorf("not enough CPUs for %d exclusive CPUs, %d are available", n, len(free))
+	}
+	cpus := free[:n]
+	for _, cpu := range cpus {
+		a.inUse[cpu] = true
+	}
+	a.assigned[id] = cpus
+	a.signalChanged()
+	return cpus, nil
+}
+
+// shared returns the CPUs that are not given exclusively to an instance
+func (a *cpuAllocator) shared() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sharedLocked()
+}
+
+// cpus returns the CPUs of an instance, its exclusive CPUs or else the shared CPUs
+func (a *cpuAllocator) cpus(id string) []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cpus, ok := a.assigned[id]; ok {
+		return cpus
+	}
+	return a.sharedLocked()
+}
+
+func (a *cpuAllocator) sharedLocked() []int {
+	var cpus []int
+	for _, cpu := range a.online {
+		if !a.inUse[cpu] {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// release returns the exclusive CPUs of an instance
+func (a *cpuAllocator) release(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.assigned[id]; !ok {
+		return
+	}
+	for _, cpu := range a.assigned[id] {
+		delete(a.inUse, cpu)
+	}
+	delete(a.assigned, id)
+	a.signalChanged()
+}
+
+func (a *cpuAllocator) signalChanged() {
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCPUAllocatorSharedCPUs(t *testing.T) {
+	a := &cpuAllocator{
+		online:   []int{0, 1, 2, 3},
+		reserved: map[int]bool{0: true},
+		assigned: map[string][]int{},
+		inUse:    map[int]bool{},
+		changed:  make(chan struct{}, 1),
+	}
+	changed := func() bool {
+		select {
+		case <-a.changed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if cpus := a.cpus("shared"); !reflect.DeepEqual(cpus, []int{0, 1, 2, 3}) {
+		t.Fatalf("expected all CPUs to be shared, got %v", cpus)
+	}
+	exclusive, err := a.allocate("exclusive", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exclusive, []int{1, 2}) {
+		t.Fatalf("expected the exclusive CPUs 1-2, got %v", exclusive)
+	}
+	if !changed() {
+		t.Fatal("expected the cpusets to be updated after an allocation")
+	}
+	if cpus := a.cpus("shared"); !reflect.DeepEqual(cpus, []int{0, 3}) {
+		t.Fatalf("expected the shared CPUs 0,3, got %v", cpus)
+	}
+	if cpus := a.cpus("exclusive"); !reflect.DeepEqual(cpus, exclusive) {
+		t.Fatalf("expected the instance to keep its exclusive CPUs, got %v", cpus)
+	}
+
+	// The reserved CPU is never given out
+	if _, err = a.allocate("other", 2); err == nil {
+		t.Fatal("expected only one CPU to be left for exclusive use")
+	}
+	if changed() {
+		t.Fatal("expected no update after a failed allocation")
+	}
+
+	a.release("exclusive")
+	if !changed() {
+		t.Fatal("expected the cpusets to be updated after a release")
+	}
+	if cpus := a.cpus("shared"); !reflect.DeepEqual(cpus, []int{0, 1, 2, 3}) {
+		t.Fatalf("expected the released CPUs to be shared again, got %v", cpus)
+	}
+	a.release("shared")
+	if changed() {
+		t.Fatal("expected no update when an instance without exclusive CPUs is released")
+	}
+}
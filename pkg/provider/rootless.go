@@ -0,0 +1,376 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// In rootless mode fledge runs as an unprivileged user next to a rootless containerd, which runs in the user, mount
+// and network namespaces of RootlessKit:
+//   - the containers of pods share the network of RootlessKit (slirp4netns), their ports are forwarded by the port
+//     driver of RootlessKit
+//   - the cgroups of pods are created in the cgroup that systemd delegates to the user, if it has the controllers
+//   - volumes and virtiofsd are handled in the user namespace of RootlessKit, where the user is root
+//
+// Features that are unavailable are announced in an annotation of the node.
+
+const (
+	// labelRootless is set on nodes that run fledge in rootless mode
+	labelRootless = "fledge.io/rootless"
+	// annotationUnavailableFeatures lists the features that are unavailable on a node, separated by commas
+	annotationUnavailableFeatures = "fledge.io/unavailable-features"
+)
+
+// Features that may be unavailable in rootless mode
+const (
+	// featurePodNetwork means that pods have no network (and IP) of their own
+	featurePodNetwork = "PodNetwork"
+	// featurePodCgroups means that the resources of pods are not limited as a whole
+	featurePodCgroups = "PodCgroups"
+	// featureCPUManager means that the static CPU manager policy can not give exclusive CPUs
+	featureCPUManager = "CPUManager"
+	// featurePrivilegedPorts means that host ports below net.ipv4.ip_unprivileged_port_start can not be forwarded
+	featurePrivilegedPorts = "PrivilegedPorts"
+	// featureCheckpoint means that containers can not be checkpointed, which CRIU only does as root
+	featureCheckpoint = "Checkpoint"
+)
+
+// rootlessDefaults fills in the defaults of rootless mode, which enables itself when fledge does not run as root, and
+// returns the features that are unavailable because of them. The other defaults are filled in afterwards.
+func rootlessDefaults(ctx context.Context, config *Config) []string {
+	if !config.Rootless.Enabled && os.Geteuid() != 0 {
+		log.G(ctx).Infof("enabling rootless mode, fledge does not run as root")
+		config.Rootless.Enabled = true
+	}
+	if !config.Rootless.Enabled {
+		return nil
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join("/run/user", strconv.Itoa(os.Geteuid()))
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, _ := os.UserHomeDir()
+		dataHome = filepath.Join(home, ".local/share")
+	}
+	if config.Containerd.Address == "" {
+		config.Containerd.Address = filepath.Join(runtimeDir, "containerd/containerd.sock")
+	}
+	if config.Containerd.Root == "" {
+		config.Containerd.Root = filepath.Join(dataHome, "containerd")
+	}
+	if config.Rootless.StateDir == "" {
+		config.Rootless.StateDir = filepath.Join(runtimeDir, "containerd-rootless")
+	}
+	if config.Devices.PluginDir == "" {
+		config.Devices.PluginDir = filepath.Join(runtimeDir, "fledge/device-plugins")
+	}
+	if config.Resources.CgroupParent == "" {
+		if parent, err := delegatedCgroup(); err == nil {
+			config.Resources.CgroupParent = parent
+		} else {
+			log.G(ctx).Warnf("failed to find the delegated cgroup of the user: %s", err)
+		}
+	}
+	// Pod cgroups are created in the delegated cgroup directly, not by the systemd of the user
+	if config.Resources.CgroupDriver == CgroupDriverSystemd {
+		log.G(ctx).Warnf("the %s cgroup driver is not supported in rootless mode, using %s", CgroupDriverSystemd, CgroupDriverCgroupfs)
+	}
+	config.Resources.CgroupDriver = CgroupDriverCgroupfs
+	features := []string{featurePodNetwork, featureCheckpoint}
+	// Exclusive CPUs need the cpuset controller
+	if config.Resources.CPUManagerPolicy == CPUManagerPolicyStatic && !cgroupControllerDelegated(config.Resources.CgroupParent, "cpuset") {
+		log.G(ctx).Warnf("the cpuset controller is not delegated, using the %s cpu manager policy", CPUManagerPolicyNone)
+		config.Resources.CPUManagerPolicy = CPUManagerPolicyNone
+		features = append(features, featureCPUManager)
+	}
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if start, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && start > 0 {
+			features = append(features, featurePrivilegedPorts)
+		}
+	}
+	return features
+}
+
+// delegatedCgroup returns the cgroup that systemd delegates to the service manager of the user, in which fledge runs
+func delegatedCgroup() (string, error) {
+	if cgroups.Mode() != cgroups.Unified {
+		return "", errors.New("cgroups can only be delegated with cgroup v2")
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	// The unified hierarchy is the line 0::<path>
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		path, ok := strings.CutPrefix(line, "0::")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(path, "/")
+		for i, part := range parts {
+			if strings.HasPrefix(part, "user@") && strings.HasSuffix(part, ".service") {
+				return strings.Join(parts[:i+1], "/"), nil
+			}
+		}
+		return "", errors.Errorf("cgroup %q is not delegated by the service manager of a user", path)
+	}
+	return "", errors.New("no cgroup in the unified hierarchy")
+}
+
+// cgroupControllerDelegated reports whether a controller is available in a cgroup (of the unified hierarchy)
+func cgroupControllerDelegated(path string, controller string) bool {
+	data, err := os.ReadFile(filepath.Join(unifiedMountpoint, path, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+	for _, c := range strings.Fields(string(data)) {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// A rootlessKit is the RootlessKit in which the rootless containerd runs
+// Its child process owns the namespaces of the containers, its API forwards ports from the host to them.
+type rootlessKit struct {
+	stateDir string
+	client   *http.Client
+}
+
+func newRootlessKit(stateDir string) *rootlessKit {
+	apiSocket := filepath.Join(stateDir, "api.sock")
+	return &rootlessKit{
+		stateDir: stateDir,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", apiSocket)
+				},
+			},
+		},
+	}
+}
+
+// childPID returns the PID of the child of RootlessKit, which changes whenever containerd is restarted
+func (k *rootlessKit) childPID() (int, error) {
+	data, err := os.ReadFile(filepath.Join(k.stateDir, "child_pid"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read the child pid of RootlessKit")
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// command returns a command that runs in the user and mount namespaces of RootlessKit, where the user is root and
+// the IDs of the containers are mapped
+func (k *rootlessKit) command(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	nsenterArgs, err := k.nsenterArgs()
+	if err != nil {
+		return nil, err
+	}
+	nsenterArgs = append(nsenterArgs, name)
+	return exec.CommandContext(ctx, nsenterArgs[0], append(nsenterArgs[1:], args...)...), nil
+}
+
+// nsenterArgs returns the arguments that prefix a command to run it in the namespaces of RootlessKit
+func (k *rootlessKit) nsenterArgs() ([]string, error) {
+	pid, err := k.childPID()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"nsenter", "-U", "--preserve-credentials", "-m", "-t", strconv.Itoa(pid), "--"}, nil
+}
+
+// containerGID maps a group of the host to the group in the user namespace of RootlessKit, -1 if it is not mapped
+func (k *rootlessKit) containerGID(hostGID int) (int, error) {
+	pid, err := k.childPID()
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/gid_map", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return mapID(f, hostGID)
+}
+
+// mapID maps an ID of the host to the ID in a user namespace with an ID map (uid_map or gid_map), -1 if it is not
+// mapped
+func mapID(idMap io.Reader, hostID int) (int, error) {
+	// Every line maps a range: <first inside> <first outside> <count>
+	scanner := bufio.NewScanner(idMap)
+	for scanner.Scan() {
+		var inside, outside, count int
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &inside, &outside, &count); err != nil {
+			continue
+		}
+		if hostID >= outside && hostID < outside+count {
+			return inside + hostID - outside, nil
+		}
+	}
+	return -1, scanner.Err()
+}
+
+// applyFSGroup is applyFSGroup in the user namespace of RootlessKit, where the fsGroup of a pod is mapped to a
+// subordinate group of the user that only root in the namespace can give files to
+func (k *rootlessKit) applyFSGroup(ctx context.Context, root string, fsGroup int64, policy *corev1.PodFSGroupChangePolicy) error {
+	if policy != nil && *policy == corev1.FSGroupChangeOnRootMismatch {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&os.ModeSetgid != 0 {
+			if gid, err := k.containerGID(int(stat.Gid)); err == nil && int64(gid) == fsGroup {
+				return nil
+			}
+		}
+	}
+	script := `chgrp -R -h "$1" "$2" && chmod -R g+rwX "$2" && find "$2" -type d -exec chmod g+s {} +`
+	cmd, err := k.command(ctx, "sh", "-c", script, "sh", strconv.FormatInt(fsGroup, 10), root)
+	if err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("failed to apply fsGroup %d to %q: %s\n%s", fsGroup, root, err, out)
+	}
+	return nil
+}
+
+// rootlessPortSpec is a port that the port driver of RootlessKit forwards from the host to its network namespace
+type rootlessPortSpec struct {
+	Proto      string `json:"proto"`
+	ParentIP   string `json:"parentIP,omitempty"`
+	ParentPort int    `json:"parentPort"`
+	ChildPort  int    `json:"childPort"`
+}
+
+// exposePodPorts forwards the host ports of the containers of a pod and returns the IDs of the forwards
+// Like with a kubelet only ports with a host port are exposed on the host, pods have no network of their own that
+// other ports could be reached on (the node lists PodNetwork as unavailable).
+func (k *rootlessKit) exposePodPorts(ctx context.Context, pod *corev1.Pod) ([]int, error) {
+	var ids []int
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.HostPort == 0 {
+				continue
+			}
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			spec := rootlessPortSpec{
+				Proto:      strings.ToLower(string(protocol)),
+				ParentIP:   p.HostIP,
+				ParentPort: int(p.HostPort),
+				ChildPort:  int(p.ContainerPort),
+			}
+			id, err := k.addPort(ctx, spec)
+			if err != nil {
+				k.removePorts(ctx, ids)
+				return nil, errors.Wrapf(err, "failed to forward port %d of container %q", spec.ParentPort, c.Name)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// dialPort connects to a port in the network namespace of RootlessKit, which fledge can not enter without being root
+// in its own user namespace. The port is forwarded from a free loopback port of the host until the returned function
+// is called.
+func (k *rootlessKit) dialPort(ctx context.Context, port int32) (net.Conn, func(), error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	parentPort := listener.Addr().(*net.TCPAddr).Port
+	if err = listener.Close(); err != nil {
+		return nil, nil, err
+	}
+	id, err := k.addPort(ctx, rootlessPortSpec{
+		Proto:      "tcp",
+		ParentIP:   "127.0.0.1",
+		ParentPort: parentPort,
+		ChildPort:  int(port),
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to forward port %d", port)
+	}
+	// The forward outlives the context of the stream
+	remove := func() {
+		k.removePorts(log.WithLogger(context.Background(), log.G(ctx)), []int{id})
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(parentPort)))
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return conn, remove, nil
+}
+
+func (k *rootlessKit) addPort(ctx context.Context, spec rootlessPortSpec) (int, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return 0, err
+	}
+	var status struct {
+		ID int `json:"id"`
+	}
+	if err = k.request(ctx, http.MethodPost, "/v1/ports", bytes.NewReader(body), &status); err != nil {
+		return 0, err
+	}
+	return status.ID, nil
+}
+
+// removePorts stops forwarding ports, failures are only logged
+func (k *rootlessKit) removePorts(ctx context.Context, ids []int) {
+	for _, id := range ids {
+		if err := k.request(ctx, http.MethodDelete, fmt.Sprintf("/v1/ports/%d", id), nil, nil); err != nil {
+			log.G(ctx).Warnf("failed to remove forwarded port %d: %s", id, err)
+		}
+	}
+}
+
+func (k *rootlessKit) request(ctx context.Context, method, path string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://rootlesskit"+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "RootlessKit API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.Errorf("RootlessKit API: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
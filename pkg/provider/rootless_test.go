@@ -0,0 +1,108 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapID(t *testing.T) {
+	// The map of RootlessKit: root is the user, the other IDs are its subordinate IDs
+	idMap := "         0       1000          1\n         1     100000      65536\n"
+	tests := []struct {
+		hostID   int
+		expected int
+	}{
+		{hostID: 1000, expected: 0},
+		{hostID: 100000, expected: 1},
+		{hostID: 100999, expected: 1000},
+		{hostID: 165535, expected: 65536},
+		{hostID: 165536, expected: -1},
+		{hostID: 0, expected: -1},
+		{hostID: 999, expected: -1},
+	}
+	for _, test := range tests {
+		id, err := mapID(strings.NewReader(idMap), test.hostID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != test.expected {
+			t.Errorf("expected host ID %d to map to %d, got %d", test.hostID, test.expected, id)
+		}
+	}
+}
+
+func TestRootlessDefaults(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	t.Setenv("XDG_DATA_HOME", "/home/user/.local/share")
+
+	tests := []struct {
+		name     string
+		config   Config
+		expected Config
+		features []string
+	}{
+		{
+			name: "defaults",
+			config: Config{
+				Rootless:  RootlessConfig{Enabled: true},
+				Resources: ResourcesConfig{CgroupParent: "/user.slice/user-1000.slice/user@1000.service", CgroupDriver: CgroupDriverSystemd},
+			},
+			expected: Config{
+				Containerd: ContainerdConfig{Address: "/run/user/1000/containerd/containerd.sock", Root: "/home/user/.local/share/containerd"},
+				Rootless:   RootlessConfig{Enabled: true, StateDir: "/run/user/1000/containerd-rootless"},
+				Devices:    DevicesConfig{PluginDir: "/run/user/1000/fledge/device-plugins"},
+				Resources:  ResourcesConfig{CgroupParent: "/user.slice/user-1000.slice/user@1000.service", CgroupDriver: CgroupDriverCgroupfs},
+			},
+			features: []string{featurePodNetwork, featureCheckpoint},
+		},
+		{
+			name: "configured",
+			config: Config{
+				Containerd: ContainerdConfig{Address: "/tmp/containerd.sock", Root: "/tmp/containerd"},
+				Rootless:   RootlessConfig{Enabled: true, StateDir: "/tmp/rootlesskit"},
+				Devices:    DevicesConfig{PluginDir: "/tmp/device-plugins"},
+				Resources:  ResourcesConfig{CgroupParent: "/fledge"},
+			},
+			expected: Config{
+				Containerd: ContainerdConfig{Address: "/tmp/containerd.sock", Root: "/tmp/containerd"},
+				Rootless:   RootlessConfig{Enabled: true, StateDir: "/tmp/rootlesskit"},
+				Devices:    DevicesConfig{PluginDir: "/tmp/device-plugins"},
+				Resources:  ResourcesConfig{CgroupParent: "/fledge", CgroupDriver: CgroupDriverCgroupfs},
+			},
+			features: []string{featurePodNetwork, featureCheckpoint},
+		},
+		{
+			// The cgroup does not exist, so cpuset is not delegated to it
+			name: "static cpu manager policy without cpuset",
+			config: Config{
+				Containerd: ContainerdConfig{Address: "/tmp/containerd.sock", Root: "/tmp/containerd"},
+				Rootless:   RootlessConfig{Enabled: true, StateDir: "/tmp/rootlesskit"},
+				Devices:    DevicesConfig{PluginDir: "/tmp/device-plugins"},
+				Resources:  ResourcesConfig{CgroupParent: "/fledge-test-missing", CPUManagerPolicy: CPUManagerPolicyStatic},
+			},
+			expected: Config{
+				Containerd: ContainerdConfig{Address: "/tmp/containerd.sock", Root: "/tmp/containerd"},
+				Rootless:   RootlessConfig{Enabled: true, StateDir: "/tmp/rootlesskit"},
+				Devices:    DevicesConfig{PluginDir: "/tmp/device-plugins"},
+				Resources:  ResourcesConfig{CgroupParent: "/fledge-test-missing", CgroupDriver: CgroupDriverCgroupfs, CPUManagerPolicy: CPUManagerPolicyNone},
+			},
+			features: []string{featurePodNetwork, featureCheckpoint, featureCPUManager},
+		},
+	}
+	for _, test := range tests {
+		config := test.config
+		features := rootlessDefaults(context.Background(), &config)
+		// Privileged ports depend on the sysctl of the host
+		if len(features) > 0 && features[len(features)-1] == featurePrivilegedPorts {
+			features = features[:len(features)-1]
+		}
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("%s: expected the config %+v, got %+v", test.name, test.expected, config)
+		}
+		if !reflect.DeepEqual(features, test.features) {
+			t.Errorf("%s: expected the unavailable features %v, got %v", test.name, test.features, features)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Sandbox groups the instances of a pod and owns the namespaces they share
+// The backend runs an infra (pause) task that keeps the namespaces alive as long as the pod
+type Sandbox struct {
+	ID       string
+	Backend  SandboxBackend
+	Hostname string
+	// Network is the network of the pod, nil if it uses the host network
+	Network *PodNetwork
+	// RootlessPorts are the IDs of the ports that RootlessKit forwards to the pod in rootless mode
+	RootlessPorts []int
+	// Pod.HostNetwork, Pod.HostIPC and Pod.HostPID
+	HostNetwork bool
+	HostIPC     bool
+	HostPID     bool
+	// Pod.ShareProcessNamespace
+	ShareProcessNamespace bool
+	// Pod.SecurityContext.Sysctls
+	Sysctls map[string]string
+	// Pod.RuntimeClassName
+	RuntimeClassName string
+	// CgroupParent is the cgroup of the pod, empty if there is none
+	CgroupParent string
+	// Namespaces are the paths of the namespaces of the infra task, set by the backend
+	Namespaces map[specs.LinuxNamespaceType]string
+}
+
+// A SandboxBackend is a Backend whose instances can join the namespaces of a Sandbox
+type SandboxBackend interface {
+	Backend
+	CreateSandbox(sandbox *Sandbox) error
+	DeleteSandbox(sandbox *Sandbox) error
+}
+
+// createSandbox sets up the network and shared namespaces of a pod for the instances that support it
+func (p *Provider) createSandbox(ctx context.Context, pod *corev1.Pod, instances []*Instance, cgroupParent string) (*Sandbox, error) {
+	// Use the first backend that supports sandboxes (only containerd right now)
+	var backend SandboxBackend
+	for _, instance := range instances {
+		if b, ok := instance.Backend.(SandboxBackend); ok {
+			backend = b
+			break
+		}
+	}
+	if backend == nil {
+		return nil, nil
+	}
+
+	hostname := pod.Name
+	if pod.Spec.Hostname != "" {
+		hostname = pod.Spec.Hostname
+	}
+	sandbox := &Sandbox{
+		ID:                    podToIdentifier(pod),
+		Backend:               backend,
+		Hostname:              hostname,
+		HostNetwork:           pod.Spec.HostNetwork,
+		HostIPC:               pod.Spec.HostIPC,
+		HostPID:               pod.Spec.HostPID,
+		ShareProcessNamespace: pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace,
+		RuntimeClassName:      runtimeClassName(pod),
+		CgroupParent:          cgroupParent,
+	}
+
+	// Rootless pods share the network of RootlessKit
+	if p.rootless != nil {
+		sandbox.HostNetwork = true
+	}
+
+	// Pod.SecurityContext.Sysctls are set on the namespaces of the sandbox
+	if pod.Spec.SecurityContext != nil {
+		sysctls, err := validateSysctls(pod.Spec.SecurityContext.Sysctls, sandbox.HostNetwork, sandbox.HostIPC)
+		if err != nil {
+			return nil, err
+		}
+		sandbox.Sysctls = sysctls
+	}
+
+	// Pod network
+	if !sandbox.HostNetwork {
+		if p.network == nil {
+			return nil, errors.Errorf("pod networking is not available")
+		}
+		network, err := p.network.Setup(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		sandbox.Network = network
+	}
+	if p.rootless != nil {
+		ports, err := p.rootless.exposePodPorts(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		sandbox.RootlessPorts = ports
+	}
+
+	// Infra task
+	log.G(ctx).Infof("creating sandbox %q", sandbox.ID)
+	if err := backend.CreateSandbox(sandbox); err != nil {
+		if sandbox.Network != nil {
+			if err := p.network.Teardown(ctx, pod, sandbox.Network); err != nil {
+				log.G(ctx).Error(err)
+			}
+		}
+		if p.rootless != nil {
+			p.rootless.removePorts(ctx, sandbox.RootlessPorts)
+		}
+		return nil, errors.Wrapf(err, "failed to create sandbox %q", sandbox.ID)
+	}
+
+	p.mu.Lock()
+	p.sandboxes[sandbox.ID] = sandbox
+	p.mu.Unlock()
+	return sandbox, nil
+}
+
+// deleteSandbox stops the infra task of a pod and detaches it from the network
+func (p *Provider) deleteSandbox(ctx context.Context, pod *corev1.Pod) {
+	sandbox, ok := p.getSandbox(pod)
+	if !ok {
+		return
+	}
+	log.G(ctx).Infof("deleting sandbox %q", sandbox.ID)
+	if err := sandbox.Backend.DeleteSandbox(sandbox); err != nil {
+		log.G(ctx).Errorf("failed to delete sandbox %q: %s", sandbox.ID, err)
+	}
+	if sandbox.Network != nil {
+		if err := p.network.Teardown(ctx, pod, sandbox.Network); err != nil {
+			log.G(ctx).Errorf("failed to tear down network of pod %q: %s", sandbox.ID, err)
+		}
+	}
+	if p.rootless != nil {
+		p.rootless.removePorts(ctx, sandbox.RootlessPorts)
+	}
+	if err := os.RemoveAll(sandbox.Dir()); err != nil {
+		log.G(ctx).Errorf("failed to remove directory of sandbox %q: %s", sandbox.ID, err)
+	}
+	p.mu.Lock()
+	delete(p.sandboxes, sandbox.ID)
+	p.mu.Unlock()
+}
+
+func (p *Provider) getSandbox(pod *corev1.Pod) (*Sandbox, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	sandbox, ok := p.sandboxes[podToIdentifier(pod)]
+	return sandbox, ok
+}
+
+// Dir is where the files that are shared by the instances of the sandbox are kept
+func (s *Sandbox) Dir() string {
+	return storage.InstancePath(s.ID)
+}
+
+// HostsPath returns the /etc/hosts file for the instances of the sandbox, it is created when needed
+func (s *Sandbox) HostsPath() (string, error) {
+	path := filepath.Join(s.Dir(), "hosts")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	lines := []string{
+		"127.0.0.1\tlocalhost",
+		"::1\tlocalhost ip6-localhost ip6-loopback",
+	}
+	if s.Network != nil {
+		for _, ip := range s.Network.IPs {
+			lines = append(lines, fmt.Sprintf("%s\t%s", ip, s.Hostname))
+		}
+	}
+	if err := os.MkdirAll(s.Dir(), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
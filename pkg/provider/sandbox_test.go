@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCreateSandbox(t *testing.T) {
+	shareProcessNamespace := true
+	tests := []struct {
+		name     string
+		sandbox  bool
+		rootless bool
+		pod      func() *corev1.Pod
+		failures map[string]int
+		expected *Sandbox
+		err      bool
+	}{
+		{name: "backend without sandboxes"},
+		{
+			name:    "host network",
+			sandbox: true,
+			pod: func() *corev1.Pod {
+				pod := newTestPod("a")
+				pod.Spec.HostNetwork = true
+				pod.Spec.HostIPC = true
+				pod.Spec.Hostname = "host"
+				pod.Spec.ShareProcessNamespace = &shareProcessNamespace
+				return pod
+			},
+			expected: &Sandbox{Hostname: "host", HostNetwork: true, HostIPC: true, ShareProcessNamespace: true},
+		},
+		{
+			// Rootless pods always share the network of RootlessKit
+			name:     "rootless",
+			sandbox:  true,
+			rootless: true,
+			expected: &Sandbox{Hostname: "pod", HostNetwork: true},
+		},
+		{name: "pod network not available", sandbox: true, err: true},
+		{
+			name:    "failed infra task",
+			sandbox: true,
+			pod: func() *corev1.Pod {
+				pod := newTestPod("a")
+				pod.Spec.HostNetwork = true
+				return pod
+			},
+			failures: map[string]int{"create sandbox": 1},
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		var backend Backend = newTestBackend(test.failures)
+		if test.sandbox {
+			backend = testSandboxBackend{newTestBackend(test.failures)}
+		}
+		p := newTestProvider(backend)
+		if test.rootless {
+			p.rootless = &rootlessKit{}
+		}
+		pod := newTestPod("a")
+		if test.pod != nil {
+			pod = test.pod()
+		}
+		instances := []*Instance{{Backend: backend}}
+
+		sandbox, err := p.createSandbox(context.Background(), pod, instances, "")
+		if test.err != (err != nil) {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		if test.expected == nil {
+			if sandbox != nil || len(p.sandboxes) != 0 {
+				t.Errorf("%s: expected no sandbox, got %+v", test.name, sandbox)
+			}
+			continue
+		}
+		test.expected.ID = podToIdentifier(pod)
+		test.expected.Backend = backend.(SandboxBackend)
+		if !reflect.DeepEqual(sandbox, test.expected) {
+			t.Errorf("%s: expected the sandbox %+v, got %+v", test.name, test.expected, sandbox)
+		}
+		if current, ok := p.getSandbox(pod); !ok || current != sandbox {
+			t.Errorf("%s: expected the sandbox of the pod to be kept, got %+v", test.name, current)
+		}
+	}
+}
+
+func TestCreateInstancesDeletesSandbox(t *testing.T) {
+	storage.SetRootPath(t.TempDir())
+	defer storage.SetRootPath("")
+
+	backend := testSandboxBackend{newTestBackend(map[string]int{"create b": 1})}
+	p := newTestProvider(backend)
+	pod := newTestPod("a", "b")
+	pod.Spec.HostNetwork = true
+	var instances []*Instance
+	for i := range pod.Spec.Containers {
+		instances = append(instances, &Instance{ID: podAndContainerToIdentifier(pod, &pod.Spec.Containers[i]), Backend: backend, Container: &pod.Spec.Containers[i]})
+	}
+
+	if err := p.createInstances(context.Background(), pod, instances); err == nil {
+		t.Fatal("expected the creation of the instances to fail")
+	}
+	expected := []string{"create sandbox", "create a", "create b", "delete a", "delete b", "delete sandbox"}
+	if !reflect.DeepEqual(backend.calls, expected) {
+		t.Errorf("expected the calls %v, got %v", expected, backend.calls)
+	}
+	for _, instance := range instances {
+		if instance.Sandbox == nil {
+			t.Errorf("expected instance %q to join the sandbox", instance.ID)
+		}
+	}
+	if _, ok := p.getSandbox(pod); ok {
+		t.Errorf("expected the sandbox to be deleted")
+	}
+}
+
+func TestSandboxOpts(t *testing.T) {
+	storage.SetRootPath(t.TempDir())
+	defer storage.SetRootPath("")
+
+	namespaces := map[specs.LinuxNamespaceType]string{
+		specs.NetworkNamespace: "/run/netns/cni-1",
+		specs.UTSNamespace:     "/proc/1/ns/uts",
+		specs.IPCNamespace:     "/proc/1/ns/ipc",
+		specs.PIDNamespace:     "/proc/1/ns/pid",
+	}
+	tests := []struct {
+		name     string
+		sandbox  *Sandbox
+		expected []specs.LinuxNamespace
+		hosts    bool
+	}{
+		{
+			name:    "shared namespaces",
+			sandbox: &Sandbox{ID: "default-pod", Hostname: "pod", Network: &PodNetwork{IPs: []string{"10.88.0.2"}}, Namespaces: namespaces},
+			expected: []specs.LinuxNamespace{
+				{Type: specs.IPCNamespace, Path: "/proc/1/ns/ipc"},
+				{Type: specs.MountNamespace},
+				{Type: specs.NetworkNamespace, Path: "/run/netns/cni-1"},
+				{Type: specs.PIDNamespace, Path: "/proc/1/ns/pid"},
+				{Type: specs.UTSNamespace, Path: "/proc/1/ns/uts"},
+			},
+			hosts: true,
+		},
+		{
+			// The PID namespace is private unless the pod shares it
+			name:    "private PID namespace",
+			sandbox: &Sandbox{ID: "default-pod", HostNetwork: true, Namespaces: map[specs.LinuxNamespaceType]string{specs.IPCNamespace: "/proc/1/ns/ipc"}},
+			expected: []specs.LinuxNamespace{
+				{Type: specs.IPCNamespace, Path: "/proc/1/ns/ipc"},
+				{Type: specs.MountNamespace},
+				{Type: specs.PIDNamespace},
+			},
+		},
+		{
+			name:     "host namespaces",
+			sandbox:  &Sandbox{ID: "default-pod", HostNetwork: true, HostIPC: true, HostPID: true},
+			expected: []specs.LinuxNamespace{{Type: specs.MountNamespace}},
+		},
+	}
+	b := &ContainerdBackend{}
+	for _, test := range tests {
+		specOpts, err := b.getSandboxOpts(&Instance{ID: "default-pod-a", Sandbox: test.sandbox})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		spec := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{
+			{Type: specs.PIDNamespace},
+			{Type: specs.IPCNamespace},
+			{Type: specs.UTSNamespace},
+			{Type: specs.MountNamespace},
+			{Type: specs.NetworkNamespace},
+		}}}
+		for _, opt := range specOpts {
+			if err = opt(context.Background(), nil, &containers.Container{}, spec); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		sort.Slice(spec.Linux.Namespaces, func(i, j int) bool {
+			return spec.Linux.Namespaces[i].Type < spec.Linux.Namespaces[j].Type
+		})
+		if !reflect.DeepEqual(spec.Linux.Namespaces, test.expected) {
+			t.Errorf("%s: expected the namespaces %+v, got %+v", test.name, test.expected, spec.Linux.Namespaces)
+		}
+
+		// Pods with a network of their own get a hosts file with their IPs
+		var hostsPath string
+		for _, m := range spec.Mounts {
+			if m.Destination == "/etc/hosts" {
+				hostsPath = m.Source
+			}
+		}
+		if !test.hosts {
+			continue
+		}
+		hosts, err := os.ReadFile(hostsPath)
+		if err != nil {
+			t.Fatalf("%s: expected a hosts file of the sandbox, got %v", test.name, err)
+		}
+		if expected := "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n10.88.0.2\tpod\n"; string(hosts) != expected {
+			t.Errorf("%s: expected the hosts file %q, got %q", test.name, expected, hosts)
+		}
+	}
+}
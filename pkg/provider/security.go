@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"github.com/pkg/errors"
+	"io/fs"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Prefixes of sysctls that are namespaced, grouped by the namespace they live in
+var (
+	ipcSysctlPrefixes     = []string{"kernel.shm", "kernel.msg", "kernel.sem", "fs.mqueue."}
+	networkSysctlPrefixes = []string{"net."}
+)
+
+// effectiveSecurityContext merges the security context of the pod into the one of the container
+// The fields that are set on the container take precedence over the ones of the pod
+func effectiveSecurityContext(pod *corev1.PodSecurityContext, container *corev1.SecurityContext) *corev1.SecurityContext {
+	sc := &corev1.SecurityContext{}
+	if container != nil {
+		sc = container.DeepCopy()
+	}
+	if pod == nil {
+		return sc
+	}
+	if sc.SELinuxOptions == nil {
+		sc.SELinuxOptions = pod.SELinuxOptions
+	}
+	if sc.RunAsUser == nil {
+		sc.RunAsUser = pod.RunAsUser
+	}
+	if sc.RunAsGroup == nil {
+		sc.RunAsGroup = pod.RunAsGroup
+	}
+	if sc.RunAsNonRoot == nil {
+		sc.RunAsNonRoot = pod.RunAsNonRoot
+	}
+	if sc.SeccompProfile == nil {
+		sc.SeccompProfile = pod.SeccompProfile
+	}
+	return sc
+}
+
+// verifyRunAsNonRoot checks that the instance will not run as root, the messages follow the ones of the kubelet
+func verifyRunAsNonRoot(sc *corev1.SecurityContext, imageUser string) error {
+	if sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot {
+		return nil
+	}
+	if sc.RunAsUser != nil {
+		if *sc.RunAsUser == 0 {
+			return errors.New("container's runAsUser breaks non-root policy")
+		}
+		return nil
+	}
+	// The user of the image is either "user", "uid", "user:group" or "uid:gid"
+	user := strings.SplitN(imageUser, ":", 2)[0]
+	if user == "" || user == "root" {
+		return errors.New("container has runAsNonRoot and image will run as root")
+	}
+	uid, err := strconv.ParseInt(user, 10, 64)
+	if err != nil {
+		return errors.Errorf("container has runAsNonRoot and image has non-numeric user (%s), cannot verify user is non-root", user)
+	}
+	if uid == 0 {
+		return errors.New("container has runAsNonRoot and image will run as root")
+	}
+	return nil
+}
+
+// supplementalGroups returns the additional groups of the processes in an instance
+func supplementalGroups(pod *corev1.PodSecurityContext) []uint32 {
+	if pod == nil {
+		return nil
+	}
+	var gids []uint32
+	if pod.FSGroup != nil {
+		gids = append(gids, uint32(*pod.FSGroup))
+	}
+	for _, gid := range pod.SupplementalGroups {
+		gids = append(gids, uint32(gid))
+	}
+	return gids
+}
+
+// validateSysctls checks that the sysctls of a pod only affect its own namespaces
+func validateSysctls(sysctls []corev1.Sysctl, hostNetwork, hostIPC bool) (map[string]string, error) {
+	hasPrefix := func(name string, prefixes []string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	values := map[string]string{}
+	for _, s := range sysctls {
+		switch {
+		case hasPrefix(s.Name, ipcSysctlPrefixes):
+			if hostIPC {
+				return nil, errors.Errorf("sysctl %q not allowed with host ipc enabled", s.Name)
+			}
+		case hasPrefix(s.Name, networkSysctlPrefixes):
+			if hostNetwork {
+				return nil, errors.Errorf("sysctl %q not allowed with host net enabled", s.Name)
+			}
+		default:
+			return nil, errors.Errorf("sysctl %q is not namespaced and cannot be set for a pod", s.Name)
+		}
+		values[s.Name] = s.Value
+	}
+	return values, nil
+}
+
+// applyFSGroup gives the fsGroup access to everything in a volume and makes new files inherit the group
+func applyFSGroup(root string, fsGroup int64, policy *corev1.PodFSGroupChangePolicy) error {
+	// Only look at the root of the volume if that is sufficient
+	if policy != nil && *policy == corev1.FSGroupChangeOnRootMismatch {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int64(stat.Gid) == fsGroup && info.Mode()&os.ModeSetgid != 0 {
+			return nil
+		}
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, -1, int(fsGroup)); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode() | 0060
+		if d.IsDir() {
+			mode |= os.ModeSetgid | 0010
+		}
+		return os.Chmod(path, mode)
+	})
+}
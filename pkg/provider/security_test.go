@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateSysctls(t *testing.T) {
+	tests := []struct {
+		name        string
+		sysctls     []corev1.Sysctl
+		hostNetwork bool
+		hostIPC     bool
+		expected    map[string]string
+		err         bool
+	}{
+		{"none", nil, false, false, map[string]string{}, false},
+		{
+			"namespaced",
+			[]corev1.Sysctl{{Name: "net.ipv4.ip_forward", Value: "1"}, {Name: "kernel.shmmax", Value: "65536"}, {Name: "fs.mqueue.msg_max", Value: "20"}},
+			false, false,
+			map[string]string{"net.ipv4.ip_forward": "1", "kernel.shmmax": "65536", "fs.mqueue.msg_max": "20"},
+			false,
+		},
+		{"network with host network", []corev1.Sysctl{{Name: "net.core.somaxconn", Value: "1024"}}, true, false, nil, true},
+		{"ipc with host network", []corev1.Sysctl{{Name: "kernel.msgmax", Value: "1024"}}, true, false, map[string]string{"kernel.msgmax": "1024"}, false},
+		{"ipc with host ipc", []corev1.Sysctl{{Name: "kernel.sem", Value: "1 2 3 4"}}, false, true, nil, true},
+		{"not namespaced", []corev1.Sysctl{{Name: "vm.swappiness", Value: "10"}}, false, false, nil, true},
+		// kernel.shm matches as a prefix, other kernel sysctls are not namespaced
+		{"kernel", []corev1.Sysctl{{Name: "kernel.hostname", Value: "pod"}}, false, false, nil, true},
+	}
+	for _, test := range tests {
+		values, err := validateSysctls(test.sysctls, test.hostNetwork, test.hostIPC)
+		if test.err != (err != nil) {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, values)
+		}
+	}
+}
+
+func TestVerifyRunAsNonRoot(t *testing.T) {
+	yes, no := true, false
+	root, user := int64(0), int64(1000)
+	tests := []struct {
+		name      string
+		sc        *corev1.SecurityContext
+		imageUser string
+		err       bool
+	}{
+		{"not required", &corev1.SecurityContext{}, "", false},
+		{"not required as root", &corev1.SecurityContext{RunAsNonRoot: &no, RunAsUser: &root}, "", false},
+		{"run as root", &corev1.SecurityContext{RunAsNonRoot: &yes, RunAsUser: &root}, "1000", true},
+		// The user of the container takes precedence over the one of the image
+		{"run as user", &corev1.SecurityContext{RunAsNonRoot: &yes, RunAsUser: &user}, "root", false},
+		{"image without user", &corev1.SecurityContext{RunAsNonRoot: &yes}, "", true},
+		{"image as root", &corev1.SecurityContext{RunAsNonRoot: &yes}, "root", true},
+		{"image as uid 0", &corev1.SecurityContext{RunAsNonRoot: &yes}, "0:1000", true},
+		{"image as uid", &corev1.SecurityContext{RunAsNonRoot: &yes}, "1000:1000", false},
+		{"image as named user", &corev1.SecurityContext{RunAsNonRoot: &yes}, "nobody", true},
+	}
+	for _, test := range tests {
+		if err := verifyRunAsNonRoot(test.sc, test.imageUser); test.err != (err != nil) {
+			t.Errorf("%s: expected an error %t, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestEffectiveSecurityContext(t *testing.T) {
+	podUser, containerUser, group, fsGroup := int64(1000), int64(2000), int64(3000), int64(4000)
+	pod := &corev1.PodSecurityContext{RunAsUser: &podUser, RunAsGroup: &group, FSGroup: &fsGroup, SupplementalGroups: []int64{5000}}
+
+	sc := effectiveSecurityContext(pod, &corev1.SecurityContext{RunAsUser: &containerUser})
+	if *sc.RunAsUser != containerUser || *sc.RunAsGroup != group {
+		t.Errorf("expected the user of the container and the group of the pod, got %d:%d", *sc.RunAsUser, *sc.RunAsGroup)
+	}
+	if sc = effectiveSecurityContext(pod, nil); *sc.RunAsUser != podUser {
+		t.Errorf("expected the user of the pod, got %d", *sc.RunAsUser)
+	}
+	if sc = effectiveSecurityContext(nil, nil); sc.RunAsUser != nil {
+		t.Errorf("expected no user, got %d", *sc.RunAsUser)
+	}
+
+	if groups := supplementalGroups(pod); !reflect.DeepEqual(groups, []uint32{4000, 5000}) {
+		t.Errorf("expected the fsGroup and the supplemental groups, got %v", groups)
+	}
+	if groups := supplementalGroups(nil); groups != nil {
+		t.Errorf("expected no groups, got %v", groups)
+	}
+}
+
+func TestApplyFSGroup(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The group of the test is one that it can always change files to
+	fsGroup := int64(os.Getgid())
+	if err := applyFSGroup(root, fsGroup, nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]os.FileMode{
+		"dir":      os.ModeDir | os.ModeSetgid | 0770,
+		"dir/file": 0660,
+	} {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != expected {
+			t.Errorf("expected the mode %s of %q, got %s", expected, path, info.Mode())
+		}
+	}
+
+	// Volumes of which the root already has the group are left alone with OnRootMismatch
+	if err := os.Chmod(filepath.Join(root, "dir", "file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy := corev1.FSGroupChangeOnRootMismatch
+	if err := applyFSGroup(root, fsGroup, &policy); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(root, "dir", "file")); info.Mode() != 0600 {
+		t.Errorf("expected the file to be left alone, got %s", info.Mode())
+	}
+}
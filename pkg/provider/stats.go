@@ -2,12 +2,69 @@ package provider
 
 import (
 	"context"
-	"errors"
+	v1stats "github.com/containerd/cgroups/stats/v1"
+	v2stats "github.com/containerd/cgroups/v2/stats"
 	"github.com/containerd/containerd/log"
+	cnins "github.com/containernetworking/plugins/pkg/ns"
 	"github.com/virtual-kubelet/virtual-kubelet/node/api/statsv1alpha1"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/system"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
 )
 
+// podInterface is the network interface that CNI creates in the network namespace of a pod
+const podInterface = "eth0"
+
+// unlimitedMemory is the smallest memory limit that is considered no limit, cgroups report no limit as a huge value
+const unlimitedMemory = 1 << 62
+
+// InstanceStats is the CPU and memory usage of an Instance (or a pod) at a point in time
+type InstanceStats struct {
+	Time time.Time
+	// StartTime is when the instance was started, it is not set for pods
+	StartTime time.Time
+	// CPUUsage is the cumulative CPU time in nanoseconds
+	CPUUsage uint64
+	// MemoryUsage includes the page cache, the working set excludes the part of it that can be reclaimed
+	MemoryUsage      uint64
+	MemoryWorkingSet uint64
+	MemoryRSS        uint64
+	// MemoryLimit is zero when there is no limit
+	MemoryLimit     uint64
+	PageFaults      uint64
+	MajorPageFaults uint64
+	Processes       uint64
+}
+
+// Add sums the usage of two instances, the limit only remains if both are limited
+func (s InstanceStats) Add(other InstanceStats) InstanceStats {
+	sum := InstanceStats{
+		Time:             s.Time,
+		CPUUsage:         s.CPUUsage + other.CPUUsage,
+		MemoryUsage:      s.MemoryUsage + other.MemoryUsage,
+		MemoryWorkingSet: s.MemoryWorkingSet + other.MemoryWorkingSet,
+		MemoryRSS:        s.MemoryRSS + other.MemoryRSS,
+		PageFaults:       s.PageFaults + other.PageFaults,
+		MajorPageFaults:  s.MajorPageFaults + other.MajorPageFaults,
+		Processes:        s.Processes + other.Processes,
+	}
+	if s.MemoryLimit > 0 && other.MemoryLimit > 0 {
+		sum.MemoryLimit = s.MemoryLimit + other.MemoryLimit
+	}
+	if other.Time.After(s.Time) {
+		sum.Time = other.Time
+	}
+	return sum
+}
+
+// cpuSample is the last CPU usage that was reported, to compute the usage in cores
+type cpuSample struct {
+	time  time.Time
+	usage uint64
+}
+
 // GetStatsSummary gets the stats for the node, including running pods
 func (p *Provider) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
 	ctx, span := trace.StartSpan(ctx, "GetStatsSummary")
@@ -15,7 +72,294 @@ func (p *Provider) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary,
 
 	log.G(ctx).Info("receive GetStatsSummary")
 
-	// TODO Implement
+	// Node
+	nodeStats := p.nodeStats(ctx)
+
+	// Pods
+	var podsStats []statsv1alpha1.PodStats
+	for _, pod := range p.listPods() {
+		podID := podToIdentifier(pod)
+		podStats := statsv1alpha1.PodStats{
+			PodRef: statsv1alpha1.PodReference{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				UID:       string(pod.UID),
+			},
+			StartTime: pod.CreationTimestamp,
+		}
+		usage, hasUsage := p.getStorageUsage(pod)
+		// CPU and memory of the instances, the ones outside the cgroup of the pod add to it
+		var podTotal InstanceStats
+		hasPodCgroup, hasPodTotal := false, false
+		if p.cgroups != nil {
+			if stats, err := p.cgroups.podStats(pod); err == nil {
+				podTotal, hasPodCgroup, hasPodTotal = stats, true, true
+			} else {
+				log.G(ctx).Debugf("failed to get stats of cgroup of pod %q: %s", podID, err)
+			}
+		}
+		for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			containerStats := statsv1alpha1.ContainerStats{Name: c.Name}
+			instanceID := podAndContainerToIdentifier(pod, &c)
+			p.mu.RLock()
+			instance, ok := p.instances[instanceID]
+			p.mu.RUnlock()
+			if ok {
+				if stats, err := instance.Stats(); err == nil {
+					containerStats.StartTime = metav1.NewTime(stats.StartTime)
+					containerStats.CPU = p.cpuStats(instanceID, stats)
+					containerStats.Memory = memoryStats(stats)
+					if !hasPodCgroup || instance.CgroupParent == "" {
+						podTotal, hasPodTotal = podTotal.Add(stats), true
+					}
+				} else {
+					log.G(ctx).Debugf("failed to get stats of instance %q: %s", instanceID, err)
+				}
+			}
+			// Ephemeral storage as measured by the storage tracker
+			if hasUsage {
+				if containerUsage, ok := usage.Containers[c.Name]; ok {
+					time := metav1.NewTime(usage.Time)
+					containerStats.Rootfs = fsStatsFromUsage(time, containerUsage.Rootfs)
+					containerStats.Logs = fsStatsFromUsage(time, containerUsage.Logs)
+				}
+			}
+			if ok || containerStats.Rootfs != nil {
+				podStats.Containers = append(podStats.Containers, containerStats)
+			}
+		}
+		if hasPodTotal {
+			podStats.CPU = p.cpuStats(podID, podTotal)
+			podStats.Memory = memoryStats(podTotal)
+			processes := podTotal.Processes
+			podStats.ProcessStats = &statsv1alpha1.ProcessStats{ProcessCount: &processes}
+		}
+		// Network of the sandbox
+		if sandbox, ok := p.getSandbox(pod); ok && sandbox.Network != nil {
+			var interfaces []system.InterfaceInfo
+			err := cnins.WithNetNSPath(sandbox.Network.Path(), func(cnins.NetNS) error {
+				var err error
+				interfaces, err = system.NetworkInterfaces()
+				return err
+			})
+			if err == nil {
+				podStats.Network = networkStats(interfaces, podInterface)
+			} else {
+				log.G(ctx).Debugf("failed to get network stats of pod %q: %s", podID, err)
+			}
+		}
+		// Volumes and ephemeral storage as measured by the storage tracker
+		if hasUsage {
+			time := metav1.NewTime(usage.Time)
+			for _, v := range pod.Spec.Volumes {
+				volumeUsage, ok := usage.Volumes[v.Name]
+				if !ok {
+					continue
+				}
+				podStats.VolumeStats = append(podStats.VolumeStats, statsv1alpha1.VolumeStats{
+					Name:    v.Name,
+					FsStats: *fsStatsFromUsage(time, volumeUsage),
+				})
+			}
+			podStats.EphemeralStorage = fsStatsFromUsage(time, usage.Total())
+		}
+		podsStats = append(podsStats, podStats)
+	}
+
+	return &statsv1alpha1.Summary{
+		Node: nodeStats,
+		Pods: podsStats,
+	}, nil
+}
+
+// nodeStats collects the usage of the node from /proc and /sys
+func (p *Provider) nodeStats(ctx context.Context) statsv1alpha1.NodeStats {
+	now := metav1.Now()
+	nodeStats := statsv1alpha1.NodeStats{
+		NodeName:  p.nodeName,
+		StartTime: metav1.NewTime(p.startTime),
+	}
+	// CPU
+	if usage, err := system.CPUUsage(); err == nil {
+		nodeStats.CPU = p.cpuStats(p.nodeName, InstanceStats{Time: now.Time, CPUUsage: usage})
+	} else {
+		log.G(ctx).Warnf("failed to get cpu usage of node: %s", err)
+	}
+	// Memory, the working set excludes the page cache that can be reclaimed (like cAdvisor for the root cgroup)
+	if info, err := system.MemoryInfo(); err == nil {
+		usage := info["MemTotal"] - info["MemFree"]
+		workingSet := usage
+		if inactiveFile := info["Inactive(file)"]; inactiveFile < workingSet {
+			workingSet -= inactiveFile
+		}
+		available, rss := info["MemAvailable"], info["AnonPages"]
+		nodeStats.Memory = &statsv1alpha1.MemoryStats{
+			Time:            now,
+			AvailableBytes:  &available,
+			UsageBytes:      &usage,
+			WorkingSetBytes: &workingSet,
+			RSSBytes:        &rss,
+		}
+	} else {
+		log.G(ctx).Warnf("failed to get memory usage of node: %s", err)
+	}
+	// Network
+	if interfaces, err := system.NetworkInterfaces(); err == nil {
+		defaultInterface, _ := system.DefaultInterface()
+		nodeStats.Network = networkStats(interfaces, defaultInterface)
+	} else {
+		log.G(ctx).Warnf("failed to get network stats of node: %s", err)
+	}
+	// Filesystems
+	if fsInfo, err := system.StorageInfo(storage.RootPath()); err == nil {
+		nodeStats.Fs = fsStatsFromInfo(now, fsInfo)
+	} else {
+		log.G(ctx).Warnf("failed to get filesystem info of %q: %s", storage.RootPath(), err)
+	}
+	if backend, ok := p.backends[BackendContainerd].(ImageBackend); ok {
+		if fsInfo, err := system.StorageInfo(backend.ImageFsPath()); err == nil {
+			nodeStats.Runtime = &statsv1alpha1.RuntimeStats{ImageFs: fsStatsFromInfo(now, fsInfo)}
+		} else {
+			log.G(ctx).Warnf("failed to get filesystem info of %q: %s", backend.ImageFsPath(), err)
+		}
+	}
+	// Processes
+	if maxPID, processes, err := system.ProcessLimits(); err == nil {
+		nodeStats.Rlimit = &statsv1alpha1.RlimitStats{
+			Time:                  now,
+			MaxPID:                &maxPID,
+			NumOfRunningProcesses: &processes,
+		}
+	} else {
+		log.G(ctx).Warnf("failed to get process limits of node: %s", err)
+	}
+	return nodeStats
+}
+
+// cpuStats converts the CPU usage, the usage in cores is the average since the previous call with the same key
+func (p *Provider) cpuStats(key string, stats InstanceStats) *statsv1alpha1.CPUStats {
+	usage := stats.CPUUsage
+	cpuStats := &statsv1alpha1.CPUStats{
+		Time:                 metav1.NewTime(stats.Time),
+		UsageCoreNanoSeconds: &usage,
+	}
+	p.mu.Lock()
+	previous, ok := p.cpuSamples[key]
+	p.cpuSamples[key] = cpuSample{time: stats.Time, usage: usage}
+	p.mu.Unlock()
+	if ok && stats.Time.After(previous.time) && usage >= previous.usage {
+		nanoCores := uint64(float64(usage-previous.usage) / stats.Time.Sub(previous.time).Seconds())
+		cpuStats.UsageNanoCores = &nanoCores
+	}
+	return cpuStats
+}
+
+func memoryStats(stats InstanceStats) *statsv1alpha1.MemoryStats {
+	usage, workingSet, rss := stats.MemoryUsage, stats.MemoryWorkingSet, stats.MemoryRSS
+	pageFaults, majorPageFaults := stats.PageFaults, stats.MajorPageFaults
+	memoryStats := &statsv1alpha1.MemoryStats{
+		Time:            metav1.NewTime(stats.Time),
+		UsageBytes:      &usage,
+		WorkingSetBytes: &workingSet,
+		RSSBytes:        &rss,
+		PageFaults:      &pageFaults,
+		MajorPageFaults: &majorPageFaults,
+	}
+	if stats.MemoryLimit > 0 && stats.MemoryLimit < unlimitedMemory {
+		available := uint64(0)
+		if stats.MemoryLimit > workingSet {
+			available = stats.MemoryLimit - workingSet
+		}
+		memoryStats.AvailableBytes = &available
+	}
+	return memoryStats
+}
+
+// networkStats converts the traffic of network interfaces, the default interface is also reported on its own
+func networkStats(interfaces []system.InterfaceInfo, defaultInterface string) *statsv1alpha1.NetworkStats {
+	networkStats := &statsv1alpha1.NetworkStats{Time: metav1.Now()}
+	for _, i := range interfaces {
+		i := i
+		interfaceStats := statsv1alpha1.InterfaceStats{
+			Name:     i.Name,
+			RxBytes:  &i.RxBytes,
+			RxErrors: &i.RxErrors,
+			TxBytes:  &i.TxBytes,
+			TxErrors: &i.TxErrors,
+		}
+		if i.Name == defaultInterface {
+			networkStats.InterfaceStats = interfaceStats
+		}
+		networkStats.Interfaces = append(networkStats.Interfaces, interfaceStats)
+	}
+	return networkStats
+}
+
+// instanceStatsFromCgroupV1 converts the metrics of a cgroup v1, the working set is computed like cAdvisor does
+func instanceStatsFromCgroupV1(metrics *v1stats.Metrics) InstanceStats {
+	stats := InstanceStats{Time: time.Now()}
+	if metrics.CPU != nil && metrics.CPU.Usage != nil {
+		stats.CPUUsage = metrics.CPU.Usage.Total
+	}
+	if memory := metrics.Memory; memory != nil {
+		if memory.Usage != nil {
+			stats.MemoryUsage = memory.Usage.Usage
+			stats.MemoryLimit = memory.Usage.Limit
+		}
+		stats.MemoryWorkingSet = stats.MemoryUsage
+		if memory.TotalInactiveFile < stats.MemoryWorkingSet {
+			stats.MemoryWorkingSet -= memory.TotalInactiveFile
+		}
+		stats.MemoryRSS = memory.TotalRSS
+		stats.PageFaults = memory.TotalPgFault
+		stats.MajorPageFaults = memory.TotalPgMajFault
+	}
+	if metrics.Pids != nil {
+		stats.Processes = metrics.Pids.Current
+	}
+	return stats
+}
+
+// instanceStatsFromCgroupV2 converts the metrics of a cgroup v2, the working set is computed like cAdvisor does
+func instanceStatsFromCgroupV2(metrics *v2stats.Metrics) InstanceStats {
+	stats := InstanceStats{Time: time.Now()}
+	if metrics.CPU != nil {
+		stats.CPUUsage = metrics.CPU.UsageUsec * 1000
+	}
+	if memory := metrics.Memory; memory != nil {
+		stats.MemoryUsage = memory.Usage
+		stats.MemoryLimit = memory.UsageLimit
+		stats.MemoryWorkingSet = stats.MemoryUsage
+		if memory.InactiveFile < stats.MemoryWorkingSet {
+			stats.MemoryWorkingSet -= memory.InactiveFile
+		}
+		stats.MemoryRSS = memory.Anon
+		stats.PageFaults = memory.Pgfault
+		stats.MajorPageFaults = memory.Pgmajfault
+	}
+	if metrics.Pids != nil {
+		stats.Processes = metrics.Pids.Current
+	}
+	return stats
+}
+
+func fsStatsFromUsage(time metav1.Time, usage storage.Usage) *statsv1alpha1.FsStats {
+	usedBytes, inodesUsed := usage.Bytes, usage.Inodes
+	return &statsv1alpha1.FsStats{
+		Time:       time,
+		UsedBytes:  &usedBytes,
+		InodesUsed: &inodesUsed,
+	}
+}
 
-	return nil, errors.New("GetStatsSummary not implemented")
+func fsStatsFromInfo(time metav1.Time, info system.FsInfo) *statsv1alpha1.FsStats {
+	return &statsv1alpha1.FsStats{
+		Time:           time,
+		AvailableBytes: &info.Available,
+		CapacityBytes:  &info.Capacity,
+		UsedBytes:      &info.Used,
+		InodesFree:     &info.InodesFree,
+		Inodes:         &info.Inodes,
+		InodesUsed:     &info.InodesUsed,
+	}
 }
@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1stats "github.com/containerd/cgroups/stats/v1"
+	v2stats "github.com/containerd/cgroups/v2/stats"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/storage"
+)
+
+// statsBackend reports the stats of instances by the name of their container
+type statsBackend struct {
+	*testBackend
+	stats map[string]InstanceStats
+}
+
+func (b statsBackend) GetInstanceStats(instance *Instance) (InstanceStats, error) {
+	return b.stats[instance.Container.Name], nil
+}
+
+func TestInstanceStatsAdd(t *testing.T) {
+	now := time.Now()
+	a := InstanceStats{Time: now, CPUUsage: 1, MemoryUsage: 10, MemoryWorkingSet: 5, Processes: 1, MemoryLimit: 100}
+	b := InstanceStats{Time: now.Add(time.Second), CPUUsage: 2, MemoryUsage: 20, MemoryWorkingSet: 15, Processes: 2, MemoryLimit: 200}
+
+	sum := a.Add(b)
+	if sum.CPUUsage != 3 || sum.MemoryUsage != 30 || sum.MemoryWorkingSet != 20 || sum.Processes != 3 {
+		t.Errorf("expected the sum of the usage, got %+v", sum)
+	}
+	if sum.MemoryLimit != 300 {
+		t.Errorf("expected the sum of the limits, got %d", sum.MemoryLimit)
+	}
+	if !sum.Time.Equal(b.Time) {
+		t.Errorf("expected the time of the latest stats, got %s", sum.Time)
+	}
+	// One instance without a limit leaves the sum without a limit
+	b.MemoryLimit = 0
+	if sum = b.Add(a); sum.MemoryLimit != 0 || !sum.Time.Equal(b.Time) {
+		t.Errorf("expected no limit at the latest time, got %d at %s", sum.MemoryLimit, sum.Time)
+	}
+}
+
+func TestCPUStats(t *testing.T) {
+	p := newTestProvider(newTestBackend(nil))
+	now := time.Now()
+	tests := []struct {
+		name      string
+		time      time.Time
+		usage     uint64
+		nanoCores *uint64
+	}{
+		{name: "first sample", time: now, usage: 1e9},
+		{name: "one core", time: now.Add(2 * time.Second), usage: 3e9, nanoCores: newUint64(1e9)},
+		{name: "half a core", time: now.Add(4 * time.Second), usage: 4e9, nanoCores: newUint64(5e8)},
+		// Counters that were reset (e.g. a restarted instance) have no rate
+		{name: "reset", time: now.Add(6 * time.Second), usage: 1e9},
+		{name: "same time", time: now.Add(6 * time.Second), usage: 2e9},
+	}
+	for _, test := range tests {
+		stats := p.cpuStats("key", InstanceStats{Time: test.time, CPUUsage: test.usage})
+		if *stats.UsageCoreNanoSeconds != test.usage {
+			t.Errorf("%s: expected the usage %d, got %d", test.name, test.usage, *stats.UsageCoreNanoSeconds)
+		}
+		switch {
+		case test.nanoCores == nil && stats.UsageNanoCores != nil:
+			t.Errorf("%s: expected no usage in cores, got %d", test.name, *stats.UsageNanoCores)
+		case test.nanoCores != nil && (stats.UsageNanoCores == nil || *stats.UsageNanoCores != *test.nanoCores):
+			t.Errorf("%s: expected the usage %d in cores, got %v", test.name, *test.nanoCores, stats.UsageNanoCores)
+		}
+	}
+}
+
+func newUint64(v uint64) *uint64 {
+	return &v
+}
+
+func TestMemoryStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     uint64
+		available *uint64
+	}{
+		{name: "no limit"},
+		{name: "limit", limit: 1000, available: newUint64(600)},
+		{name: "limit below the working set", limit: 300, available: newUint64(0)},
+		{name: "unlimited cgroup", limit: 1<<63 - 4096},
+	}
+	for _, test := range tests {
+		stats := memoryStats(InstanceStats{MemoryUsage: 500, MemoryWorkingSet: 400, MemoryLimit: test.limit})
+		if *stats.UsageBytes != 500 || *stats.WorkingSetBytes != 400 {
+			t.Errorf("%s: expected the usage and the working set, got %d and %d", test.name, *stats.UsageBytes, *stats.WorkingSetBytes)
+		}
+		switch {
+		case test.available == nil && stats.AvailableBytes != nil:
+			t.Errorf("%s: expected no available bytes, got %d", test.name, *stats.AvailableBytes)
+		case test.available != nil && (stats.AvailableBytes == nil || *stats.AvailableBytes != *test.available):
+			t.Errorf("%s: expected %d available bytes, got %v", test.name, *test.available, stats.AvailableBytes)
+		}
+	}
+}
+
+func TestInstanceStatsFromCgroup(t *testing.T) {
+	expected := InstanceStats{
+		CPUUsage:         2000000,
+		MemoryUsage:      1000,
+		MemoryWorkingSet: 700,
+		MemoryRSS:        500,
+		MemoryLimit:      4096,
+		PageFaults:       10,
+		MajorPageFaults:  1,
+		Processes:        3,
+	}
+	v1 := instanceStatsFromCgroupV1(&v1stats.Metrics{
+		CPU:    &v1stats.CPUStat{Usage: &v1stats.CPUUsage{Total: 2000000}},
+		Memory: &v1stats.MemoryStat{Usage: &v1stats.MemoryEntry{Usage: 1000, Limit: 4096}, TotalInactiveFile: 300, TotalRSS: 500, TotalPgFault: 10, TotalPgMajFault: 1},
+		Pids:   &v1stats.PidsStat{Current: 3},
+	})
+	v2 := instanceStatsFromCgroupV2(&v2stats.Metrics{
+		CPU:    &v2stats.CPUStat{UsageUsec: 2000},
+		Memory: &v2stats.MemoryStat{Usage: 1000, UsageLimit: 4096, InactiveFile: 300, Anon: 500, Pgfault: 10, Pgmajfault: 1},
+		Pids:   &v2stats.PidsStat{Current: 3},
+	})
+	for version, stats := range map[string]InstanceStats{"v1": v1, "v2": v2} {
+		stats.Time = time.Time{}
+		if stats != expected {
+			t.Errorf("expected the stats %+v of cgroup %s, got %+v", expected, version, stats)
+		}
+	}
+
+	// The inactive page cache can exceed the usage while it is being reclaimed
+	v2 = instanceStatsFromCgroupV2(&v2stats.Metrics{Memory: &v2stats.MemoryStat{Usage: 100, InactiveFile: 300}})
+	if v2.MemoryWorkingSet != 100 {
+		t.Errorf("expected the working set to be the usage, got %d", v2.MemoryWorkingSet)
+	}
+}
+
+func TestGetStatsSummaryPods(t *testing.T) {
+	storage.SetRootPath(t.TempDir())
+	defer storage.SetRootPath("")
+
+	now := time.Now()
+	backend := statsBackend{testBackend: newTestBackend(nil), stats: map[string]InstanceStats{
+		"a": {Time: now, CPUUsage: 100, MemoryWorkingSet: 10, Processes: 1},
+		"b": {Time: now, CPUUsage: 200, MemoryWorkingSet: 20, Processes: 2},
+	}}
+	p := newTestProvider(backend)
+	pod := newTestPod("a", "b", "c")
+	p.pods[podToIdentifier(pod)] = pod
+	for i := range pod.Spec.Containers[:2] {
+		c := &pod.Spec.Containers[i]
+		p.instances[podAndContainerToIdentifier(pod, c)] = &Instance{Backend: backend, Container: c}
+	}
+
+	summary, err := p.GetStatsSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Pods) != 1 {
+		t.Fatalf("expected the stats of the pod, got %d", len(summary.Pods))
+	}
+	podStats := summary.Pods[0]
+	// Containers without an instance have no stats yet
+	if len(podStats.Containers) != 2 || podStats.Containers[0].Name != "a" || podStats.Containers[1].Name != "b" {
+		t.Fatalf("expected the stats of the instances, got %+v", podStats.Containers)
+	}
+	// Without a cgroup of the pod, the pod uses the sum of its instances
+	if *podStats.CPU.UsageCoreNanoSeconds != 300 || *podStats.Memory.WorkingSetBytes != 30 || *podStats.ProcessStats.ProcessCount != 3 {
+		t.Errorf("expected the sum of the instances, got %d ns, %d bytes and %d processes", *podStats.CPU.UsageCoreNanoSeconds, *podStats.Memory.WorkingSetBytes, *podStats.ProcessStats.ProcessCount)
+	}
+	if summary.Node.NodeName != "node" {
+		t.Errorf("expected the stats of the node, got %q", summary.Node.NodeName)
+	}
+}
@@ -0,0 +1,164 @@
+package puller
+
+import (
+	"context"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+// partialSuffix is appended to the path of a blob while it is downloaded
+const partialSuffix = ".partial"
+
+// Resolver wraps a resolver, so the blobs it fetches count towards the progress and limits of the Puller
+func (p *Puller) Resolver(resolver remotes.Resolver, progress *Progress) remotes.Resolver {
+	return &progressResolver{Resolver: resolver, puller: p, progress: progress}
+}
+
+type progressResolver struct {
+	remotes.Resolver
+	puller   *Puller
+	progress *Progress
+}
+
+func (r *progressResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &progressFetcher{Fetcher: fetcher, puller: r.puller, progress: r.progress}, nil
+}
+
+type progressFetcher struct {
+	remotes.Fetcher
+	puller   *Puller
+	progress *Progress
+}
+
+func (f *progressFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	f.progress.total.Add(desc.Size)
+	return f.puller.reader(ctx, f.progress, rc), nil
+}
+
+// FetchBlob downloads a blob to a file
+// The blob is downloaded to a partial file first, which later attempts resume. Only once its digest is verified,
+// the partial file is renamed to the path, so the path either does not exist or holds the complete blob.
+func (p *Puller) FetchBlob(ctx context.Context, progress *Progress, fetcher remotes.Fetcher, desc ocispec.Descriptor, path string) error {
+	partialPath := path + partialSuffix
+	f, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Digest the bytes that an earlier attempt downloaded
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > desc.Size {
+		offset = 0
+	}
+	digester := desc.Digest.Algorithm().Digester()
+	if _, err = io.Copy(digester.Hash(), io.NewSectionReader(f, 0, offset)); err != nil {
+		return err
+	}
+
+	// An earlier attempt may have been interrupted right before the rename
+	if offset == desc.Size && digester.Digest() == desc.Digest {
+		progress.total.Add(desc.Size)
+		progress.downloaded.Add(offset)
+		return os.Rename(partialPath, path)
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// Registries that do not support ranges require a download from the start
+	if seeker, ok := rc.(io.Seeker); ok && offset > 0 {
+		if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+			offset = 0
+		}
+	} else {
+		offset = 0
+	}
+	if offset == 0 {
+		digester = desc.Digest.Algorithm().Digester()
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	progress.total.Add(desc.Size)
+	progress.downloaded.Add(offset)
+
+	if _, err = io.Copy(io.MultiWriter(f, digester.Hash()), p.reader(ctx, progress, rc)); err != nil {
+		return err
+	}
+	if actual := digester.Digest(); actual != desc.Digest {
+		// The partial file can not be resumed
+		os.Remove(partialPath)
+		return errors.Errorf("digest mismatch of blob %s: %s", desc.Digest, actual)
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(partialPath, path)
+}
+
+// reader counts the bytes that are read towards the progress and throttles them to the bandwidth limit
+// Readers that can seek remain seekable, containerd uses this to resume interrupted downloads
+func (p *Puller) reader(ctx context.Context, progress *Progress, rc io.ReadCloser) io.ReadCloser {
+	r := &progressReader{ctx: ctx, rc: rc, puller: p, progress: progress}
+	if _, ok := rc.(io.Seeker); ok {
+		return &progressReadSeeker{r}
+	}
+	return r
+}
+
+type progressReader struct {
+	ctx      context.Context
+	rc       io.ReadCloser
+	puller   *Puller
+	progress *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	limiter := r.puller.limiter
+	if limiter != nil && len(b) > limiter.Burst() {
+		b = b[:limiter.Burst()]
+	}
+	n, err := r.rc.Read(b)
+	if n > 0 {
+		r.progress.downloaded.Add(int64(n))
+		pullBytes.WithLabelValues(r.progress.backend).Add(float64(n))
+		if limiter != nil {
+			if waitErr := limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+				err = waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.rc.Close()
+}
+
+type progressReadSeeker struct {
+	*progressReader
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.rc.(io.Seeker).Seek(offset, whence)
+}
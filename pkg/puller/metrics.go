@@ -0,0 +1,39 @@
+package puller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	pullsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "fledge",
+		Subsystem: "image_pull",
+		Name:      "in_flight",
+		Help:      "Number of image pulls that are running.",
+	})
+	pullsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fledge",
+		Subsystem: "image_pull",
+		Name:      "total",
+		Help:      "Number of image pulls that finished, by backend and result.",
+	}, []string{"backend", "result"})
+	pullDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "fledge",
+		Subsystem: "image_pull",
+		Name:      "duration_seconds",
+		Help:      "Duration of image pulls, including failed ones, by backend.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"backend"})
+	pullBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fledge",
+		Subsystem: "image_pull",
+		Name:      "bytes_total",
+		Help:      "Number of bytes downloaded by image pulls, by backend.",
+	}, []string{"backend"})
+)
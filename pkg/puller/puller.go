@@ -0,0 +1,204 @@
+package puller
+
+import (
+	"context"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/time/rate"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is the interval at which the progress of running pulls is logged
+const progressInterval = 10 * time.Second
+
+// Config contains the limits that apply to all pulls of a Puller
+type Config struct {
+	// MaxParallel is the maximum number of pulls that run at the same time, there is no limit if it is zero
+	MaxParallel int
+	// MaxBandwidth is the maximum number of bytes per second that all pulls download together, there is no limit if it is zero
+	MaxBandwidth int64
+}
+
+// A Puller runs the image pulls of all backends
+// Concurrent pulls of the same image are collapsed into one, and all pulls share the limits of the configuration
+type Puller struct {
+	slots   chan struct{}
+	limiter *rate.Limiter
+
+	mu    sync.Mutex
+	pulls map[string]*pull
+}
+
+// Progress keeps track of the bytes a pull downloads
+type Progress struct {
+	// backend is the backend that pulls the image, in the labels of the metrics
+	backend    string
+	downloaded atomic.Int64
+	total      atomic.Int64
+}
+
+// Downloaded returns the number of bytes that were downloaded so far
+func (p *Progress) Downloaded() int64 {
+	return p.downloaded.Load()
+}
+
+// Total returns the size of all blobs that the pull started to download
+func (p *Progress) Total() int64 {
+	return p.total.Load()
+}
+
+// PullFunc downloads an image, it reports its progress by downloading through the readers of the Puller
+type PullFunc func(ctx context.Context, progress *Progress) error
+
+type pull struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	// canceled is set once all waiters gave up, the pull is only forgotten once it returned
+	canceled bool
+	waiters  int
+	progress Progress
+}
+
+// New creates a Puller
+func New(config Config) *Puller {
+	p := &Puller{
+		pulls: map[string]*pull{},
+	}
+	if config.MaxParallel > 0 {
+		p.slots = make(chan struct{}, config.MaxParallel)
+	}
+	if config.MaxBandwidth > 0 {
+		// Reads are split in chunks of at most the burst size
+		burst := 64 * 1024
+		if config.MaxBandwidth < int64(burst) {
+			burst = int(config.MaxBandwidth)
+		}
+		p.limiter = rate.NewLimiter(rate.Limit(config.MaxBandwidth), burst)
+	}
+	return p
+}
+
+// Pull runs the pull of an image for a backend, identified by key, and waits for it to finish
+// When the image is already being pulled, it waits for that pull instead. The pull runs on its own and is only
+// canceled once all callers that wait for it have given up. A new pull of the image waits until a canceled one has
+// returned, so two pulls never write the same files.
+func (p *Puller) Pull(ctx context.Context, backend string, key string, fn PullFunc) error {
+	p.mu.Lock()
+	pl, ok := p.pulls[key]
+	for ok && pl.canceled {
+		p.mu.Unlock()
+		select {
+		case <-pl.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		p.mu.Lock()
+		pl, ok = p.pulls[key]
+	}
+	if ok {
+		log.G(ctx).Infof("waiting for running pull of %q", key)
+	} else {
+		runCtx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+		pl = &pull{cancel: cancel, done: make(chan struct{})}
+		pl.progress.backend = backend
+		p.pulls[key] = pl
+		go p.run(runCtx, key, pl, fn)
+	}
+	pl.waiters++
+	p.mu.Unlock()
+
+	select {
+	case <-pl.done:
+		p.mu.Lock()
+		pl.waiters--
+		p.mu.Unlock()
+		return pl.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		pl.waiters--
+		if pl.waiters == 0 {
+			pl.canceled = true
+			pl.cancel()
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// run executes a pull once a slot is available
+func (p *Puller) run(ctx context.Context, key string, pl *pull, fn PullFunc) {
+	defer close(pl.done)
+	defer pl.cancel()
+	defer func() {
+		p.mu.Lock()
+		p.forget(key, pl)
+		p.mu.Unlock()
+	}()
+
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+		default:
+			log.G(ctx).Infof("pull of %q is queued", key)
+			select {
+			case p.slots <- struct{}{}:
+				defer func() { <-p.slots }()
+			case <-ctx.Done():
+				pl.err = ctx.Err()
+				return
+			}
+		}
+	}
+
+	pullsInFlight.Inc()
+	defer pullsInFlight.Dec()
+	log.G(ctx).Infof("pulling %q", key)
+	start := time.Now()
+	stopProgress := p.logProgress(ctx, key, &pl.progress)
+	pl.err = fn(ctx, &pl.progress)
+	stopProgress()
+	duration := time.Since(start)
+
+	pullDuration.WithLabelValues(pl.progress.backend).Observe(duration.Seconds())
+	if pl.err != nil {
+		pullsTotal.WithLabelValues(pl.progress.backend, resultFailure).Inc()
+		log.G(ctx).Warnf("failed to pull %q after %s: %s", key, duration.Round(time.Millisecond), pl.err)
+		return
+	}
+	pullsTotal.WithLabelValues(pl.progress.backend, resultSuccess).Inc()
+	log.G(ctx).Infof("pulled %q in %s, downloaded %d bytes", key, duration.Round(time.Millisecond), pl.progress.Downloaded())
+}
+
+// forget removes a pull, so the next call of Pull starts a new one (requires the lock)
+func (p *Puller) forget(key string, pl *pull) {
+	if p.pulls[key] == pl {
+		delete(p.pulls, key)
+	}
+}
+
+// logProgress periodically logs the progress of a pull until the returned function is called
+func (p *Puller) logProgress(ctx context.Context, key string, progress *Progress) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		last := progress.Downloaded()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			downloaded := progress.Downloaded()
+			speed := float64(downloaded-last) / progressInterval.Seconds()
+			last = downloaded
+			log.G(ctx).Infof("pulling %q: downloaded %d of %d bytes (%.0f bytes/s)", key, downloaded, progress.Total(), speed)
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,180 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPullDeduplicates(t *testing.T) {
+	p := New(Config{MaxParallel: 1})
+	release := make(chan struct{})
+	var runs atomic.Int32
+	fn := func(ctx context.Context, progress *Progress) error {
+		runs.Add(1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Pull(context.Background(), "test", "image", fn); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// All callers join the same pull before it finishes
+	for {
+		p.mu.Lock()
+		pl, ok := p.pulls["image"]
+		waiters := 0
+		if ok {
+			waiters = pl.waiters
+		}
+		p.mu.Unlock()
+		if waiters == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("expected 1 run, got %d", n)
+	}
+}
+
+func TestPullCanceledByLastWaiter(t *testing.T) {
+	p := New(Config{})
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := p.Pull(ctx, "test", "image", func(ctx context.Context, progress *Progress) error {
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	<-canceled
+}
+
+func TestPullWaitsForCanceledPull(t *testing.T) {
+	p := New(Config{})
+	release := make(chan struct{})
+	var running atomic.Int32
+	fn := func(ctx context.Context, progress *Progress) error {
+		if running.Add(1) != 1 {
+			t.Error("two pulls of the same image run at the same time")
+		}
+		defer running.Add(-1)
+		<-release
+		return ctx.Err()
+	}
+
+	// The only waiter gives up, but the pull does not return until it is released
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- p.Pull(ctx, "test", "image", fn) }()
+	for running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	second := make(chan error, 1)
+	go func() { second <- p.Pull(context.Background(), "test", "image", fn) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seekFetcher serves a blob from memory and supports resuming like the fetcher of a registry
+type seekFetcher struct {
+	blob   []byte
+	offset int64
+}
+
+func (f *seekFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return &seekReadCloser{f: f, Reader: bytes.NewReader(f.blob)}, nil
+}
+
+type seekReadCloser struct {
+	*bytes.Reader
+	f *seekFetcher
+}
+
+func (r *seekReadCloser) Seek(offset int64, whence int) (int64, error) {
+	r.f.offset = offset
+	return r.Reader.Seek(offset, whence)
+}
+
+func (r *seekReadCloser) Close() error {
+	return nil
+}
+
+func TestFetchBlobResumes(t *testing.T) {
+	blob := bytes.Repeat([]byte("fledge"), 1000)
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	path := filepath.Join(t.TempDir(), "blob")
+	// An earlier attempt downloaded the first part
+	if err := os.WriteFile(path+partialSuffix, blob[:1234], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(Config{})
+	fetcher := &seekFetcher{blob: blob}
+	progress := &Progress{}
+	if err := p.FetchBlob(context.Background(), progress, fetcher, desc, path); err != nil {
+		t.Fatal(err)
+	}
+	if fetcher.offset != 1234 {
+		t.Errorf("expected download to resume at 1234, got %d", fetcher.offset)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Error("blob differs from the original")
+	}
+	if _, err = os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Error("partial file still exists")
+	}
+	if progress.Downloaded() != desc.Size {
+		t.Errorf("expected progress of %d bytes, got %d", desc.Size, progress.Downloaded())
+	}
+}
+
+func TestFetchBlobDigestMismatch(t *testing.T) {
+	blob := []byte("fledge")
+	desc := ocispec.Descriptor{Digest: digest.FromString("other"), Size: int64(len(blob))}
+	path := filepath.Join(t.TempDir(), "blob")
+
+	p := New(Config{})
+	if err := p.FetchBlob(context.Background(), &Progress{}, &seekFetcher{blob: blob}, desc, path); err == nil {
+		t.Fatal("expected digest mismatch")
+	}
+	for _, path := range []string{path, path + partialSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist", path)
+		}
+	}
+}
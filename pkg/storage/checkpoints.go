@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"path"
+)
+
+func CheckpointsPath() string {
+	return path.Join(RootPath(), "checkpoints")
+}
+
+func CheckpointPath(name string) string {
+	return path.Join(CheckpointsPath(), name)
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
 	"github.com/regclient/regclient/types"
 	"github.com/regclient/regclient/types/manifest"
 	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
+	"gitlab.ilabt.imec.be/fledge/service/pkg/credentials"
 	ociv1ext "gitlab.ilabt.imec.be/fledge/service/pkg/oci/v1/ext"
 	"path"
 	"regexp"
+	"time"
 )
 
 func ImagesPath() string {
@@ -55,7 +58,21 @@ func ImagePath(name string) string {
 //	return tgt, nil
 //}
 
-func ImageGetConfig(ctx context.Context, name string) (ociv1ext.Image, error) {
+// NewRegClient creates a client for the registry of an image
+// The credentials of image pull secrets in the keyring take precedence over the ones in the docker config of the host
+func NewRegClient(r ref.Ref, keyring *credentials.Keyring) *regclient.RegClient {
+	opts := []regclient.Opt{regclient.WithDockerCreds()}
+	if creds := keyring.Lookup(r.CommonName()); len(creds) > 0 {
+		opts = append(opts, regclient.WithConfigHost(config.Host{
+			Name: r.Registry,
+			User: creds[0].Username,
+			Pass: creds[0].Password,
+		}))
+	}
+	return regclient.New(opts...)
+}
+
+func ImageGetConfig(ctx context.Context, name string, keyring *credentials.Keyring) (ociv1ext.Image, error) {
 	// Parse image source
 	src, err := ref.New(name)
 	if err != nil {
@@ -65,11 +82,13 @@ func ImageGetConfig(ctx context.Context, name string) (ociv1ext.Image, error) {
 		return ociv1ext.Image{}, fmt.Errorf("reference %s does not contain a valid registry", src.CommonName())
 	}
 	// Retrieve manifest of the image
-	rc := regclient.New(regclient.WithDockerCreds())
+	rc := NewRegClient(src, keyring)
 	return ImageGetConfigWithClient(rc, ctx, src)
 }
 
-func ImageGetConfigWithClient(rc *regclient.RegClient, ctx context.Context, r ref.Ref) (ociv1ext.Image, error) {
+func ImageGetConfigWithClient(rc *regclient.RegClient, ctx context.Context, r ref.Ref) (im ociv1ext.Image, err error) {
+	defer func(start time.Time) { observeRegistryRequest(requestConfig, start, err) }(time.Now())
+
 	// Retrieve manifest of the image
 	manifestDesc, err := rc.ManifestGet(ctx, r)
 	if err != nil {
@@ -121,7 +140,7 @@ func ImageGetConfigWithClient(rc *regclient.RegClient, ctx context.Context, r re
 	return ociv1ext.Image{}, fmt.Errorf("reference %s does not represent a valid image", r.CommonName())
 }
 
-func ImageGetLayers(ctx context.Context, name string) ([]types.Descriptor, error) {
+func ImageGetLayers(ctx context.Context, name string, keyring *credentials.Keyring) ([]types.Descriptor, error) {
 	// Parse image source
 	src, err := ref.New(name)
 	if err != nil {
@@ -131,11 +150,13 @@ func ImageGetLayers(ctx context.Context, name string) ([]types.Descriptor, error
 		return nil, fmt.Errorf("reference %s does not contain a valid registry", src.CommonName())
 	}
 	// Retrieve manifest of the image
-	rc := regclient.New(regclient.WithDockerCreds())
+	rc := NewRegClient(src, keyring)
 	return ImageGetLayersWithClient(rc, ctx, src)
 }
 
-func ImageGetLayersWithClient(rc *regclient.RegClient, ctx context.Context, r ref.Ref) ([]types.Descriptor, error) {
+func ImageGetLayersWithClient(rc *regclient.RegClient, ctx context.Context, r ref.Ref) (layers []types.Descriptor, err error) {
+	defer func(start time.Time) { observeRegistryRequest(requestLayers, start, err) }(time.Now())
+
 	// Retrieve manifest of the image
 	manifestDesc, err := rc.ManifestGet(ctx, r)
 	if err != nil {
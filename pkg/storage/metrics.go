@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+const (
+	requestConfig = "config"
+	requestLayers = "layers"
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	registryRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "fledge",
+		Subsystem: "storage",
+		Name:      "registry_request_duration_seconds",
+		Help:      "Duration of retrieving the config or layers of images from their registry, by request and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"request", "result"})
+	usageScanDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "fledge",
+		Subsystem: "storage",
+		Name:      "usage_scan_duration_seconds",
+		Help:      "Duration of walking a directory tree to measure its disk usage.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	usageScanErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "fledge",
+		Subsystem: "storage",
+		Name:      "usage_scan_errors_total",
+		Help:      "Number of failed measurements of disk usage.",
+	})
+)
+
+// observeRegistryRequest records how long a request to a registry took
+func observeRegistryRequest(request string, start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	registryRequestDuration.WithLabelValues(request, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,10 @@
+package storage
+
+import (
+	"path"
+)
+
+// NetworksPath is where the networks of pods are recorded, so that they can be torn down after a restart
+func NetworksPath() string {
+	return path.Join(RootPath(), "networks")
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Usage describes the disk space and inodes consumed by a file or a directory tree
+type Usage struct {
+	Bytes  uint64
+	Inodes uint64
+}
+
+// Add returns the sum of both usages
+func (u Usage) Add(other Usage) Usage {
+	return Usage{Bytes: u.Bytes + other.Bytes, Inodes: u.Inodes + other.Inodes}
+}
+
+// PathUsage walks the given path and returns the space that is actually allocated on disk (similar to du)
+// A path that does not exist has no usage
+func PathUsage(root string) (Usage, error) {
+	defer func(start time.Time) { usageScanDuration.Observe(time.Since(start).Seconds()) }(time.Now())
+	usage := Usage{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can disappear while walking (e.g. rotated logs), these are not errors
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		usage.Inodes++
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			// Blocks are always expressed in units of 512 bytes
+			usage.Bytes += uint64(stat.Blocks) * 512
+		} else {
+			usage.Bytes += uint64(info.Size())
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return Usage{}, nil
+	}
+	if err != nil {
+		usageScanErrors.Inc()
+	}
+	return usage, err
+}
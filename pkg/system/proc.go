@@ -0,0 +1,210 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is the number of clock ticks per second in /proc (USER_HZ), which is 100 on all supported platforms
+const clockTicks = 100
+
+// CPUUsage returns the CPU time that the node spent on work since it booted, in nanoseconds
+// Idle and iowait time are excluded, guest time is already counted as user time.
+func CPUUsage() (uint64, error) {
+	contents, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal
+		var ticks uint64
+		for _, i := range []int{1, 2, 3, 6, 7, 8} {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			ticks += value
+		}
+		return ticks * (1e9 / clockTicks), nil
+	}
+	return 0, fmt.Errorf("no cpu line in /proc/stat")
+}
+
+// MemoryInfo returns the fields of /proc/meminfo in bytes
+func MemoryInfo() (map[string]uint64, error) {
+	contents, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]uint64{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			value *= 1024
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return info, nil
+}
+
+// ProcessCPUUsage returns the CPU time that all threads of a process spent, in nanoseconds
+func ProcessCPUUsage(pid int) (uint64, error) {
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command may contain spaces, the fields after it are separated by spaces
+	end := bytes.LastIndexByte(contents, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(string(contents[end+1:]))
+	// utime and stime are the 14th and 15th field, the state (3rd field) is the first one after the command
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	var ticks uint64
+	for _, i := range []int{11, 12} {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ticks += value
+	}
+	return ticks * (1e9 / clockTicks), nil
+}
+
+// ProcessMemoryInfo returns the fields of the status of a process that are sizes (e.g. VmRSS) in bytes
+func ProcessMemoryInfo(pid int) (map[string]uint64, error) {
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]uint64{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+	return info, nil
+}
+
+// ProcessLimits returns the maximum and current number of processes on the node
+func ProcessLimits() (int64, int64, error) {
+	contents, err := os.ReadFile("/proc/sys/kernel/pid_max")
+	if err != nil {
+		return 0, 0, err
+	}
+	maxPID, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The fourth field of loadavg is "running/total"
+	contents, err = os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) < 4 || !strings.Contains(fields[3], "/") {
+		return 0, 0, fmt.Errorf("invalid /proc/loadavg")
+	}
+	processes, err := strconv.ParseInt(strings.SplitN(fields[3], "/", 2)[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return maxPID, processes, nil
+}
+
+// InterfaceInfo describes the traffic of a network interface
+type InterfaceInfo struct {
+	Name     string
+	RxBytes  uint64
+	RxErrors uint64
+	TxBytes  uint64
+	TxErrors uint64
+}
+
+// NetworkInterfaces returns the traffic of the network interfaces in the network namespace of the calling thread
+// The loopback interface is left out.
+func NetworkInterfaces() ([]InterfaceInfo, error) {
+	f, err := os.Open("/proc/thread-self/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetDev(f)
+}
+
+// parseNetDev parses the format of /proc/net/dev, which starts with two header lines
+func parseNetDev(r io.Reader) ([]InterfaceInfo, error) {
+	var interfaces []InterfaceInfo
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(counters)
+		if name == "lo" || len(fields) < 11 {
+			continue
+		}
+		// Receive: bytes packets errs ..., transmit (from the 9th field): bytes packets errs ...
+		var values [4]uint64
+		for i, field := range []int{0, 2, 8, 10} {
+			var err error
+			if values[i], err = strconv.ParseUint(fields[field], 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		interfaces = append(interfaces, InterfaceInfo{
+			Name:     name,
+			RxBytes:  values[0],
+			RxErrors: values[1],
+			TxBytes:  values[2],
+			TxErrors: values[3],
+		})
+	}
+	return interfaces, scanner.Err()
+}
+
+// DefaultInterface returns the network interface of the default route of the node
+func DefaultInterface() (string, error) {
+	contents, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	// Iface Destination Gateway ..., the destination of the default route is 00000000
+	for _, line := range strings.Split(string(contents), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no default route")
+}
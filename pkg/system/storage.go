@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"gitlab.ilabt.imec.be/fledge/service/pkg/util"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"syscall"
 )
 
 func StorageSize() (resource.Quantity, error) {
@@ -41,3 +42,31 @@ func IsStorageFull() bool {
 	storAvailable, _ := StorageAvailable()
 	return (storAvailable.AsApproximateFloat64() / storTotal.AsApproximateFloat64()) <= 0.01
 }
+
+// FsInfo describes the capacity and usage of a filesystem
+type FsInfo struct {
+	Capacity   uint64
+	Available  uint64
+	Used       uint64
+	Inodes     uint64
+	InodesFree uint64
+	InodesUsed uint64
+}
+
+// StorageInfo returns information about the filesystem that contains the given path
+func StorageInfo(path string) (FsInfo, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return FsInfo{}, err
+	}
+	blockSize := uint64(stat.Bsize)
+	info := FsInfo{
+		Capacity:   stat.Blocks * blockSize,
+		Available:  stat.Bavail * blockSize,
+		Used:       (stat.Blocks - stat.Bfree) * blockSize,
+		Inodes:     stat.Files,
+		InodesFree: stat.Ffree,
+		InodesUsed: stat.Files - stat.Ffree,
+	}
+	return info, nil
+}